@@ -8,6 +8,7 @@
 
 #define map_of_manager      kmesh_manage
 #define MAP_SIZE_OF_MANAGER 8192
+#define map_of_bypass       kmesh_bypass
 /*0x3a1(929) is the specific port handled by the cni to enable kmesh*/
 #define ENABLE_KMESH_PORT 0x3a1
 /*0x3a2(930) is the specific port handled by the cni to enable kmesh*/
@@ -35,10 +36,25 @@ struct {
     __uint(map_flags, BPF_F_NO_PREALLOC);
 } map_of_manager SEC(".maps");
 
+/*
+ * This map is used to store the pods whose traffic bypasses kmesh,
+ * the daemon records both their netns cookie and their ips, so that
+ * the cgroup and the sockops programs can both look them up.
+ */
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, struct manager_key);
+    __type(value, __u32);
+    __uint(max_entries, MAP_SIZE_OF_MANAGER);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+} map_of_bypass SEC(".maps");
+
 struct sock_storage_data {
     __u64 connect_ns;
     __u8 direction;
     __u8 connect_success;
+    __u8 via_waypoint;
+    __u8 sample_state;
 };
 
 struct {
@@ -75,6 +91,17 @@ static inline bool is_kmesh_enabled(struct bpf_sock_addr *ctx)
     return bpf_map_lookup_elem(&map_of_manager, &key);
 }
 
+/*
+ * From v5.4, bpf_get_netns_cookie can be called for bpf cgroup hooks, from v5.15, it can be called for bpf sockops
+ * hook. Therefore, ensure that function is correctly used.
+ */
+static inline bool is_bypass_enabled(struct bpf_sock_addr *ctx)
+{
+    struct manager_key key = {0};
+    key.netns_cookie = bpf_get_netns_cookie(ctx);
+    return bpf_map_lookup_elem(&map_of_bypass, &key);
+}
+
 /*
  * From v5.4, bpf_get_netns_cookie can be called for bpf cgroup hooks, from v5.15, it can be called for bpf sockops
  * hook. Therefore, ensure that function is correctly used.
@@ -16,6 +16,10 @@
 #define EAGAIN 11 /* Try again */
 #endif
 
+#ifndef EACCES
+#define EACCES 13 /* Permission denied */
+#endif
+
 #ifndef EBUSY
 #define EBUSY 16 /* Device or resource busy */
 #endif
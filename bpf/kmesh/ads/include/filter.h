@@ -5,6 +5,7 @@
 #define __KMESH_FILTER_H__
 
 #include "tcp_proxy.h"
+#include "http_auth.h"
 #include "tail_call.h"
 #include "bpf_log.h"
 #include "kmesh_common.h"
@@ -138,6 +139,11 @@ int filter_manager(ctx_buff_t *ctx)
             ret = -1;
             break;
         }
+        ret = http_auth_check(&addr);
+        if (ret != 0) {
+            BPF_LOG(INFO, FILTER, "http request denied by authorization policy\n");
+            break;
+        }
         ret = handle_http_connection_manager(http_conn, &addr, ctx, ctx_val->msg);
         break;
 #endif
@@ -0,0 +1,232 @@
+/* SPDX-License-Identifier: (GPL-2.0-only OR BSD-2-Clause) */
+/* Copyright Authors of Kmesh */
+
+#ifndef __KMESH_HTTP_AUTH_H__
+#define __KMESH_HTTP_AUTH_H__
+
+#include "bpf_log.h"
+#include "kmesh_common.h"
+
+/*
+ * HTTP authorization compiled by pkg/auth from the envoy RBAC http
+ * filters of the ADS listeners, one policy per filter. The envoy policies
+ * of a filter become its rules and are flattened into a list of
+ * conditions sorted by (rule, clause, match, group); conditions sharing
+ * all four ids form a group, e.g. the OR-ed paths of one permission:
+ *   - a positive group hits if ANY of its conditions hits
+ *   - a negative group hits if NONE of its conditions hits
+ * groups are AND-ed into a match, matches are OR-ed into a clause,
+ * clauses are AND-ed into a rule and rules are OR-ed into the policy;
+ * clause 0 holds the permissions and clause 1 the principals.
+ * pkg/auth marks in `end` which of them the condition is the last one of.
+ * Keep the layout in sync with pkg/auth/http_policy.go.
+ *
+ * The condition loop is unrolled while the policy loop stays a bounded
+ * loop, so the program holds the condition checks of a single policy.
+ */
+#define HTTP_AUTH_MAX_POLICIES 8
+#define HTTP_AUTH_MAX_CONDS    16
+#define HTTP_AUTH_NAME_LEN     32
+#define HTTP_AUTH_VALUE_LEN    64
+
+#define map_of_http_auth kmesh_http_auth
+
+enum http_auth_action {
+    HTTP_AUTH_ACTION_ALLOW = 0,
+    HTTP_AUTH_ACTION_DENY,
+};
+
+enum http_auth_field {
+    HTTP_AUTH_FIELD_ANY = 0,
+    HTTP_AUTH_FIELD_PATH,
+    HTTP_AUTH_FIELD_METHOD,
+    HTTP_AUTH_FIELD_HOST,
+    HTTP_AUTH_FIELD_HEADER,
+    HTTP_AUTH_FIELD_DST_PORT,
+};
+
+enum http_auth_match_type {
+    HTTP_AUTH_MATCH_EXACT = 0,
+    HTTP_AUTH_MATCH_PREFIX,
+    HTTP_AUTH_MATCH_SUFFIX,
+    HTTP_AUTH_MATCH_PRESENCE,
+};
+
+enum http_auth_end {
+    HTTP_AUTH_END_NONE = 0,
+    HTTP_AUTH_END_GROUP,
+    HTTP_AUTH_END_MATCH,
+    HTTP_AUTH_END_CLAUSE,
+    HTTP_AUTH_END_RULE,
+};
+
+struct http_auth_cond {
+    __u16 rule;
+    __u16 clause;
+    __u16 match;
+    __u16 group;
+    __u8 field;
+    __u8 match_type;
+    __u8 negate;
+    __u8 end;
+    __u32 port; // network order like address_t, only for HTTP_AUTH_FIELD_DST_PORT
+    char name[HTTP_AUTH_NAME_LEN];
+    char value[HTTP_AUTH_VALUE_LEN];
+};
+
+struct http_auth_policy {
+    __u32 action;
+    __u32 n_conds;
+    __u32 ipv4; // listener address like address_t, 0 for a wildcard listener
+    __u32 port;
+    struct http_auth_cond conds[HTTP_AUTH_MAX_CONDS];
+};
+
+/* the request attributes looked up once for all policies */
+struct http_auth_request {
+    struct bpf_mem_ptr *method;
+    struct bpf_mem_ptr *uri;
+    struct bpf_mem_ptr *host;
+    const address_t *addr;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(key_size, sizeof(__u32));
+    __uint(value_size, sizeof(struct http_auth_policy));
+    __uint(max_entries, HTTP_AUTH_MAX_POLICIES);
+} map_of_http_auth SEC(".maps");
+
+static inline bool http_auth_value_match(const struct http_auth_cond *cond, struct bpf_mem_ptr *elem)
+{
+    void *ptr;
+    __u32 size;
+    long len;
+
+    if (cond->match_type == HTTP_AUTH_MATCH_PRESENCE)
+        return elem != NULL;
+    if (!elem)
+        return false;
+
+    ptr = _(elem->ptr);
+    size = _(elem->size);
+    if (!ptr)
+        return false;
+
+    len = bpf_strnlen((char *)cond->value, HTTP_AUTH_VALUE_LEN);
+    switch (cond->match_type) {
+    case HTTP_AUTH_MATCH_EXACT:
+        return len == size && bpf__strncmp(cond->value, len, ptr) == 0;
+    case HTTP_AUTH_MATCH_PREFIX:
+        return len <= size && bpf__strncmp(cond->value, len, ptr) == 0;
+    case HTTP_AUTH_MATCH_SUFFIX:
+        return len <= size && bpf__strncmp(cond->value, len, ptr + size - len) == 0;
+    default:
+        return false;
+    }
+}
+
+static inline bool http_auth_cond_hit(const struct http_auth_cond *cond, const struct http_auth_request *req)
+{
+    switch (cond->field) {
+    case HTTP_AUTH_FIELD_ANY:
+        return true;
+    case HTTP_AUTH_FIELD_PATH:
+        return http_auth_value_match(cond, req->uri);
+    case HTTP_AUTH_FIELD_METHOD:
+        return http_auth_value_match(cond, req->method);
+    case HTTP_AUTH_FIELD_HOST:
+        return http_auth_value_match(cond, req->host);
+    case HTTP_AUTH_FIELD_HEADER:
+        return http_auth_value_match(cond, bpf_get_msg_header_element((void *)cond->name));
+    case HTTP_AUTH_FIELD_DST_PORT:
+        return cond->port == req->addr->port;
+    default:
+        return false;
+    }
+}
+
+static inline bool http_auth_policy_match(const struct http_auth_policy *policy, const struct http_auth_request *req)
+{
+    bool group_ok = false, match_ok = true, clause_ok = false, rule_ok = true;
+    bool group_start = true;
+    const struct http_auth_cond *cond;
+    bool hit;
+
+#pragma unroll
+    for (int i = 0; i < HTTP_AUTH_MAX_CONDS; i++) {
+        if (i >= policy->n_conds)
+            break;
+        cond = &policy->conds[i];
+        hit = http_auth_cond_hit(cond, req);
+        if (group_start)
+            group_ok = cond->negate ? true : false;
+        group_ok = cond->negate ? (group_ok && !hit) : (group_ok || hit);
+        group_start = cond->end >= HTTP_AUTH_END_GROUP;
+        if (cond->end < HTTP_AUTH_END_GROUP)
+            continue;
+
+        match_ok = match_ok && group_ok;
+        if (cond->end < HTTP_AUTH_END_MATCH)
+            continue;
+
+        clause_ok = clause_ok || match_ok;
+        match_ok = true;
+        if (cond->end < HTTP_AUTH_END_CLAUSE)
+            continue;
+
+        rule_ok = rule_ok && clause_ok;
+        clause_ok = false;
+        if (cond->end < HTTP_AUTH_END_RULE)
+            continue;
+
+        if (rule_ok)
+            return true;
+        rule_ok = true;
+    }
+    return false;
+}
+
+/*
+ * http_auth_check applies the filters of the listener of addr the way the
+ * envoy filter chain does: a matched DENY filter denies the request and so
+ * does an ALLOW filter none of whose rules match. Returns 0 if the request
+ * is allowed and -EACCES otherwise.
+ */
+static inline int http_auth_check(const address_t *addr)
+{
+    char method_key[7] = {'M', 'E', 'T', 'H', 'O', 'D', '\0'};
+    char uri_key[4] = {'U', 'R', 'I', '\0'};
+    char host_key[5] = {'H', 'o', 's', 't', '\0'};
+    struct http_auth_request req = {0};
+    struct http_auth_policy *policy;
+    bool matched;
+
+    req.method = bpf_get_msg_header_element(method_key);
+    req.uri = bpf_get_msg_header_element(uri_key);
+    req.host = bpf_get_msg_header_element(host_key);
+    req.addr = addr;
+
+#pragma clang loop unroll(disable)
+    for (__u32 i = 0; i < HTTP_AUTH_MAX_POLICIES; i++) {
+        __u32 key = i;
+        policy = bpf_map_lookup_elem(&map_of_http_auth, &key);
+        if (!policy || policy->n_conds == 0)
+            continue;
+        if (policy->port != addr->port || (policy->ipv4 && policy->ipv4 != addr->ipv4))
+            continue;
+
+        matched = http_auth_policy_match(policy, &req);
+        if (policy->action == HTTP_AUTH_ACTION_DENY && matched) {
+            BPF_LOG(DEBUG, FILTER, "http request denied by policy slot %u\n", i);
+            return -EACCES;
+        }
+        if (policy->action == HTTP_AUTH_ACTION_ALLOW && !matched) {
+            BPF_LOG(DEBUG, FILTER, "http request matches no rule of allow policy slot %u\n", i);
+            return -EACCES;
+        }
+    }
+    return 0;
+}
+
+#endif // __KMESH_HTTP_AUTH_H__
@@ -22,6 +22,27 @@ static inline void observe_on_pre_connect(struct bpf_sock *sk)
     return;
 }
 
+// observe_on_connect makes sure an outbound connection has its storage, so that
+// it is reported even if it fails before being established
+static inline void observe_on_connect(struct bpf_sock *sk, bool via_waypoint)
+{
+    struct sock_storage_data *storage = NULL;
+    if (!sk)
+        return;
+
+    storage = bpf_sk_storage_get(&map_of_sock_storage, sk, 0, BPF_LOCAL_STORAGE_GET_F_CREATE);
+    if (!storage) {
+        BPF_LOG(ERR, PROBE, "connect bpf_sk_storage_get failed\n");
+        return;
+    }
+
+    // waypoint connections skip observe_on_pre_connect in the tail call
+    if (storage->connect_ns == 0)
+        storage->connect_ns = bpf_ktime_get_ns();
+    storage->direction = OUTBOUND;
+    storage->via_waypoint = via_waypoint;
+}
+
 static inline void observe_on_connect_established(struct bpf_sock *sk, __u8 direction)
 {
     struct bpf_tcp_sock *tcp_sock = NULL;
@@ -46,10 +67,10 @@ static inline void observe_on_connect_established(struct bpf_sock *sk, __u8 dire
     storage->direction = direction;
     storage->connect_success = true;
 
-    tcp_report(sk, tcp_sock, storage, BPF_TCP_ESTABLISHED);
+    tcp_report(sk, tcp_sock, storage, BPF_TCP_ESTABLISHED, 0);
 }
 
-static inline void observe_on_close(struct bpf_sock *sk)
+static inline void observe_on_close(struct bpf_sock *sk, __u32 close_flags)
 {
     struct bpf_tcp_sock *tcp_sock = NULL;
     struct sock_storage_data *storage = NULL;
@@ -65,6 +86,6 @@ static inline void observe_on_close(struct bpf_sock *sk)
         return;
     }
 
-    tcp_report(sk, tcp_sock, storage, BPF_TCP_CLOSE);
+    tcp_report(sk, tcp_sock, storage, BPF_TCP_CLOSE, close_flags);
 }
 #endif
\ No newline at end of file
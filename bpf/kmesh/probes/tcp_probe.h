@@ -18,6 +18,70 @@ enum family_type {
     IPV6,
 };
 
+// conn_flags
+enum {
+    TCP_PROBE_FLAG_WAYPOINT = 1 << 0,    // redirected to a waypoint
+    TCP_PROBE_FLAG_RESET = 1 << 1,       // aborted instead of closed by FIN
+    TCP_PROBE_FLAG_AUTH_DENIED = 1 << 2, // shut down by kmesh authorization
+    TCP_PROBE_FLAG_MTLS = 1 << 3,        // HBONE port 15008, always mTLS
+};
+
+#define HBONE_MTLS_PORT 15008
+
+// sample_state of a connection, decided on its first report
+enum {
+    TCP_PROBE_SAMPLE_UNDECIDED = 0,
+    TCP_PROBE_SAMPLE_REPORT,
+    TCP_PROBE_SAMPLE_AGGREGATE,
+};
+
+// index of map_of_tcp_probe_stats
+enum {
+    TCP_PROBE_STAT_RINGBUF_FULL = 0,
+    TCP_PROBE_STAT_EXCLUDED,
+    TCP_PROBE_STAT_AGGREGATED,
+    TCP_PROBE_STAT_MAX,
+};
+
+#define TCP_PROBE_MAX_EXCLUDE_PORTS 16
+#define MAP_SIZE_OF_TCP_PROBE_EXCL  8192
+#define MAP_SIZE_OF_TCP_PROBE_PAIR  16384
+
+/*
+ * tcp_probe_config is written by the daemon, a zero value reports every
+ * connection through the ringbuf
+ */
+struct tcp_probe_config {
+    __u32 sample_rate;        // report 1 of every sample_rate connections, aggregate the others
+    __u32 exclude_port_count; // valid entries of exclude_ports
+    __u64 short_conn_ns;      // aggregate connections closed sooner, 0 disables aggregation
+    __u16 exclude_ports[TCP_PROBE_MAX_EXCLUDE_PORTS]; // server ports not observed at all
+};
+
+/*
+ * Connections are aggregated by pair, leaving out the client port. The daemon
+ * reads the counters periodically and reports the increase.
+ */
+struct tcp_probe_pair {
+    struct ip_addr src;
+    struct ip_addr dst;
+    __u16 dst_port;
+    __u8 direction;
+    __u8 conn_success;
+    __u32 conn_flags;
+};
+
+struct tcp_probe_pair_stats {
+    __u64 opened;
+    __u64 closed;
+    __u64 sent_bytes;
+    __u64 received_bytes;
+    __u64 duration; // ns
+    __u64 total_retrans;
+    __u64 segs_out;
+    __u64 segs_in;
+};
+
 struct tcp_probe_info {
     __u32 type;
     struct bpf_sock_tuple tuple;
@@ -40,6 +104,7 @@ struct tcp_probe_info {
                           * The total number of segments sent.
                           */
     __u32 lost_out;      /* Lost packets			*/
+    __u32 conn_flags;
 };
 
 struct {
@@ -47,6 +112,36 @@ struct {
     __uint(max_entries, RINGBUF_SIZE);
 } map_of_tcp_info SEC(".maps");
 
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct tcp_probe_config);
+} map_of_tcp_probe_conf SEC(".maps");
+
+/* addresses of the workloads not observed, e.g. of an excluded namespace */
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, struct ip_addr);
+    __type(value, __u32);
+    __uint(max_entries, MAP_SIZE_OF_TCP_PROBE_EXCL);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+} map_of_tcp_probe_excl SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, struct tcp_probe_pair);
+    __type(value, struct tcp_probe_pair_stats);
+    __uint(max_entries, MAP_SIZE_OF_TCP_PROBE_PAIR);
+} map_of_tcp_probe_pair SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, TCP_PROBE_STAT_MAX);
+    __type(key, __u32);
+    __type(value, __u64);
+} map_of_tcp_probe_stats SEC(".maps");
+
 static inline void constuct_tuple(struct bpf_sock *sk, struct bpf_sock_tuple *tuple, __u8 direction)
 {
     if (direction == OUTBOUND) {
@@ -102,32 +197,184 @@ static inline void get_tcp_probe_info(struct bpf_tcp_sock *tcp_sock, struct tcp_
     return;
 }
 
-static inline void
-tcp_report(struct bpf_sock *sk, struct bpf_tcp_sock *tcp_sock, struct sock_storage_data *storage, __u32 state)
+static inline __u16 get_server_port(struct bpf_sock *sk, __u8 direction)
+{
+    return (direction == OUTBOUND) ? bpf_ntohs(sk->dst_port) : sk->src_port;
+}
+
+static inline __u32 get_conn_flags(struct bpf_sock *sk, struct sock_storage_data *storage)
+{
+    __u32 flags = 0;
+    __u16 server_port = get_server_port(sk, storage->direction);
+
+    if (storage->via_waypoint)
+        flags |= TCP_PROBE_FLAG_WAYPOINT;
+    if (server_port == HBONE_MTLS_PORT)
+        flags |= TCP_PROBE_FLAG_MTLS;
+    return flags;
+}
+
+static inline void tcp_probe_stat_inc(__u32 index)
+{
+    __u64 *value = bpf_map_lookup_elem(&map_of_tcp_probe_stats, &index);
+    if (value)
+        (*value)++;
+}
+
+static inline bool tcp_probe_excluded(
+    struct bpf_sock *sk, struct tcp_probe_config *config, struct bpf_sock_tuple *tuple, __u8 direction, bool is_ipv4)
+{
+    struct ip_addr src = {0};
+    struct ip_addr dst = {0};
+    __u16 server_port = get_server_port(sk, direction);
+
+    if (config) {
+#pragma unroll
+        for (int i = 0; i < TCP_PROBE_MAX_EXCLUDE_PORTS; i++) {
+            if (i >= config->exclude_port_count)
+                break;
+            if (config->exclude_ports[i] == server_port)
+                return true;
+        }
+    }
+
+    if (is_ipv4) {
+        src.ip4 = tuple->ipv4.saddr;
+        dst.ip4 = tuple->ipv4.daddr;
+    } else {
+        bpf_memcpy(src.ip6, tuple->ipv6.saddr, IPV6_ADDR_LEN);
+        bpf_memcpy(dst.ip6, tuple->ipv6.daddr, IPV6_ADDR_LEN);
+    }
+    return bpf_map_lookup_elem(&map_of_tcp_probe_excl, &src) || bpf_map_lookup_elem(&map_of_tcp_probe_excl, &dst);
+}
+
+/*
+ * tcp_probe_should_aggregate decides between a ringbuf record and the pair counters.
+ * With aggregation on, established events are always counted in the pair, so that
+ * a short connection never has a record of its opening without one of its close.
+ */
+static inline bool tcp_probe_should_aggregate(
+    struct tcp_probe_config *config, struct sock_storage_data *storage, __u32 state, __u64 duration)
+{
+    if (!config)
+        return false;
+
+    if (storage->sample_state == TCP_PROBE_SAMPLE_UNDECIDED) {
+        storage->sample_state = TCP_PROBE_SAMPLE_REPORT;
+        if (config->sample_rate > 1 && bpf_get_prandom_u32() % config->sample_rate != 0)
+            storage->sample_state = TCP_PROBE_SAMPLE_AGGREGATE;
+    }
+    if (storage->sample_state == TCP_PROBE_SAMPLE_AGGREGATE)
+        return true;
+
+    if (config->short_conn_ns == 0)
+        return false;
+    return state != BPF_TCP_CLOSE || duration < config->short_conn_ns;
+}
+
+static inline void tcp_probe_aggregate(
+    struct bpf_tcp_sock *tcp_sock,
+    struct sock_storage_data *storage,
+    struct bpf_sock_tuple *tuple,
+    bool is_ipv4,
+    __u32 state,
+    __u32 conn_flags,
+    __u64 duration)
+{
+    struct tcp_probe_pair pair = {0};
+    struct tcp_probe_pair_stats init = {0};
+    struct tcp_probe_pair_stats *stats = NULL;
+
+    if (is_ipv4) {
+        pair.src.ip4 = tuple->ipv4.saddr;
+        pair.dst.ip4 = tuple->ipv4.daddr;
+        pair.dst_port = tuple->ipv4.dport;
+    } else {
+        bpf_memcpy(pair.src.ip6, tuple->ipv6.saddr, IPV6_ADDR_LEN);
+        bpf_memcpy(pair.dst.ip6, tuple->ipv6.daddr, IPV6_ADDR_LEN);
+        pair.dst_port = tuple->ipv6.dport;
+    }
+    pair.direction = storage->direction;
+    pair.conn_success = storage->connect_success;
+    pair.conn_flags = conn_flags;
+
+    stats = bpf_map_lookup_elem(&map_of_tcp_probe_pair, &pair);
+    if (!stats) {
+        bpf_map_update_elem(&map_of_tcp_probe_pair, &pair, &init, BPF_NOEXIST);
+        stats = bpf_map_lookup_elem(&map_of_tcp_probe_pair, &pair);
+        if (!stats)
+            return;
+    }
+
+    tcp_probe_stat_inc(TCP_PROBE_STAT_AGGREGATED);
+    // the bytes of a connection are counted once, when it is closed
+    if (state != BPF_TCP_CLOSE) {
+        __sync_fetch_and_add(&stats->opened, 1);
+        return;
+    }
+    // a connection never established is opened and closed at once
+    if (!storage->connect_success)
+        __sync_fetch_and_add(&stats->opened, 1);
+    __sync_fetch_and_add(&stats->closed, 1);
+    __sync_fetch_and_add(&stats->sent_bytes, tcp_sock->delivered);
+    __sync_fetch_and_add(&stats->received_bytes, tcp_sock->bytes_received);
+    __sync_fetch_and_add(&stats->duration, duration);
+    __sync_fetch_and_add(&stats->total_retrans, tcp_sock->total_retrans);
+    __sync_fetch_and_add(&stats->segs_out, tcp_sock->segs_out);
+    __sync_fetch_and_add(&stats->segs_in, tcp_sock->segs_in);
+}
+
+static inline void tcp_report(
+    struct bpf_sock *sk,
+    struct bpf_tcp_sock *tcp_sock,
+    struct sock_storage_data *storage,
+    __u32 state,
+    __u32 close_flags)
 {
     // struct connect_info *info = NULL;
     struct tcp_probe_info *info = NULL;
+    struct tcp_probe_config *config = NULL;
+    struct bpf_sock_tuple tuple = {0};
+    __u32 zero = 0;
+    __u32 conn_flags = get_conn_flags(sk, storage) | close_flags;
+    __u64 close_ns = 0;
+    __u64 duration = 0;
+    bool is_ipv4 = (sk->family == AF_INET) || is_ipv4_mapped_addr(sk->dst_ip6);
 
     // store tuple
+    constuct_tuple(sk, &tuple, storage->direction);
+    if (state == BPF_TCP_CLOSE) {
+        close_ns = bpf_ktime_get_ns();
+        duration = close_ns - storage->connect_ns;
+    }
+
+    config = bpf_map_lookup_elem(&map_of_tcp_probe_conf, &zero);
+    if (tcp_probe_excluded(sk, config, &tuple, storage->direction, is_ipv4)) {
+        tcp_probe_stat_inc(TCP_PROBE_STAT_EXCLUDED);
+        return;
+    }
+    if (tcp_probe_should_aggregate(config, storage, state, duration)) {
+        tcp_probe_aggregate(tcp_sock, storage, &tuple, is_ipv4, state, conn_flags, duration);
+        return;
+    }
+
     info = bpf_ringbuf_reserve(&map_of_tcp_info, sizeof(struct tcp_probe_info), 0);
     if (!info) {
-        BPF_LOG(ERR, PROBE, "bpf_ringbuf_reserve tcp_report failed\n");
+        // fall back to the pair counters, so that the metrics still add up
+        tcp_probe_stat_inc(TCP_PROBE_STAT_RINGBUF_FULL);
+        tcp_probe_aggregate(tcp_sock, storage, &tuple, is_ipv4, state, conn_flags, duration);
         return;
     }
 
-    constuct_tuple(sk, &info->tuple, storage->direction);
+    bpf_memcpy(&info->tuple, &tuple, sizeof(tuple));
     info->state = state;
     info->direction = storage->direction;
-    if (state == BPF_TCP_CLOSE) {
-        info->close_ns = bpf_ktime_get_ns();
-        info->duration = info->close_ns - storage->connect_ns;
-    }
+    info->close_ns = close_ns;
+    info->duration = duration;
     info->conn_success = storage->connect_success;
+    info->conn_flags = conn_flags;
     get_tcp_probe_info(tcp_sock, info);
-    (*info).type = (sk->family == AF_INET) ? IPV4 : IPV6;
-    if (is_ipv4_mapped_addr(sk->dst_ip6)) {
-        (*info).type = IPV4;
-    }
+    (*info).type = is_ipv4 ? IPV4 : IPV6;
 
     bpf_ringbuf_submit(info, 0);
 }
@@ -74,7 +74,7 @@ int cgroup_connect4_prog(struct bpf_sock_addr *ctx)
     kmesh_ctx.dnat_ip.ip4 = ctx->user_ip4;
     kmesh_ctx.dnat_port = ctx->user_port;
 
-    if (handle_kmesh_manage_process(&kmesh_ctx) || !is_kmesh_enabled(ctx)) {
+    if (handle_kmesh_manage_process(&kmesh_ctx) || !is_kmesh_enabled(ctx) || is_bypass_enabled(ctx)) {
         return CGROUP_SOCK_OK;
     }
     int ret = sock_traffic_control(&kmesh_ctx);
@@ -104,7 +104,7 @@ int cgroup_connect6_prog(struct bpf_sock_addr *ctx)
     IP6_COPY(kmesh_ctx.dnat_ip.ip6, kmesh_ctx.orig_dst_addr.ip6);
     kmesh_ctx.dnat_port = ctx->user_port;
 
-    if (handle_kmesh_manage_process(&kmesh_ctx) || !is_kmesh_enabled(ctx)) {
+    if (handle_kmesh_manage_process(&kmesh_ctx) || !is_kmesh_enabled(ctx) || is_bypass_enabled(ctx)) {
         return CGROUP_SOCK_OK;
     }
 
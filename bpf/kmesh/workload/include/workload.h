@@ -98,6 +98,15 @@ struct {
     __uint(map_flags, BPF_F_NO_PREALLOC);
 } map_of_auth SEC(".maps");
 
+// map_of_auth_denied keeps the tuples shut down by xdp until sockops reports their
+// close as denied, it is an LRU so that the tuples of lost closes are recycled
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, struct bpf_sock_tuple);
+    __type(value, __u32);
+    __uint(max_entries, MAP_SIZE_OF_AUTH);
+} map_of_auth_denied SEC(".maps");
+
 struct {
     __uint(type, BPF_MAP_TYPE_RINGBUF);
     __uint(max_entries, RINGBUF_SIZE);
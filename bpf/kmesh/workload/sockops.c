@@ -41,9 +41,10 @@ static inline bool is_managed_by_kmesh(struct bpf_sock_ops *skops)
     }
 
     int *value = bpf_map_lookup_elem(&map_of_manager, &key);
-    if (!value)
+    if (!value || *value != 0)
         return false;
-    return (*value == 0);
+    // the bypassed pods are also recorded by their ips
+    return !bpf_map_lookup_elem(&map_of_bypass, &key);
 }
 
 static inline void extract_skops_to_tuple(struct bpf_sock_ops *skops, struct bpf_sock_tuple *tuple_key)
@@ -93,7 +94,7 @@ static inline void extract_skops_to_tuple_reverse(struct bpf_sock_ops *skops, st
     }
 }
 
-// clean map_of_auth
+// clean map_of_auth and map_of_auth_denied
 static inline void clean_auth_map(struct bpf_sock_ops *skops)
 {
     struct bpf_sock_tuple tuple_key = {0};
@@ -106,6 +107,7 @@ static inline void clean_auth_map(struct bpf_sock_ops *skops)
     int ret = bpf_map_delete_elem(&map_of_auth, &tuple_key);
     if (ret && ret != -ENOENT)
         BPF_LOG(ERR, SOCKOPS, "map_of_auth bpf_map_delete_elem failed, ret: %d", ret);
+    bpf_map_delete_elem(&map_of_auth_denied, &tuple_key);
 }
 
 static inline void clean_dstinfo_map(struct bpf_sock_ops *skops)
@@ -116,6 +118,31 @@ static inline void clean_dstinfo_map(struct bpf_sock_ops *skops)
         BPF_LOG(ERR, SOCKOPS, "bpf map delete destination info failed, ret: %d", ret);
 }
 
+// close_flags tells why a connection is closed, it must run before clean_auth_map
+static inline __u32 close_flags(struct bpf_sock_ops *skops)
+{
+    __u32 flags = 0;
+    struct bpf_sock_tuple tuple_key = {0};
+
+    // a graceful close always goes through FIN_WAIT* or LAST_ACK, closing from any
+    // other state means the connection is reset or never established
+    switch (skops->args[0]) {
+    case BPF_TCP_FIN_WAIT1:
+    case BPF_TCP_FIN_WAIT2:
+    case BPF_TCP_CLOSING:
+    case BPF_TCP_LAST_ACK:
+    case BPF_TCP_TIME_WAIT:
+        break;
+    default:
+        flags |= TCP_PROBE_FLAG_RESET;
+    }
+
+    extract_skops_to_tuple_reverse(skops, &tuple_key);
+    if (bpf_map_lookup_elem(&map_of_auth_denied, &tuple_key))
+        flags |= TCP_PROBE_FLAG_AUTH_DENIED;
+    return flags;
+}
+
 // insert an IPv4 tuple into the ringbuf
 static inline void auth_ip_tuple(struct bpf_sock_ops *skops)
 {
@@ -220,6 +247,13 @@ int sockops_prog(struct bpf_sock_ops *skops)
     switch (skops->op) {
     case BPF_SOCK_OPS_TCP_CONNECT_CB:
         skops_handle_kmesh_managed_process(skops);
+        if (skops_conn_from_cni_sim_add(skops) || skops_conn_from_cni_sim_delete(skops) || !is_managed_by_kmesh(skops))
+            break;
+        // watch the state from now on, so that failed connections are reported too
+        __u64 *connect_sk = (__u64 *)skops->sk;
+        observe_on_connect(skops->sk, bpf_map_lookup_elem(&map_of_dst_info, &connect_sk) != NULL);
+        if (bpf_sock_ops_cb_flags_set(skops, BPF_SOCK_OPS_STATE_CB_FLAG) != 0)
+            BPF_LOG(ERR, SOCKOPS, "set sockops cb failed!\n");
         break;
     case BPF_SOCK_OPS_ACTIVE_ESTABLISHED_CB:
         if (!is_managed_by_kmesh(skops))
@@ -242,7 +276,7 @@ int sockops_prog(struct bpf_sock_ops *skops)
         break;
     case BPF_SOCK_OPS_STATE_CB:
         if (skops->args[1] == BPF_TCP_CLOSE) {
-            observe_on_close(skops->sk);
+            observe_on_close(skops->sk, close_flags(skops));
             clean_auth_map(skops);
             clean_dstinfo_map(skops);
         }
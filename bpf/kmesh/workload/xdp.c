@@ -70,6 +70,8 @@ static inline int should_shutdown(struct xdp_info *info, struct bpf_sock_tuple *
                 "auth denied, src ip: %s, port: %u\n",
                 ip2str(&tuple_info->ipv6.saddr[0], false),
                 bpf_ntohs(tuple_info->ipv6.sport));
+        // sockops reports the close as denied from map_of_auth_denied
+        bpf_map_update_elem(&map_of_auth_denied, tuple_info, value, BPF_ANY);
         bpf_map_delete_elem(&map_of_auth, tuple_info);
         return AUTH_FORBID;
     }
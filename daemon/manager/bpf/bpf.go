@@ -0,0 +1,192 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"kmesh.net/kmesh/pkg/status"
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+func NewCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bpf",
+		Short: "Inspect the bpf maps pinned by kmesh-daemon",
+	}
+	cmd.AddCommand(newMapsCmd())
+	cmd.AddCommand(newMapCmd())
+	return cmd
+}
+
+func newMapsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "maps",
+		Short: "List the pinned kmesh maps with their size and occupancy",
+		Example: `List the maps:
+		kmesh-daemon bpf maps
+
+	  Print as json:
+		kmesh-daemon bpf maps -o json`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			output, _ := cmd.Flags().GetString("output")
+			if err := RunMaps(os.Stdout, output); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringP("output", "o", "table", "Output format, table or json")
+	return cmd
+}
+
+func newMapCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "map <name>",
+		Short: "Decode the entries of a kmesh map, with HashName ids translated to names",
+		Example: `Dump the services map:
+		kmesh-daemon bpf map kmesh_service
+
+	  Only the entries whose key contains a service name:
+		kmesh-daemon bpf map kmesh_endpoint --key default/httpbin
+
+	  One entry per line:
+		kmesh-daemon bpf map kmesh_frontend -o table`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			key, _ := cmd.Flags().GetString("key")
+			output, _ := cmd.Flags().GetString("output")
+			if err := RunMap(os.Stdout, args[0], key, output); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().String("key", "", "Only print the entries whose key contains this string")
+	cmd.Flags().StringP("output", "o", "json", "Output format, json or table")
+	return cmd
+}
+
+func RunMaps(w io.Writer, output string) error {
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unknown output format %q, must be table or json", output)
+	}
+
+	body, err := get(status.GetBpfMapsURL())
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		fmt.Fprintln(w, string(body))
+		return nil
+	}
+
+	var stats []utils.MapStats
+	if err = json.Unmarshal(body, &stats); err != nil {
+		return fmt.Errorf("unmarshaling response body: %v", err)
+	}
+	printMaps(w, stats)
+	return nil
+}
+
+func RunMap(w io.Writer, name, key, output string) error {
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unknown output format %q, must be json or table", output)
+	}
+
+	mapURL := status.GetBpfMapURL(name)
+	if key != "" {
+		mapURL += "?" + url.Values{"key": []string{key}}.Encode()
+	}
+	body, err := get(mapURL)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		fmt.Fprintln(w, string(body))
+		return nil
+	}
+
+	var dump struct {
+		Entries []struct {
+			Key   string          `json:"key"`
+			Value json.RawMessage `json:"value"`
+		} `json:"entries"`
+	}
+	if err = json.Unmarshal(body, &dump); err != nil {
+		return fmt.Errorf("unmarshaling response body: %v", err)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE")
+	for _, e := range dump.Entries {
+		var value bytes.Buffer
+		if err = json.Compact(&value, e.Value); err != nil {
+			return fmt.Errorf("compacting value of %s: %v", e.Key, err)
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", e.Key, value.String())
+	}
+	_ = tw.Flush()
+	return nil
+}
+
+func get(url string) ([]byte, error) {
+	resp, err := status.GetAdminClient().Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("making GET request(%s): %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response body(%s): %v", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func printMaps(w io.Writer, stats []utils.MapStats) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tKEY\tVALUE\tMAX ENTRIES\tENTRIES\tUSAGE")
+	for _, s := range stats {
+		if s.Error != "" {
+			fmt.Fprintf(tw, "%s\terror: %s\t-\t-\t-\t-\t-\n", s.Name, s.Error)
+			continue
+		}
+		entries, usage := "-", "-"
+		if s.Entries >= 0 {
+			entries = fmt.Sprintf("%d", s.Entries)
+			if s.MaxEntries > 0 {
+				usage = fmt.Sprintf("%.1f%%", float64(s.Entries)*100/float64(s.MaxEntries))
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%s\t%s\n", s.Name, s.Type, s.KeySize, s.ValueSize, s.MaxEntries, entries, usage)
+	}
+	_ = tw.Flush()
+}
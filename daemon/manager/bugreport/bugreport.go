@@ -0,0 +1,308 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bugreport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"kmesh.net/kmesh/pkg/bugreport"
+	"kmesh.net/kmesh/pkg/constants"
+	"kmesh.net/kmesh/pkg/logger"
+	"kmesh.net/kmesh/pkg/status"
+	"kmesh.net/kmesh/pkg/version"
+)
+
+const (
+	requestTimeout = 30 * time.Second
+	// maxCPUProfile stays below the write timeout of the status server, which aborts longer profiles
+	maxCPUProfile = 19 * time.Second
+)
+
+type Options struct {
+	Output        string
+	Redact        bugreport.RedactOptions
+	CPUProfile    time.Duration
+	EventsCapture time.Duration
+	// LogSizeLimit is the number of bytes kept from the end of each log file
+	LogSizeLimit int64
+	BpfFsPath    string
+	CniConfDir   string
+}
+
+func NewCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bugreport",
+		Short: "Collect the state of kmesh daemon on this node into a tarball to attach to issues",
+		Example: `Write kmesh-bugreport-<node>-<time>.tar.gz in the current directory:
+		kmesh-daemon bugreport
+
+	  Also replace the ip addresses with placeholders:
+		kmesh-daemon bugreport --redact-ips
+
+	  Stream the bundle out of the daemon pod:
+		kubectl exec -n kmesh-system <kmesh-pod> -- kmesh-daemon bugreport -o - > bugreport.tar.gz`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			opts := Options{}
+			opts.Output, _ = cmd.Flags().GetString("output")
+			opts.Redact.Secrets, _ = cmd.Flags().GetBool("redact-secrets")
+			opts.Redact.IPs, _ = cmd.Flags().GetBool("redact-ips")
+			opts.CPUProfile, _ = cmd.Flags().GetDuration("cpu-profile")
+			opts.EventsCapture, _ = cmd.Flags().GetDuration("events")
+			logSizeMB, _ := cmd.Flags().GetInt64("log-size-limit")
+			opts.LogSizeLimit = logSizeMB << 20
+			// inherited from the daemon flags, so that a non default layout is reported as deployed
+			opts.BpfFsPath, _ = cmd.Flags().GetString("bpf-fs-path")
+			opts.CniConfDir, _ = cmd.Flags().GetString("cni-etc-path")
+			if err := RunBugReport(os.Stderr, opts); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringP("output", "o", "", "Path of the tarball, - writes to stdout (default kmesh-bugreport-<node>-<time>.tar.gz)")
+	cmd.Flags().Bool("redact-secrets", true, "Remove private keys, tokens and passwords")
+	cmd.Flags().Bool("redact-ips", false, "Replace ip addresses with placeholders, consistently across the bundle")
+	cmd.Flags().Duration("cpu-profile", 10*time.Second, fmt.Sprintf("Duration of the cpu profile, from 1s to %v, 0 skips it", maxCPUProfile))
+	cmd.Flags().Duration("events", 5*time.Second, "How long to capture the daemon event stream, 0 skips it")
+	cmd.Flags().Int64("log-size-limit", 100, "Megabytes kept from the end of each log file")
+	return cmd
+}
+
+// RunBugReport collects the bundle, reporting progress and the items that failed on w.
+// Items that cannot be collected do not fail the report, they are listed in its manifest.
+func RunBugReport(w io.Writer, opts Options) error {
+	if opts.CPUProfile != 0 && (opts.CPUProfile < time.Second || opts.CPUProfile > maxCPUProfile) {
+		return fmt.Errorf("cpu profile duration must be 0 or between 1s and %v", maxCPUProfile)
+	}
+	if opts.EventsCapture < 0 || opts.LogSizeLimit < 0 {
+		return fmt.Errorf("events duration and log size limit must not be negative")
+	}
+
+	hostname, _ := os.Hostname()
+	root := fmt.Sprintf("kmesh-bugreport-%s-%s", hostname, time.Now().Format("20060102-150405"))
+	var out io.Writer
+	if opts.Output == "-" {
+		out = os.Stdout
+	} else {
+		if opts.Output == "" {
+			opts.Output = root + ".tar.gz"
+		}
+		f, err := os.Create(opts.Output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	b := bugreport.NewBundle(out, root, bugreport.NewRedactor(opts.Redact))
+	collectDebugEndpoints(w, b)
+	collectEvents(w, b, opts.EventsCapture)
+	collectProfiles(w, b, opts.CPUProfile)
+	collectLogs(w, b, opts.LogSizeLimit)
+	collectNodeState(w, b, opts)
+	if err := b.Close(); err != nil {
+		return err
+	}
+
+	manifest := b.Manifest()
+	fmt.Fprintf(w, "collected %d files", len(manifest.Files))
+	if len(manifest.Errors) > 0 {
+		fmt.Fprintf(w, ", %d items failed, see %s", len(manifest.Errors), bugreport.ManifestName)
+	}
+	if opts.Output != "-" {
+		fmt.Fprintf(w, " into %s", opts.Output)
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+// record stores the outcome of collecting name and reports failures as they happen
+func record(w io.Writer, b *bugreport.Bundle, name string, err error) {
+	if err == nil {
+		return
+	}
+	b.AddError(name, err)
+	fmt.Fprintf(w, "failed to collect %s: %v\n", name, err)
+}
+
+func collectDebugEndpoints(w io.Writer, b *bugreport.Bundle) {
+	fmt.Fprintln(w, "collecting debug endpoints")
+	for _, endpoint := range status.GetDebugEndpoints() {
+		name := "debug/" + endpoint.File
+		data, err := httpGet(context.Background(), endpoint.URL)
+		record(w, b, name, keepBody(b.Add, name, data, err))
+	}
+}
+
+func collectEvents(w io.Writer, b *bugreport.Bundle, duration time.Duration) {
+	if duration == 0 {
+		return
+	}
+	fmt.Fprintf(w, "capturing events for %v\n", duration)
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	data, err := httpGet(ctx, status.GetEventsURL())
+	// the stream never ends on its own, the deadline is the expected way out
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = nil
+	}
+	record(w, b, "debug/events.ndjson", keepBody(b.Add, "debug/events.ndjson", data, err))
+}
+
+func collectProfiles(w io.Writer, b *bugreport.Bundle, cpu time.Duration) {
+	fmt.Fprintln(w, "collecting profiles")
+	data, err := httpGet(context.Background(), status.GetPprofURL("goroutine?debug=2"))
+	record(w, b, "pprof/goroutine.txt", keepBody(b.Add, "pprof/goroutine.txt", data, err))
+
+	profiles := map[string]string{
+		"pprof/heap.pb.gz":   "heap",
+		"pprof/allocs.pb.gz": "allocs",
+	}
+	if cpu > 0 {
+		fmt.Fprintf(w, "profiling cpu for %v\n", cpu)
+		profiles["pprof/cpu.pb.gz"] = fmt.Sprintf("profile?seconds=%d", int(cpu.Seconds()))
+	}
+	for file, profile := range profiles {
+		data, err := httpGet(context.Background(), status.GetPprofURL(profile))
+		// profiles are compressed protobufs, redaction would corrupt them
+		record(w, b, file, keepBody(b.AddBinary, file, data, err))
+	}
+}
+
+func collectLogs(w io.Writer, b *bugreport.Bundle, limit int64) {
+	fmt.Fprintln(w, "collecting logs")
+	dir := logger.LogDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		record(w, b, "logs", err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		name := "logs/" + entry.Name()
+		record(w, b, name, b.AddFile(name, filepath.Join(dir, entry.Name()), limit))
+	}
+}
+
+func collectNodeState(w io.Writer, b *bugreport.Bundle, opts Options) {
+	fmt.Fprintln(w, "collecting node state")
+	record(w, b, "version.json", b.AddJSON("version.json", version.Get()))
+
+	if _, err := os.Stat(constants.HashNamePersistPath); err == nil {
+		record(w, b, "state/workload_hash_name.yaml",
+			b.AddFile("state/workload_hash_name.yaml", constants.HashNamePersistPath, 0))
+	} else if !os.IsNotExist(err) {
+		record(w, b, "state/workload_hash_name.yaml", err)
+	}
+
+	inventory := bugreport.CollectBpfInventory(opts.BpfFsPath)
+	for _, v := range inventory.Versions {
+		if !v.Match {
+			fmt.Fprintf(w, "warning: bpf programs under %s were loaded by another version than %s\n",
+				filepath.Dir(filepath.Dir(v.PinPath)), v.Daemon)
+		}
+	}
+	record(w, b, "bpf/inventory.json", b.AddJSON("bpf/inventory.json", inventory))
+
+	// only the network configs, the directory also holds the kubeconfig of the cni plugin
+	for _, pattern := range []string{"*.conflist", "*.conf"} {
+		files, _ := filepath.Glob(filepath.Join(opts.CniConfDir, pattern))
+		for _, file := range files {
+			name := "cni/" + filepath.Base(file)
+			record(w, b, name, b.AddFile(name, file, 0))
+		}
+	}
+
+	config, source, err := bugreport.ReadKernelConfig()
+	if err == nil {
+		header := fmt.Sprintf("# options relevant to kmesh, from %s\n", source)
+		err = b.Add("kernel/config", append([]byte(header), bugreport.FilterKernelConfig(config)...))
+	}
+	record(w, b, "kernel/config", err)
+	kernelVersion, err := os.ReadFile("/proc/version")
+	if err == nil {
+		err = b.Add("kernel/version", kernelVersion)
+	}
+	record(w, b, "kernel/version", err)
+}
+
+// statusError reports a non 2xx response, whose body is still worth keeping, e.g. the
+// health report of an unhealthy daemon comes with 503
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("received status code %d", e.code)
+}
+
+// keepBody adds the body of a response with add. The body of a non 2xx response is
+// added as well and its status stays the reported error.
+func keepBody(add func(name string, data []byte) error, name string, data []byte, err error) error {
+	var statusErr *statusError
+	if err != nil && !errors.As(err, &statusErr) {
+		return err
+	}
+	if addErr := add(name, data); addErr != nil {
+		return addErr
+	}
+	return err
+}
+
+// httpGet returns the body read so far along with the error, so that streams cut by a
+// deadline and non 2xx responses still yield what they received
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := status.GetAdminClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("making GET request(%s): %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return body, &statusError{code: resp.StatusCode}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return body, err
+	}
+	return body, nil
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"kmesh.net/kmesh/pkg/controller/security"
+	"kmesh.net/kmesh/pkg/status"
+)
+
+func NewCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "certs",
+		Short: "List the workload certificates held by kmesh-daemon",
+		Example: `List all certificates:
+		kmesh-daemon certs
+
+	  Show the certificate of an identity:
+		kmesh-daemon certs spiffe://cluster.local/ns/default/sa/default
+
+	  Print as json:
+		kmesh-daemon certs -o json`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			output, _ := cmd.Flags().GetString("output")
+			if err := RunCerts(os.Stdout, args, output); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringP("output", "o", "table", "Output format, table or json")
+	return cmd
+}
+
+func RunCerts(w io.Writer, args []string, output string) error {
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unknown output format %q, must be table or json", output)
+	}
+
+	certs, err := getCerts(status.GetCertsURL())
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		filtered := certs[:0]
+		for _, cert := range certs {
+			if cert.Identity == args[0] {
+				filtered = append(filtered, cert)
+			}
+		}
+		if len(filtered) == 0 {
+			return fmt.Errorf("no certificate of %s", args[0])
+		}
+		certs = filtered
+	}
+
+	if output == "json" {
+		data, err := json.MarshalIndent(certs, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+		return nil
+	}
+	printCerts(w, certs, time.Now())
+	return nil
+}
+
+func getCerts(url string) ([]security.CertInfo, error) {
+	resp, err := status.GetAdminClient().Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("making GET request(%s): %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response body(%s): %v", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var certs []security.CertInfo
+	if err = json.Unmarshal(body, &certs); err != nil {
+		return nil, fmt.Errorf("unmarshaling response body: %v", err)
+	}
+	return certs, nil
+}
+
+func printCerts(w io.Writer, certs []security.CertInfo, now time.Time) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "IDENTITY\tREFS\tSERIAL\tNOT BEFORE\tNOT AFTER\tEXPIRES IN\tNEXT ROTATION\tWORKLOADS")
+	for _, cert := range certs {
+		workloads := strings.Join(cert.Workloads, ",")
+		if workloads == "" {
+			workloads = "-"
+		}
+		if cert.Pending {
+			state := "pending"
+			if cert.RetryExhausted {
+				state = "failed"
+			} else if cert.Retries > 0 {
+				state = fmt.Sprintf("retrying(%d)", cert.Retries)
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t-\t-\t-\t-\t%s\n", cert.Identity, cert.RefCnt, state, workloads)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", cert.Identity, cert.RefCnt, cert.SerialNumber,
+			formatTime(cert.NotBefore), formatTime(cert.NotAfter), cert.NotAfter.Sub(now).Truncate(time.Second),
+			formatTime(cert.NextRotation), workloads)
+	}
+	_ = tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package describe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"kmesh.net/kmesh/pkg/status"
+)
+
+func NewCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "describe",
+		Short: "Show what kmesh-daemon knows about a resource",
+	}
+	cmd.AddCommand(newPodCmd())
+	return cmd
+}
+
+func newPodCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pod <namespace>/<name>",
+		Short: "Show the enrollment, bpf entries, policies, certificate and connection metrics of a pod",
+		Example: `Describe a pod running on this node:
+		kmesh-daemon describe pod default/httpbin-5c5944c58c-v8j2w
+
+	  Print as json:
+		kmesh-daemon describe pod default/httpbin-5c5944c58c-v8j2w -o json`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			output, _ := cmd.Flags().GetString("output")
+			if err := RunDescribePod(os.Stdout, args[0], output); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringP("output", "o", "text", "Output format, text or json")
+	return cmd
+}
+
+func RunDescribePod(w io.Writer, pod string, output string) error {
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unknown output format %q, must be text or json", output)
+	}
+	namespace, name, ok := strings.Cut(pod, "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid pod %q, must be <namespace>/<name>", pod)
+	}
+
+	desc, err := getPodDescription(status.GetDescribePodURL(namespace, name))
+	if err != nil {
+		return err
+	}
+
+	if output == "json" {
+		data, err := json.MarshalIndent(desc, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+		return nil
+	}
+	printPodDescription(w, desc)
+	return nil
+}
+
+func getPodDescription(url string) (*status.PodDescription, error) {
+	resp, err := status.GetAdminClient().Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("making GET request(%s): %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response body(%s): %v", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var desc status.PodDescription
+	if err = json.Unmarshal(body, &desc); err != nil {
+		return nil, fmt.Errorf("unmarshaling response body: %v", err)
+	}
+	return &desc, nil
+}
+
+func printPodDescription(w io.Writer, desc *status.PodDescription) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+
+	fmt.Fprintf(tw, "Name:\t%s\n", desc.Name)
+	fmt.Fprintf(tw, "Namespace:\t%s\n", desc.Namespace)
+	fmt.Fprintf(tw, "Node:\t%s\n", orNone(desc.Node))
+	fmt.Fprintf(tw, "IP:\t%s\n", orNone(desc.IP))
+	fmt.Fprintf(tw, "Service Account:\t%s\n", orNone(desc.ServiceAccount))
+
+	if e := desc.Enrollment; e != nil {
+		fmt.Fprintln(tw, "Enrollment:")
+		fmt.Fprintf(tw, "  Should Enroll:\t%t\n", e.ShouldEnroll)
+		fmt.Fprintf(tw, "  Enrolled:\t%t\n", e.Enrolled)
+		fmt.Fprintf(tw, "  Annotation:\t%s\n", orNone(e.Annotation))
+		fmt.Fprintf(tw, "  Pod Label:\t%s\n", orNone(e.PodLabel))
+		fmt.Fprintf(tw, "  Namespace Label:\t%s\n", orNone(e.NamespaceLabel))
+	}
+	if b := desc.Bypass; b != nil {
+		fmt.Fprintln(tw, "Bypass:")
+		fmt.Fprintf(tw, "  Bypassed:\t%t\n", b.Bypassed)
+		fmt.Fprintf(tw, "  Controller Enabled:\t%t\n", b.ControllerEnabled)
+		fmt.Fprintf(tw, "  Label:\t%t\n", b.Label)
+		fmt.Fprintf(tw, "  Sidecar:\t%t\n", b.Sidecar)
+	}
+
+	fmt.Fprintln(tw, "XDP:")
+	switch {
+	case desc.XdpError != "":
+		fmt.Fprintf(tw, "  Error:\t%s\n", desc.XdpError)
+	case len(desc.Xdp) == 0:
+		fmt.Fprintln(tw, "  <none>")
+	}
+	for _, link := range desc.Xdp {
+		if link.Attached {
+			fmt.Fprintf(tw, "  %s:\tattached, prog id %d\n", link.Interface, link.ProgramId)
+		} else {
+			fmt.Fprintf(tw, "  %s:\tnot attached\n", link.Interface)
+		}
+	}
+
+	if wl := desc.Workload; wl != nil {
+		fmt.Fprintln(tw, "Workload:")
+		fmt.Fprintf(tw, "  Uid:\t%s\n", wl.Uid)
+		fmt.Fprintf(tw, "  Workload Name:\t%s\n", wl.WorkloadName)
+		fmt.Fprintf(tw, "  Addresses:\t%s\n", orNone(strings.Join(wl.Addresses, ", ")))
+		fmt.Fprintf(tw, "  Protocol:\t%s\n", wl.Protocol)
+		fmt.Fprintf(tw, "  Status:\t%s\n", wl.Status)
+	} else {
+		fmt.Fprintf(tw, "Workload:\t%s\n", "<none>")
+	}
+	fmt.Fprintf(tw, "Waypoint:\t%s\n", orNone(desc.Waypoint))
+
+	fmt.Fprintln(tw, "BPF:")
+	for _, frontend := range desc.Frontends {
+		fmt.Fprintf(tw, "  Frontend:\t%s\n", frontend.Address)
+	}
+	if b := desc.Backend; b != nil {
+		fmt.Fprintf(tw, "  Backend:\tuid %d, %s\n", b.BackendUid, b.Address)
+		if b.Waypoint != "" {
+			fmt.Fprintf(tw, "  Backend Waypoint:\t%s\n", b.Waypoint)
+		}
+	} else {
+		fmt.Fprintf(tw, "  Backend:\t%s\n", "<none>")
+	}
+
+	fmt.Fprintln(tw, "Services:")
+	if len(desc.Services) == 0 {
+		fmt.Fprintln(tw, "  <none>")
+	}
+	for _, svc := range desc.Services {
+		fmt.Fprintf(tw, "  %s\n", svc.Name)
+		if svc.Service != nil {
+			fmt.Fprintf(tw, "    VIPs:\t%s\n", orNone(strings.Join(svc.Service.Addresses, ", ")))
+			if svc.Service.Waypoint != nil && svc.Service.Waypoint.Destination != "" {
+				fmt.Fprintf(tw, "    Waypoint:\t%s\n", svc.Service.Waypoint.Destination)
+			}
+		} else {
+			fmt.Fprintf(tw, "    VIPs:\t%s\n", "<service not in cache>")
+		}
+		frontends := make([]string, 0, len(svc.Frontends))
+		for _, frontend := range svc.Frontends {
+			frontends = append(frontends, frontend.Address)
+		}
+		fmt.Fprintf(tw, "    Frontends:\t%s\n", orNone(strings.Join(frontends, ", ")))
+		slots := make([]string, 0, len(svc.Endpoints))
+		for _, endpoint := range svc.Endpoints {
+			slots = append(slots, fmt.Sprint(endpoint.BackendIndex))
+		}
+		fmt.Fprintf(tw, "    Endpoint Slots:\t%s\n", orNone(strings.Join(slots, ", ")))
+	}
+
+	fmt.Fprintln(tw, "Authorization Policies:")
+	if len(desc.Policies) == 0 {
+		fmt.Fprintln(tw, "  <none>")
+	}
+	for _, policy := range desc.Policies {
+		fmt.Fprintf(tw, "  %s/%s:\t%s, %s scope\n", policy.Namespace, policy.Name, policy.Action, policy.Scope)
+	}
+
+	fmt.Fprintf(tw, "Identity:\t%s\n", orNone(desc.Identity))
+	if cert := desc.Certificate; cert != nil {
+		fmt.Fprintln(tw, "Certificate:")
+		if cert.Pending {
+			fmt.Fprintf(tw, "  Status:\t%s\n", "pending")
+		} else {
+			fmt.Fprintf(tw, "  Serial Number:\t%s\n", cert.SerialNumber)
+			fmt.Fprintf(tw, "  Not After:\t%s\n", cert.NotAfter.UTC().Format(time.RFC3339))
+			fmt.Fprintf(tw, "  Next Rotation:\t%s\n", cert.NextRotation.UTC().Format(time.RFC3339))
+		}
+	} else {
+		fmt.Fprintf(tw, "Certificate:\t%s\n", "<none>")
+	}
+
+	if desc.Inbound != nil && desc.Outbound != nil {
+		fmt.Fprintf(tw, "Connections (last %v):\n", desc.ConnectionWindow)
+		fmt.Fprintln(tw, "  \tOPENED\tCLOSED\tFAILED\tSENT BYTES\tRECEIVED BYTES")
+		fmt.Fprintf(tw, "  Inbound\t%.0f\t%.0f\t%.0f\t%.0f\t%.0f\n", desc.Inbound.Opened, desc.Inbound.Closed,
+			desc.Inbound.Failed, desc.Inbound.SentBytes, desc.Inbound.ReceivedBytes)
+		fmt.Fprintf(tw, "  Outbound\t%.0f\t%.0f\t%.0f\t%.0f\t%.0f\n", desc.Outbound.Opened, desc.Outbound.Closed,
+			desc.Outbound.Failed, desc.Outbound.SentBytes, desc.Outbound.ReceivedBytes)
+	}
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"kmesh.net/kmesh/pkg/controller/consistency"
+	"kmesh.net/kmesh/pkg/status"
+)
+
+func NewCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff",
+		Short: "Compare the userspace cache of kmesh-daemon with the bpf maps",
+		Example: `List the bpf map entries out of sync with the cache:
+		kmesh-daemon diff
+
+	  Rewrite the out of sync entries from the cache:
+		kmesh-daemon diff --repair
+
+	  Print as json:
+		kmesh-daemon diff -o json`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			output, _ := cmd.Flags().GetString("output")
+			repair, _ := cmd.Flags().GetBool("repair")
+			if err := RunDiff(os.Stdout, repair, output); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringP("output", "o", "table", "Output format, table or json")
+	cmd.Flags().Bool("repair", false, "Rewrite the out of sync bpf map entries from the cache")
+	return cmd
+}
+
+func RunDiff(w io.Writer, repair bool, output string) error {
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unknown output format %q, must be table or json", output)
+	}
+
+	report, err := getReport(status.GetDiffURL(), repair)
+	if err != nil {
+		return err
+	}
+
+	if output == "json" {
+		data, err := json.MarshalIndent(report, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+		return nil
+	}
+	printReport(w, report)
+	return nil
+}
+
+func getReport(url string, repair bool) (*consistency.Report, error) {
+	method := http.MethodGet
+	if repair {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := status.GetAdminClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("making %s request(%s): %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response body(%s): %v", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var report consistency.Report
+	if err = json.Unmarshal(body, &report); err != nil {
+		return nil, fmt.Errorf("unmarshaling response body: %v", err)
+	}
+	return &report, nil
+}
+
+func printReport(w io.Writer, report *consistency.Report) {
+	if len(report.Diffs) == 0 {
+		fmt.Fprintln(w, "bpf maps are in sync with the cache")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MAP\tKIND\tKEY\tDETAIL")
+	for _, d := range report.Diffs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.Map, d.Kind, d.Key, d.Detail)
+	}
+	_ = tw.Flush()
+	if report.Repaired {
+		fmt.Fprintf(w, "repaired %d entries\n", len(report.Diffs))
+	}
+}
@@ -19,7 +19,6 @@ package dump
 import (
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 
 	"github.com/spf13/cobra"
@@ -51,7 +50,7 @@ func RunDump(cmd *cobra.Command, args []string) error {
 		os.Exit(1)
 	} else {
 		url := status.GetConfigDumpAddr(mode)
-		resp, err := http.Get(url)
+		resp, err := status.GetAdminClient().Get(url)
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
@@ -49,7 +49,7 @@ func NewCmd() *cobra.Command {
 }
 
 func GetJson(url string, val any) {
-	resp, err := http.Get(url)
+	resp, err := status.GetAdminClient().Get(url)
 	if err != nil {
 		fmt.Printf("Error making GET request(%s): %v\n", url, err)
 		return
@@ -125,8 +125,7 @@ func SetLoggerLevel(setFlag string) {
 		return
 	}
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := status.GetAdminClient().Do(req)
 	if err != nil {
 		fmt.Printf("Error making request: %v\n", err)
 		return
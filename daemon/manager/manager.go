@@ -27,14 +27,21 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
+	bpfcmd "kmesh.net/kmesh/daemon/manager/bpf"
+	"kmesh.net/kmesh/daemon/manager/bugreport"
+	"kmesh.net/kmesh/daemon/manager/certs"
+	"kmesh.net/kmesh/daemon/manager/describe"
+	"kmesh.net/kmesh/daemon/manager/diff"
 	"kmesh.net/kmesh/daemon/manager/dump"
 	logcmd "kmesh.net/kmesh/daemon/manager/log"
+	"kmesh.net/kmesh/daemon/manager/top"
 	"kmesh.net/kmesh/daemon/manager/uninstall"
 	"kmesh.net/kmesh/daemon/manager/version"
 	"kmesh.net/kmesh/daemon/options"
 	"kmesh.net/kmesh/pkg/bpf"
 	"kmesh.net/kmesh/pkg/cni"
 	"kmesh.net/kmesh/pkg/controller"
+	"kmesh.net/kmesh/pkg/health"
 	"kmesh.net/kmesh/pkg/logger"
 	"kmesh.net/kmesh/pkg/status"
 )
@@ -67,8 +74,14 @@ func NewCommand() *cobra.Command {
 
 	// add sub commands
 	cmd.AddCommand(version.NewCmd())
+	cmd.AddCommand(bpfcmd.NewCmd())
+	cmd.AddCommand(bugreport.NewCmd())
+	cmd.AddCommand(certs.NewCmd())
+	cmd.AddCommand(describe.NewCmd())
+	cmd.AddCommand(diff.NewCmd())
 	cmd.AddCommand(dump.NewCmd())
 	cmd.AddCommand(logcmd.NewCmd())
+	cmd.AddCommand(top.NewCmd())
 	cmd.AddCommand(uninstall.NewCmd())
 
 	return cmd
@@ -86,6 +99,7 @@ func Execute(configs *options.BootstrapConfigs) error {
 		return err
 	}
 	defer bpfLoader.Stop()
+	health.Register("bpf", health.Readiness|health.Liveness, bpfLoader.HealthCheck)
 	log.Info("bpf loader start successfully")
 
 	stopCh := make(chan struct{})
@@ -98,14 +112,18 @@ func Execute(configs *options.BootstrapConfigs) error {
 	log.Info("controller start successfully")
 	defer c.Stop()
 
-	statusServer := status.NewServer(c.GetXdsClient(), configs, bpfLoader.GetBpfLogLevel())
+	// register the cni check before serving the probes, so that the daemon
+	// is not reported ready before the cni plugin is installed
+	cniInstaller := cni.NewInstaller(configs.BpfConfig.Mode,
+		configs.CniConfig.CniMountNetEtcDIR, configs.CniConfig.CniConfigName, configs.CniConfig.CniConfigChained)
+	health.Register("cni", health.Readiness, cniInstaller.HealthCheck)
+
+	statusServer := status.NewServer(c.GetXdsClient(), configs, bpfLoader.GetBpfLogLevel(), c.GetSecretManager(), c.GetKmeshManageController())
 	statusServer.StartServer()
 	defer func() {
 		_ = statusServer.StopServer()
 	}()
 
-	cniInstaller := cni.NewInstaller(configs.BpfConfig.Mode,
-		configs.CniConfig.CniMountNetEtcDIR, configs.CniConfig.CniConfigName, configs.CniConfig.CniConfigChained)
 	if err := cniInstaller.Start(); err != nil {
 		return err
 	}
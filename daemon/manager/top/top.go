@@ -0,0 +1,185 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package top
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+	"kmesh.net/kmesh/pkg/status"
+)
+
+// clearScreen moves the cursor home and clears the terminal
+const clearScreen = "\033[H\033[2J"
+
+func NewCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "top",
+		Short: "Show the busiest connections and workload pairs on the node, refreshed live",
+		Example: `Watch the connections of the node:
+		kmesh-daemon top
+
+	  Refresh every 5 seconds and show 10 entries per table:
+		kmesh-daemon top --interval 5s --limit 10
+
+	  Print 3 frames without clearing the screen, e.g. to attach to an incident:
+		kmesh-daemon top -b -n 3
+
+	  Print the raw frames as json lines:
+		kmesh-daemon top -o json`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			interval, _ := cmd.Flags().GetDuration("interval")
+			limit, _ := cmd.Flags().GetInt("limit")
+			count, _ := cmd.Flags().GetInt("iterations")
+			batch, _ := cmd.Flags().GetBool("batch")
+			output, _ := cmd.Flags().GetString("output")
+			if err := RunTop(os.Stdout, interval, limit, count, batch, output); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().Duration("interval", 2*time.Second, "Refresh interval")
+	cmd.Flags().Int("limit", 20, "Maximum number of entries per table")
+	cmd.Flags().IntP("iterations", "n", 0, "Exit after this many frames, 0 runs until interrupted")
+	cmd.Flags().BoolP("batch", "b", false, "Do not clear the screen between frames")
+	cmd.Flags().StringP("output", "o", "text", "Output format, text or json")
+	return cmd
+}
+
+func RunTop(w io.Writer, interval time.Duration, limit, count int, batch bool, output string) error {
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unknown output format %q, must be text or json", output)
+	}
+	if limit < 0 || count < 0 {
+		return fmt.Errorf("limit and iterations must not be negative")
+	}
+
+	query := url.Values{}
+	query.Set("interval", interval.String())
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("count", strconv.Itoa(count))
+	streamURL := status.GetTopURL() + "?" + query.Encode()
+
+	resp, err := status.GetAdminClient().Get(streamURL)
+	if err != nil {
+		return fmt.Errorf("making GET request(%s): %v", streamURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("received status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if output == "json" {
+			fmt.Fprintln(w, scanner.Text())
+			continue
+		}
+		var snapshot telemetry.TopSnapshot
+		if err := json.Unmarshal(scanner.Bytes(), &snapshot); err != nil {
+			return fmt.Errorf("unmarshaling frame: %v", err)
+		}
+		if !batch {
+			fmt.Fprint(w, clearScreen)
+		}
+		printSnapshot(w, &snapshot)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading stream(%s): %v", streamURL, err)
+	}
+	return nil
+}
+
+func printSnapshot(w io.Writer, s *telemetry.TopSnapshot) {
+	fmt.Fprintf(w, "kmesh top - %s  open: %d  throughput: %s/s  denied: %d\n\n",
+		s.Time.Local().Format(time.TimeOnly), s.OpenConnections, formatBytes(s.BytesPerSecond), s.DeniedTotal)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "WORKLOAD PAIRS")
+	fmt.Fprintln(tw, "SOURCE\tDESTINATION\tACTIVE\tOPENED\tFAILED\tDENIED\tSENT\tRECEIVED\tRATE")
+	for _, p := range s.Pairs {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s/s\n", p.SourceWorkload, p.DestinationWorkload,
+			p.Active, p.Opened, p.Failed, p.Denied,
+			formatBytes(float64(p.SentBytes)), formatBytes(float64(p.ReceivedBytes)), formatBytes(p.BytesPerSecond))
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "OPEN CONNECTIONS")
+	fmt.Fprintln(tw, "SOURCE\tDESTINATION\tSOURCE WORKLOAD\tDESTINATION WORKLOAD\tDIRECTION\tAGE")
+	for _, c := range s.Connections {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", c.Source, c.Destination, orDash(c.SourceWorkload),
+			orDash(c.DestinationWorkload), c.Direction, s.Time.Sub(c.Opened).Truncate(time.Second))
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "RECENTLY CLOSED")
+	fmt.Fprintln(tw, "SOURCE\tDESTINATION\tSOURCE WORKLOAD\tDESTINATION WORKLOAD\tSENT\tRECEIVED\tRATE\tFLAGS")
+	for _, c := range s.Closed {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s/s\t%s\n", c.Source, c.Destination, orDash(c.SourceWorkload),
+			orDash(c.DestinationWorkload), formatBytes(float64(c.SentBytes)), formatBytes(float64(c.ReceivedBytes)),
+			formatBytes(c.BytesPerSecond), orDash(c.ResponseFlags))
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "RBAC DENIES")
+	fmt.Fprintln(tw, "TIME\tSOURCE\tDESTINATION\tSOURCE WORKLOAD\tDESTINATION WORKLOAD")
+	for _, c := range s.Denies {
+		var closed string
+		if c.Closed != nil {
+			closed = c.Closed.Local().Format(time.TimeOnly)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", orDash(closed), c.Source, c.Destination,
+			orDash(c.SourceWorkload), orDash(c.DestinationWorkload))
+	}
+	_ = tw.Flush()
+}
+
+func formatBytes(b float64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%.0fB", b)
+	}
+	div, exp := float64(unit), 0
+	for n := b / unit; n >= unit && exp < 4; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", b/div, "KMGTP"[exp])
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	AccesslogEncodingText = "text"
+	AccesslogEncodingJson = "json"
+
+	AccesslogSinkStdout = "stdout"
+	AccesslogSinkFile   = "file"
+	AccesslogSinkSyslog = "syslog"
+	AccesslogSinkUnix   = "unix"
+)
+
+type AccesslogConfig struct {
+	// ConfigFile is a yaml file with the same fields, it overrides the flags and is
+	// reloaded when changed
+	ConfigFile string `json:"-"`
+
+	// Format is an envoy style format string, e.g. "%START_TIME% %UPSTREAM_HOST%".
+	// Empty means the default kmesh format.
+	Format   string `json:"format,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Sink     string `json:"sink,omitempty"`
+
+	FilePath       string `json:"filePath,omitempty"`
+	FileMaxSize    int    `json:"fileMaxSize,omitempty"`
+	FileMaxBackups int    `json:"fileMaxBackups,omitempty"`
+	FileMaxAge     int    `json:"fileMaxAge,omitempty"`
+
+	SyslogNetwork string `json:"syslogNetwork,omitempty"`
+	SyslogAddress string `json:"syslogAddress,omitempty"`
+	SyslogTag     string `json:"syslogTag,omitempty"`
+
+	SocketPath string `json:"socketPath,omitempty"`
+
+	// QueueSize bounds the records waiting for the sink, it is not reloaded
+	QueueSize int `json:"-"`
+
+	Filter AccesslogFilter `json:"filter,omitempty"`
+}
+
+// AccesslogFilter drops the records not matching all of the non-empty fields
+type AccesslogFilter struct {
+	// Namespaces matches either the source or the destination namespace
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Workloads matches either the source or the destination workload
+	Workloads     []string        `json:"workloads,omitempty"`
+	ResponseFlags []string        `json:"responseFlags,omitempty"`
+	MinDuration   metav1.Duration `json:"minDuration,omitempty"`
+}
+
+func (c *AccesslogConfig) AttachFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&c.ConfigFile, "accesslog-config-file", "", "accesslog config file in yaml, overrides the accesslog flags and is reloaded on change")
+	cmd.PersistentFlags().StringVar(&c.Format, "accesslog-format", "", "envoy style accesslog format, e.g. \"%START_TIME% %DOWNSTREAM_REMOTE_ADDRESS% %UPSTREAM_HOST%\"")
+	cmd.PersistentFlags().StringVar(&c.Encoding, "accesslog-encoding", AccesslogEncodingText, "accesslog encoding, valid values are [text, json]")
+	cmd.PersistentFlags().StringVar(&c.Sink, "accesslog-sink", AccesslogSinkStdout, "accesslog sink, valid values are [stdout, file, syslog, unix]")
+	cmd.PersistentFlags().StringVar(&c.FilePath, "accesslog-file-path", "/var/log/kmesh/accesslog.log", "accesslog file path of the file sink")
+	cmd.PersistentFlags().IntVar(&c.FileMaxSize, "accesslog-file-max-size", 100, "max megabytes of an accesslog file before it is rotated")
+	cmd.PersistentFlags().IntVar(&c.FileMaxBackups, "accesslog-file-max-backups", 3, "max number of rotated accesslog files to retain")
+	cmd.PersistentFlags().IntVar(&c.FileMaxAge, "accesslog-file-max-age", 7, "max days to retain rotated accesslog files")
+	cmd.PersistentFlags().StringVar(&c.SyslogNetwork, "accesslog-syslog-network", "", "network of the syslog sink, empty for the local syslog")
+	cmd.PersistentFlags().StringVar(&c.SyslogAddress, "accesslog-syslog-address", "", "address of the syslog sink, empty for the local syslog")
+	cmd.PersistentFlags().StringVar(&c.SyslogTag, "accesslog-syslog-tag", "kmesh-accesslog", "tag of the syslog sink")
+	cmd.PersistentFlags().StringVar(&c.SocketPath, "accesslog-socket-path", "", "unix datagram socket path of the unix sink")
+	cmd.PersistentFlags().IntVar(&c.QueueSize, "accesslog-queue-size", 4096, "max records buffered for the accesslog sink, new records are dropped when full")
+	cmd.PersistentFlags().StringSliceVar(&c.Filter.Namespaces, "accesslog-filter-namespaces", nil, "only log connections from or to these namespaces")
+	cmd.PersistentFlags().StringSliceVar(&c.Filter.Workloads, "accesslog-filter-workloads", nil, "only log connections from or to these workloads")
+	cmd.PersistentFlags().StringSliceVar(&c.Filter.ResponseFlags, "accesslog-filter-response-flags", nil, "only log connections with any of these response flags")
+	cmd.PersistentFlags().DurationVar(&c.Filter.MinDuration.Duration, "accesslog-filter-min-duration", 0, "only log connections lasting at least this long")
+}
+
+func (c *AccesslogConfig) ParseConfig() error {
+	effective, err := c.Load()
+	if err != nil {
+		return err
+	}
+	return effective.Validate()
+}
+
+// Load returns the flag settings overridden by the config file, if any
+func (c *AccesslogConfig) Load() (*AccesslogConfig, error) {
+	effective := *c
+	effective.Filter.Namespaces = append([]string(nil), c.Filter.Namespaces...)
+	effective.Filter.Workloads = append([]string(nil), c.Filter.Workloads...)
+	effective.Filter.ResponseFlags = append([]string(nil), c.Filter.ResponseFlags...)
+	if c.ConfigFile == "" {
+		return &effective, nil
+	}
+
+	data, err := os.ReadFile(c.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("read accesslog config file failed, %s", err)
+	}
+	if err = yaml.UnmarshalStrict(data, &effective); err != nil {
+		return nil, fmt.Errorf("parse accesslog config file %s failed, %s", c.ConfigFile, err)
+	}
+	return &effective, nil
+}
+
+func (c *AccesslogConfig) Validate() error {
+	if c.Encoding != AccesslogEncodingText && c.Encoding != AccesslogEncodingJson {
+		return fmt.Errorf("invalid accesslog encoding %q, valid values are [text, json]", c.Encoding)
+	}
+
+	switch c.Sink {
+	case AccesslogSinkStdout, AccesslogSinkSyslog:
+	case AccesslogSinkFile:
+		if c.FilePath == "" {
+			return fmt.Errorf("accesslog file path is required by the file sink")
+		}
+	case AccesslogSinkUnix:
+		if c.SocketPath == "" {
+			return fmt.Errorf("accesslog socket path is required by the unix sink")
+		}
+	default:
+		return fmt.Errorf("invalid accesslog sink %q, valid values are [stdout, file, syslog, unix]", c.Sink)
+	}
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("accesslog queue size must be positive")
+	}
+	return nil
+}
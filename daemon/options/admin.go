@@ -0,0 +1,67 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// AdminTCPAccessProbes restricts the plain tcp listener to the probes and the help
+	AdminTCPAccessProbes = "probes"
+	// AdminTCPAccessRead also serves the read only debug endpoints on the plain tcp listener
+	AdminTCPAccessRead = "read"
+)
+
+// AdminConfig secures the status server. Mutating requests are only accepted on the unix
+// socket, whose peers must run as root or as the daemon user, or over mutual TLS.
+type AdminConfig struct {
+	TCPAccess    string
+	TLSCertFile  string
+	TLSKeyFile   string
+	ClientCAFile string
+}
+
+func (c *AdminConfig) AttachFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&c.TCPAccess, "admin-tcp-access", AdminTCPAccessProbes, "endpoints served on the plain tcp admin listener, valid values are [probes, read]; read exposes the debug endpoints to every process of the host network namespace")
+	cmd.PersistentFlags().StringVar(&c.TLSCertFile, "admin-tls-cert", "", "serve the tcp admin listener over mutual TLS with this certificate, which grants clients full access")
+	cmd.PersistentFlags().StringVar(&c.TLSKeyFile, "admin-tls-key", "", "private key of the admin TLS certificate")
+	cmd.PersistentFlags().StringVar(&c.ClientCAFile, "admin-tls-client-ca", "", "CA bundle verifying the client certificates of the admin TLS listener")
+}
+
+func (c *AdminConfig) ParseConfig() error {
+	if c.TCPAccess != AdminTCPAccessProbes && c.TCPAccess != AdminTCPAccessRead {
+		return fmt.Errorf("invalid admin tcp access %q, valid values are [probes, read]", c.TCPAccess)
+	}
+	set := 0
+	for _, file := range []string{c.TLSCertFile, c.TLSKeyFile, c.ClientCAFile} {
+		if file != "" {
+			set++
+		}
+	}
+	if set != 0 && set != 3 {
+		return fmt.Errorf("admin TLS requires a certificate, a key and a client CA")
+	}
+	return nil
+}
+
+// TLSEnabled reports whether the tcp admin listener serves mutual TLS
+func (c *AdminConfig) TLSEnabled() bool {
+	return c.TLSCertFile != ""
+}
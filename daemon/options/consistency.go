@@ -0,0 +1,40 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type ConsistencyConfig struct {
+	// CheckInterval is the interval of the periodic cache versus bpf map check, 0 disables it
+	CheckInterval time.Duration
+}
+
+func (c *ConsistencyConfig) AttachFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().DurationVar(&c.CheckInterval, "consistency-check-interval", 0, "interval to compare the userspace cache with the bpf maps, 0 disables the periodic check, which is the default")
+}
+
+func (c *ConsistencyConfig) ParseConfig() error {
+	if c.CheckInterval < 0 {
+		return fmt.Errorf("consistency check interval must not be negative")
+	}
+	return nil
+}
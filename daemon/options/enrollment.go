@@ -0,0 +1,46 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type EnrollmentConfig struct {
+	// ReconcileInterval is the interval of the pod enrollment drift repair, 0 disables it
+	ReconcileInterval time.Duration
+	// MaxRepairBackoff caps the delay before retrying a pod whose repair keeps failing
+	MaxRepairBackoff time.Duration
+}
+
+func (c *EnrollmentConfig) AttachFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().DurationVar(&c.ReconcileInterval, "enrollment-reconcile-interval", time.Minute, "interval to compare and repair the enrollment of the node pods, 0 disables the reconciler")
+	cmd.PersistentFlags().DurationVar(&c.MaxRepairBackoff, "enrollment-max-repair-backoff", 10*time.Minute, "maximum delay before retrying the repair of a pod that keeps failing")
+}
+
+func (c *EnrollmentConfig) ParseConfig() error {
+	if c.ReconcileInterval < 0 {
+		return fmt.Errorf("enrollment reconcile interval must not be negative")
+	}
+	if c.MaxRepairBackoff <= 0 {
+		return fmt.Errorf("enrollment max repair backoff must be positive")
+	}
+	return nil
+}
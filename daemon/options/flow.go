@@ -0,0 +1,84 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	FlowTransportUdp = "udp"
+	FlowTransportTcp = "tcp"
+
+	// ipfixMinMessageSize leaves room for the message, set and template headers
+	ipfixMinMessageSize = 512
+)
+
+type FlowConfig struct {
+	// CollectorAddress is the host:port of the IPFIX collector, the exporter is disabled if empty
+	CollectorAddress        string
+	Transport               string
+	SamplingRate            uint32
+	ExportInterval          time.Duration
+	TemplateRefreshInterval time.Duration
+	ObservationDomainID     uint32
+	EnterpriseNumber        uint32
+	MaxMessageSize          int
+	QueueSize               int
+}
+
+func (c *FlowConfig) AttachFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&c.CollectorAddress, "flow-collector-address", "", "IPFIX collector host:port, flow export is disabled if empty")
+	cmd.PersistentFlags().StringVar(&c.Transport, "flow-transport", FlowTransportUdp, "IPFIX transport, valid values are [udp, tcp]")
+	cmd.PersistentFlags().Uint32Var(&c.SamplingRate, "flow-sampling-rate", 1, "export one of every N flows, chosen by a hash of the 5-tuple")
+	cmd.PersistentFlags().DurationVar(&c.ExportInterval, "flow-export-interval", 5*time.Second, "interval over which the closed connections are aggregated into flows before export")
+	cmd.PersistentFlags().DurationVar(&c.TemplateRefreshInterval, "flow-template-refresh-interval", 10*time.Minute, "interval to resend the templates over udp")
+	cmd.PersistentFlags().Uint32Var(&c.ObservationDomainID, "flow-observation-domain-id", 0, "IPFIX observation domain id of this node")
+	// 32473 is the example enterprise number reserved for documentation by RFC 5612
+	cmd.PersistentFlags().Uint32Var(&c.EnterpriseNumber, "flow-enterprise-number", 32473, "private enterprise number of the kmesh workload identity elements")
+	cmd.PersistentFlags().IntVar(&c.MaxMessageSize, "flow-max-message-size", 1400, "max bytes of an IPFIX message")
+	cmd.PersistentFlags().IntVar(&c.QueueSize, "flow-queue-size", 4096, "max flows buffered for export, new flows are dropped when full")
+}
+
+func (c *FlowConfig) ParseConfig() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Transport != FlowTransportUdp && c.Transport != FlowTransportTcp {
+		return fmt.Errorf("invalid flow transport %q, valid values are [udp, tcp]", c.Transport)
+	}
+	if c.SamplingRate == 0 {
+		return fmt.Errorf("flow sampling rate must be at least 1")
+	}
+	if c.ExportInterval <= 0 || c.TemplateRefreshInterval <= 0 {
+		return fmt.Errorf("flow export and template refresh intervals must be positive")
+	}
+	if c.MaxMessageSize < ipfixMinMessageSize || c.MaxMessageSize > 65535 {
+		return fmt.Errorf("flow max message size must be within [%d, 65535]", ipfixMinMessageSize)
+	}
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("flow queue size must be positive")
+	}
+	return nil
+}
+
+func (c *FlowConfig) Enabled() bool {
+	return c.CollectorAddress != ""
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type MetricConfig struct {
+	SeriesIdleTTL time.Duration
+	MaxSeries     int
+	DropLabels    []string
+	// BpfMapInterval is the interval of the bpf map occupancy metrics, 0 (the default) disables them
+	BpfMapInterval time.Duration
+}
+
+func (c *MetricConfig) AttachFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().DurationVar(&c.SeriesIdleTTL, "metric-series-idle-ttl", time.Hour, "delete a metric series not updated for this long, 0 keeps series forever")
+	cmd.PersistentFlags().IntVar(&c.MaxSeries, "metric-max-series", 0, "max workload and service metric series on this node, further series are aggregated into an overflow series, 0 means no limit")
+	cmd.PersistentFlags().StringSliceVar(&c.DropLabels, "metric-drop-labels", nil, "metric labels to aggregate away, e.g. destination_pod_name,destination_pod_address")
+	cmd.PersistentFlags().DurationVar(&c.BpfMapInterval, "metric-bpf-map-interval", 0, "interval to count the entries of the pinned bpf maps for the occupancy metrics, e.g. 5m, 0 disables them. Counting walks every hash map key by key")
+}
+
+func (c *MetricConfig) ParseConfig() error {
+	if c.SeriesIdleTTL < 0 {
+		return fmt.Errorf("metric series idle ttl must not be negative")
+	}
+	if c.MaxSeries < 0 {
+		return fmt.Errorf("metric max series must not be negative")
+	}
+	if c.BpfMapInterval < 0 {
+		return fmt.Errorf("metric bpf map interval must not be negative")
+	}
+	return nil
+}
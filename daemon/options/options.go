@@ -29,6 +29,14 @@ type BootstrapConfigs struct {
 	CniConfig           *cniConfig
 	ByPassConfig        *byPassConfig
 	SecretManagerConfig *secretConfig
+	OtlpConfig          *OtlpConfig
+	AccesslogConfig     *AccesslogConfig
+	MetricConfig        *MetricConfig
+	FlowConfig          *FlowConfig
+	ProbeConfig         *ProbeConfig
+	ConsistencyConfig   *ConsistencyConfig
+	AdminConfig         *AdminConfig
+	EnrollmentConfig    *EnrollmentConfig
 }
 
 func NewBootstrapConfigs() *BootstrapConfigs {
@@ -37,6 +45,14 @@ func NewBootstrapConfigs() *BootstrapConfigs {
 		CniConfig:           &cniConfig{},
 		ByPassConfig:        &byPassConfig{},
 		SecretManagerConfig: &secretConfig{},
+		OtlpConfig:          &OtlpConfig{},
+		AccesslogConfig:     &AccesslogConfig{},
+		MetricConfig:        &MetricConfig{},
+		FlowConfig:          &FlowConfig{},
+		ProbeConfig:         &ProbeConfig{},
+		ConsistencyConfig:   &ConsistencyConfig{},
+		AdminConfig:         &AdminConfig{},
+		EnrollmentConfig:    &EnrollmentConfig{},
 	}
 }
 
@@ -54,6 +70,14 @@ func (c *BootstrapConfigs) AttachFlags(cmd *cobra.Command) {
 	c.CniConfig.AttachFlags(cmd)
 	c.ByPassConfig.AttachFlags(cmd)
 	c.SecretManagerConfig.AttachFlags(cmd)
+	c.OtlpConfig.AttachFlags(cmd)
+	c.AccesslogConfig.AttachFlags(cmd)
+	c.MetricConfig.AttachFlags(cmd)
+	c.FlowConfig.AttachFlags(cmd)
+	c.ProbeConfig.AttachFlags(cmd)
+	c.ConsistencyConfig.AttachFlags(cmd)
+	c.AdminConfig.AttachFlags(cmd)
+	c.EnrollmentConfig.AttachFlags(cmd)
 }
 
 func (c *BootstrapConfigs) ParseConfigs() error {
@@ -63,5 +87,32 @@ func (c *BootstrapConfigs) ParseConfigs() error {
 	if err := c.CniConfig.ParseConfig(); err != nil {
 		return fmt.Errorf("parse CniConfig failed, %s", err)
 	}
+	if err := c.SecretManagerConfig.ParseConfig(); err != nil {
+		return fmt.Errorf("parse SecretManagerConfig failed, %s", err)
+	}
+	if err := c.OtlpConfig.ParseConfig(); err != nil {
+		return fmt.Errorf("parse OtlpConfig failed, %s", err)
+	}
+	if err := c.AccesslogConfig.ParseConfig(); err != nil {
+		return fmt.Errorf("parse AccesslogConfig failed, %s", err)
+	}
+	if err := c.MetricConfig.ParseConfig(); err != nil {
+		return fmt.Errorf("parse MetricConfig failed, %s", err)
+	}
+	if err := c.FlowConfig.ParseConfig(); err != nil {
+		return fmt.Errorf("parse FlowConfig failed, %s", err)
+	}
+	if err := c.ProbeConfig.ParseConfig(); err != nil {
+		return fmt.Errorf("parse ProbeConfig failed, %s", err)
+	}
+	if err := c.ConsistencyConfig.ParseConfig(); err != nil {
+		return fmt.Errorf("parse ConsistencyConfig failed, %s", err)
+	}
+	if err := c.AdminConfig.ParseConfig(); err != nil {
+		return fmt.Errorf("parse AdminConfig failed, %s", err)
+	}
+	if err := c.EnrollmentConfig.ParseConfig(); err != nil {
+		return fmt.Errorf("parse EnrollmentConfig failed, %s", err)
+	}
 	return nil
 }
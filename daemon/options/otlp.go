@@ -0,0 +1,85 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	OtlpProtocolGrpc = "grpc"
+	OtlpProtocolHttp = "http"
+)
+
+type OtlpConfig struct {
+	// Endpoint is host:port of the collector for grpc, or its base url for http.
+	// The exporter is disabled if empty.
+	Endpoint           string
+	Protocol           string
+	Insecure           bool
+	ExportMetrics      bool
+	ExportAccesslog    bool
+	ExportInterval     time.Duration
+	Timeout            time.Duration
+	QueueSize          int
+	BatchSize          int
+	MaxRetries         int
+	ResourceAttributes map[string]string
+}
+
+func (c *OtlpConfig) AttachFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&c.Endpoint, "otlp-endpoint", "", "OTLP collector endpoint, host:port for grpc or url for http, disabled if empty")
+	cmd.PersistentFlags().StringVar(&c.Protocol, "otlp-protocol", OtlpProtocolGrpc, "OTLP protocol, valid values are [grpc, http]")
+	cmd.PersistentFlags().BoolVar(&c.Insecure, "otlp-insecure", false, "disable TLS when connecting to the OTLP collector")
+	cmd.PersistentFlags().BoolVar(&c.ExportMetrics, "otlp-export-metrics", true, "export metrics to the OTLP collector")
+	cmd.PersistentFlags().BoolVar(&c.ExportAccesslog, "otlp-export-accesslog", true, "export access logs to the OTLP collector")
+	cmd.PersistentFlags().DurationVar(&c.ExportInterval, "otlp-export-interval", 15*time.Second, "interval between two metric exports, also the max delay of an access log batch")
+	cmd.PersistentFlags().DurationVar(&c.Timeout, "otlp-timeout", 10*time.Second, "timeout of a single OTLP export request")
+	cmd.PersistentFlags().IntVar(&c.QueueSize, "otlp-queue-size", 2048, "max access log records buffered for export, new records are dropped when full")
+	cmd.PersistentFlags().IntVar(&c.BatchSize, "otlp-batch-size", 512, "max access log records in one export request")
+	cmd.PersistentFlags().IntVar(&c.MaxRetries, "otlp-max-retries", 5, "max retries of a failed export request")
+	cmd.PersistentFlags().StringToStringVar(&c.ResourceAttributes, "otlp-resource-attributes", nil, "extra OTLP resource attributes, e.g. k8s.cluster.name=c1,deployment.environment=prod")
+}
+
+func (c *OtlpConfig) ParseConfig() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.Protocol != OtlpProtocolGrpc && c.Protocol != OtlpProtocolHttp {
+		return fmt.Errorf("invalid otlp protocol %q, valid values are [grpc, http]", c.Protocol)
+	}
+	if c.ExportInterval <= 0 {
+		return fmt.Errorf("otlp export interval must be positive")
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("otlp timeout must be positive")
+	}
+	if c.QueueSize <= 0 || c.BatchSize <= 0 {
+		return fmt.Errorf("otlp queue size and batch size must be positive")
+	}
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("otlp max retries must not be negative")
+	}
+	return nil
+}
+
+func (c *OtlpConfig) Enabled() bool {
+	return c.Endpoint != ""
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// MaxProbeExcludePorts is the size of the port list of the bpf probe config
+const MaxProbeExcludePorts = 16
+
+type ProbeConfig struct {
+	SampleRate         uint32
+	ExcludePorts       []uint
+	ExcludeNamespaces  []string
+	ShortConnThreshold time.Duration
+	FlushInterval      time.Duration
+}
+
+func (c *ProbeConfig) AttachFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().Uint32Var(&c.SampleRate, "probe-sample-rate", 1, "report 1 of every N connections in full, the others only count in the metrics")
+	cmd.PersistentFlags().UintSliceVar(&c.ExcludePorts, "probe-exclude-ports", nil, "server ports of the connections not observed at all, e.g. health checks")
+	cmd.PersistentFlags().StringSliceVar(&c.ExcludeNamespaces, "probe-exclude-namespaces", nil, "namespaces of the workloads whose connections are not observed at all")
+	cmd.PersistentFlags().DurationVar(&c.ShortConnThreshold, "probe-short-conn-threshold", 0, "count the connections closed sooner in per pair counters instead of reporting them, 0 disables")
+	cmd.PersistentFlags().DurationVar(&c.FlushInterval, "probe-flush-interval", 5*time.Second, "interval to read the per pair counters and the probe stats")
+}
+
+func (c *ProbeConfig) ParseConfig() error {
+	if c.SampleRate == 0 {
+		return fmt.Errorf("probe sample rate must be at least 1")
+	}
+	if len(c.ExcludePorts) > MaxProbeExcludePorts {
+		return fmt.Errorf("at most %d probe exclude ports are supported", MaxProbeExcludePorts)
+	}
+	for _, port := range c.ExcludePorts {
+		if port == 0 || port > 65535 {
+			return fmt.Errorf("invalid probe exclude port %d", port)
+		}
+	}
+	if c.ShortConnThreshold < 0 {
+		return fmt.Errorf("probe short connection threshold must not be negative")
+	}
+	if c.FlushInterval <= 0 {
+		return fmt.Errorf("probe flush interval must be positive")
+	}
+	return nil
+}
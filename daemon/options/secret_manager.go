@@ -16,13 +16,68 @@
 package options
 
 import (
+	"fmt"
+
 	"github.com/spf13/cobra"
+
+	"kmesh.net/kmesh/pkg/constants"
 )
 
 type secretConfig struct {
 	Enable bool
+	// StoreDir keeps the issued certificates across restarts, disabled if empty
+	StoreDir string
+	// StoreKeyFile holds the key encrypting the store, it is created if missing
+	StoreKeyFile string
+
+	// CaProvider is the CA signing the workload certs
+	CaProvider string
+	// CaClusterID is sent to istiod along the CSRs
+	CaClusterID string
+	// CaCertDir holds the CA bundle of the file provider
+	CaCertDir string
+	// SpireSocket is the Workload API address of the SPIRE agent
+	SpireSocket string
+	// TrustDomain of the self-signed CA
+	TrustDomain string
+
+	// SdsSocket serves the certs to the local consumers over SDS, disabled if empty
+	SdsSocket string
+	// SdsAllow are the identities each peer uid may get from SDS, in the form of uid=identity
+	// or uid=@pod for the identity of the peer pod
+	SdsAllow []string
 }
 
 func (c *secretConfig) AttachFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().BoolVar(&c.Enable, "enable-secret-manager", false, "whether to start secret manager or not, default to false")
+	cmd.PersistentFlags().StringVar(&c.StoreDir, "secret-store-dir", "", "directory to persist the workload certificates encrypted across restarts, disabled if empty")
+	cmd.PersistentFlags().StringVar(&c.StoreKeyFile, "secret-store-key-file", "", "file of the 32 bytes key encrypting the secret store, created if missing, keep it out of the store directory")
+	cmd.PersistentFlags().StringVar(&c.CaProvider, "ca-provider", constants.CaProviderIstiod, "CA signing the workload certificates: istiod, file, spire or self-signed")
+	cmd.PersistentFlags().StringVar(&c.CaClusterID, "ca-cluster-id", "Kubernetes", "cluster ID sent to istiod when requesting certificates, needed by multicluster meshes")
+	cmd.PersistentFlags().StringVar(&c.CaCertDir, "ca-cert-dir", "", "directory of ca-cert.pem, ca-key.pem, root-cert.pem and an optional cert-chain.pem, used by the file CA provider")
+	cmd.PersistentFlags().StringVar(&c.SpireSocket, "spire-agent-socket", "unix:///run/spire/sockets/agent.sock", "Workload API address of the SPIRE agent, used by the spire CA provider")
+	cmd.PersistentFlags().StringVar(&c.TrustDomain, "ca-trust-domain", constants.TrustDomain, "trust domain of the self-signed CA provider")
+	cmd.PersistentFlags().StringVar(&c.SdsSocket, "sds-socket", "", "unix socket to serve the workload certificates over Envoy SDS to local consumers, disabled if empty")
+	cmd.PersistentFlags().StringSliceVar(&c.SdsAllow, "sds-allow", nil, "identities a peer uid may get from SDS in the form of uid=identity, the identity may end with * to match a prefix, "+
+		"or be @pod for the identity of the pod the peer runs in. The other identities are granted to every process of the uid, "+
+		"so use @pod for the proxies, which usually all run as uid 1337")
+}
+
+func (c *secretConfig) ParseConfig() error {
+	if c.StoreDir != "" && c.StoreKeyFile == "" {
+		return fmt.Errorf("secret store key file is required by the secret store")
+	}
+	if c.SdsSocket != "" && !c.Enable {
+		return fmt.Errorf("sds server requires the secret manager enabled")
+	}
+	switch c.CaProvider {
+	case constants.CaProviderIstiod, constants.CaProviderSpire, constants.CaProviderSelfSigned:
+	case constants.CaProviderFile:
+		if c.CaCertDir == "" {
+			return fmt.Errorf("ca cert dir is required by the file CA provider")
+		}
+	default:
+		return fmt.Errorf("unknown CA provider %q", c.CaProvider)
+	}
+	return nil
 }
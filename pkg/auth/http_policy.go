@@ -0,0 +1,611 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	config_rbac_v3 "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v3"
+	config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	envoy_type_matcher_v3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+// HTTPAuthMapName is the name map_of_http_auth is pinned as in ADS mode
+const HTTPAuthMapName = "kmesh_http_auth"
+
+// The following constants and types mirror bpf/kmesh/ads/include/http_auth.h
+const (
+	HTTP_AUTH_MAX_POLICIES = 8
+	HTTP_AUTH_MAX_CONDS    = 16
+	HTTP_AUTH_NAME_LEN     = 32
+	HTTP_AUTH_VALUE_LEN    = 64
+)
+
+const (
+	httpAuthActionAllow uint32 = iota
+	httpAuthActionDeny
+)
+
+const (
+	httpAuthFieldAny uint8 = iota
+	httpAuthFieldPath
+	httpAuthFieldMethod
+	httpAuthFieldHost
+	httpAuthFieldHeader
+	httpAuthFieldDstPort
+)
+
+const (
+	httpAuthMatchExact uint8 = iota
+	httpAuthMatchPrefix
+	httpAuthMatchSuffix
+	httpAuthMatchPresence
+)
+
+// A condition closes its group, match, clause or rule if the next condition belongs
+// to another one. Closing a level closes all the levels below it.
+const (
+	httpAuthEndNone uint8 = iota
+	httpAuthEndGroup
+	httpAuthEndMatch
+	httpAuthEndClause
+	httpAuthEndRule
+)
+
+type httpAuthCond struct {
+	Rule      uint16
+	Clause    uint16
+	Match     uint16
+	Group     uint16
+	Field     uint8
+	MatchType uint8
+	Negate    uint8
+	End       uint8
+	// Port is in network order, the same as the listener address in ADS mode
+	Port  uint32
+	Name  [HTTP_AUTH_NAME_LEN]byte
+	Value [HTTP_AUTH_VALUE_LEN]byte
+}
+
+type httpAuthPolicy struct {
+	Action uint32
+	NConds uint32
+	// Ipv4 and Port are the address of the listener the policy belongs to, in the
+	// byte order of the listener map. Ipv4 is 0 for a wildcard listener.
+	Ipv4  uint32
+	Port  uint32
+	Conds [HTTP_AUTH_MAX_CONDS]httpAuthCond
+}
+
+// HTTPRBAC is an envoy RBAC http filter of the http connection manager of an ADS listener
+type HTTPRBAC struct {
+	// Name identifies the filter among the filters of all the listeners
+	Name string
+	// Ipv4 and Port are the listener address as stored in the listener map
+	Ipv4 uint32
+	Port uint32
+	// Rules is nil if the filter only has shadow rules
+	Rules *config_rbac_v3.RBAC
+}
+
+// compileHTTPRBAC flattens the rules of an RBAC http filter into the condition list
+// evaluated by http_auth_check, it returns nil if the filter never denies a request.
+// istiod compiles the AuthorizationPolicies that select the proxy into these filters, all
+// the policies of an action share a filter and any of them matching is enough, so an
+// ALLOW policy without HTTP attributes still allows what it matches.
+//
+// Principals, ip blocks, metadata and the matchers bpf cannot evaluate where the request
+// is parsed are handled like ztunnel handles HTTP attributes at L4: the rule of an ALLOW
+// filter needing them never matches, while a DENY filter ignores them so that the deny
+// gets broader, never narrower. Values are compared byte for byte, hosts included.
+func compileHTTPRBAC(filter *HTTPRBAC) (*httpAuthPolicy, error) {
+	if filter.Rules == nil {
+		return nil, nil
+	}
+	out := &httpAuthPolicy{Ipv4: filter.Ipv4, Port: filter.Port}
+	switch filter.Rules.GetAction() {
+	case config_rbac_v3.RBAC_ALLOW:
+		out.Action = httpAuthActionAllow
+	case config_rbac_v3.RBAC_DENY:
+		out.Action = httpAuthActionDeny
+	default:
+		// LOG only records the requests
+		return nil, nil
+	}
+	// a condition bpf cannot evaluate takes the value that keeps the filter safe
+	unknown := out.Action == httpAuthActionDeny
+
+	policies := filter.Rules.GetPolicies()
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var conds []httpAuthCond
+	ruleIdx := 0
+	for _, name := range names {
+		ruleConds, ok, err := compileHTTPRule(policies[name], unknown)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %v", name, err)
+		}
+		if !ok {
+			continue
+		}
+		for i := range ruleConds {
+			ruleConds[i].Rule = uint16(ruleIdx)
+		}
+		conds = append(conds, ruleConds...)
+		ruleIdx++
+	}
+
+	if len(conds) == 0 {
+		if out.Action == httpAuthActionDeny {
+			return nil, nil
+		}
+		// An ALLOW filter without any usable rule denies every request, like envoy
+		// does, so keep it in the map with a condition that never hits.
+		conds = append(conds, httpAuthCond{Field: httpAuthFieldAny, Negate: 1})
+	}
+	if len(conds) > HTTP_AUTH_MAX_CONDS {
+		return nil, fmt.Errorf("%d conditions are needed, more than the supported %d", len(conds), HTTP_AUTH_MAX_CONDS)
+	}
+	setHTTPCondEnds(conds)
+	out.NConds = uint32(len(conds))
+	copy(out.Conds[:], conds)
+	return out, nil
+}
+
+// setHTTPCondEnds marks the last condition of every group, match, clause and rule,
+// so that bpf does not need to compare neighbouring conditions
+func setHTTPCondEnds(conds []httpAuthCond) {
+	for i := range conds {
+		cur := &conds[i]
+		if i == len(conds)-1 {
+			cur.End = httpAuthEndRule
+			continue
+		}
+		next := &conds[i+1]
+		switch {
+		case next.Rule != cur.Rule:
+			cur.End = httpAuthEndRule
+		case next.Clause != cur.Clause:
+			cur.End = httpAuthEndClause
+		case next.Match != cur.Match:
+			cur.End = httpAuthEndMatch
+		case next.Group != cur.Group:
+			cur.End = httpAuthEndGroup
+		default:
+			cur.End = httpAuthEndNone
+		}
+	}
+}
+
+// compileHTTPRule compiles an RBAC policy into a rule of two clauses, the permissions
+// and the principals, ok is false if the rule can never match
+func compileHTTPRule(policy *config_rbac_v3.Policy, unknown bool) ([]httpAuthCond, bool, error) {
+	if (policy.GetCondition() != nil || policy.GetCheckedCondition() != nil) && !unknown {
+		// CEL conditions are not evaluated
+		return nil, false, nil
+	}
+
+	var permissions, principals []*rbacNode
+	for _, permission := range policy.GetPermissions() {
+		permissions = append(permissions, permissionNode(permission))
+	}
+	for _, principal := range policy.GetPrincipals() {
+		principals = append(principals, principalNode(principal))
+	}
+
+	var conds []httpAuthCond
+	for clauseIdx, nodes := range [][]*rbacNode{permissions, principals} {
+		var clauseConds []httpAuthCond
+		matchIdx := 0
+		for _, node := range nodes {
+			matchConds, ok, err := compileHTTPMatch(node, unknown)
+			if err != nil {
+				return nil, false, err
+			}
+			if !ok {
+				continue
+			}
+			for i := range matchConds {
+				matchConds[i].Clause = uint16(clauseIdx)
+				matchConds[i].Match = uint16(matchIdx)
+			}
+			clauseConds = append(clauseConds, matchConds...)
+			matchIdx++
+		}
+		if len(clauseConds) == 0 {
+			// none of the permissions or principals can hit
+			return nil, false, nil
+		}
+		conds = append(conds, clauseConds...)
+	}
+	return conds, true, nil
+}
+
+type rbacOp int
+
+const (
+	rbacAnd rbacOp = iota
+	rbacOr
+	rbacNot
+	rbacAny
+	rbacLeaf
+	rbacUnknown
+)
+
+// rbacNode is a permission or a principal reduced to what bpf can evaluate
+type rbacNode struct {
+	op       rbacOp
+	children []*rbacNode
+	// leaf compiles the condition of a leaf, ok is false if bpf cannot evaluate it.
+	// unknown is the value the condition should take when bpf is not sure.
+	leaf func(unknown bool) (cond httpAuthCond, ok bool, err error)
+}
+
+func permissionNode(permission *config_rbac_v3.Permission) *rbacNode {
+	switch rule := permission.GetRule().(type) {
+	case *config_rbac_v3.Permission_AndRules:
+		node := &rbacNode{op: rbacAnd}
+		for _, child := range rule.AndRules.GetRules() {
+			node.children = append(node.children, permissionNode(child))
+		}
+		return node
+	case *config_rbac_v3.Permission_OrRules:
+		node := &rbacNode{op: rbacOr}
+		for _, child := range rule.OrRules.GetRules() {
+			node.children = append(node.children, permissionNode(child))
+		}
+		return node
+	case *config_rbac_v3.Permission_NotRule:
+		return &rbacNode{op: rbacNot, children: []*rbacNode{permissionNode(rule.NotRule)}}
+	case *config_rbac_v3.Permission_Any:
+		return &rbacNode{op: rbacAny}
+	case *config_rbac_v3.Permission_Header:
+		return headerNode(rule.Header)
+	case *config_rbac_v3.Permission_UrlPath:
+		return urlPathNode(rule.UrlPath)
+	case *config_rbac_v3.Permission_DestinationPort:
+		return &rbacNode{op: rbacLeaf, leaf: func(bool) (httpAuthCond, bool, error) {
+			return httpAuthCond{Field: httpAuthFieldDstPort, Port: nets.ConvertPortToBigEndian(rule.DestinationPort)}, true, nil
+		}}
+	default:
+		return &rbacNode{op: rbacUnknown}
+	}
+}
+
+func principalNode(principal *config_rbac_v3.Principal) *rbacNode {
+	switch id := principal.GetIdentifier().(type) {
+	case *config_rbac_v3.Principal_AndIds:
+		node := &rbacNode{op: rbacAnd}
+		for _, child := range id.AndIds.GetIds() {
+			node.children = append(node.children, principalNode(child))
+		}
+		return node
+	case *config_rbac_v3.Principal_OrIds:
+		node := &rbacNode{op: rbacOr}
+		for _, child := range id.OrIds.GetIds() {
+			node.children = append(node.children, principalNode(child))
+		}
+		return node
+	case *config_rbac_v3.Principal_NotId:
+		return &rbacNode{op: rbacNot, children: []*rbacNode{principalNode(id.NotId)}}
+	case *config_rbac_v3.Principal_Any:
+		return &rbacNode{op: rbacAny}
+	case *config_rbac_v3.Principal_Header:
+		return headerNode(id.Header)
+	case *config_rbac_v3.Principal_UrlPath:
+		return urlPathNode(id.UrlPath)
+	default:
+		// the peer identity and addresses are not known where the request is parsed
+		return &rbacNode{op: rbacUnknown}
+	}
+}
+
+func headerNode(header *config_route_v3.HeaderMatcher) *rbacNode {
+	return &rbacNode{op: rbacLeaf, leaf: func(unknown bool) (httpAuthCond, bool, error) {
+		var cond httpAuthCond
+		name := header.GetName()
+		switch strings.ToLower(name) {
+		case ":method":
+			cond.Field, name = httpAuthFieldMethod, ""
+		case ":authority", "host":
+			cond.Field, name = httpAuthFieldHost, ""
+		case ":path":
+			// the pseudo header has the query, the same as the uri parsed by bpf
+			cond.Field, name = httpAuthFieldPath, ""
+		default:
+			if strings.HasPrefix(name, ":") {
+				return cond, false, nil
+			}
+			cond.Field = httpAuthFieldHeader
+		}
+		if header.GetInvertMatch() {
+			return cond, false, nil
+		}
+
+		var (
+			value string
+			ok    = true
+		)
+		switch m := header.GetHeaderMatchSpecifier().(type) {
+		case *config_route_v3.HeaderMatcher_StringMatch:
+			cond.MatchType, value, ok = stringMatch(m.StringMatch, unknown)
+		case *config_route_v3.HeaderMatcher_ExactMatch:
+			cond.MatchType, value = httpAuthMatchExact, m.ExactMatch
+		case *config_route_v3.HeaderMatcher_PrefixMatch:
+			cond.MatchType, value = httpAuthMatchPrefix, m.PrefixMatch
+		case *config_route_v3.HeaderMatcher_SuffixMatch:
+			cond.MatchType, value = httpAuthMatchSuffix, m.SuffixMatch
+		case *config_route_v3.HeaderMatcher_PresentMatch:
+			cond.MatchType, ok = httpAuthMatchPresence, m.PresentMatch
+		default:
+			ok = false
+		}
+		if !ok {
+			return cond, false, nil
+		}
+		return setHTTPCondValue(cond, name, value)
+	}}
+}
+
+// urlPathNode matches the path without its query like envoy does, while bpf compares
+// the whole uri. A query appended to the path could make an exact or a suffix match miss,
+// so unless missing is the safe outcome they are widened to a prefix or not evaluated.
+func urlPathNode(path *envoy_type_matcher_v3.PathMatcher) *rbacNode {
+	return &rbacNode{op: rbacLeaf, leaf: func(unknown bool) (httpAuthCond, bool, error) {
+		cond := httpAuthCond{Field: httpAuthFieldPath}
+		matchType, value, ok := stringMatch(path.GetPath(), unknown)
+		if !ok {
+			return cond, false, nil
+		}
+		switch {
+		case matchType == httpAuthMatchExact && unknown:
+			matchType = httpAuthMatchPrefix
+		case matchType == httpAuthMatchSuffix && unknown:
+			return cond, false, nil
+		}
+		cond.MatchType = matchType
+		return setHTTPCondValue(cond, "", value)
+	}}
+}
+
+// stringMatch converts the string matchers bpf can evaluate, ok is false for the others.
+// bpf compares case sensitively, so a case insensitive matcher is lowercased when
+// missing a request that is not in lowercase is the safe outcome.
+func stringMatch(sm *envoy_type_matcher_v3.StringMatcher, unknown bool) (matchType uint8, value string, ok bool) {
+	if sm == nil || (sm.GetIgnoreCase() && unknown) {
+		return 0, "", false
+	}
+	switch m := sm.GetMatchPattern().(type) {
+	case *envoy_type_matcher_v3.StringMatcher_Exact:
+		matchType, value = httpAuthMatchExact, m.Exact
+	case *envoy_type_matcher_v3.StringMatcher_Prefix:
+		matchType, value = httpAuthMatchPrefix, m.Prefix
+	case *envoy_type_matcher_v3.StringMatcher_Suffix:
+		matchType, value = httpAuthMatchSuffix, m.Suffix
+	default:
+		return 0, "", false
+	}
+	// istio "*" is converted into an empty prefix or suffix, which means presence
+	if value == "" && matchType != httpAuthMatchExact {
+		return httpAuthMatchPresence, "", true
+	}
+	if sm.GetIgnoreCase() {
+		value = strings.ToLower(value)
+	}
+	return matchType, value, true
+}
+
+func setHTTPCondValue(cond httpAuthCond, name, value string) (httpAuthCond, bool, error) {
+	if len(name) >= HTTP_AUTH_NAME_LEN {
+		return cond, false, fmt.Errorf("header name %q exceeds %d bytes", name, HTTP_AUTH_NAME_LEN-1)
+	}
+	if len(value) >= HTTP_AUTH_VALUE_LEN {
+		return cond, false, fmt.Errorf("match value %q exceeds %d bytes", value, HTTP_AUTH_VALUE_LEN-1)
+	}
+	copy(cond.Name[:], name)
+	copy(cond.Value[:], value)
+	return cond, true, nil
+}
+
+// compileHTTPMatch compiles a permission or a principal into AND-ed groups,
+// ok is false if it can never hit
+func compileHTTPMatch(node *rbacNode, unknown bool) ([]httpAuthCond, bool, error) {
+	parts := []*rbacNode{node}
+	if node.op == rbacAnd {
+		parts = node.children
+	}
+
+	var (
+		conds []httpAuthCond
+		group uint16
+	)
+	for _, part := range parts {
+		groupConds, decided, value, err := compileHTTPGroup(part, unknown)
+		if err != nil {
+			return nil, false, err
+		}
+		if decided {
+			if !value {
+				return nil, false, nil
+			}
+			continue
+		}
+		for i := range groupConds {
+			groupConds[i].Group = group
+		}
+		conds = append(conds, groupConds...)
+		group++
+	}
+	if len(conds) == 0 {
+		// Nothing left to check, the match hits every request
+		conds = []httpAuthCond{{Field: httpAuthFieldAny}}
+	}
+	return conds, true, nil
+}
+
+// compileHTTPGroup compiles a set of OR-ed leaves, or the negation of one, into a group.
+// decided is set when the value of the group does not depend on the request.
+func compileHTTPGroup(node *rbacNode, unknown bool) (conds []httpAuthCond, decided, value bool, err error) {
+	negate := node.op == rbacNot
+	if negate {
+		node = node.children[0]
+		// a negated condition has to take the opposite value to stay safe
+		unknown = !unknown
+	}
+	leaves := []*rbacNode{node}
+	if node.op == rbacOr {
+		leaves = node.children
+	}
+
+	hit := false
+	for _, leaf := range leaves {
+		switch leaf.op {
+		case rbacAny:
+			hit = true
+		case rbacLeaf:
+			cond, ok, err := leaf.leaf(unknown)
+			if err != nil {
+				return nil, false, false, err
+			}
+			if ok {
+				if negate {
+					cond.Negate = 1
+				}
+				conds = append(conds, cond)
+				continue
+			}
+			hit = unknown
+		default:
+			// nested sets and attributes bpf cannot see
+			hit = unknown
+		}
+		if hit {
+			// one leaf hitting is enough for the OR-ed leaves
+			return nil, true, !negate, nil
+		}
+	}
+	if len(conds) == 0 {
+		// none of the leaves can hit
+		return nil, true, negate, nil
+	}
+	return conds, false, false, nil
+}
+
+// HTTPPolicyMap keeps the compiled RBAC http filters of the ADS listeners in map_of_http_auth
+type HTTPPolicyMap struct {
+	bpfMap *ebpf.Map
+	// slots maps a filter name to its index in map_of_http_auth
+	slots map[string]uint32
+	// written is the policy stored in every slot, unchanged filters are not written again
+	written map[string]httpAuthPolicy
+	free    []uint32
+	mutex   sync.Mutex
+}
+
+func NewHTTPPolicyMap(m *ebpf.Map) *HTTPPolicyMap {
+	hm := &HTTPPolicyMap{
+		bpfMap:  m,
+		slots:   make(map[string]uint32),
+		written: make(map[string]httpAuthPolicy),
+	}
+	for i := HTTP_AUTH_MAX_POLICIES - 1; i >= 0; i-- {
+		hm.free = append(hm.free, uint32(i))
+	}
+	return hm
+}
+
+// Sync writes the RBAC http filters of the current listeners and clears the filters that
+// are gone. A filter that cannot be compiled or stored is reported, the others are written.
+func (hm *HTTPPolicyMap) Sync(filters []HTTPRBAC) error {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+
+	current := make(map[string]struct{}, len(filters))
+	for _, filter := range filters {
+		current[filter.Name] = struct{}{}
+	}
+	var errs []error
+	for name := range hm.slots {
+		if _, ok := current[name]; !ok {
+			errs = append(errs, hm.remove(name))
+		}
+	}
+
+	for i := range filters {
+		filter := &filters[i]
+		policy, err := compileHTTPRBAC(filter)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("compile http rbac filter %s failed: %v", filter.Name, err))
+		}
+		if policy == nil {
+			errs = append(errs, hm.remove(filter.Name))
+			continue
+		}
+		errs = append(errs, hm.store(filter.Name, policy))
+	}
+	return errors.Join(errs...)
+}
+
+func (hm *HTTPPolicyMap) store(name string, policy *httpAuthPolicy) error {
+	slot, ok := hm.slots[name]
+	if ok && hm.written[name] == *policy {
+		return nil
+	}
+	if !ok {
+		if len(hm.free) == 0 {
+			return fmt.Errorf("no free slot for http rbac filter %s, at most %d filters are supported",
+				name, HTTP_AUTH_MAX_POLICIES)
+		}
+		slot = hm.free[len(hm.free)-1]
+		hm.free = hm.free[:len(hm.free)-1]
+	}
+	if err := hm.bpfMap.Update(&slot, policy, ebpf.UpdateAny); err != nil {
+		if !ok {
+			hm.free = append(hm.free, slot)
+		}
+		return fmt.Errorf("update http rbac filter %s failed: %v", name, err)
+	}
+	hm.slots[name] = slot
+	hm.written[name] = *policy
+	return nil
+}
+
+func (hm *HTTPPolicyMap) remove(name string) error {
+	slot, ok := hm.slots[name]
+	if !ok {
+		return nil
+	}
+	// array map entries can not be deleted, an empty entry is skipped by bpf
+	if err := hm.bpfMap.Update(&slot, &httpAuthPolicy{}, ebpf.UpdateAny); err != nil {
+		return fmt.Errorf("clear http rbac filter %s failed: %v", name, err)
+	}
+	delete(hm.slots, name)
+	delete(hm.written, name)
+	hm.free = append(hm.free, slot)
+	return nil
+}
@@ -0,0 +1,496 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	config_rbac_v3 "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v3"
+	config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	envoy_type_matcher_v3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+var (
+	listenerIp   = nets.ConvertIpToUint32("10.0.0.1")
+	listenerPort = nets.ConvertPortToBigEndian(8080)
+)
+
+func exact(v string) *envoy_type_matcher_v3.StringMatcher {
+	return &envoy_type_matcher_v3.StringMatcher{MatchPattern: &envoy_type_matcher_v3.StringMatcher_Exact{Exact: v}}
+}
+
+func prefix(v string) *envoy_type_matcher_v3.StringMatcher {
+	return &envoy_type_matcher_v3.StringMatcher{MatchPattern: &envoy_type_matcher_v3.StringMatcher_Prefix{Prefix: v}}
+}
+
+func suffix(v string) *envoy_type_matcher_v3.StringMatcher {
+	return &envoy_type_matcher_v3.StringMatcher{MatchPattern: &envoy_type_matcher_v3.StringMatcher_Suffix{Suffix: v}}
+}
+
+func headerPermission(name string, sm *envoy_type_matcher_v3.StringMatcher) *config_rbac_v3.Permission {
+	return &config_rbac_v3.Permission{Rule: &config_rbac_v3.Permission_Header{Header: &config_route_v3.HeaderMatcher{
+		Name:                 name,
+		HeaderMatchSpecifier: &config_route_v3.HeaderMatcher_StringMatch{StringMatch: sm},
+	}}}
+}
+
+func pathPermission(sm *envoy_type_matcher_v3.StringMatcher) *config_rbac_v3.Permission {
+	return &config_rbac_v3.Permission{Rule: &config_rbac_v3.Permission_UrlPath{
+		UrlPath: &envoy_type_matcher_v3.PathMatcher{Rule: &envoy_type_matcher_v3.PathMatcher_Path{Path: sm}},
+	}}
+}
+
+func portPermission(port uint32) *config_rbac_v3.Permission {
+	return &config_rbac_v3.Permission{Rule: &config_rbac_v3.Permission_DestinationPort{DestinationPort: port}}
+}
+
+func orPermissions(rules ...*config_rbac_v3.Permission) *config_rbac_v3.Permission {
+	return &config_rbac_v3.Permission{Rule: &config_rbac_v3.Permission_OrRules{OrRules: &config_rbac_v3.Permission_Set{Rules: rules}}}
+}
+
+func andPermissions(rules ...*config_rbac_v3.Permission) *config_rbac_v3.Permission {
+	return &config_rbac_v3.Permission{Rule: &config_rbac_v3.Permission_AndRules{AndRules: &config_rbac_v3.Permission_Set{Rules: rules}}}
+}
+
+func notPermission(rule *config_rbac_v3.Permission) *config_rbac_v3.Permission {
+	return &config_rbac_v3.Permission{Rule: &config_rbac_v3.Permission_NotRule{NotRule: rule}}
+}
+
+// anyPrincipal is what istiod generates for a rule without from
+func anyPrincipal() *config_rbac_v3.Principal {
+	return &config_rbac_v3.Principal{Identifier: &config_rbac_v3.Principal_AndIds{AndIds: &config_rbac_v3.Principal_Set{
+		Ids: []*config_rbac_v3.Principal{{Identifier: &config_rbac_v3.Principal_Any{Any: true}}},
+	}}}
+}
+
+func namespacePrincipal(ns string) *config_rbac_v3.Principal {
+	return &config_rbac_v3.Principal{Identifier: &config_rbac_v3.Principal_AndIds{AndIds: &config_rbac_v3.Principal_Set{
+		Ids: []*config_rbac_v3.Principal{{Identifier: &config_rbac_v3.Principal_OrIds{OrIds: &config_rbac_v3.Principal_Set{
+			Ids: []*config_rbac_v3.Principal{{Identifier: &config_rbac_v3.Principal_Authenticated_{
+				Authenticated: &config_rbac_v3.Principal_Authenticated{
+					PrincipalName: &envoy_type_matcher_v3.StringMatcher{
+						MatchPattern: &envoy_type_matcher_v3.StringMatcher_SafeRegex{
+							SafeRegex: &envoy_type_matcher_v3.RegexMatcher{Regex: ".*/ns/" + ns + "/.*"},
+						},
+					},
+				},
+			}}},
+		}}}},
+	}}}
+}
+
+func rbacPolicy(permissions ...*config_rbac_v3.Permission) *config_rbac_v3.Policy {
+	return &config_rbac_v3.Policy{Permissions: permissions, Principals: []*config_rbac_v3.Principal{anyPrincipal()}}
+}
+
+func rbacFilter(name string, action config_rbac_v3.RBAC_Action, policies map[string]*config_rbac_v3.Policy) HTTPRBAC {
+	return HTTPRBAC{
+		Name:  name,
+		Ipv4:  listenerIp,
+		Port:  listenerPort,
+		Rules: &config_rbac_v3.RBAC{Action: action, Policies: policies},
+	}
+}
+
+func compileFilters(t *testing.T, filters ...HTTPRBAC) []*httpAuthPolicy {
+	var out []*httpAuthPolicy
+	for i := range filters {
+		policy, err := compileHTTPRBAC(&filters[i])
+		require.NoError(t, err)
+		if policy != nil {
+			out = append(out, policy)
+		}
+	}
+	return out
+}
+
+type httpRequest struct {
+	method, uri, host string
+	headers           map[string]string
+	ipv4, port        uint32
+}
+
+func newRequest(method, uri string) *httpRequest {
+	return &httpRequest{method: method, uri: uri, host: "example.com", ipv4: listenerIp, port: listenerPort}
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
+
+// valueMatch mirrors http_auth_value_match
+func valueMatch(cond *httpAuthCond, value string, present bool) bool {
+	if cond.MatchType == httpAuthMatchPresence {
+		return present
+	}
+	if !present {
+		return false
+	}
+	want := cString(cond.Value[:])
+	switch cond.MatchType {
+	case httpAuthMatchExact:
+		return value == want
+	case httpAuthMatchPrefix:
+		return strings.HasPrefix(value, want)
+	case httpAuthMatchSuffix:
+		return strings.HasSuffix(value, want)
+	default:
+		return false
+	}
+}
+
+// condHit mirrors http_auth_cond_hit
+func condHit(cond *httpAuthCond, req *httpRequest) bool {
+	switch cond.Field {
+	case httpAuthFieldAny:
+		return true
+	case httpAuthFieldPath:
+		return valueMatch(cond, req.uri, req.uri != "")
+	case httpAuthFieldMethod:
+		return valueMatch(cond, req.method, req.method != "")
+	case httpAuthFieldHost:
+		return valueMatch(cond, req.host, req.host != "")
+	case httpAuthFieldHeader:
+		value, ok := req.headers[cString(cond.Name[:])]
+		return valueMatch(cond, value, ok)
+	case httpAuthFieldDstPort:
+		return cond.Port == req.port
+	default:
+		return false
+	}
+}
+
+// policyMatch mirrors http_auth_policy_match
+func policyMatch(policy *httpAuthPolicy, req *httpRequest) bool {
+	groupOk, matchOk, clauseOk, ruleOk := false, true, false, true
+	groupStart := true
+	for i := 0; i < int(policy.NConds); i++ {
+		cond := &policy.Conds[i]
+		hit := condHit(cond, req)
+		if groupStart {
+			groupOk = cond.Negate == 1
+		}
+		if cond.Negate == 1 {
+			groupOk = groupOk && !hit
+		} else {
+			groupOk = groupOk || hit
+		}
+		groupStart = cond.End >= httpAuthEndGroup
+		if cond.End < httpAuthEndGroup {
+			continue
+		}
+		matchOk = matchOk && groupOk
+		if cond.End < httpAuthEndMatch {
+			continue
+		}
+		clauseOk = clauseOk || matchOk
+		matchOk = true
+		if cond.End < httpAuthEndClause {
+			continue
+		}
+		ruleOk = ruleOk && clauseOk
+		clauseOk = false
+		if cond.End < httpAuthEndRule {
+			continue
+		}
+		if ruleOk {
+			return true
+		}
+		ruleOk = true
+	}
+	return false
+}
+
+// allowed mirrors http_auth_check
+func allowed(policies []*httpAuthPolicy, req *httpRequest) bool {
+	for _, policy := range policies {
+		if policy.NConds == 0 {
+			continue
+		}
+		if policy.Port != req.port || (policy.Ipv4 != 0 && policy.Ipv4 != req.ipv4) {
+			continue
+		}
+		matched := policyMatch(policy, req)
+		if policy.Action == httpAuthActionDeny && matched {
+			return false
+		}
+		if policy.Action == httpAuthActionAllow && !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHTTPAuthRequests(t *testing.T) {
+	withHeader := func(req *httpRequest, name, value string) *httpRequest {
+		req.headers = map[string]string{name: value}
+		return req
+	}
+	withHost := func(req *httpRequest, host string) *httpRequest {
+		req.host = host
+		return req
+	}
+
+	tests := []struct {
+		name    string
+		filters []HTTPRBAC
+		allow   []*httpRequest
+		deny    []*httpRequest
+	}{
+		{
+			name: "allow methods and path prefix",
+			filters: []HTTPRBAC{rbacFilter("allow", config_rbac_v3.RBAC_ALLOW, map[string]*config_rbac_v3.Policy{
+				"ns[default]-policy[api]-rule[0]": rbacPolicy(andPermissions(
+					orPermissions(headerPermission(":method", exact("GET")), headerPermission(":method", exact("HEAD"))),
+					orPermissions(pathPermission(prefix("/api/"))),
+				)),
+			})},
+			allow: []*httpRequest{newRequest("GET", "/api/v1"), newRequest("HEAD", "/api/")},
+			deny:  []*httpRequest{newRequest("POST", "/api/v1"), newRequest("GET", "/apis")},
+		},
+		{
+			name: "deny path suffix and header presence",
+			filters: []HTTPRBAC{rbacFilter("deny", config_rbac_v3.RBAC_DENY, map[string]*config_rbac_v3.Policy{
+				"ns[default]-policy[deny]-rule[0]": rbacPolicy(andPermissions(
+					orPermissions(headerPermission("user-agent", suffix("bot"))),
+				)),
+				"ns[default]-policy[deny]-rule[1]": rbacPolicy(andPermissions(
+					orPermissions(headerPermission("x-debug", prefix(""))),
+				)),
+			})},
+			allow: []*httpRequest{withHeader(newRequest("GET", "/"), "user-agent", "curl"), withHeader(newRequest("GET", "/"), "x-user", "1")},
+			deny:  []*httpRequest{withHeader(newRequest("GET", "/"), "user-agent", "crawlbot"), withHeader(newRequest("GET", "/"), "x-debug", "")},
+		},
+		{
+			// the uri checked by bpf has the query, a suffix cannot be checked safely
+			name: "deny path suffix denies every path",
+			filters: []HTTPRBAC{rbacFilter("deny", config_rbac_v3.RBAC_DENY, map[string]*config_rbac_v3.Policy{
+				"ns[default]-policy[deny]-rule[0]": rbacPolicy(andPermissions(
+					orPermissions(pathPermission(suffix(".php"))),
+				)),
+			})},
+			deny: []*httpRequest{newRequest("GET", "/index.php?x=1"), newRequest("GET", "/index.html")},
+		},
+		{
+			name: "allow hosts and header exact",
+			filters: []HTTPRBAC{rbacFilter("allow", config_rbac_v3.RBAC_ALLOW, map[string]*config_rbac_v3.Policy{
+				"ns[default]-policy[hosts]-rule[0]": rbacPolicy(andPermissions(
+					orPermissions(headerPermission(":authority", &envoy_type_matcher_v3.StringMatcher{
+						MatchPattern: &envoy_type_matcher_v3.StringMatcher_Suffix{Suffix: ".Example.com"},
+						IgnoreCase:   true,
+					})),
+					orPermissions(headerPermission("x-user", exact("admin"))),
+				)),
+			})},
+			allow: []*httpRequest{withHeader(withHost(newRequest("GET", "/"), "api.example.com"), "x-user", "admin")},
+			deny: []*httpRequest{
+				withHeader(withHost(newRequest("GET", "/"), "example.org"), "x-user", "admin"),
+				withHeader(withHost(newRequest("GET", "/"), "api.example.com"), "x-user", "guest"),
+				withHost(newRequest("GET", "/"), "api.example.com"),
+			},
+		},
+		{
+			name: "allow with not_paths",
+			filters: []HTTPRBAC{rbacFilter("allow", config_rbac_v3.RBAC_ALLOW, map[string]*config_rbac_v3.Policy{
+				"ns[default]-policy[public]-rule[0]": rbacPolicy(andPermissions(
+					orPermissions(headerPermission(":method", exact("GET"))),
+					notPermission(orPermissions(pathPermission(exact("/admin")), pathPermission(prefix("/internal/")))),
+				)),
+			})},
+			allow: []*httpRequest{newRequest("GET", "/"), newRequest("GET", "/api")},
+			// the exact not_path is widened to a prefix so that a query cannot bypass it
+			deny: []*httpRequest{
+				newRequest("GET", "/admin"), newRequest("GET", "/admin?x=1"), newRequest("GET", "/administrator"),
+				newRequest("GET", "/internal/a"), newRequest("POST", "/"),
+			},
+		},
+		{
+			name: "deny takes precedence over allow",
+			filters: []HTTPRBAC{
+				rbacFilter("deny", config_rbac_v3.RBAC_DENY, map[string]*config_rbac_v3.Policy{
+					"ns[default]-policy[deny]-rule[0]": rbacPolicy(andPermissions(
+						orPermissions(pathPermission(prefix("/api/private"))),
+					)),
+				}),
+				rbacFilter("allow", config_rbac_v3.RBAC_ALLOW, map[string]*config_rbac_v3.Policy{
+					"ns[default]-policy[allow]-rule[0]": rbacPolicy(andPermissions(
+						orPermissions(pathPermission(prefix("/api/"))),
+					)),
+				}),
+			},
+			allow: []*httpRequest{newRequest("GET", "/api/public")},
+			deny:  []*httpRequest{newRequest("GET", "/api/private/x"), newRequest("GET", "/other")},
+		},
+		{
+			name: "allow policies are OR-ed, an L4 only policy included",
+			filters: []HTTPRBAC{rbacFilter("allow", config_rbac_v3.RBAC_ALLOW, map[string]*config_rbac_v3.Policy{
+				"ns[default]-policy[http]-rule[0]": rbacPolicy(andPermissions(
+					orPermissions(pathPermission(prefix("/api/"))),
+				)),
+				"ns[default]-policy[l4]-rule[0]": rbacPolicy(andPermissions(
+					orPermissions(portPermission(8080)),
+				)),
+			})},
+			allow: []*httpRequest{newRequest("GET", "/api/v1"), newRequest("GET", "/other")},
+		},
+		{
+			name: "an L4 only allow policy of another port",
+			filters: []HTTPRBAC{rbacFilter("allow", config_rbac_v3.RBAC_ALLOW, map[string]*config_rbac_v3.Policy{
+				"ns[default]-policy[http]-rule[0]": rbacPolicy(andPermissions(
+					orPermissions(pathPermission(prefix("/api/"))),
+				)),
+				"ns[default]-policy[l4]-rule[0]": rbacPolicy(andPermissions(
+					orPermissions(portPermission(9090)),
+				)),
+			})},
+			allow: []*httpRequest{newRequest("GET", "/api/v1")},
+			deny:  []*httpRequest{newRequest("GET", "/other")},
+		},
+		{
+			name: "deny with an unknown principal gets broader",
+			filters: []HTTPRBAC{rbacFilter("deny", config_rbac_v3.RBAC_DENY, map[string]*config_rbac_v3.Policy{
+				"ns[default]-policy[deny]-rule[0]": {
+					Permissions: []*config_rbac_v3.Permission{andPermissions(orPermissions(pathPermission(prefix("/admin"))))},
+					Principals:  []*config_rbac_v3.Principal{namespacePrincipal("foo")},
+				},
+			})},
+			allow: []*httpRequest{newRequest("GET", "/")},
+			deny:  []*httpRequest{newRequest("GET", "/admin")},
+		},
+		{
+			name: "allow with an unknown principal never matches",
+			filters: []HTTPRBAC{rbacFilter("allow", config_rbac_v3.RBAC_ALLOW, map[string]*config_rbac_v3.Policy{
+				"ns[default]-policy[allow]-rule[0]": {
+					Permissions: []*config_rbac_v3.Permission{andPermissions(orPermissions(pathPermission(prefix("/"))))},
+					Principals:  []*config_rbac_v3.Principal{namespacePrincipal("foo")},
+				},
+			})},
+			deny: []*httpRequest{newRequest("GET", "/"), newRequest("GET", "/api")},
+		},
+		{
+			name: "policies of another listener do not apply",
+			filters: []HTTPRBAC{rbacFilter("deny", config_rbac_v3.RBAC_DENY, map[string]*config_rbac_v3.Policy{
+				"ns[default]-policy[deny]-rule[0]": rbacPolicy(&config_rbac_v3.Permission{Rule: &config_rbac_v3.Permission_Any{Any: true}}),
+			})},
+			allow: []*httpRequest{
+				{method: "GET", uri: "/", ipv4: listenerIp, port: listenerPort + 1},
+				{method: "GET", uri: "/", ipv4: listenerIp + 1, port: listenerPort},
+			},
+			deny: []*httpRequest{newRequest("GET", "/")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policies := compileFilters(t, tt.filters...)
+			for _, req := range tt.allow {
+				assert.True(t, allowed(policies, req), "%s %s should be allowed", req.method, req.uri)
+			}
+			for _, req := range tt.deny {
+				assert.False(t, allowed(policies, req), "%s %s should be denied", req.method, req.uri)
+			}
+		})
+	}
+}
+
+func TestCompileHTTPRBAC(t *testing.T) {
+	t.Run("log and empty deny filters are not stored", func(t *testing.T) {
+		policy, err := compileHTTPRBAC(&HTTPRBAC{Rules: &config_rbac_v3.RBAC{Action: config_rbac_v3.RBAC_LOG}})
+		assert.NoError(t, err)
+		assert.Nil(t, policy)
+
+		filter := rbacFilter("deny", config_rbac_v3.RBAC_DENY, nil)
+		policy, err = compileHTTPRBAC(&filter)
+		assert.NoError(t, err)
+		assert.Nil(t, policy)
+	})
+
+	t.Run("an empty allow filter denies everything", func(t *testing.T) {
+		filter := rbacFilter("allow", config_rbac_v3.RBAC_ALLOW, nil)
+		policy, err := compileHTTPRBAC(&filter)
+		assert.NoError(t, err)
+		require.NotNil(t, policy)
+		assert.False(t, allowed([]*httpAuthPolicy{policy}, newRequest("GET", "/")))
+	})
+
+	t.Run("values that do not fit are rejected", func(t *testing.T) {
+		filter := rbacFilter("deny", config_rbac_v3.RBAC_DENY, map[string]*config_rbac_v3.Policy{
+			"long-value": rbacPolicy(pathPermission(prefix("/" + strings.Repeat("a", HTTP_AUTH_VALUE_LEN)))),
+		})
+		_, err := compileHTTPRBAC(&filter)
+		assert.Error(t, err)
+
+		filter = rbacFilter("deny", config_rbac_v3.RBAC_DENY, map[string]*config_rbac_v3.Policy{
+			"long-name": rbacPolicy(headerPermission(strings.Repeat("x", HTTP_AUTH_NAME_LEN), exact("v"))),
+		})
+		_, err = compileHTTPRBAC(&filter)
+		assert.Error(t, err)
+	})
+}
+
+func TestHTTPPolicyMapSync(t *testing.T) {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "ut_http_auth",
+		Type:       ebpf.Array,
+		KeySize:    uint32(unsafe.Sizeof(uint32(0))),
+		ValueSize:  uint32(unsafe.Sizeof(httpAuthPolicy{})),
+		MaxEntries: HTTP_AUTH_MAX_POLICIES,
+	})
+	if err != nil {
+		t.Skipf("create array map failed: %v", err)
+	}
+	defer m.Close()
+
+	hm := NewHTTPPolicyMap(m)
+	deny := rbacFilter("listener/0/0", config_rbac_v3.RBAC_DENY, map[string]*config_rbac_v3.Policy{
+		"ns[default]-policy[deny]-rule[0]": rbacPolicy(andPermissions(orPermissions(pathPermission(prefix("/admin"))))),
+	})
+	tooLong := rbacFilter("listener/0/1", config_rbac_v3.RBAC_DENY, map[string]*config_rbac_v3.Policy{
+		"long-value": rbacPolicy(pathPermission(prefix("/" + strings.Repeat("a", HTTP_AUTH_VALUE_LEN)))),
+	})
+
+	// the filter that cannot be compiled does not keep the others out
+	assert.Error(t, hm.Sync([]HTTPRBAC{deny, tooLong}))
+	slot, ok := hm.slots[deny.Name]
+	require.True(t, ok)
+	assert.NotContains(t, hm.slots, tooLong.Name)
+
+	var got httpAuthPolicy
+	require.NoError(t, m.Lookup(&slot, &got))
+	assert.Equal(t, httpAuthActionDeny, got.Action)
+	assert.Equal(t, listenerPort, got.Port)
+	assert.False(t, allowed([]*httpAuthPolicy{&got}, newRequest("GET", "/admin")))
+	assert.True(t, allowed([]*httpAuthPolicy{&got}, newRequest("GET", "/")))
+
+	// the filters that are gone are cleared
+	assert.NoError(t, hm.Sync(nil))
+	require.NoError(t, m.Lookup(&slot, &got))
+	assert.Equal(t, uint32(0), got.NConds)
+	assert.Empty(t, hm.slots)
+	assert.Len(t, hm.free, HTTP_AUTH_MAX_POLICIES)
+}
@@ -18,6 +18,7 @@ package auth
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 
 	"istio.io/istio/pkg/util/sets"
@@ -115,6 +116,21 @@ func (ps *policyStore) getAllPolicies() map[string]string {
 	return out
 }
 
+// listPolicies returns all policies sorted by key
+func (ps *policyStore) listPolicies() []*security.Authorization {
+	ps.rwLock.RLock()
+	defer ps.rwLock.RUnlock()
+
+	out := make([]*security.Authorization, 0, len(ps.byKey))
+	for _, policy := range ps.byKey {
+		out = append(out, policy)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ResourceName() < out[j].ResourceName()
+	})
+	return out
+}
+
 // getByNamespace returns a copied set of policy name in namespace, or an empty set if namespace not exists
 func (ps *policyStore) getByNamespace(namespace string) []string {
 	ps.rwLock.RLock()
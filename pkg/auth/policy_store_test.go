@@ -114,3 +114,28 @@ func Test_policyStore_removePolicy(t *testing.T) {
 		})
 	}
 }
+
+func Test_policyStore_listPolicies(t *testing.T) {
+	ps := newPolicyStore()
+	policies := []*security.Authorization{
+		{Name: "b", Namespace: "ns1", Scope: security.Scope_NAMESPACE},
+		{Name: "a", Namespace: "ns2", Scope: security.Scope_WORKLOAD_SELECTOR},
+		{Name: "a", Namespace: "ns1", Scope: security.Scope_GLOBAL},
+	}
+	for _, policy := range policies {
+		if err := ps.updatePolicy(policy); err != nil {
+			t.Fatalf("updatePolicy() error = %v", err)
+		}
+	}
+
+	got := ps.listPolicies()
+	want := []string{"ns1/a", "ns1/b", "ns2/a"}
+	if len(got) != len(want) {
+		t.Fatalf("listPolicies() returned %d policies, want %d", len(got), len(want))
+	}
+	for i, policy := range got {
+		if policy.ResourceName() != want[i] {
+			t.Errorf("listPolicies()[%d] = %s, want %s", i, policy.ResourceName(), want[i])
+		}
+	}
+}
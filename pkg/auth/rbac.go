@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"sort"
+	"strconv"
 	"strings"
 	"unsafe"
 
@@ -33,6 +35,8 @@ import (
 	"kmesh.net/kmesh/api/v2/workloadapi/security"
 	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/controller/workload/cache"
+	"kmesh.net/kmesh/pkg/events"
+	"kmesh.net/kmesh/pkg/health"
 	"kmesh.net/kmesh/pkg/logger"
 )
 
@@ -102,6 +106,10 @@ func (r *Rbac) Run(ctx context.Context, mapOfTuple, mapOfAuth *ebpf.Map) {
 		log.Error("r or mapOfTuple is nil")
 		return
 	}
+	status := health.NewStatus(nil)
+	health.Register("ringbuf/rbac", health.Liveness, status.Check)
+	defer status.SetUnhealthy("rbac ringbuf reader exited")
+
 	reader, err := ringbuf.NewReader(mapOfTuple)
 	if err != nil {
 		log.Error("open ringbuf map FAILED, err: ", err)
@@ -145,7 +153,9 @@ func (r *Rbac) Run(ctx context.Context, mapOfTuple, mapOfAuth *ebpf.Map) {
 				continue
 			}
 
-			if !r.doRbac(&conn) {
+			allowed := r.doRbac(&conn)
+			r.publishVerdict(&conn, allowed)
+			if !allowed {
 				log.Infof("Auth denied for connection: %+v", conn)
 				// If conn is denied, write tuples into XDP map, which includes source/destination IP/Port
 				if err = r.notifyFunc(mapOfAuth, msgType, tupleData); err != nil {
@@ -156,6 +166,41 @@ func (r *Rbac) Run(ctx context.Context, mapOfTuple, mapOfAuth *ebpf.Map) {
 	}
 }
 
+// publishVerdict reports the verdict of a connection, it is only built when someone listens
+func (r *Rbac) publishVerdict(conn *rbacConnection, allowed bool) {
+	if !events.Enabled() {
+		return
+	}
+	e := events.Event{
+		Type:   events.Rbac,
+		Action: "allow",
+		Attributes: map[string]string{
+			"source":      conn.srcIdentity.String(),
+			"sourceIp":    ipString(conn.srcIp),
+			"destination": net.JoinHostPort(ipString(conn.dstIp), strconv.Itoa(int(conn.dstPort))),
+		},
+	}
+	if !allowed {
+		e.Action = "deny"
+	}
+	var networkAddress cache.NetworkAddress
+	networkAddress.Network = conn.dstNetwork
+	networkAddress.Address, _ = netip.AddrFromSlice(conn.dstIp)
+	if dstWorkload := r.workloadCache.GetWorkloadByAddr(networkAddress); dstWorkload != nil {
+		e.Namespace = dstWorkload.Namespace
+		e.Name = dstWorkload.Name
+	}
+	events.Publish(e)
+}
+
+func ipString(ip []byte) string {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return ""
+	}
+	return addr.Unmap().String()
+}
+
 func (r *Rbac) UpdatePolicy(auth *security.Authorization) error {
 	return r.policyStore.updatePolicy(auth)
 }
@@ -172,6 +217,35 @@ func (r *Rbac) GetAllPolicies() map[string]string {
 	return r.policyStore.getAllPolicies()
 }
 
+// ListPolicies returns the policies in the policy store, sorted by namespace/name
+func (r *Rbac) ListPolicies() []*security.Authorization {
+	if r == nil {
+		return nil
+	}
+	return r.policyStore.listPolicies()
+}
+
+// WorkloadPolicies returns the deny and allow policies applied to the workload, sorted by namespace/name
+func (r *Rbac) WorkloadPolicies(workload *workloadapi.Workload) []*security.Authorization {
+	if r == nil || workload == nil {
+		return nil
+	}
+	allowPolicies, denyPolicies := r.aggregate(workload)
+	seen := make(map[string]struct{}, len(allowPolicies)+len(denyPolicies))
+	out := make([]*security.Authorization, 0, len(allowPolicies)+len(denyPolicies))
+	for _, policy := range append(denyPolicies, allowPolicies...) {
+		if _, ok := seen[policy.ResourceName()]; ok {
+			continue
+		}
+		seen[policy.ResourceName()] = struct{}{}
+		out = append(out, policy)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ResourceName() < out[j].ResourceName()
+	})
+	return out
+}
+
 func (r *Rbac) doRbac(conn *rbacConnection) bool {
 	var networkAddress cache.NetworkAddress
 	networkAddress.Network = conn.dstNetwork
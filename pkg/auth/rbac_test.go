@@ -33,6 +33,7 @@ import (
 	"kmesh.net/kmesh/api/v2/workloadapi/security"
 	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/controller/workload/cache"
+	"kmesh.net/kmesh/pkg/events"
 )
 
 const (
@@ -1279,6 +1280,23 @@ var (
 		},
 	}
 
+	// istiod leaves an empty match for the rules that only have HTTP attributes
+	policy9_5 = &security.Authorization{
+		Name:      DENY_AUTH,
+		Namespace: GLOBAL_NAMESPACE,
+		Scope:     security.Scope_WORKLOAD_SELECTOR,
+		Action:    security.Action_DENY,
+		Rules: []*security.Rule{
+			{
+				Clauses: []*security.Clause{
+					{
+						Matches: []*security.Match{{}},
+					},
+				},
+			},
+		},
+	}
+
 	byNamespaceAllow = map[string]sets.Set[string]{GLOBAL_NAMESPACE: sets.New(ALLOW_POLICY)}
 
 	byNamespaceDeny = map[string]sets.Set[string]{GLOBAL_NAMESPACE: sets.New(DENY_POLICY)}
@@ -1963,6 +1981,26 @@ func TestRbac_doRbac(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"9-5. deny match without L4 attributes matches no connection, allow",
+			fields{
+				&policyStore{
+					byKey:       map[string]*security.Authorization{DENY_POLICY: policy9_5},
+					byNamespace: byNamespaceDeny,
+				},
+			},
+			args{
+				conn: &rbacConnection{
+					srcIp:   []byte{192, 168, 122, 5},
+					dstIp:   []byte{192, 168, 122, 2},
+					dstPort: 8080,
+				},
+				workload: &workloadapi.Workload{
+					Addresses: [][]byte{{192, 168, 122, 2}},
+				},
+			},
+			true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -2215,3 +2253,66 @@ func TestRbac_Run(t *testing.T) {
 		mapOfAuth.Close()
 	}
 }
+
+func TestRbac_WorkloadPolicies(t *testing.T) {
+	ps := newPolicyStore()
+	policies := []*security.Authorization{
+		{Name: "deny-all", Namespace: "ns1", Scope: security.Scope_NAMESPACE, Action: security.Action_DENY},
+		{Name: "allow-sleep", Namespace: "ns1", Scope: security.Scope_WORKLOAD_SELECTOR, Action: security.Action_ALLOW},
+		{Name: "other", Namespace: "ns1", Scope: security.Scope_WORKLOAD_SELECTOR, Action: security.Action_ALLOW},
+		{Name: "mesh", Namespace: "istio-system", Scope: security.Scope_GLOBAL, Action: security.Action_ALLOW},
+		{Name: "deny-all", Namespace: "ns2", Scope: security.Scope_NAMESPACE, Action: security.Action_DENY},
+	}
+	for _, policy := range policies {
+		if err := ps.updatePolicy(policy); err != nil {
+			t.Fatalf("updatePolicy() error = %v", err)
+		}
+	}
+	r := &Rbac{policyStore: ps}
+
+	workload := &workloadapi.Workload{
+		Name:      "httpbin",
+		Namespace: "ns1",
+		// the namespace scoped policy is listed on the workload as well
+		AuthorizationPolicies: []string{"ns1/allow-sleep", "ns1/deny-all"},
+	}
+	var got []string
+	for _, policy := range r.WorkloadPolicies(workload) {
+		got = append(got, policy.ResourceName())
+	}
+	assert.Equal(t, []string{"istio-system/mesh", "ns1/allow-sleep", "ns1/deny-all"}, got)
+
+	var nilRbac *Rbac
+	assert.Nil(t, nilRbac.WorkloadPolicies(workload))
+}
+
+func TestRbac_publishVerdict(t *testing.T) {
+	workloadCache := cache.NewWorkloadCache()
+	workloadCache.AddOrUpdateWorkload(&workloadapi.Workload{
+		Uid:       "cluster0//Pod/ns1/httpbin",
+		Name:      "httpbin",
+		Namespace: "ns1",
+		Network:   "network0",
+		Addresses: [][]byte{{10, 0, 0, 2}},
+	})
+	r := &Rbac{workloadCache: workloadCache}
+	conn := &rbacConnection{
+		srcIdentity: Identity{trustDomain: "cluster.local", namespace: "ns2", serviceAccount: "sleep"},
+		dstNetwork:  "network0",
+		srcIp:       []byte{10, 0, 0, 1},
+		dstIp:       []byte{10, 0, 0, 2},
+		dstPort:     8080,
+	}
+
+	sub := events.Default().Subscribe(events.Filter{Types: []events.Type{events.Rbac}}, 1)
+	defer sub.Close()
+	r.publishVerdict(conn, false)
+
+	e := <-sub.Events()
+	assert.Equal(t, "deny", e.Action)
+	assert.Equal(t, "ns1", e.Namespace)
+	assert.Equal(t, "httpbin", e.Name)
+	assert.Equal(t, "spiffe://cluster.local/ns/ns2/sa/sleep", e.Attributes["source"])
+	assert.Equal(t, "10.0.0.1", e.Attributes["sourceIp"])
+	assert.Equal(t, "10.0.0.2:8080", e.Attributes["destination"])
+}
@@ -33,6 +33,7 @@ import (
 
 	"kmesh.net/kmesh/bpf/kmesh/bpf2go"
 	"kmesh.net/kmesh/daemon/options"
+	"kmesh.net/kmesh/pkg/constants"
 )
 
 type BpfTracePoint struct {
@@ -60,7 +61,7 @@ func (sc *BpfTracePoint) NewBpf(cfg *options.BpfConfig) {
 }
 
 func (sc *BpfSockOps) NewBpf(cfg *options.BpfConfig) error {
-	sc.Info.MapPath = cfg.BpfFsPath + "/bpf_kmesh/map/"
+	sc.Info.MapPath = cfg.BpfFsPath + constants.AdsMapPath
 	sc.Info.BpfFsPath = cfg.BpfFsPath + "/bpf_kmesh/sockops/"
 	sc.Info.Cgroup2Path = cfg.Cgroup2Path
 
@@ -32,6 +32,7 @@ import (
 
 	"kmesh.net/kmesh/bpf/kmesh/bpf2go"
 	"kmesh.net/kmesh/daemon/options"
+	"kmesh.net/kmesh/pkg/constants"
 )
 
 var KMESH_TAIL_CALL_LISTENER = uint32(C.KMESH_TAIL_CALL_LISTENER)
@@ -49,7 +50,7 @@ type BpfSockConn struct {
 }
 
 func (sc *BpfSockConn) NewBpf(cfg *options.BpfConfig) error {
-	sc.Info.MapPath = cfg.BpfFsPath + "/bpf_kmesh/map/"
+	sc.Info.MapPath = cfg.BpfFsPath + constants.AdsMapPath
 	sc.Info.BpfFsPath = cfg.BpfFsPath + "/bpf_kmesh/sockconn/"
 	sc.Info.Cgroup2Path = cfg.Cgroup2Path
 
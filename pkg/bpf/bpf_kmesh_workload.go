@@ -43,7 +43,7 @@ type BpfSockConnWorkload struct {
 }
 
 func (sc *BpfSockConnWorkload) NewBpf(cfg *options.BpfConfig) error {
-	sc.Info.MapPath = cfg.BpfFsPath + "/bpf_kmesh_workload/map/"
+	sc.Info.MapPath = cfg.BpfFsPath + constants.WorkloadMapPath
 	sc.Info.BpfFsPath = cfg.BpfFsPath + "/bpf_kmesh_workload/sockconn/"
 	sc.Info.Cgroup2Path = cfg.Cgroup2Path
 	sc.Info6 = sc.Info
@@ -222,7 +222,7 @@ type BpfSockOpsWorkload struct {
 }
 
 func (so *BpfSockOpsWorkload) NewBpf(cfg *options.BpfConfig) error {
-	so.Info.MapPath = cfg.BpfFsPath + "/bpf_kmesh_workload/map/"
+	so.Info.MapPath = cfg.BpfFsPath + constants.WorkloadMapPath
 	so.Info.BpfFsPath = cfg.BpfFsPath + "/bpf_kmesh_workload/sockops/"
 	so.Info.Cgroup2Path = cfg.Cgroup2Path
 
@@ -352,7 +352,7 @@ type BpfSendMsgWorkload struct {
 }
 
 func (sm *BpfSendMsgWorkload) NewBpf(cfg *options.BpfConfig, sockOpsWorkloadObj *BpfSockOpsWorkload) error {
-	sm.Info.MapPath = cfg.BpfFsPath + "/bpf_kmesh_workload/map/"
+	sm.Info.MapPath = cfg.BpfFsPath + constants.WorkloadMapPath
 	sm.Info.BpfFsPath = cfg.BpfFsPath + "/bpf_kmesh_workload/sendmsg/"
 	sm.Info.Cgroup2Path = cfg.Cgroup2Path
 	sm.sockOpsWorkloadObj = sockOpsWorkloadObj
@@ -487,7 +487,7 @@ type BpfXdpAuthWorkload struct {
 }
 
 func (xa *BpfXdpAuthWorkload) NewBpf(cfg *options.BpfConfig) error {
-	xa.Info.MapPath = cfg.BpfFsPath + "/bpf_kmesh_workload/map/"
+	xa.Info.MapPath = cfg.BpfFsPath + constants.WorkloadMapPath
 	xa.Info.BpfFsPath = cfg.BpfFsPath + "/bpf_kmesh_workload/xdpauth/"
 	xa.Info.Cgroup2Path = cfg.Cgroup2Path
 
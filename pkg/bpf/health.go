@@ -0,0 +1,101 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+// HealthCheck verifies that the kmesh bpf programs are still loaded and
+// attached. The pins alone are not enough, a cgroup link detached with e.g.
+// `bpftool link detach` stays pinned, so the links are asked for their cgroup.
+func (l *BpfLoader) HealthCheck() error {
+	if l.VersionMap == nil {
+		return fmt.Errorf("kmesh version map is not created")
+	}
+
+	var pinned, links []string
+	if l.config.AdsEnabled() {
+		if l.obj == nil {
+			return fmt.Errorf("ads bpf programs are not loaded")
+		}
+		pinned = append(pinned, filepath.Join(l.config.BpfFsPath+constants.VersionPath, "kmesh_version"))
+		// the ads links are not pinned, they live as long as the daemon
+		if err := cgroupAttached("cgroup connect", l.obj.SockConn.Link); err != nil {
+			return err
+		}
+	} else if l.config.WdsEnabled() {
+		if l.workloadObj == nil {
+			return fmt.Errorf("workload bpf programs are not loaded")
+		}
+		pinned = append(pinned, filepath.Join(l.config.BpfFsPath+constants.WorkloadVersionPath, "kmesh_version"))
+		links = append(links,
+			filepath.Join(l.workloadObj.SockConn.Info.BpfFsPath, "sockconn_prog"),
+			filepath.Join(l.workloadObj.SockConn.Info6.BpfFsPath, "sockconn6_prog"),
+			filepath.Join(l.workloadObj.SockOps.Info.BpfFsPath, "cgroup_sockops_prog"),
+		)
+	}
+
+	for _, path := range pinned {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("%s is no longer pinned: %v", path, err)
+		}
+	}
+	// the links are loaded from their pins, the ones of a restarted daemon are
+	// updated in place and never held by the loader
+	for _, path := range links {
+		lk, err := link.LoadPinnedLink(path, nil)
+		if err != nil {
+			return fmt.Errorf("%s is no longer pinned: %v", path, err)
+		}
+		err = cgroupAttached(path, lk)
+		lk.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cgroupAttached fails unless lk is a cgroup link still attached to its cgroup
+func cgroupAttached(name string, lk link.Link) error {
+	if lk == nil {
+		return fmt.Errorf("%s is not attached", name)
+	}
+	info, err := lk.Info()
+	// kernels without cgroup links fall back to a plain program attachment,
+	// which has no link to ask
+	if errors.Is(err, ebpf.ErrNotSupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get %s link info failed: %v", name, err)
+	}
+	// the kernel reports no cgroup once the link is detached
+	if cg := info.Cgroup(); cg == nil || cg.CgroupId == 0 {
+		return fmt.Errorf("%s is no longer attached to a cgroup", name)
+	}
+	return nil
+}
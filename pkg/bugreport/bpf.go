@@ -0,0 +1,242 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bugreport
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cilium/ebpf"
+
+	"kmesh.net/kmesh/pkg/utils"
+	"kmesh.net/kmesh/pkg/version"
+)
+
+// kmeshPinDirs are the bpffs directories kmesh pins its programs and maps under
+var kmeshPinDirs = []string{"bpf_kmesh", "bpf_kmesh_workload"}
+
+// BpfInventory lists the bpf objects loaded on the node. Objects pinned by kmesh carry
+// their pin paths, the others belong to other agents and are listed to spot conflicts.
+type BpfInventory struct {
+	Versions []BpfVersion `json:"versions"`
+	Programs []BpfProgram `json:"programs"`
+	Maps     []BpfMap     `json:"maps"`
+	Errors   []string     `json:"errors,omitempty"`
+}
+
+// BpfVersion compares the version recorded in a kmesh_version map by the daemon that
+// loaded the programs with the version of this binary. A mismatch means the programs
+// were not reloaded on the last upgrade.
+type BpfVersion struct {
+	PinPath    string `json:"pinPath"`
+	LoadedHash uint32 `json:"loadedHash"`
+	Daemon     string `json:"daemon"`
+	DaemonHash uint32 `json:"daemonHash"`
+	Match      bool   `json:"match"`
+}
+
+type BpfProgram struct {
+	ID     uint32   `json:"id"`
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Tag    string   `json:"tag"`
+	MapIDs []uint32 `json:"mapIds,omitempty"`
+	Pins   []string `json:"pins,omitempty"`
+}
+
+type BpfMap struct {
+	ID         uint32 `json:"id"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	KeySize    uint32 `json:"keySize"`
+	ValueSize  uint32 `json:"valueSize"`
+	MaxEntries uint32 `json:"maxEntries"`
+	Flags      uint32 `json:"flags"`
+	// Bytes is the size of the preallocated key and value storage
+	Bytes uint64 `json:"bytes"`
+	// Entries is only counted for kmesh maps, walking every map on the node is too costly
+	Entries *int     `json:"entries,omitempty"`
+	Pins    []string `json:"pins,omitempty"`
+}
+
+// CollectBpfInventory enumerates the programs and maps of the node and resolves the kmesh
+// pins found under bpfFsPath. Objects that fail to be inspected are reported in Errors.
+func CollectBpfInventory(bpfFsPath string) *BpfInventory {
+	inv := &BpfInventory{}
+	progPins, mapPins := inv.collectPins(bpfFsPath)
+	inv.collectPrograms(progPins)
+	inv.collectMaps(mapPins)
+	return inv
+}
+
+func (inv *BpfInventory) errorf(format string, args ...any) {
+	inv.Errors = append(inv.Errors, fmt.Sprintf(format, args...))
+}
+
+// collectPins walks the kmesh pin directories and indexes the pin paths by object id
+func (inv *BpfInventory) collectPins(bpfFsPath string) (map[uint32][]string, map[uint32][]string) {
+	progPins := make(map[uint32][]string)
+	mapPins := make(map[uint32][]string)
+	readOnly := &ebpf.LoadPinOptions{ReadOnly: true}
+
+	for _, dir := range kmeshPinDirs {
+		root := filepath.Join(bpfFsPath, dir)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			if m, err := ebpf.LoadPinnedMap(path, readOnly); err == nil {
+				defer m.Close()
+				if info, err := m.Info(); err == nil {
+					if id, ok := info.ID(); ok {
+						mapPins[uint32(id)] = append(mapPins[uint32(id)], path)
+					}
+				}
+				if filepath.Base(path) == "kmesh_version" {
+					inv.collectVersion(path, m)
+				}
+				return nil
+			}
+			if p, err := ebpf.LoadPinnedProgram(path, readOnly); err == nil {
+				defer p.Close()
+				if info, err := p.Info(); err == nil {
+					if id, ok := info.ID(); ok {
+						progPins[uint32(id)] = append(progPins[uint32(id)], path)
+					}
+				}
+			}
+			// anything else is a pinned link, which the program entries already cover
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			inv.errorf("walking %s: %v", root, err)
+		}
+	}
+	return progPins, mapPins
+}
+
+func (inv *BpfInventory) collectVersion(path string, m *ebpf.Map) {
+	var key, loaded uint32
+	if err := m.Lookup(&key, &loaded); err != nil {
+		inv.errorf("reading %s: %v", path, err)
+		return
+	}
+	daemon := version.Get().GitVersion
+	hash := fnv.New32a()
+	hash.Write([]byte(daemon))
+	inv.Versions = append(inv.Versions, BpfVersion{
+		PinPath:    path,
+		LoadedHash: loaded,
+		Daemon:     daemon,
+		DaemonHash: hash.Sum32(),
+		Match:      loaded == hash.Sum32(),
+	})
+}
+
+func (inv *BpfInventory) collectPrograms(pins map[uint32][]string) {
+	id := ebpf.ProgramID(0)
+	for {
+		var err error
+		if id, err = ebpf.ProgramGetNextID(id); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				inv.errorf("listing programs: %v", err)
+			}
+			break
+		}
+		prog, err := ebpf.NewProgramFromID(id)
+		if err != nil {
+			// the program may have been unloaded since it was listed
+			if !errors.Is(err, os.ErrNotExist) {
+				inv.errorf("opening program %d: %v", id, err)
+			}
+			continue
+		}
+		info, err := prog.Info()
+		prog.Close()
+		if err != nil {
+			inv.errorf("reading program %d: %v", id, err)
+			continue
+		}
+		p := BpfProgram{
+			ID:   uint32(id),
+			Name: info.Name,
+			Type: info.Type.String(),
+			Tag:  info.Tag,
+			Pins: pins[uint32(id)],
+		}
+		if mapIDs, ok := info.MapIDs(); ok {
+			for _, mapID := range mapIDs {
+				p.MapIDs = append(p.MapIDs, uint32(mapID))
+			}
+		}
+		inv.Programs = append(inv.Programs, p)
+	}
+	sort.Slice(inv.Programs, func(i, j int) bool { return inv.Programs[i].ID < inv.Programs[j].ID })
+}
+
+func (inv *BpfInventory) collectMaps(pins map[uint32][]string) {
+	id := ebpf.MapID(0)
+	for {
+		var err error
+		if id, err = ebpf.MapGetNextID(id); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				inv.errorf("listing maps: %v", err)
+			}
+			break
+		}
+		m, err := ebpf.NewMapFromID(id)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				inv.errorf("opening map %d: %v", id, err)
+			}
+			continue
+		}
+		inv.addMap(uint32(id), m, pins[uint32(id)])
+		m.Close()
+	}
+	sort.Slice(inv.Maps, func(i, j int) bool { return inv.Maps[i].ID < inv.Maps[j].ID })
+}
+
+func (inv *BpfInventory) addMap(id uint32, m *ebpf.Map, pins []string) {
+	info, err := m.Info()
+	if err != nil {
+		inv.errorf("reading map %d: %v", id, err)
+		return
+	}
+	bm := BpfMap{
+		ID:         id,
+		Name:       info.Name,
+		Type:       info.Type.String(),
+		KeySize:    info.KeySize,
+		ValueSize:  info.ValueSize,
+		MaxEntries: info.MaxEntries,
+		Flags:      info.Flags,
+		Bytes:      uint64(info.KeySize+info.ValueSize) * uint64(info.MaxEntries),
+		Pins:       pins,
+	}
+	if len(pins) > 0 {
+		if n, err := utils.CountMapEntries(m); err == nil {
+			bm.Entries = &n
+		}
+	}
+	inv.Maps = append(inv.Maps, bm)
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bugreport
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"kmesh.net/kmesh/pkg/version"
+)
+
+// ManifestName is the file listing the content of a bundle, written last
+const ManifestName = "manifest.json"
+
+// Manifest describes what a bundle contains and what could not be collected
+type Manifest struct {
+	Created   time.Time     `json:"created"`
+	Version   version.Info  `json:"version"`
+	Redaction RedactOptions `json:"redaction"`
+	Files     []FileEntry   `json:"files"`
+	Errors    []ErrorEntry  `json:"errors,omitempty"`
+}
+
+type FileEntry struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+}
+
+// ErrorEntry records an item that failed to be collected, so that its absence is explained
+type ErrorEntry struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// Bundle writes collected files into a gzipped tarball rooted at a single directory
+type Bundle struct {
+	mu       sync.Mutex
+	root     string
+	gz       *gzip.Writer
+	tw       *tar.Writer
+	redactor *Redactor
+	manifest Manifest
+}
+
+// NewBundle starts a bundle on w. All files are placed under root, so that extracting
+// several bundles side by side does not mix them up.
+func NewBundle(w io.Writer, root string, redactor *Redactor) *Bundle {
+	gz := gzip.NewWriter(w)
+	return &Bundle{
+		root:     root,
+		gz:       gz,
+		tw:       tar.NewWriter(gz),
+		redactor: redactor,
+		manifest: Manifest{
+			Created:   time.Now(),
+			Version:   version.Get(),
+			Redaction: redactor.Options(),
+		},
+	}
+}
+
+// Add stores a text file after redaction
+func (b *Bundle) Add(name string, data []byte) error {
+	return b.add(name, b.redactor.Redact(data))
+}
+
+// AddBinary stores a file as is, it is meant for formats redaction would corrupt, such as profiles
+func (b *Bundle) AddBinary(name string, data []byte) error {
+	return b.add(name, data)
+}
+
+// AddJSON stores v as indented json after redaction
+func (b *Bundle) AddJSON(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return fmt.Errorf("marshaling %s: %v", name, err)
+	}
+	return b.Add(name, data)
+}
+
+// AddError records that name could not be collected
+func (b *Bundle) AddError(name string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.manifest.Errors = append(b.manifest.Errors, ErrorEntry{
+		Name:  name,
+		Error: b.redactor.RedactString(err.Error()),
+	})
+}
+
+// Manifest returns a copy of the manifest as collected so far
+func (b *Bundle) Manifest() Manifest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m := b.manifest
+	m.Files = append([]FileEntry(nil), b.manifest.Files...)
+	m.Errors = append([]ErrorEntry(nil), b.manifest.Errors...)
+	return m
+}
+
+// Close writes the manifest and flushes the archive, it does not close the underlying writer
+func (b *Bundle) Close() error {
+	manifest, err := json.MarshalIndent(b.Manifest(), "", "    ")
+	if err != nil {
+		return fmt.Errorf("marshaling manifest: %v", err)
+	}
+	if err := b.add(ManifestName, manifest); err != nil {
+		return err
+	}
+	if err := b.tw.Close(); err != nil {
+		return fmt.Errorf("closing tar stream: %v", err)
+	}
+	if err := b.gz.Close(); err != nil {
+		return fmt.Errorf("closing gzip stream: %v", err)
+	}
+	return nil
+}
+
+func (b *Bundle) add(name string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hdr := &tar.Header{
+		Name:    path.Join(b.root, name),
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: b.manifest.Created,
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("writing header of %s: %v", name, err)
+	}
+	if _, err := b.tw.Write(data); err != nil {
+		return fmt.Errorf("writing %s: %v", name, err)
+	}
+	if name != ManifestName {
+		b.manifest.Files = append(b.manifest.Files, FileEntry{Name: name, Size: len(data)})
+	}
+	return nil
+}
+
+// AddFile stores the file at path after redaction. Only the last limit bytes of larger
+// files are kept, which are the most recent lines of a log.
+func (b *Bundle) AddFile(name, path string, limit int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var header []byte
+	if limit > 0 && stat.Size() > limit {
+		if _, err := f.Seek(-limit, io.SeekEnd); err != nil {
+			return err
+		}
+		header = []byte(fmt.Sprintf("# truncated to the last %d of %d bytes\n", limit, stat.Size()))
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	return b.Add(name, append(header, data...))
+}
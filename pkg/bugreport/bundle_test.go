@@ -0,0 +1,75 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bugreport
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readBundle(t *testing.T, data []byte) map[string]string {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = string(content)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "daemon.log")
+	require.NoError(t, os.WriteFile(log, []byte("first line from 10.0.0.1\nlast line\n"), 0o644))
+
+	var buf bytes.Buffer
+	b := NewBundle(&buf, "kmesh-bugreport", NewRedactor(RedactOptions{Secrets: true, IPs: true}))
+	require.NoError(t, b.Add("debug/health.json", []byte(`{"endpoint": "10.0.0.1"}`)))
+	require.NoError(t, b.AddBinary("pprof/heap.pb.gz", []byte("10.0.0.1")))
+	require.NoError(t, b.AddJSON("debug/options.json", map[string]string{"token": "abc"}))
+	require.NoError(t, b.AddFile("logs/daemon.log", log, 10))
+	b.AddError("debug/certs.json", errors.New("dial tcp 10.0.0.2:15200: connection refused"))
+	require.NoError(t, b.Close())
+
+	files := readBundle(t, buf.Bytes())
+	assert.Equal(t, `{"endpoint": "<ipv4-1>"}`, files["kmesh-bugreport/debug/health.json"])
+	assert.Equal(t, "10.0.0.1", files["kmesh-bugreport/pprof/heap.pb.gz"])
+	assert.Equal(t, "{\n    \"token\": \"<redacted>\"\n}", files["kmesh-bugreport/debug/options.json"])
+	assert.Equal(t, "# truncated to the last 10 of 35 bytes\nlast line\n", files["kmesh-bugreport/logs/daemon.log"])
+
+	var manifest Manifest
+	require.NoError(t, json.Unmarshal([]byte(files["kmesh-bugreport/"+ManifestName]), &manifest))
+	assert.Equal(t, RedactOptions{Secrets: true, IPs: true}, manifest.Redaction)
+	assert.Len(t, manifest.Files, 4)
+	assert.Equal(t, []ErrorEntry{{Name: "debug/certs.json", Error: "dial tcp <ipv4-2>:15200: connection refused"}}, manifest.Errors)
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bugreport
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	procKernelConfig = "/proc/config.gz"
+	bootConfigDir    = "/boot"
+	procOSRelease    = "/proc/sys/kernel/osrelease"
+)
+
+// kernelConfigKeywords select the options kmesh depends on: bpf and btf support, cgroup
+// hooks, xdp and the kprobes used by the tracing programs
+var kernelConfigKeywords = []string{"BPF", "BTF", "CGROUP", "XDP", "KPROBE", "NET_CLS_ACT", "NET_SCH_INGRESS"}
+
+// ReadKernelConfig returns the kernel build configuration, read from /proc/config.gz or
+// /boot/config-<release>, along with the path it was read from
+func ReadKernelConfig() ([]byte, string, error) {
+	if f, err := os.Open(procKernelConfig); err == nil {
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, procKernelConfig, fmt.Errorf("decompressing %s: %v", procKernelConfig, err)
+		}
+		data, err := io.ReadAll(gz)
+		return data, procKernelConfig, err
+	}
+
+	release, err := os.ReadFile(procOSRelease)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading kernel release: %v", err)
+	}
+	path := filepath.Join(bootConfigDir, "config-"+strings.TrimSpace(string(release)))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, path, fmt.Errorf("neither %s nor %s is readable: %v", procKernelConfig, path, err)
+	}
+	return data, path, nil
+}
+
+// FilterKernelConfig keeps the options relevant to kmesh, both set and explicitly unset ones
+func FilterKernelConfig(config []byte) []byte {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(config))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var option string
+		switch {
+		case strings.HasPrefix(line, "CONFIG_"):
+			option, _, _ = strings.Cut(line, "=")
+		case strings.HasPrefix(line, "# CONFIG_") && strings.HasSuffix(line, " is not set"):
+			option = strings.TrimSuffix(strings.TrimPrefix(line, "# "), " is not set")
+		default:
+			continue
+		}
+		for _, keyword := range kernelConfigKeywords {
+			if strings.Contains(option, keyword) {
+				out.WriteString(line)
+				out.WriteByte('\n')
+				break
+			}
+		}
+	}
+	return out.Bytes()
+}
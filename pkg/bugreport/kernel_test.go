@@ -0,0 +1,46 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bugreport
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterKernelConfig(t *testing.T) {
+	config := `#
+# Automatically generated file; DO NOT EDIT.
+#
+CONFIG_BPF=y
+CONFIG_BPF_SYSCALL=y
+CONFIG_DEBUG_INFO_BTF=y
+CONFIG_CGROUP_BPF=y
+# CONFIG_XDP_SOCKETS is not set
+CONFIG_EXT4_FS=y
+# CONFIG_SOUND is not set
+CONFIG_NET_CLS_ACT=y
+`
+	want := `CONFIG_BPF=y
+CONFIG_BPF_SYSCALL=y
+CONFIG_DEBUG_INFO_BTF=y
+CONFIG_CGROUP_BPF=y
+# CONFIG_XDP_SOCKETS is not set
+CONFIG_NET_CLS_ACT=y
+`
+	assert.Equal(t, want, string(FilterKernelConfig([]byte(config))))
+}
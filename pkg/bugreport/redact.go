@@ -0,0 +1,130 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bugreport
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"sync"
+)
+
+const redacted = "<redacted>"
+
+var (
+	// privateKeyBlock matches PEM encoded private keys, certificates are public and kept as is
+	privateKeyBlock = regexp.MustCompile(`(?s)-----BEGIN ([A-Z0-9 ]*PRIVATE KEY)-----.*?-----END ([A-Z0-9 ]*PRIVATE KEY)-----`)
+	// secretField matches json and yaml fields whose values are credentials
+	secretField = regexp.MustCompile(`(?i)("?(?:private_?key|password|passwd|secret|token|access_?token|client_?secret)"?\s*[:=]\s*)("(?:[^"\\]|\\.)*"|[^\s,}\]]+)`)
+	// authorization matches authorization headers, whose value is a scheme followed by the credentials
+	authorization = regexp.MustCompile(`(?i)(authorization"?\s*[:=]\s*"?)[^"\n]+`)
+	// bearerToken matches bearer credentials outside of a recognised field
+	bearerToken = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`)
+	// jwt matches json web tokens, such as service account tokens
+	jwt = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+
+	ipv4Candidate = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	// ipv6Candidate also takes a trailing dotted quad, as in ::ffff:10.0.0.1
+	ipv6Candidate = regexp.MustCompile(`(?:[0-9A-Fa-f]{0,4}:){2,7}(?:(?:\d{1,3}\.){3}\d{1,3}|[0-9A-Fa-f]{0,4})`)
+)
+
+// RedactOptions selects what is scrubbed from the collected files
+type RedactOptions struct {
+	// Secrets removes private keys, tokens and passwords
+	Secrets bool `json:"secrets"`
+	// IPs replaces addresses with stable placeholders, so that flows can still be followed
+	// across the files of a bundle
+	IPs bool `json:"ips"`
+}
+
+// Redactor scrubs sensitive data from text. A single Redactor should be used for a whole
+// bundle so that an address is replaced by the same placeholder everywhere.
+type Redactor struct {
+	opts RedactOptions
+
+	mu  sync.Mutex
+	ips map[netip.Addr]string
+	v4  int
+	v6  int
+}
+
+func NewRedactor(opts RedactOptions) *Redactor {
+	return &Redactor{
+		opts: opts,
+		ips:  make(map[netip.Addr]string),
+	}
+}
+
+func (r *Redactor) Options() RedactOptions {
+	return r.opts
+}
+
+// Redact returns data with the configured classes of information replaced
+func (r *Redactor) Redact(data []byte) []byte {
+	if r.opts.Secrets {
+		data = privateKeyBlock.ReplaceAll(data, []byte("-----BEGIN $1-----\n"+redacted+"\n-----END $2-----"))
+		data = secretField.ReplaceAllFunc(data, func(match []byte) []byte {
+			sub := secretField.FindSubmatch(match)
+			value := redacted
+			if len(sub[2]) > 0 && sub[2][0] == '"' {
+				value = `"` + redacted + `"`
+			}
+			return append(append([]byte{}, sub[1]...), value...)
+		})
+		data = authorization.ReplaceAll(data, []byte("${1}"+redacted))
+		data = bearerToken.ReplaceAll(data, []byte("${1}"+redacted))
+		data = jwt.ReplaceAll(data, []byte(redacted))
+	}
+	if r.opts.IPs {
+		data = ipv6Candidate.ReplaceAllFunc(data, r.replaceIP)
+		data = ipv4Candidate.ReplaceAllFunc(data, r.replaceIP)
+	}
+	return data
+}
+
+// RedactString is the string variant of Redact
+func (r *Redactor) RedactString(s string) string {
+	return string(r.Redact([]byte(s)))
+}
+
+func (r *Redactor) replaceIP(match []byte) []byte {
+	addr, err := netip.ParseAddr(string(match))
+	if err != nil {
+		// timestamps, mac addresses and the like
+		return match
+	}
+	addr = addr.Unmap()
+	// loopback and wildcard addresses identify nothing and help reading listener configs
+	if addr.IsLoopback() || addr.IsUnspecified() {
+		return match
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	placeholder, ok := r.ips[addr]
+	if !ok {
+		if addr.Is4() {
+			r.v4++
+			placeholder = fmt.Sprintf("<ipv4-%d>", r.v4)
+		} else {
+			r.v6++
+			placeholder = fmt.Sprintf("<ipv6-%d>", r.v6)
+		}
+		r.ips[addr] = placeholder
+	}
+	return []byte(placeholder)
+}
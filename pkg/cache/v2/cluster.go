@@ -22,6 +22,7 @@ package cache_v2
 import (
 	"sync"
 
+	"google.golang.org/protobuf/proto"
 	"k8s.io/apimachinery/pkg/util/sets"
 
 	cluster_v2 "kmesh.net/kmesh/api/v2/cluster"
@@ -182,6 +183,30 @@ func (cache *ClusterCache) DumpBpf() []*cluster_v2.Cluster {
 	return clusters
 }
 
+// CompareBpf looks the flushed clusters up in the bpf map, and returns the names
+// of those missing from the map and of those whose bpf copy differs from the cache.
+// The clusters still waiting for a flush are skipped.
+func (cache *ClusterCache) CompareBpf() (missing []string, mismatched []string) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	for name, cluster := range cache.apiClusterCache {
+		if cluster.GetApiStatus() != core_v2.ApiStatus_NONE {
+			continue
+		}
+
+		tmp := &cluster_v2.Cluster{}
+		if err := maps_v2.ClusterLookup(name, tmp); err != nil {
+			missing = append(missing, name)
+			continue
+		}
+		tmp.ApiStatus = cluster.ApiStatus
+		if !proto.Equal(tmp, cluster) {
+			mismatched = append(mismatched, name)
+		}
+	}
+	return missing, mismatched
+}
+
 func (cache *ClusterCache) Dump() []*cluster_v2.Cluster {
 	cache.mutex.RLock()
 	defer cache.mutex.RUnlock()
@@ -22,6 +22,7 @@ package cache_v2
 import (
 	"sync"
 
+	"google.golang.org/protobuf/proto"
 	"k8s.io/apimachinery/pkg/util/sets"
 
 	core_v2 "kmesh.net/kmesh/api/v2/core"
@@ -145,6 +146,30 @@ func (cache *ListenerCache) DumpBpf() []*listener_v2.Listener {
 	return listeners
 }
 
+// CompareBpf looks the flushed listeners up in the bpf map, and returns the names
+// of those missing from the map and of those whose bpf copy differs from the cache.
+// The listeners still waiting for a flush are skipped.
+func (cache *ListenerCache) CompareBpf() (missing []string, mismatched []string) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	for name, listener := range cache.apiListenerCache {
+		if listener.GetApiStatus() != core_v2.ApiStatus_NONE {
+			continue
+		}
+
+		tmp := &listener_v2.Listener{}
+		if err := maps_v2.ListenerLookup(listener.GetAddress(), tmp); err != nil {
+			missing = append(missing, name)
+			continue
+		}
+		tmp.ApiStatus = listener.ApiStatus
+		if !proto.Equal(tmp, listener) {
+			mismatched = append(mismatched, name)
+		}
+	}
+	return missing, mismatched
+}
+
 func (cache *ListenerCache) Dump() []*listener_v2.Listener {
 	cache.mutex.RLock()
 	defer cache.mutex.RUnlock()
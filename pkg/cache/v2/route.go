@@ -19,6 +19,7 @@ package cache_v2
 import (
 	"sync"
 
+	"google.golang.org/protobuf/proto"
 	"k8s.io/apimachinery/pkg/util/sets"
 
 	core_v2 "kmesh.net/kmesh/api/v2/core"
@@ -125,6 +126,30 @@ func (cache *RouteConfigCache) DumpBpf() []*route_v2.RouteConfiguration {
 	return mapCache
 }
 
+// CompareBpf looks the flushed route configs up in the bpf map, and returns the names
+// of those missing from the map and of those whose bpf copy differs from the cache.
+// The route configs still waiting for a flush are skipped.
+func (cache *RouteConfigCache) CompareBpf() (missing []string, mismatched []string) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	for name, route := range cache.apiRouteConfigCache {
+		if route.GetApiStatus() != core_v2.ApiStatus_NONE {
+			continue
+		}
+
+		tmp := &route_v2.RouteConfiguration{}
+		if err := maps_v2.RouteConfigLookup(name, tmp); err != nil {
+			missing = append(missing, name)
+			continue
+		}
+		tmp.ApiStatus = route.ApiStatus
+		if !proto.Equal(tmp, route) {
+			mismatched = append(mismatched, name)
+		}
+	}
+	return missing, mismatched
+}
+
 func (cache *RouteConfigCache) Dump() []*route_v2.RouteConfiguration {
 	cache.mutex.RLock()
 	defer cache.mutex.RUnlock()
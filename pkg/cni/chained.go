@@ -140,6 +140,26 @@ func (i *Installer) insertCNIConfig(oldconfig []byte, mode string) ([]byte, erro
 	return byte, nil
 }
 
+// hasKmeshPlugin reports whether the kmesh plugin is in the plugin list of the cni config
+func hasKmeshPlugin(config []byte) (bool, error) {
+	var cniConfigMap map[string]interface{}
+	if err := json.Unmarshal(config, &cniConfigMap); err != nil {
+		return false, fmt.Errorf("failed to unmarshal json: %v", err)
+	}
+
+	plugins, ok := cniConfigMap["plugins"].([]interface{})
+	if !ok {
+		return false, fmt.Errorf("can not found valid plugin list in cni config")
+	}
+	for _, rawplugin := range plugins {
+		plugin, ok := rawplugin.(map[string]interface{})
+		if ok && plugin["type"] == kmeshCniPluginName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func deleteCNIConfig(oldconfig []byte) ([]byte, error) {
 	var cniConfigMap map[string]interface{}
 	var index int
@@ -203,16 +223,27 @@ func (i *Installer) chainedKmeshCniPlugin(mode string, cniMountNetEtcDIR string)
 		return fmt.Errorf("write kubeconfig: %v", err)
 	}
 
+	if len(i.CniConfigName) == 0 {
+		if _, err := convertCniConf(i.CniMountNetEtcDIR); err != nil {
+			return err
+		}
+	}
 	cniConfigFilePath, err := i.getCniConfigPath()
 	if err != nil {
 		return err
 	}
 	log.Infof("cni config file: %s", cniConfigFilePath)
 
-	/*
-	 TODO: add watcher for cniConfigFile
-	*/
+	if err := i.installKmeshPlugin(cniConfigFilePath, mode); err != nil {
+		return err
+	}
+	i.setCniConfigPath(cniConfigFilePath)
+
+	return nil
+}
 
+// installKmeshPlugin inserts the kmesh plugin into the plugin list of the cni config file
+func (i *Installer) installKmeshPlugin(cniConfigFilePath string, mode string) error {
 	existCNIConfig, err := os.ReadFile(cniConfigFilePath)
 	if err != nil {
 		err = fmt.Errorf("failed to read cni config file %v : %v", cniConfigFilePath, err)
@@ -242,17 +273,47 @@ func (i *Installer) chainedKmeshCniPlugin(mode string, cniMountNetEtcDIR string)
 		log.Errorf("failed to write cni config file")
 		return err
 	}
-
 	return nil
 }
 
 func (i *Installer) removeChainedKmeshCniPlugin() error {
 	var err error
-	var newCNIConfig []byte
 	cniConfigFilePath, err := i.getCniConfigPath()
 	if err != nil {
 		return err
 	}
+	if err = uninstallKmeshPlugin(cniConfigFilePath); err != nil {
+		return err
+	}
+	i.setCniConfigPath("")
+	if len(i.CniConfigName) == 0 {
+		if err = restoreCniConf(i.CniMountNetEtcDIR); err != nil {
+			return err
+		}
+	}
+
+	// remove kubeconfig file
+	if kubeconfigFilepath := filepath.Join(i.CniMountNetEtcDIR, kmeshCniKubeConfig); fileExists(kubeconfigFilepath) {
+		kubeconfigFilepath := filepath.Join(i.CniMountNetEtcDIR, kmeshCniKubeConfig)
+		log.Infof("Removing Kmesh CNI kubeconfig file: %s", kubeconfigFilepath)
+		if err := os.Remove(kubeconfigFilepath); err != nil {
+			return err
+		}
+	}
+
+	// remove cni binary
+	if kmeshCNIBin := filepath.Join(MountedCNIBinDir, kmeshCniPluginName); fileExists(kmeshCNIBin) {
+		log.Infof("Removing binary: %s", kmeshCNIBin)
+		if err := os.Remove(kmeshCNIBin); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// uninstallKmeshPlugin deletes the kmesh plugin from the plugin list of the cni config file
+func uninstallKmeshPlugin(cniConfigFilePath string) error {
 	existCNIConfig, err := os.ReadFile(cniConfigFilePath)
 	if err != nil {
 		err = fmt.Errorf("failed to read cni config file %v : %v", cniConfigFilePath, err)
@@ -260,7 +321,7 @@ func (i *Installer) removeChainedKmeshCniPlugin() error {
 		return err
 	}
 
-	newCNIConfig, err = deleteCNIConfig(existCNIConfig)
+	newCNIConfig, err := deleteCNIConfig(existCNIConfig)
 	if err != nil {
 		log.Error("failed to delete cni config")
 		return err
@@ -277,24 +338,6 @@ func (i *Installer) removeChainedKmeshCniPlugin() error {
 		log.Errorf("failed to write cni config file")
 		return err
 	}
-
-	// remove kubeconfig file
-	if kubeconfigFilepath := filepath.Join(i.CniMountNetEtcDIR, kmeshCniKubeConfig); fileExists(kubeconfigFilepath) {
-		kubeconfigFilepath := filepath.Join(i.CniMountNetEtcDIR, kmeshCniKubeConfig)
-		log.Infof("Removing Kmesh CNI kubeconfig file: %s", kubeconfigFilepath)
-		if err := os.Remove(kubeconfigFilepath); err != nil {
-			return err
-		}
-	}
-
-	// remove cni binary
-	if kmeshCNIBin := filepath.Join(MountedCNIBinDir, kmeshCniPluginName); fileExists(kmeshCNIBin) {
-		log.Infof("Removing binary: %s", kmeshCNIBin)
-		if err := os.Remove(kmeshCNIBin); err != nil {
-			return err
-		}
-	}
-
 	return nil
 }
 
@@ -19,6 +19,8 @@ package cni
 import (
 	"encoding/json"
 	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/agiledragon/gomonkey/v2"
@@ -317,3 +319,49 @@ func TestInsertCNIConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestHealthCheck(t *testing.T) {
+	dir := t.TempDir()
+	cniConfigPath := filepath.Join(dir, "10-calico.conflist")
+	calicoConfig := []byte(`{
+		"cniVersion": "0.3.1",
+		"name": "k8s-pod-network",
+		"plugins": [
+			{
+				"type": "calico"
+			}
+		]
+	}`)
+	if err := os.WriteFile(cniConfigPath, calicoConfig, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	i := NewInstaller(constants.WorkloadMode, dir, "", true)
+	if err := i.HealthCheck(); err == nil {
+		t.Errorf("HealthCheck() should fail before the plugin is installed")
+	}
+
+	kmeshConfig, err := i.insertCNIConfig(calicoConfig, constants.WorkloadMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cniConfigPath, kmeshConfig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	i.setCniConfigPath(cniConfigPath)
+	if err := i.HealthCheck(); err != nil {
+		t.Errorf("HealthCheck() error = %v, want nil", err)
+	}
+
+	// another cni rewrites its config without the kmesh plugin
+	if err := os.WriteFile(cniConfigPath, calicoConfig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.HealthCheck(); err == nil {
+		t.Errorf("HealthCheck() should fail once the plugin is removed")
+	}
+
+	if err := NewInstaller(constants.WorkloadMode, dir, "", false).HealthCheck(); err != nil {
+		t.Errorf("HealthCheck() error = %v, want nil when cni is not chained", err)
+	}
+}
@@ -20,6 +20,10 @@
 package cni
 
 import (
+	"fmt"
+	"os"
+	"sync"
+
 	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/logger"
 )
@@ -54,6 +58,13 @@ type Installer struct {
 	CniMountNetEtcDIR string
 	CniConfigName     string
 	CniConfigChained  bool
+
+	mu sync.RWMutex
+	// cniConfigPath is the cni config file the kmesh plugin was inserted in
+	cniConfigPath string
+
+	stopWatch chan struct{}
+	watchDone chan struct{}
 }
 
 func NewInstaller(mode string,
@@ -76,11 +87,51 @@ func (i *Installer) Start() error {
 			i.Stop()
 			return err
 		}
+		if i.CniConfigChained {
+			// the primary cni may rewrite its config and drop kmesh from the chain
+			if err = i.startWatcher(); err != nil {
+				log.Errorf("kmesh plugin will not be repaired in the cni config: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// HealthCheck verifies that the kmesh cni plugin is still in the cni config it was inserted in
+func (i *Installer) HealthCheck() error {
+	if (i.Mode != constants.AdsMode && i.Mode != constants.WorkloadMode) || !i.CniConfigChained {
+		return nil
+	}
+
+	i.mu.RLock()
+	cniConfigPath := i.cniConfigPath
+	i.mu.RUnlock()
+	if cniConfigPath == "" {
+		return fmt.Errorf("kmesh cni plugin is not installed")
+	}
+
+	config, err := os.ReadFile(cniConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to read cni config file %v : %v", cniConfigPath, err)
+	}
+	installed, err := hasKmeshPlugin(config)
+	if err != nil {
+		return fmt.Errorf("invalid cni config file %v : %v", cniConfigPath, err)
+	}
+	if !installed {
+		return fmt.Errorf("kmesh cni plugin is missing from %v", cniConfigPath)
 	}
 	return nil
 }
 
+func (i *Installer) setCniConfigPath(path string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.cniConfigPath = path
+}
+
 func (i *Installer) Stop() {
+	i.stopWatcher()
 	if i.Mode == constants.AdsMode || i.Mode == constants.WorkloadMode {
 		log.Info("start remove CNI config")
 		if err := i.removeCniConfig(); err != nil {
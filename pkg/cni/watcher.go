@@ -0,0 +1,274 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/fsnotify/fsnotify"
+
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// The reasons of a cni config repair
+const (
+	// RepairPluginMissing is the kmesh plugin dropped from the chain, e.g. by the
+	// primary cni rewriting its config during an upgrade
+	RepairPluginMissing = "plugin_missing"
+	// RepairConfigRenamed is the primary cni config moved to another file
+	RepairConfigRenamed = "config_renamed"
+	// RepairConfConverted is a single plugin .conf converted to a .conflist to chain kmesh
+	RepairConfConverted = "conf_converted"
+)
+
+// cniConfigDebounce lets the primary cni finish writing its config before it is checked
+const cniConfigDebounce = 500 * time.Millisecond
+
+// cniConfBackupSuffix is appended to a .conf set aside by convertCniConf, the kubelet
+// does not load it under this extension
+const cniConfBackupSuffix = ".kmesh-bak"
+
+// startWatcher repairs the cni config whenever a file changes in the cni config dir,
+// until stopWatcher is called
+func (i *Installer) startWatcher() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("create cni config watcher failed: %v", err)
+	}
+	if err = watcher.Add(i.CniMountNetEtcDIR); err != nil {
+		watcher.Close()
+		return fmt.Errorf("watch cni config dir %s failed: %v", i.CniMountNetEtcDIR, err)
+	}
+	// the config may have been rewritten since it was installed and before it was watched
+	if err = i.repairCniConfig(); err != nil {
+		log.Errorf("repair cni config failed: %v", err)
+	}
+
+	i.stopWatch = make(chan struct{})
+	i.watchDone = make(chan struct{})
+	go i.watch(watcher, i.stopWatch, i.watchDone)
+	log.Infof("watching cni config dir %s", i.CniMountNetEtcDIR)
+	return nil
+}
+
+// stopWatcher waits for the watcher to exit, so that it does not put back the plugin
+// being removed on stop
+func (i *Installer) stopWatcher() {
+	if i.stopWatch == nil {
+		return
+	}
+	close(i.stopWatch)
+	<-i.watchDone
+	i.stopWatch = nil
+}
+
+func (i *Installer) watch(watcher *fsnotify.Watcher, stopCh <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	defer watcher.Close()
+
+	debounce := time.NewTimer(cniConfigDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !isCniConfigFile(event.Name) || event.Op == fsnotify.Chmod {
+				continue
+			}
+			debounce.Reset(cniConfigDebounce)
+		case <-debounce.C:
+			if err := i.repairCniConfig(); err != nil {
+				log.Errorf("repair cni config failed: %v", err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("cni config watcher error: %v", err)
+		}
+	}
+}
+
+// isCniConfigFile tells whether the kubelet may load the file as a cni config
+func isCniConfigFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".conf", ".conflist", ".json":
+		return true
+	}
+	return false
+}
+
+// repairCniConfig puts the kmesh plugin back in the chain of the primary cni config when
+// it is missing, following the config to its new file when it was renamed or converted.
+// It is idempotent, the writes it makes wake up the watcher again and find nothing to do.
+func (i *Installer) repairCniConfig() error {
+	var reasons []string
+	if len(i.CniConfigName) == 0 {
+		converted, err := convertCniConf(i.CniMountNetEtcDIR)
+		if err != nil {
+			return err
+		}
+		if converted {
+			reasons = append(reasons, RepairConfConverted)
+		}
+	}
+
+	cniConfigPath, err := i.getCniConfigPath()
+	if err != nil {
+		return err
+	}
+	i.mu.RLock()
+	oldConfigPath := i.cniConfigPath
+	i.mu.RUnlock()
+	if oldConfigPath != cniConfigPath {
+		reasons = append(reasons, RepairConfigRenamed)
+		// the previous config is no longer used by the kubelet, leave it as it was
+		if oldConfigPath != "" && fileExists(oldConfigPath) {
+			if err := uninstallKmeshPlugin(oldConfigPath); err != nil {
+				log.Warnf("failed to remove kmesh plugin from the previous cni config %s: %v", oldConfigPath, err)
+			}
+		}
+	}
+
+	config, err := os.ReadFile(cniConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to read cni config file %v : %v", cniConfigPath, err)
+	}
+	installed, err := hasKmeshPlugin(config)
+	if err != nil {
+		return fmt.Errorf("invalid cni config file %v : %v", cniConfigPath, err)
+	}
+	if !installed {
+		reasons = append(reasons, RepairPluginMissing)
+		if err := i.installKmeshPlugin(cniConfigPath, i.Mode); err != nil {
+			return err
+		}
+	}
+	i.setCniConfigPath(cniConfigPath)
+
+	if len(reasons) == 0 {
+		return nil
+	}
+	for _, reason := range reasons {
+		telemetry.CniConfigRepairs.WithLabelValues(reason).Inc()
+	}
+	log.Infof("repaired kmesh plugin in cni config %s: %s", cniConfigPath, strings.Join(reasons, ", "))
+	return nil
+}
+
+// convertCniConf converts the config the kubelet loads first to a .conflist when it is a
+// single plugin .conf or .json, which cannot chain the kmesh plugin. The kubelet loads the
+// first valid config in lexical order, the .conflist is named after the .conf it replaces.
+// The .conf is kept aside with cniConfBackupSuffix for restoreCniConf.
+func convertCniConf(dir string) (bool, error) {
+	files, err := libcni.ConfFiles(dir, []string{".conf", ".conflist", ".json"})
+	if err != nil {
+		return false, fmt.Errorf("failed to load cni configs from dir :%v, : %v", dir, err)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		if filepath.Ext(file) == ".conflist" {
+			if confList, err := libcni.ConfListFromFile(file); err == nil && len(confList.Plugins) > 0 {
+				return false, nil
+			}
+			continue
+		}
+		conf, err := libcni.ConfFromFile(file)
+		if err != nil {
+			continue
+		}
+
+		var plugin map[string]interface{}
+		if err = json.Unmarshal(conf.Bytes, &plugin); err != nil {
+			continue
+		}
+		if _, ok := plugin["plugins"]; ok {
+			// a plugin list with a .json extension, kmesh does not manage it
+			return false, nil
+		}
+		confList := map[string]interface{}{
+			"cniVersion": plugin["cniVersion"],
+			"name":       plugin["name"],
+			"plugins":    []interface{}{plugin},
+		}
+		delete(plugin, "cniVersion")
+		delete(plugin, "name")
+		data, err := json.MarshalIndent(confList, "", "  ")
+		if err != nil {
+			return false, fmt.Errorf("failed to marshal json: %v", err)
+		}
+
+		fileInfo, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		confListFile := strings.TrimSuffix(file, filepath.Ext(file)) + ".conflist"
+		if err = utils.AtomicWrite(confListFile, data, fileInfo.Mode().Perm()); err != nil {
+			return false, err
+		}
+		if err = os.Rename(file, file+cniConfBackupSuffix); err != nil {
+			return false, err
+		}
+		log.Infof("converted cni config %s to %s", file, confListFile)
+		return true, nil
+	}
+	return false, nil
+}
+
+// restoreCniConf puts back the configs set aside by convertCniConf and removes the
+// .conflist they were converted to. A backup is dropped when the primary cni has
+// written its config again meanwhile.
+func restoreCniConf(dir string) error {
+	backups, err := filepath.Glob(filepath.Join(dir, "*"+cniConfBackupSuffix))
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups {
+		file := strings.TrimSuffix(backup, cniConfBackupSuffix)
+		confListFile := strings.TrimSuffix(file, filepath.Ext(file)) + ".conflist"
+		if err = os.Remove(confListFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if fileExists(file) {
+			if err = os.Remove(backup); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = os.Rename(backup, file); err != nil {
+			return err
+		}
+		log.Infof("restored cni config %s", file)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cni
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+func copyFixture(t *testing.T, dir, fixture, name string) string {
+	data, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func pluginTypes(t *testing.T, path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var confList struct {
+		Plugins []struct {
+			Type string `json:"type"`
+		} `json:"plugins"`
+	}
+	if err := json.Unmarshal(data, &confList); err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, p := range confList.Plugins {
+		types = append(types, p.Type)
+	}
+	return types
+}
+
+func equalTypes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRepairCniConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		fixture     string
+		file        string
+		wantFile    string
+		wantPlugins []string
+	}{
+		{
+			name:        "calico",
+			fixture:     "10-calico.conflist",
+			file:        "10-calico.conflist",
+			wantFile:    "10-calico.conflist",
+			wantPlugins: []string{"calico", "portmap", "bandwidth", kmeshCniPluginName},
+		},
+		{
+			name:        "cilium",
+			fixture:     "05-cilium.conflist",
+			file:        "05-cilium.conflist",
+			wantFile:    "05-cilium.conflist",
+			wantPlugins: []string{"cilium-cni", kmeshCniPluginName},
+		},
+		{
+			name:        "flannel",
+			fixture:     "10-flannel.conflist",
+			file:        "10-flannel.conflist",
+			wantFile:    "10-flannel.conflist",
+			wantPlugins: []string{"flannel", "portmap", kmeshCniPluginName},
+		},
+		{
+			name:        "single plugin conf",
+			fixture:     "10-bridge.conf",
+			file:        "10-bridge.conf",
+			wantFile:    "10-bridge.conflist",
+			wantPlugins: []string{"bridge", kmeshCniPluginName},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			copyFixture(t, dir, tt.fixture, tt.file)
+			i := NewInstaller(constants.WorkloadMode, dir, "", true)
+
+			if err := i.repairCniConfig(); err != nil {
+				t.Fatalf("repairCniConfig() error = %v", err)
+			}
+			wantPath := filepath.Join(dir, tt.wantFile)
+			if got := pluginTypes(t, wantPath); !equalTypes(got, tt.wantPlugins) {
+				t.Errorf("plugins = %v, want %v", got, tt.wantPlugins)
+			}
+			if tt.file != tt.wantFile && fileExists(filepath.Join(dir, tt.file)) {
+				t.Errorf("%s should be replaced by %s", tt.file, tt.wantFile)
+			}
+			if tt.file != tt.wantFile && !fileExists(filepath.Join(dir, tt.file+cniConfBackupSuffix)) {
+				t.Errorf("%s should be kept aside", tt.file)
+			}
+			if err := i.HealthCheck(); err != nil {
+				t.Errorf("HealthCheck() error = %v", err)
+			}
+
+			// repairing again changes nothing
+			before, _ := os.ReadFile(wantPath)
+			if err := i.repairCniConfig(); err != nil {
+				t.Fatalf("repairCniConfig() error = %v", err)
+			}
+			after, _ := os.ReadFile(wantPath)
+			if string(before) != string(after) {
+				t.Errorf("repairCniConfig() is not idempotent")
+			}
+
+			// the primary cni rewrites its config during an upgrade
+			copyFixture(t, dir, tt.fixture, tt.file)
+			if err := i.repairCniConfig(); err != nil {
+				t.Fatalf("repairCniConfig() error = %v", err)
+			}
+			if got := pluginTypes(t, wantPath); !equalTypes(got, tt.wantPlugins) {
+				t.Errorf("plugins after upgrade = %v, want %v", got, tt.wantPlugins)
+			}
+
+			// uninstalling leaves the configs of the primary cni as they were
+			if err := restoreCniConf(dir); err != nil {
+				t.Fatalf("restoreCniConf() error = %v", err)
+			}
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 1 || entries[0].Name() != tt.file {
+				t.Errorf("cni config dir holds %v, want only %s", entries, tt.file)
+			}
+		})
+	}
+}
+
+func TestRepairCniConfigRenamed(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := copyFixture(t, dir, "10-calico.conflist", "10-calico.conflist")
+	i := NewInstaller(constants.WorkloadMode, dir, "", true)
+	if err := i.repairCniConfig(); err != nil {
+		t.Fatalf("repairCniConfig() error = %v", err)
+	}
+
+	// the primary cni writes its config under a new name, which the kubelet loads first
+	newPath := copyFixture(t, dir, "10-calico.conflist", "05-calico.conflist")
+	if err := i.repairCniConfig(); err != nil {
+		t.Fatalf("repairCniConfig() error = %v", err)
+	}
+	if got := pluginTypes(t, newPath); !equalTypes(got, []string{"calico", "portmap", "bandwidth", kmeshCniPluginName}) {
+		t.Errorf("plugins of the new config = %v", got)
+	}
+	if got := pluginTypes(t, oldPath); !equalTypes(got, []string{"calico", "portmap", "bandwidth"}) {
+		t.Errorf("plugins of the previous config = %v", got)
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cniConfigPath != newPath {
+		t.Errorf("cniConfigPath = %s, want %s", i.cniConfigPath, newPath)
+	}
+}
+
+func TestCniConfigWatcher(t *testing.T) {
+	dir := t.TempDir()
+	path := copyFixture(t, dir, "10-flannel.conflist", "10-flannel.conflist")
+	i := NewInstaller(constants.WorkloadMode, dir, "", true)
+	if err := i.repairCniConfig(); err != nil {
+		t.Fatalf("repairCniConfig() error = %v", err)
+	}
+
+	// rewritten after the install and before the watch started
+	copyFixture(t, dir, "10-flannel.conflist", "10-flannel.conflist")
+	if err := i.startWatcher(); err != nil {
+		t.Fatalf("startWatcher() error = %v", err)
+	}
+	want := []string{"flannel", "portmap", kmeshCniPluginName}
+	if got := pluginTypes(t, path); !equalTypes(got, want) {
+		t.Errorf("plugins when the watch starts = %v, want %v", got, want)
+	}
+
+	copyFixture(t, dir, "10-flannel.conflist", "10-flannel.conflist")
+	deadline := time.Now().Add(5 * time.Second)
+	for !equalTypes(pluginTypes(t, path), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("kmesh plugin was not put back in %s", path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	i.stopWatcher()
+	// no longer repaired once stopped
+	copyFixture(t, dir, "10-flannel.conflist", "10-flannel.conflist")
+	time.Sleep(2 * cniConfigDebounce)
+	if got := pluginTypes(t, path); !equalTypes(got, []string{"flannel", "portmap"}) {
+		t.Errorf("plugins after stop = %v", got)
+	}
+}
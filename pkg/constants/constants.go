@@ -32,6 +32,12 @@ const (
 	RootCertPath = "/var/run/secrets/istio/root-cert.pem"
 	TrustDomain  = "cluster.local"
 
+	// CA providers signing the workload certs
+	CaProviderIstiod     = "istiod"
+	CaProviderFile       = "file"
+	CaProviderSpire      = "spire"
+	CaProviderSelfSigned = "self-signed"
+
 	BPF_LOG_ERR   = 0
 	BPF_LOG_WARN  = 1
 	BPF_LOG_INFO  = 2
@@ -58,6 +64,14 @@ const (
 	Cgroup2Path = "/mnt/kmesh_cgroup2"
 	BpfFsPath   = "/sys/fs/bpf"
 
-	VersionPath         = "/bpf_kmesh/map/"
-	WorkloadVersionPath = "/bpf_kmesh_workload/map/"
+	// AdsMapPath and WorkloadMapPath are the directories the loader pins the maps of
+	// each mode under, relative to the bpf filesystem
+	AdsMapPath      = "/bpf_kmesh/map/"
+	WorkloadMapPath = "/bpf_kmesh_workload/map/"
+
+	VersionPath         = AdsMapPath
+	WorkloadVersionPath = WorkloadMapPath
+
+	// HashNamePersistPath is where the workload HashName table is persisted across restarts
+	HashNamePersistPath = "/mnt/workload_hash_name.yaml"
 )
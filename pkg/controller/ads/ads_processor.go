@@ -18,7 +18,10 @@ package ads
 
 import (
 	"fmt"
+	"strconv"
+	"sync"
 
+	"github.com/cilium/ebpf"
 	config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
@@ -32,8 +35,10 @@ import (
 
 	admin_v2 "kmesh.net/kmesh/api/v2/admin"
 	core_v2 "kmesh.net/kmesh/api/v2/core"
+	"kmesh.net/kmesh/pkg/auth"
 	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/controller/config"
+	"kmesh.net/kmesh/pkg/events"
 	"kmesh.net/kmesh/pkg/utils/hash"
 )
 
@@ -48,12 +53,20 @@ type lastNonce struct {
 	rdsNonce string
 }
 type processor struct {
+	// mu serializes the handling of the responses with the consistency check and repair
+	mu        sync.Mutex
 	Cache     *AdsCache
 	ack       *service_discovery_v3.DiscoveryRequest
 	req       *service_discovery_v3.DiscoveryRequest
 	lastNonce *lastNonce
 	// the channel used to send domains to dns resolver. key is domain name and value is refreshrate
 	DnsResolverChan chan []*config_cluster_v3.Cluster
+	// HTTPAuth writes the RBAC http filters of the listeners into bpf, nil to not enforce them
+	HTTPAuth *auth.HTTPPolicyMap
+	// ClusterMap and RouteConfigMap are scanned by Check for the entries left without
+	// a cached counterpart, nil to skip the scan
+	ClusterMap     *ebpf.Map
+	RouteConfigMap *ebpf.Map
 }
 
 func newProcessor() *processor {
@@ -100,6 +113,9 @@ func (p *processor) processAdsResponse(resp *service_discovery_v3.DiscoveryRespo
 
 	log.Debugf("handle ads response, %#v\n", resp.GetTypeUrl())
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.ack = newAckRequest(resp)
 	if resp.GetResources() == nil {
 		return
@@ -121,6 +137,28 @@ func (p *processor) processAdsResponse(resp *service_discovery_v3.DiscoveryRespo
 	if err != nil {
 		log.Error(err)
 	}
+	publishXdsEvent(resp, err)
+}
+
+// publishXdsEvent reports a state of the world response applied to the caches
+func publishXdsEvent(resp *service_discovery_v3.DiscoveryResponse, err error) {
+	if !events.Enabled() {
+		return
+	}
+	e := events.Event{
+		Type:   events.Xds,
+		Action: "apply",
+		Attributes: map[string]string{
+			"typeUrl":   resp.GetTypeUrl(),
+			"version":   resp.GetVersionInfo(),
+			"nonce":     resp.GetNonce(),
+			"resources": strconv.Itoa(len(resp.GetResources())),
+		},
+	}
+	if err != nil {
+		e.Message = err.Error()
+	}
+	events.Publish(e)
 }
 
 func (p *processor) handleCdsResponse(resp *service_discovery_v3.DiscoveryResponse) error {
@@ -253,6 +291,7 @@ func (p *processor) handleLdsResponse(resp *service_discovery_v3.DiscoveryRespon
 	current := sets.New[string]()
 	lastRouteNames := p.Cache.routeNames
 	p.Cache.routeNames = []string{}
+	var httpFilters []auth.HTTPRBAC
 	for _, resource := range resp.GetResources() {
 		if err = anypb.UnmarshalTo(resource, listener, proto.UnmarshalOptions{}); err != nil {
 			continue
@@ -262,6 +301,9 @@ func (p *processor) handleLdsResponse(resp *service_discovery_v3.DiscoveryRespon
 			continue
 		}
 		current.Insert(listener.GetName())
+		if p.HTTPAuth != nil {
+			httpFilters = append(httpFilters, newHTTPRBACFilters(listener)...)
+		}
 		apiStatus := core_v2.ApiStatus_UPDATE
 		newHash := hash.Sum64String(resource.String())
 		if newHash != p.Cache.ListenerCache.GetLdsHash(listener.GetName()) {
@@ -281,6 +323,13 @@ func (p *processor) handleLdsResponse(resp *service_discovery_v3.DiscoveryRespon
 
 	p.Cache.ListenerCache.Flush()
 
+	if p.HTTPAuth != nil {
+		// the filters that cannot be enforced are not a reason to reject the listeners
+		if err := p.HTTPAuth.Sync(httpFilters); err != nil {
+			log.Errorf("sync http authorization failed: %v", err)
+		}
+	}
+
 	if !slices.EqualUnordered(p.Cache.routeNames, lastRouteNames) {
 		// we cannot set the nonce here.
 		// There is a race: when xds server has pushed rds, but kmesh hasn't a chance to receive and process
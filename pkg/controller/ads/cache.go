@@ -17,11 +17,14 @@
 package ads
 
 import (
+	"fmt"
+
 	config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	filters_http_rbac "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
 	filters_network_http "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
 	filters_network_tcp "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
 	envoy_type_matcher_v3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
@@ -35,6 +38,7 @@ import (
 	filter_v2 "kmesh.net/kmesh/api/v2/filter"
 	listener_v2 "kmesh.net/kmesh/api/v2/listener"
 	route_v2 "kmesh.net/kmesh/api/v2/route"
+	"kmesh.net/kmesh/pkg/auth"
 	cache_v2 "kmesh.net/kmesh/pkg/cache/v2"
 	"kmesh.net/kmesh/pkg/nets"
 )
@@ -224,6 +228,46 @@ func (load *AdsCache) CreateApiListenerByLds(status core_v2.ApiStatus, listener
 	load.ListenerCache.SetApiListener(apiListener.GetName(), apiListener)
 }
 
+// newHTTPRBACFilters returns the RBAC http filters of the http connection managers of the
+// listener, istiod puts the AuthorizationPolicies selecting the proxy into them
+func newHTTPRBACFilters(listener *config_listener_v3.Listener) []auth.HTTPRBAC {
+	addr := newApiSocketAddress(listener.GetAddress())
+	if addr == nil {
+		return nil
+	}
+
+	var filters []auth.HTTPRBAC
+	for chainIdx, filterChain := range listener.GetFilterChains() {
+		for _, filter := range filterChain.GetFilters() {
+			if filter.GetName() != pkg_wellknown.HTTPConnectionManager || filter.GetTypedConfig() == nil {
+				continue
+			}
+			filterHttp := &filters_network_http.HttpConnectionManager{}
+			if err := anypb.UnmarshalTo(filter.GetTypedConfig(), filterHttp, proto.UnmarshalOptions{}); err != nil {
+				continue
+			}
+			for filterIdx, httpFilter := range filterHttp.GetHttpFilters() {
+				if httpFilter.GetName() != pkg_wellknown.HTTPRoleBasedAccessControl ||
+					httpFilter.GetDisabled() || httpFilter.GetTypedConfig() == nil {
+					continue
+				}
+				rbac := &filters_http_rbac.RBAC{}
+				if err := anypb.UnmarshalTo(httpFilter.GetTypedConfig(), rbac, proto.UnmarshalOptions{}); err != nil {
+					log.Errorf("unmarshal rbac filter of listener %s failed: %v", listener.GetName(), err)
+					continue
+				}
+				filters = append(filters, auth.HTTPRBAC{
+					Name:  fmt.Sprintf("%s/%d/%d", listener.GetName(), chainIdx, filterIdx),
+					Ipv4:  addr.GetIpv4(),
+					Port:  addr.GetPort(),
+					Rules: rbac.GetRules(),
+				})
+			}
+		}
+	}
+	return filters
+}
+
 func newApiFilterChainMatch(match *config_listener_v3.FilterChainMatch) *listener_v2.FilterChainMatch {
 	if match == nil {
 		return &listener_v2.FilterChainMatch{}
@@ -23,6 +23,8 @@ import (
 	v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	config_rbac_v3 "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v3"
+	filters_http_rbac "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
 	filters_network_http "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
 	filters_network_tcp "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
 	pkg_wellknown "github.com/envoyproxy/go-control-plane/pkg/wellknown"
@@ -34,6 +36,7 @@ import (
 
 	core_v2 "kmesh.net/kmesh/api/v2/core"
 	listener_v2 "kmesh.net/kmesh/api/v2/listener"
+	"kmesh.net/kmesh/pkg/auth"
 	"kmesh.net/kmesh/pkg/nets"
 )
 
@@ -420,6 +423,76 @@ func TestNewApiSocketAddress(t *testing.T) {
 	})
 }
 
+func TestNewHTTPRBACFilters(t *testing.T) {
+	rules := &config_rbac_v3.RBAC{
+		Action: config_rbac_v3.RBAC_DENY,
+		Policies: map[string]*config_rbac_v3.Policy{
+			"ns[default]-policy[deny-admin]-rule[0]": {
+				Permissions: []*config_rbac_v3.Permission{{
+					Rule: &config_rbac_v3.Permission_Any{Any: true},
+				}},
+				Principals: []*config_rbac_v3.Principal{{
+					Identifier: &config_rbac_v3.Principal_Any{Any: true},
+				}},
+			},
+		},
+	}
+	rbacConfig, err := anypb.New(&filters_http_rbac.RBAC{Rules: rules})
+	assert.NoError(t, err)
+	hcmConfig, err := anypb.New(&filters_network_http.HttpConnectionManager{
+		HttpFilters: []*filters_network_http.HttpFilter{
+			{
+				Name:       pkg_wellknown.HTTPRoleBasedAccessControl,
+				ConfigType: &filters_network_http.HttpFilter_TypedConfig{TypedConfig: rbacConfig},
+			},
+			{
+				Name:       pkg_wellknown.HTTPRoleBasedAccessControl,
+				ConfigType: &filters_network_http.HttpFilter_TypedConfig{TypedConfig: rbacConfig},
+				Disabled:   true,
+			},
+			{
+				Name: pkg_wellknown.Router,
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	listener := &config_listener_v3.Listener{
+		Name: "0.0.0.0_8080",
+		Address: &v3.Address{
+			Address: &v3.Address_SocketAddress{
+				SocketAddress: &v3.SocketAddress{
+					Address:       "0.0.0.0",
+					PortSpecifier: &v3.SocketAddress_PortValue{PortValue: 8080},
+					Protocol:      v3.SocketAddress_TCP,
+				},
+			},
+		},
+		FilterChains: []*config_listener_v3.FilterChain{
+			{
+				Filters: []*config_listener_v3.Filter{
+					{
+						Name:       pkg_wellknown.HTTPConnectionManager,
+						ConfigType: &config_listener_v3.Filter_TypedConfig{TypedConfig: hcmConfig},
+					},
+				},
+			},
+		},
+	}
+
+	filters := newHTTPRBACFilters(listener)
+	assert.Len(t, filters, 1)
+	assert.Equal(t, "0.0.0.0_8080/0/0", filters[0].Name)
+	assert.Equal(t, uint32(0), filters[0].Ipv4)
+	assert.Equal(t, nets.ConvertPortToBigEndian(8080), filters[0].Port)
+	assert.Equal(t, config_rbac_v3.RBAC_DENY, filters[0].Rules.GetAction())
+	assert.Len(t, filters[0].Rules.GetPolicies(), 1)
+
+	// a listener without a tcp address is never matched by bpf
+	listener.Address = nil
+	assert.Equal(t, []auth.HTTPRBAC(nil), newHTTPRBACFilters(listener))
+}
+
 func TestCreateApiListenerByLds(t *testing.T) {
 	t.Run("listener filter configtype is filter_typedconfig", func(t *testing.T) {
 		loader := NewAdsCache()
@@ -0,0 +1,167 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ads
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	core_v2 "kmesh.net/kmesh/api/v2/core"
+	maps_v2 "kmesh.net/kmesh/pkg/cache/v2/maps"
+	"kmesh.net/kmesh/pkg/controller/consistency"
+)
+
+const (
+	listenerMapName = "kmesh_listener"
+	clusterMapName  = "kmesh_cluster"
+	routeMapName    = "map_of_router_config"
+)
+
+// Check compares the flushed listeners, clusters and route configs of the cache
+// with the bpf maps. The clusters and route configs are keyed by name, so the
+// entries left in ClusterMap and RouteConfigMap without a cached counterpart are
+// reported too. The listeners are keyed by their C socket address, the extra
+// listener entries cannot be found.
+func (p *processor) Check() ([]consistency.Diff, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.check()
+}
+
+func (p *processor) check() ([]consistency.Diff, error) {
+	var diffs []consistency.Diff
+	add := func(mapName string, missing, mismatched []string) {
+		for _, name := range missing {
+			diffs = append(diffs, consistency.Diff{
+				Map:    mapName,
+				Key:    name,
+				Kind:   consistency.Missing,
+				Detail: "flushed but not found in the bpf map",
+			})
+		}
+		for _, name := range mismatched {
+			diffs = append(diffs, consistency.Diff{
+				Map:    mapName,
+				Key:    name,
+				Kind:   consistency.Mismatch,
+				Detail: "bpf copy differs from the cache",
+			})
+		}
+	}
+	addExtra := func(mapName string, m *ebpf.Map, cached sets.Set[string]) error {
+		names, err := bpfMapNames(m)
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %v", mapName, err)
+		}
+		for _, name := range names {
+			if cached.Has(name) {
+				continue
+			}
+			diffs = append(diffs, consistency.Diff{
+				Map:    mapName,
+				Key:    name,
+				Kind:   consistency.Extra,
+				Detail: "found in the bpf map but not in the cache",
+			})
+		}
+		return nil
+	}
+
+	missing, mismatched := p.Cache.ListenerCache.CompareBpf()
+	add(listenerMapName, missing, mismatched)
+	missing, mismatched = p.Cache.ClusterCache.CompareBpf()
+	add(clusterMapName, missing, mismatched)
+	missing, mismatched = p.Cache.RouteCache.CompareBpf()
+	add(routeMapName, missing, mismatched)
+
+	if err := addExtra(clusterMapName, p.ClusterMap, p.Cache.ClusterCache.GetResourceNames()); err != nil {
+		return nil, err
+	}
+	if err := addExtra(routeMapName, p.RouteConfigMap, p.Cache.RouteCache.GetResourceNames()); err != nil {
+		return nil, err
+	}
+	return diffs, nil
+}
+
+// Repair deletes the extra entries, marks the other entries out of sync for
+// update and flushes them again
+func (p *processor) Repair() ([]consistency.Diff, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	diffs, err := p.check()
+	if err != nil || len(diffs) == 0 {
+		return diffs, err
+	}
+
+	var errs []error
+	for _, diff := range diffs {
+		if diff.Kind == consistency.Extra {
+			switch diff.Map {
+			case clusterMapName:
+				errs = append(errs, maps_v2.ClusterDelete(diff.Key))
+			case routeMapName:
+				errs = append(errs, maps_v2.RouteConfigDelete(diff.Key))
+			}
+			continue
+		}
+
+		switch diff.Map {
+		case listenerMapName:
+			p.Cache.ListenerCache.UpdateApiListenerStatus(diff.Key, core_v2.ApiStatus_UPDATE)
+		case clusterMapName:
+			p.Cache.ClusterCache.UpdateApiClusterStatus(diff.Key, core_v2.ApiStatus_UPDATE)
+		case routeMapName:
+			p.Cache.RouteCache.UpdateApiRouteStatus(diff.Key, core_v2.ApiStatus_UPDATE)
+		}
+	}
+	p.Cache.ClusterCache.Flush()
+	p.Cache.RouteCache.Flush()
+	p.Cache.ListenerCache.Flush()
+	log.Infof("repaired %d ads bpf map entries out of sync with the cache", len(diffs))
+	return diffs, errors.Join(errs...)
+}
+
+// bpfMapNames lists the keys of a map keyed by the NUL padded names written by
+// the deserialization library
+func bpfMapNames(m *ebpf.Map) ([]string, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	var (
+		names []string
+		key   any
+		next  = make([]byte, m.KeySize())
+	)
+	for {
+		err := m.NextKey(key, next)
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name, _, _ := bytes.Cut(next, []byte{0})
+		names = append(names, string(name))
+		key = bytes.Clone(next)
+	}
+}
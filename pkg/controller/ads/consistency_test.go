@@ -0,0 +1,50 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ads
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBpfMapNames(t *testing.T) {
+	names, err := bpfMapNames(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Hash,
+		KeySize:    16,
+		ValueSize:  4,
+		MaxEntries: 4,
+	})
+	require.NoError(t, err)
+	defer m.Close()
+
+	for _, name := range []string{"outbound|80||a", "b"} {
+		key := make([]byte, 16)
+		copy(key, name)
+		require.NoError(t, m.Put(key, uint32(0)))
+	}
+
+	names, err = bpfMapNames(m)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"outbound|80||a", "b"}, names)
+}
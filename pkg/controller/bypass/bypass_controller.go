@@ -17,10 +17,17 @@
 package bypass
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
 	"time"
 
+	"github.com/cilium/ebpf"
 	netns "github.com/containernetworking/plugins/pkg/ns"
+	"golang.org/x/sys/unix"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
@@ -29,6 +36,7 @@ import (
 	ns "kmesh.net/kmesh/pkg/controller/netns"
 	"kmesh.net/kmesh/pkg/kube"
 	"kmesh.net/kmesh/pkg/logger"
+	"kmesh.net/kmesh/pkg/nets"
 	"kmesh.net/kmesh/pkg/utils"
 	"kmesh.net/kmesh/pkg/utils/istio"
 )
@@ -41,40 +49,47 @@ const (
 	DefaultInformerSyncPeriod = 30 * time.Second
 	ByPassLabel               = "kmesh.net/bypass"
 	ByPassValue               = "enabled"
+	// ByPassMapName is the pin of the map holding the bypassed pods
+	ByPassMapName = "kmesh_bypass"
 )
 
+// Controller records the pods labeled for bypass in the bypass map, the cgroup
+// programs look a pod up by its netns cookie and the sockops programs by its ips.
+// The map is pinned, so the pods stay bypassed while the daemon restarts, and
+// each entry holds the owner of its pod so that it can be pruned after the restart.
 type Controller struct {
 	pod             cache.SharedIndexInformer
 	informerFactory informers.SharedInformerFactory
+	registration    cache.ResourceEventHandlerRegistration
+	bypassMap       *ebpf.Map
+
+	// mu serializes the updates of the bypass map
+	mu sync.Mutex
 }
 
-func NewByPassController(client kubernetes.Interface) *Controller {
+func NewByPassController(client kubernetes.Interface, bypassMap *ebpf.Map) *Controller {
 	informerFactory := kube.NewInformerFactory(client)
-
 	podInformer := informerFactory.Core().V1().Pods().Informer()
-	_, _ = podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+
+	c := &Controller{
+		informerFactory: informerFactory,
+		pod:             podInformer,
+		bypassMap:       bypassMap,
+	}
+
+	c.registration, _ = podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			pod, ok := obj.(*corev1.Pod)
 			if !ok {
 				log.Errorf("expected *corev1.Pod but got %T", obj)
 				return
 			}
-			if !istio.PodHasSidecar(pod) {
-				log.Infof("pod %s/%s does not have sidecar injected, skip", pod.GetNamespace(), pod.GetName())
-				return
-			}
-
-			if !shouldBypass(pod) {
-				// TODO: add delete iptables in case we missed skip bypass during kmesh restart
+			if !shouldBypass(pod) || isPodBeingDeleted(pod) {
 				return
 			}
 
-			log.Infof("%s/%s: bypass sidecar control", pod.GetNamespace(), pod.GetName())
-			nspath, _ := ns.GetPodNSpath(pod)
-			if err := addIptables(nspath); err != nil {
-				log.Errorf("failed to add iptables rules for %s: %v", nspath, err)
-				return
-			}
+			log.Infof("%s/%s: bypass the mesh", pod.GetNamespace(), pod.GetName())
+			c.bypass(pod)
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			oldPod, okOld := oldObj.(*corev1.Pod)
@@ -89,44 +104,79 @@ func NewByPassController(client kubernetes.Interface) *Controller {
 				return
 			}
 
-			if !istio.PodHasSidecar(newPod) {
-				log.Debugf("pod %s/%s does not have a sidecar", newPod.GetNamespace(), newPod.GetName())
-				return
+			switch {
+			case shouldBypass(oldPod) && !shouldBypass(newPod):
+				log.Infof("%s/%s: restore the mesh", newPod.GetNamespace(), newPod.GetName())
+				c.restore(newPod)
+			case !shouldBypass(oldPod) && shouldBypass(newPod):
+				log.Infof("%s/%s: bypass the mesh", newPod.GetNamespace(), newPod.GetName())
+				c.bypass(newPod)
+			case shouldBypass(newPod) && podIPsChanged(oldPod, newPod):
+				// the netns and the ips of a pod being created show up in later updates
+				c.bypass(newPod)
 			}
-
-			if shouldBypass(oldPod) && !shouldBypass(newPod) {
-				log.Infof("%s/%s: restore sidecar control", newPod.GetNamespace(), newPod.GetName())
-				nspath, _ := ns.GetPodNSpath(newPod)
-				if err := deleteIptables(nspath); err != nil {
-					log.Errorf("failed to delete iptables rules for %s: %v", nspath, err)
+		},
+		DeleteFunc: func(obj interface{}) {
+			pod, ok := obj.(*corev1.Pod)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					log.Errorf("couldn't get object from tombstone %#v", obj)
 					return
 				}
-			}
-			if !shouldBypass(oldPod) && shouldBypass(newPod) {
-				log.Infof("%s/%s: bypass sidecar control", newPod.GetNamespace(), newPod.GetName())
-				nspath, _ := ns.GetPodNSpath(newPod)
-				if err := addIptables(nspath); err != nil {
-					log.Errorf("failed to add iptables rules for %s: %v", nspath, err)
+				if pod, ok = tombstone.Obj.(*corev1.Pod); !ok {
+					log.Errorf("tombstone contained object that is not a Pod %#v", obj)
 					return
 				}
 			}
+			if err := c.disableBypass(pod); err != nil {
+				log.Errorf("failed to remove the bypass of %s/%s: %v", pod.GetNamespace(), pod.GetName(), err)
+			}
 		},
-		// We do not need to process delete here, because
-		// in istio sidecar mode, we do not need to delete the iptables.
 	})
 
-	c := &Controller{
-		informerFactory: informerFactory,
-		pod:             podInformer,
-	}
-
 	return c
 }
 
 func (c *Controller) Run(stop <-chan struct{}) {
 	c.informerFactory.Start(stop)
-	if !cache.WaitForCacheSync(stop, c.pod.HasSynced) {
+	if !cache.WaitForCacheSync(stop, c.pod.HasSynced, c.registration.HasSynced) {
 		log.Error("failed to wait pod cache sync")
+		return
+	}
+
+	if err := c.pruneBypassMap(); err != nil {
+		log.Errorf("failed to prune the bypass map: %v", err)
+	}
+	// earlier versions bypassed the sidecar of a labeled pod with nat RETURN rules,
+	// which the bypass map makes unnecessary
+	for _, obj := range c.pod.GetStore().List() {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || !istio.PodHasSidecar(pod) || !shouldBypass(pod) {
+			continue
+		}
+		nspath, err := ns.GetPodNSpath(pod)
+		if err != nil {
+			continue
+		}
+		if err := deleteIptables(nspath); err != nil {
+			// fails when there is no rule left to delete
+			log.Debugf("no bypass iptables rules to remove for %s/%s: %v", pod.GetNamespace(), pod.GetName(), err)
+		}
+	}
+}
+
+// bypass takes a labeled pod off the traffic path of the mesh through the bypass map
+func (c *Controller) bypass(pod *corev1.Pod) {
+	if err := c.enableBypass(pod); err != nil {
+		log.Errorf("failed to bypass %s/%s: %v", pod.GetNamespace(), pod.GetName(), err)
+	}
+}
+
+// restore puts a pod whose label was removed back on the traffic path of the mesh
+func (c *Controller) restore(pod *corev1.Pod) {
+	if err := c.disableBypass(pod); err != nil {
+		log.Errorf("failed to restore %s/%s: %v", pod.GetNamespace(), pod.GetName(), err)
 	}
 }
 
@@ -139,35 +189,167 @@ func isPodBeingDeleted(pod *corev1.Pod) bool {
 	return pod.ObjectMeta.DeletionTimestamp != nil
 }
 
-func addIptables(ns string) error {
-	iptArgs := [][]string{
-		{"-t", "nat", "-I", "PREROUTING", "1", "-j", "RETURN"},
-		{"-t", "nat", "-I", "OUTPUT", "1", "-j", "RETURN"},
+// enableBypass records the netns cookie and the ips of the pod in the bypass map, and
+// deletes the keys of the ips the pod no longer has
+func (c *Controller) enableBypass(pod *corev1.Pod) error {
+	nspath, err := ns.GetPodNSpath(pod)
+	if err != nil {
+		return err
+	}
+	cookie, err := getNetNsCookie(nspath)
+	if err != nil {
+		return err
+	}
+	keys := bypassKeys(int(c.bypassMap.KeySize()), cookie, podIPs(pod))
+	if len(keys) == 0 {
+		return nil
 	}
 
-	execFunc := func(netns.NetNS) error {
-		log.Infof("Running add iptables rule in namespace:%s", ns)
-		//To avoid iptables rules being added multiple times due to problems with k8s resource synchronization
-		delIptArgs := [][]string{
-			{"-t", "nat", "-D", "PREROUTING", "-j", "RETURN"},
-			{"-t", "nat", "-D", "OUTPUT", "-j", "RETURN"},
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	owner := podOwner(pod)
+	for _, key := range keys {
+		if err := c.bypassMap.Put([]byte(key), owner); err != nil {
+			return fmt.Errorf("failed to update bypass map: %v", err)
 		}
-		for _, delargs := range delIptArgs {
-			_ = utils.Execute("iptables", delargs)
+	}
+	return c.deleteEntries(func(key string, value uint32) bool {
+		return value == owner && !contains(keys, key)
+	})
+}
+
+// disableBypass deletes the keys recorded for the pod from the bypass map
+func (c *Controller) disableBypass(pod *corev1.Pod) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	owner := podOwner(pod)
+	return c.deleteEntries(func(_ string, value uint32) bool {
+		return value == owner
+	})
+}
+
+// pruneBypassMap deletes the keys of the pods deleted or no longer labeled while the
+// daemon was down. The keys of the labeled pods are kept even if recording them again
+// failed, e.g. when their netns could not be entered.
+func (c *Controller) pruneBypassMap() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	labeled := make(map[uint32]struct{})
+	for _, obj := range c.pod.GetStore().List() {
+		if pod, ok := obj.(*corev1.Pod); ok && shouldBypass(pod) && !isPodBeingDeleted(pod) {
+			labeled[podOwner(pod)] = struct{}{}
 		}
-		for _, args := range iptArgs {
-			if err := utils.Execute("iptables", args); err != nil {
-				return fmt.Errorf("failed to exec command: iptables %v\", err: %v", args, err)
-			}
+	}
+	return c.deleteEntries(func(_ string, value uint32) bool {
+		_, ok := labeled[value]
+		return !ok
+	})
+}
+
+// deleteEntries deletes the entries of the bypass map matching f, c.mu must be held
+func (c *Controller) deleteEntries(f func(key string, value uint32) bool) error {
+	var (
+		stale [][]byte
+		key   []byte
+		value uint32
+	)
+	iter := c.bypassMap.Iterate()
+	for iter.Next(&key, &value) {
+		if f(string(key), value) {
+			stale = append(stale, append([]byte(nil), key...))
 		}
-		return nil
 	}
-	if err := netns.WithNetNSPath(ns, execFunc); err != nil {
-		return fmt.Errorf("enter namespace path: %v, run command failed: %v", ns, err)
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if err := c.bypassMap.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to delete from bypass map: %v", err)
+		}
 	}
 	return nil
 }
 
+// podOwner is the value of the entries of the pod in the bypass map, the bpf programs only
+// look the keys up, so the value tells the daemon which pod an entry belongs to
+func podOwner(pod *corev1.Pod) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(pod.GetUID()))
+	return h.Sum32()
+}
+
+// bypassKeys returns the keys of a pod in the bypass map, which share the layout of the
+// manage map key: a union of the netns cookie and an ip address in network order
+func bypassKeys(keySize int, cookie uint64, ips []net.IP) []string {
+	var keys []string
+	if cookie != 0 {
+		key := make([]byte, keySize)
+		binary.NativeEndian.PutUint64(key, cookie)
+		keys = append(keys, string(key))
+	}
+	for _, ip := range ips {
+		key := make([]byte, keySize)
+		if ip4 := ip.To4(); ip4 != nil {
+			copy(key, ip4)
+		} else {
+			copy(key, ip.To16())
+		}
+		keys = append(keys, string(key))
+	}
+	return keys
+}
+
+func podIPsChanged(oldPod, newPod *corev1.Pod) bool {
+	if oldPod.Status.PodIP != newPod.Status.PodIP || len(oldPod.Status.PodIPs) != len(newPod.Status.PodIPs) {
+		return true
+	}
+	for i := range oldPod.Status.PodIPs {
+		if oldPod.Status.PodIPs[i].IP != newPod.Status.PodIPs[i].IP {
+			return true
+		}
+	}
+	return false
+}
+
+func podIPs(pod *corev1.Pod) []net.IP {
+	var ips []net.IP
+	for _, podIP := range pod.Status.PodIPs {
+		if ip := net.ParseIP(podIP.IP); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		if ip := net.ParseIP(pod.Status.PodIP); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// getNetNsCookie returns the cookie of the pod netns, 0 on kernels without netns cookies,
+// where the pod is only bypassed by the sockops programs
+func getNetNsCookie(nspath string) (uint64, error) {
+	var cookie uint64
+	err := netns.WithNetNSPath(nspath, func(netns.NetNS) error {
+		var err error
+		cookie, err = nets.GetNetNsCookie()
+		return err
+	})
+	if errors.Is(err, unix.ENOPROTOOPT) {
+		return 0, nil
+	}
+	return cookie, err
+}
+
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
 func deleteIptables(ns string) error {
 	iptArgs := [][]string{
 		{"-t", "nat", "-D", "PREROUTING", "-j", "RETURN"},
@@ -175,12 +357,10 @@ func deleteIptables(ns string) error {
 	}
 
 	execFunc := func(netns.NetNS) error {
-		log.Infof("Running delete iptables rule in namespace:%s", ns)
+		log.Debugf("Running delete iptables rule in namespace:%s", ns)
 		for _, args := range iptArgs {
 			if err := utils.Execute("iptables", args); err != nil {
-				err = fmt.Errorf("failed to exec command: iptables %v\", err: %v", args, err)
-				log.Error(err)
-				return err
+				return fmt.Errorf("failed to exec command: iptables %v\", err: %v", args, err)
 			}
 		}
 		return nil
@@ -18,19 +18,72 @@ package bypass
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"net"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/agiledragon/gomonkey/v2"
+	"github.com/cilium/ebpf"
+	netns "github.com/containernetworking/plugins/pkg/ns"
 	"github.com/stretchr/testify/assert"
 	"istio.io/api/annotation"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/fake"
+
+	ns "kmesh.net/kmesh/pkg/controller/netns"
+	"kmesh.net/kmesh/pkg/utils"
 )
 
+func newFakeBypassMap(t *testing.T) *ebpf.Map {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       ByPassMapName,
+		Type:       ebpf.Hash,
+		KeySize:    16,
+		ValueSize:  4,
+		MaxEntries: 64,
+	})
+	if err != nil {
+		t.Skipf("creating a bpf map is not permitted: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+// startController runs the controller until the test ends, its handlers are done
+// before the map is closed
+func startController(t *testing.T, client *fake.Clientset, bypassMap *ebpf.Map) *Controller {
+	stopCh := make(chan struct{})
+	c := NewByPassController(client, bypassMap)
+	t.Cleanup(func() {
+		close(stopCh)
+		c.informerFactory.Shutdown()
+	})
+	c.Run(stopCh)
+	return c
+}
+
+func mapKeys(t *testing.T, m *ebpf.Map) []string {
+	var (
+		keys  []string
+		key   []byte
+		value uint32
+	)
+	iter := m.Iterate()
+	for iter.Next(&key, &value) {
+		keys = append(keys, string(key))
+	}
+	assert.NoError(t, iter.Err())
+	return keys
+}
+
 func TestBypassController(t *testing.T) {
 	nodeName := "test_node"
 	err := os.Setenv("NODE_NAME", nodeName)
@@ -38,116 +91,195 @@ func TestBypassController(t *testing.T) {
 	t.Cleanup(func() {
 		os.Unsetenv("NODE_NAME")
 	})
-	stopCh := make(chan struct{})
-	defer close(stopCh)
 	namespaceName := "default"
-	namespace := &corev1.Namespace{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "Pod",
-			APIVersion: "v1",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name: namespaceName,
-			Labels: map[string]string{
-				"istio-injection": "enabled",
-			},
-		},
-	}
-	client := fake.NewSimpleClientset(namespace)
-	c := NewByPassController(client)
-	c.Run(stopCh)
 
-	enabled := atomic.Bool{}
-	disabled := atomic.Bool{}
+	bypassMap := newFakeBypassMap(t)
+	// a pod deleted while the daemon was down
+	stale := bypassKeys(16, 7, nil)[0]
+	assert.NoError(t, bypassMap.Put([]byte(stale), uint32(0)))
 
-	var wg sync.WaitGroup
-
-	patches1 := gomonkey.NewPatches()
-	defer patches1.Reset()
-
-	patches1.ApplyFunc(addIptables, func(ns string) error {
-		enabled.Store(true)
-		// Signal that addIptables has been called
-		wg.Done()
-		return nil
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(ns.GetPodNSpath, func(pod *corev1.Pod) (string, error) {
+		if pod.GetName() == "unready-pod" {
+			return "", errors.New("netns not found")
+		}
+		return "/host/proc/1/ns/net", nil
+	})
+	patches.ApplyFunc(getNetNsCookie, func(string) (uint64, error) {
+		return 42, nil
 	})
-	patches1.ApplyFunc(deleteIptables, func(ns string) error {
-		disabled.Store(true)
-		// Signal that addIptables has been called
-		wg.Done()
+	patches.ApplyFunc(utils.Execute, func(string, []string) error {
 		return nil
 	})
 
-	podWithBypassButNoSidecar := &corev1.Pod{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "Pod",
-			APIVersion: "v1",
-		},
+	// a pod bypassed before the restart, whose netns can not be entered now
+	unreadyPod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      "test-pod-no-sidecar",
+			Name:      "unready-pod",
 			Namespace: namespaceName,
+			UID:       "uid-unready",
 			Labels: map[string]string{
 				ByPassLabel: ByPassValue,
 			},
 		},
-		Spec: corev1.PodSpec{
-			NodeName: nodeName,
-		},
 	}
-
-	// case 1: pod with bypass label but no sidecar
-	_, err = client.CoreV1().Pods(namespaceName).Create(context.TODO(), podWithBypassButNoSidecar, metav1.CreateOptions{})
-	assert.NoError(t, err)
-	assert.Equal(t, false, enabled.Load(), "unexpected value for enabled flag")
-	assert.Equal(t, false, disabled.Load(), "unexpected value for disabled flag")
+	unreadyKey := bypassKeys(16, 8, nil)[0]
+	assert.NoError(t, bypassMap.Put([]byte(unreadyKey), podOwner(unreadyPod)))
 
 	podWithBypass := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "test-pod",
 			Namespace: namespaceName,
+			UID:       "uid-1",
 			Labels: map[string]string{
 				ByPassLabel: ByPassValue,
 			},
-			Annotations: map[string]string{
-				annotation.SidecarStatus.Name: "placeholder",
-			},
 		},
 		Spec: corev1.PodSpec{
 			NodeName: nodeName,
 		},
+		Status: corev1.PodStatus{
+			PodIP:  "10.244.0.5",
+			PodIPs: []corev1.PodIP{{IP: "10.244.0.5"}, {IP: "fd00::5"}},
+		},
 	}
+	wantKeys := bypassKeys(16, 42, []net.IP{net.ParseIP("10.244.0.5"), net.ParseIP("fd00::5")})
 
-	// case 2: pod with bypass label and sidecar
-	wg.Add(1)
-	_, err = client.CoreV1().Pods(namespaceName).Create(context.TODO(), podWithBypass, metav1.CreateOptions{})
-	assert.NoError(t, err)
-	wg.Wait()
-	assert.Equal(t, true, enabled.Load(), "unexpected value for enabled flag")
-	assert.Equal(t, false, disabled.Load(), "unexpected value for disabled flag")
-
-	enabled.Store(false)
-	disabled.Store(false)
+	// case 1: the bypassed pods are recorded again and the keys of the deleted pods pruned
+	// on start, the labeled pods keep their keys even if recording them failed
+	client := fake.NewSimpleClientset(podWithBypass, unreadyPod)
+	startController(t, client, bypassMap)
+	assert.ElementsMatch(t, append([]string{unreadyKey}, wantKeys...), mapKeys(t, bypassMap))
 
-	// case 3: pod update by removing bypass label
-	// Update pod by removing the bypass label
+	// case 2: pod update by removing bypass label
 	newPod := podWithBypass.DeepCopy()
 	delete(newPod.Labels, ByPassLabel)
-	wg.Add(1)
 	_, err = client.CoreV1().Pods(namespaceName).Update(context.TODO(), newPod, metav1.UpdateOptions{})
 	assert.NoError(t, err)
-	wg.Wait()
-	assert.Equal(t, false, enabled.Load(), "unexpected value for enabled flag")
-	assert.Equal(t, true, disabled.Load(), "unexpected value for disabled flag")
-
-	enabled.Store(false)
-	disabled.Store(false)
-	// case 4: Update pod by adding the bypass label
-	newPod = podWithBypass.DeepCopy()
-	newPod.Labels[ByPassLabel] = ByPassValue
-	wg.Add(1)
-	_, err = client.CoreV1().Pods(namespaceName).Update(context.TODO(), newPod, metav1.UpdateOptions{})
+	assert.Eventually(t, func() bool { return len(mapKeys(t, bypassMap)) == 1 }, time.Second, 10*time.Millisecond)
+
+	// case 3: Update pod by adding the bypass label
+	_, err = client.CoreV1().Pods(namespaceName).Update(context.TODO(), podWithBypass.DeepCopy(), metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(mapKeys(t, bypassMap)) == len(wantKeys)+1 }, time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, append([]string{unreadyKey}, wantKeys...), mapKeys(t, bypassMap))
+
+	// case 4: pods deleted
+	err = client.CoreV1().Pods(namespaceName).Delete(context.TODO(), podWithBypass.Name, metav1.DeleteOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(mapKeys(t, bypassMap)) == 1 }, time.Second, 10*time.Millisecond)
+	err = client.CoreV1().Pods(namespaceName).Delete(context.TODO(), unreadyPod.Name, metav1.DeleteOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(mapKeys(t, bypassMap)) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestBypassKeys(t *testing.T) {
+	keys := bypassKeys(16, 42, []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("::ffff:10.0.0.2"), net.ParseIP("fd00::1")})
+	assert.Len(t, keys, 4)
+
+	cookie := make([]byte, 16)
+	binary.NativeEndian.PutUint64(cookie, 42)
+	assert.Equal(t, string(cookie), keys[0])
+	// the sockops programs look the ipv4 addresses up in the first 4 bytes, in network order
+	assert.Equal(t, string(append([]byte{10, 0, 0, 1}, make([]byte, 12)...)), keys[1])
+	assert.Equal(t, string(append([]byte{10, 0, 0, 2}, make([]byte, 12)...)), keys[2])
+	assert.Equal(t, string(net.ParseIP("fd00::1").To16()), keys[3])
+
+	// without netns cookies only the ips are recorded
+	assert.Len(t, bypassKeys(16, 0, []net.IP{net.ParseIP("10.0.0.1")}), 1)
+}
+
+// fakeIptables records the iptables rules of each netns
+type fakeIptables struct {
+	mu    sync.Mutex
+	rules map[string]int
+	cur   string
+}
+
+func (f *fakeIptables) count(nspath string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rules[nspath]
+}
+
+func TestBypassControllerSidecar(t *testing.T) {
+	bypassMap := newFakeBypassMap(t)
+
+	ipt := &fakeIptables{rules: make(map[string]int)}
+	var cookieCalls atomic.Int32
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(ns.GetPodNSpath, func(pod *corev1.Pod) (string, error) {
+		return "/host/proc/" + pod.GetName() + "/ns/net", nil
+	})
+	patches.ApplyFunc(getNetNsCookie, func(string) (uint64, error) {
+		cookieCalls.Add(1)
+		return 42, nil
+	})
+	patches.ApplyFunc(netns.WithNetNSPath, func(nspath string, toRun func(netns.NetNS) error) error {
+		ipt.mu.Lock()
+		ipt.cur = nspath
+		ipt.mu.Unlock()
+		return toRun(nil)
+	})
+	patches.ApplyFunc(utils.Execute, func(_ string, args []string) error {
+		ipt.mu.Lock()
+		defer ipt.mu.Unlock()
+		switch {
+		case args[2] == "-I":
+			ipt.rules[ipt.cur]++
+		case ipt.rules[ipt.cur] == 0:
+			return os.ErrNotExist
+		default:
+			ipt.rules[ipt.cur]--
+		}
+		return nil
+	})
+
+	bypassed := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "bypassed",
+			Namespace:   "default",
+			UID:         types.UID("uid-bypassed"),
+			Labels:      map[string]string{ByPassLabel: ByPassValue},
+			Annotations: map[string]string{annotation.SidecarStatus.Name: "placeholder"},
+		},
+		Status: corev1.PodStatus{PodIP: "10.244.0.9"},
+	}
+	// left by an earlier version of the daemon
+	ipt.rules["/host/proc/bypassed/ns/net"] = 2
+
+	client := fake.NewSimpleClientset(bypassed)
+	startController(t, client, bypassMap)
+	assert.Equal(t, 0, ipt.count("/host/proc/bypassed/ns/net"))
+	assert.NotEmpty(t, mapKeys(t, bypassMap))
+	assert.Equal(t, int32(1), cookieCalls.Load())
+
+	// an update changing neither the label nor the ips is ignored
+	updated := bypassed.DeepCopy()
+	updated.Labels["app"] = "sleep"
+	_, err := client.CoreV1().Pods("default").Update(context.TODO(), updated, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	updated = updated.DeepCopy()
+	updated.Status.PodIP = "10.244.0.10"
+	_, err = client.CoreV1().Pods("default").Update(context.TODO(), updated, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		for _, key := range mapKeys(t, bypassMap) {
+			if strings.HasPrefix(key, string([]byte{10, 244, 0, 10})) {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), cookieCalls.Load())
+
+	delete(updated.Labels, ByPassLabel)
+	_, err = client.CoreV1().Pods("default").Update(context.TODO(), updated, metav1.UpdateOptions{})
 	assert.NoError(t, err)
-	wg.Wait()
-	assert.Equal(t, true, enabled.Load(), "unexpected value for enabled flag")
-	assert.Equal(t, false, disabled.Load(), "unexpected value for disabled flag")
+	assert.Eventually(t, func() bool { return len(mapKeys(t, bypassMap)) == 0 }, time.Second, 10*time.Millisecond)
+	// no rule is ever inserted
+	assert.Equal(t, 0, ipt.count("/host/proc/bypassed/ns/net"))
 }
@@ -18,6 +18,7 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -29,7 +30,9 @@ import (
 	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/controller/ads"
 	"kmesh.net/kmesh/pkg/controller/config"
+	"kmesh.net/kmesh/pkg/controller/consistency"
 	"kmesh.net/kmesh/pkg/controller/workload"
+	"kmesh.net/kmesh/pkg/health"
 	"kmesh.net/kmesh/pkg/nets"
 )
 
@@ -46,12 +49,16 @@ type XdsClient struct {
 	AdsController      *ads.Controller
 	WorkloadController *workload.Controller
 	xdsConfig          *config.XdsConfig
+	// status is healthy once the stream is connected and the first response
+	// from the control plane has been applied
+	status *health.Status
 }
 
 func NewXdsClient(mode string, bpfWorkload *bpf.BpfKmeshWorkload) *XdsClient {
 	client := &XdsClient{
 		mode:      mode,
 		xdsConfig: config.GetConfig(mode),
+		status:    health.NewStatus(errors.New("xds stream is not connected")),
 	}
 
 	if mode == constants.WorkloadMode {
@@ -64,6 +71,18 @@ func NewXdsClient(mode string, bpfWorkload *bpf.BpfKmeshWorkload) *XdsClient {
 	return client
 }
 
+// ConsistencyChecker returns the checker of the cache versus bpf map consistency
+// of the running mode, nil if there is none
+func (c *XdsClient) ConsistencyChecker() consistency.Checker {
+	if c.WorkloadController != nil {
+		return c.WorkloadController.Processor
+	}
+	if c.AdsController != nil {
+		return c.AdsController.Processor
+	}
+	return nil
+}
+
 func (c *XdsClient) createGrpcStreamClient() error {
 	var err error
 
@@ -85,6 +104,7 @@ func (c *XdsClient) createGrpcStreamClient() error {
 		}
 	}
 
+	c.status.SetUnhealthy("xds stream is connected, waiting for the first response")
 	return nil
 }
 
@@ -124,6 +144,7 @@ func (c *XdsClient) handleUpstream(ctx context.Context) {
 
 			if c.mode == constants.AdsMode {
 				if err = c.AdsController.HandleAdsStream(); err != nil {
+					c.status.Set(fmt.Errorf("xds stream is disconnected: %v", err))
 					_ = c.AdsController.Stream.CloseSend()
 					_ = c.grpcConn.Close()
 					reconnect = true
@@ -131,6 +152,7 @@ func (c *XdsClient) handleUpstream(ctx context.Context) {
 				}
 			} else if c.mode == constants.WorkloadMode {
 				if err = c.WorkloadController.HandleWorkloadStream(); err != nil {
+					c.status.Set(fmt.Errorf("xds stream is disconnected: %v", err))
 					_ = c.WorkloadController.Stream.CloseSend()
 					_ = c.grpcConn.Close()
 					reconnect = true
@@ -141,11 +163,13 @@ func (c *XdsClient) handleUpstream(ctx context.Context) {
 				_ = c.grpcConn.Close()
 				reconnect = true
 			}
+			c.status.SetHealthy()
 		}
 	}
 }
 
 func (c *XdsClient) Run(stopCh <-chan struct{}) error {
+	health.Register("xds", health.Readiness, c.status.Check)
 	if err := c.createGrpcStreamClient(); err != nil {
 		return fmt.Errorf("create client and stream failed, %s", err)
 	}
@@ -0,0 +1,142 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consistency
+
+import (
+	"sort"
+	"time"
+
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+	"kmesh.net/kmesh/pkg/logger"
+)
+
+var log = logger.NewLoggerField("consistency")
+
+// Kind tells how a bpf map entry differs from the userspace cache.
+type Kind string
+
+const (
+	// Missing entries are expected from the cache but not found in the bpf map.
+	Missing Kind = "missing"
+	// Extra entries are found in the bpf map but not explained by the cache.
+	Extra Kind = "extra"
+	// Mismatch entries exist on both sides with different values.
+	Mismatch Kind = "mismatch"
+)
+
+// Diff is one entry out of sync between the cache and a bpf map.
+type Diff struct {
+	Map    string `json:"map"`
+	Key    string `json:"key"`
+	Kind   Kind   `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Checker compares the userspace view of a mode with its pinned bpf maps.
+type Checker interface {
+	// Check returns the entries out of sync, without changing anything.
+	Check() ([]Diff, error)
+	// Repair rewrites the bpf maps from the cache and returns the entries
+	// that were out of sync before the repair.
+	Repair() ([]Diff, error)
+}
+
+// Report is the result of one check or repair.
+type Report struct {
+	Time     time.Time `json:"time"`
+	Repaired bool      `json:"repaired"`
+	Diffs    []Diff    `json:"diffs"`
+}
+
+// Check runs the checker once, or repairs the drift when repair is set, and
+// records the result in the metrics.
+func Check(checker Checker, repair bool) (*Report, error) {
+	var (
+		diffs []Diff
+		err   error
+	)
+	if repair {
+		diffs, err = checker.Repair()
+	} else {
+		diffs, err = checker.Check()
+	}
+	if err != nil {
+		telemetry.ConsistencyChecks.WithLabelValues("error").Inc()
+		return nil, err
+	}
+
+	sortDiffs(diffs)
+	telemetry.ConsistencyDriftEntries.Reset()
+	for _, d := range diffs {
+		telemetry.ConsistencyDriftEntries.WithLabelValues(d.Map, string(d.Kind)).Inc()
+	}
+	if len(diffs) == 0 {
+		telemetry.ConsistencyChecks.WithLabelValues("consistent").Inc()
+	} else {
+		telemetry.ConsistencyChecks.WithLabelValues("drift").Inc()
+	}
+	if repair {
+		telemetry.ConsistencyRepairs.Add(float64(len(diffs)))
+		// everything found has been rewritten, the maps are in sync now
+		telemetry.ConsistencyDriftEntries.Reset()
+	}
+
+	return &Report{
+		Time:     time.Now(),
+		Repaired: repair,
+		Diffs:    diffs,
+	}, nil
+}
+
+// Run checks the consistency every interval until stopCh is closed, the drift
+// is logged and exposed by the metrics but never repaired automatically.
+func Run(stopCh <-chan struct{}, checker Checker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			report, err := Check(checker, false)
+			if err != nil {
+				log.Errorf("consistency check failed: %v", err)
+				continue
+			}
+			if len(report.Diffs) == 0 {
+				continue
+			}
+			log.Warnf("found %d bpf map entries out of sync with the cache, run `kmesh-daemon diff --repair` to rewrite them", len(report.Diffs))
+			for _, d := range report.Diffs {
+				log.Debugf("%s %s %s: %s", d.Map, d.Kind, d.Key, d.Detail)
+			}
+		}
+	}
+}
+
+func sortDiffs(diffs []Diff) {
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Map != diffs[j].Map {
+			return diffs[i].Map < diffs[j].Map
+		}
+		if diffs[i].Key != diffs[j].Key {
+			return diffs[i].Key < diffs[j].Key
+		}
+		return diffs[i].Kind < diffs[j].Kind
+	})
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consistency
+
+import (
+	"errors"
+	"testing"
+
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+)
+
+type fakeChecker struct {
+	diffs    []Diff
+	err      error
+	repaired bool
+}
+
+func (c *fakeChecker) Check() ([]Diff, error) {
+	return c.diffs, c.err
+}
+
+func (c *fakeChecker) Repair() ([]Diff, error) {
+	c.repaired = true
+	return c.diffs, c.err
+}
+
+func TestCheck(t *testing.T) {
+	checker := &fakeChecker{diffs: []Diff{
+		{Map: "kmesh_service", Key: "default/foo", Kind: Missing},
+		{Map: "kmesh_endpoint", Key: "default/foo[2]", Kind: Extra},
+		{Map: "kmesh_endpoint", Key: "default/foo[1]", Kind: Mismatch},
+	}}
+
+	drift := promtestutil.ToFloat64(telemetry.ConsistencyChecks.WithLabelValues("drift"))
+	report, err := Check(checker, false)
+	assert.NoError(t, err)
+	assert.False(t, report.Repaired)
+	assert.False(t, checker.repaired)
+	assert.Equal(t, []string{"default/foo[1]", "default/foo[2]", "default/foo"}, []string{report.Diffs[0].Key, report.Diffs[1].Key, report.Diffs[2].Key})
+	assert.Equal(t, float64(1), promtestutil.ToFloat64(telemetry.ConsistencyDriftEntries.WithLabelValues("kmesh_endpoint", string(Extra))))
+	assert.Equal(t, float64(1), promtestutil.ToFloat64(telemetry.ConsistencyDriftEntries.WithLabelValues("kmesh_service", string(Missing))))
+	assert.Equal(t, float64(1), promtestutil.ToFloat64(telemetry.ConsistencyChecks.WithLabelValues("drift"))-drift)
+
+	repairs := promtestutil.ToFloat64(telemetry.ConsistencyRepairs)
+	report, err = Check(checker, true)
+	assert.NoError(t, err)
+	assert.True(t, report.Repaired)
+	assert.True(t, checker.repaired)
+	assert.Equal(t, float64(3), promtestutil.ToFloat64(telemetry.ConsistencyRepairs)-repairs)
+	assert.Equal(t, 0, promtestutil.CollectAndCount(telemetry.ConsistencyDriftEntries))
+
+	checker.err = errors.New("dump failed")
+	failed := promtestutil.ToFloat64(telemetry.ConsistencyChecks.WithLabelValues("error"))
+	_, err = Check(checker, false)
+	assert.Error(t, err)
+	assert.Equal(t, float64(1), promtestutil.ToFloat64(telemetry.ConsistencyChecks.WithLabelValues("error"))-failed)
+}
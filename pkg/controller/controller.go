@@ -21,12 +21,16 @@ import (
 	"fmt"
 
 	"kmesh.net/kmesh/daemon/options"
+	"kmesh.net/kmesh/pkg/auth"
 	"kmesh.net/kmesh/pkg/bpf"
 	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/controller/bypass"
+	"kmesh.net/kmesh/pkg/controller/consistency"
 	manage "kmesh.net/kmesh/pkg/controller/manage"
 	"kmesh.net/kmesh/pkg/controller/security"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
 	"kmesh.net/kmesh/pkg/dns"
+	"kmesh.net/kmesh/pkg/health"
 	"kmesh.net/kmesh/pkg/logger"
 	"kmesh.net/kmesh/pkg/utils"
 )
@@ -42,8 +46,22 @@ type Controller struct {
 	client              *XdsClient
 	enableByPass        bool
 	enableSecretManager bool
+	secretStoreDir      string
+	secretStoreKeyFile  string
+	sdsSocket           string
+	sdsAllow            []string
+	caConfig            security.CaConfig
+	secretManager       *security.SecretManager
+	manageController    *manage.KmeshManageController
 	bpfFsPath           string
 	enableBpfLog        bool
+	otlpConfig          *options.OtlpConfig
+	accesslogConfig     *options.AccesslogConfig
+	metricConfig        *options.MetricConfig
+	flowConfig          *options.FlowConfig
+	probeConfig         *options.ProbeConfig
+	consistencyConfig   *options.ConsistencyConfig
+	enrollmentConfig    *options.EnrollmentConfig
 }
 
 func NewController(opts *options.BootstrapConfigs, bpfWorkloadObj *bpf.BpfKmeshWorkload, bpfFsPath string, enableBpfLog bool) *Controller {
@@ -52,8 +70,26 @@ func NewController(opts *options.BootstrapConfigs, bpfWorkloadObj *bpf.BpfKmeshW
 		enableByPass:        opts.ByPassConfig.EnableByPass,
 		bpfWorkloadObj:      bpfWorkloadObj,
 		enableSecretManager: opts.SecretManagerConfig.Enable,
+		secretStoreDir:      opts.SecretManagerConfig.StoreDir,
+		secretStoreKeyFile:  opts.SecretManagerConfig.StoreKeyFile,
+		sdsSocket:           opts.SecretManagerConfig.SdsSocket,
+		sdsAllow:            opts.SecretManagerConfig.SdsAllow,
 		bpfFsPath:           bpfFsPath,
 		enableBpfLog:        enableBpfLog,
+		otlpConfig:          opts.OtlpConfig,
+		accesslogConfig:     opts.AccesslogConfig,
+		metricConfig:        opts.MetricConfig,
+		flowConfig:          opts.FlowConfig,
+		probeConfig:         opts.ProbeConfig,
+		consistencyConfig:   opts.ConsistencyConfig,
+		enrollmentConfig:    opts.EnrollmentConfig,
+		caConfig: security.CaConfig{
+			Provider:    opts.SecretManagerConfig.CaProvider,
+			ClusterID:   opts.SecretManagerConfig.CaClusterID,
+			CertDir:     opts.SecretManagerConfig.CaCertDir,
+			SpireSocket: opts.SecretManagerConfig.SpireSocket,
+			TrustDomain: opts.SecretManagerConfig.TrustDomain,
+		},
 	}
 }
 
@@ -63,11 +99,17 @@ func (c *Controller) Start(stopCh <-chan struct{}) error {
 	var kmeshManageController *manage.KmeshManageController
 
 	if c.mode == constants.WorkloadMode && c.enableSecretManager {
-		secertManager, err = security.NewSecretManager()
+		secertManager, err = security.NewSecretManager(c.caConfig)
 		if err != nil {
 			return fmt.Errorf("secretManager create failed: %v", err)
 		}
-		go secertManager.Run(stopCh)
+		if c.secretStoreDir != "" {
+			store, err := security.NewCertStore(c.secretStoreDir, c.secretStoreKeyFile)
+			if err != nil {
+				return fmt.Errorf("cert store create failed: %v", err)
+			}
+			secertManager.SetCertStore(store)
+		}
 	}
 
 	clientset, err := utils.GetK8sclient()
@@ -83,11 +125,33 @@ func (c *Controller) Start(stopCh <-chan struct{}) error {
 	if err != nil {
 		return fmt.Errorf("failed to start kmesh manage controller: %v", err)
 	}
+	if secertManager != nil {
+		// the sds server resolves the pods of its peers with the manage controller
+		if c.sdsSocket != "" {
+			sdsServer, err := security.NewSdsServer(c.sdsSocket, c.sdsAllow, secertManager, kmeshManageController.PodIdentity)
+			if err != nil {
+				return fmt.Errorf("sds server create failed: %v", err)
+			}
+			go sdsServer.Run(stopCh)
+		}
+		go secertManager.Run(stopCh)
+		health.Register("secret-manager", health.Readiness, secertManager.HealthCheck)
+		c.secretManager = secertManager
+	}
 	go kmeshManageController.Run(stopCh)
+	c.manageController = kmeshManageController
 	log.Info("start kmesh manage controller successfully")
+	if c.enrollmentConfig.ReconcileInterval > 0 {
+		go kmeshManageController.RunReconciler(stopCh, c.bpfFsPath, c.enrollmentConfig.ReconcileInterval, c.enrollmentConfig.MaxRepairBackoff)
+		log.Infof("start pod enrollment reconciler every %s", c.enrollmentConfig.ReconcileInterval)
+	}
 
 	if c.enableByPass {
-		c := bypass.NewByPassController(clientset)
+		bypassMap, err := utils.LoadPinnedKmeshMap(c.bpfFsPath, bypass.ByPassMapName, nil)
+		if err != nil {
+			return fmt.Errorf("failed to load bypass map: %v", err)
+		}
+		c := bypass.NewByPassController(clientset, bypassMap)
 		go c.Run(stopCh)
 		log.Info("start bypass controller successfully")
 	}
@@ -104,10 +168,58 @@ func (c *Controller) Start(stopCh <-chan struct{}) error {
 	c.client = NewXdsClient(c.mode, c.bpfWorkloadObj)
 
 	if c.client.WorkloadController != nil {
+		if c.otlpConfig.Enabled() {
+			exporter, err := telemetry.NewOtlpExporter(c.otlpConfig)
+			if err != nil {
+				return fmt.Errorf("otlp exporter create failed: %v", err)
+			}
+			c.client.WorkloadController.MetricController.SetOtlpExporter(exporter)
+			go exporter.Run(ctx)
+			log.Infof("start otlp exporter to %s successfully", c.otlpConfig.Endpoint)
+		}
+		accesslogger, err := telemetry.NewAccesslogger(c.accesslogConfig)
+		if err != nil {
+			return fmt.Errorf("accesslogger create failed: %v", err)
+		}
+		c.client.WorkloadController.MetricController.SetAccesslogger(accesslogger)
+		go accesslogger.Run(ctx)
+		seriesTracker, err := telemetry.NewSeriesTracker(c.metricConfig)
+		if err != nil {
+			return fmt.Errorf("metric series tracker create failed: %v", err)
+		}
+		c.client.WorkloadController.MetricController.SetSeriesTracker(seriesTracker)
+		c.client.WorkloadController.MetricController.SetProbeConfig(c.probeConfig)
+		go seriesTracker.Run(ctx)
+		if c.flowConfig.Enabled() {
+			flowExporter, err := telemetry.NewFlowExporter(c.flowConfig)
+			if err != nil {
+				return fmt.Errorf("flow exporter create failed: %v", err)
+			}
+			c.client.WorkloadController.MetricController.SetFlowExporter(flowExporter)
+			go flowExporter.Run(ctx)
+			log.Infof("start ipfix flow exporter to %s over %s successfully", c.flowConfig.CollectorAddress, c.flowConfig.Transport)
+		}
 		c.client.WorkloadController.Run(ctx)
 	}
 
 	if c.client.AdsController != nil {
+		httpAuthMap, err := utils.LoadPinnedKmeshMap(c.bpfFsPath, auth.HTTPAuthMapName, nil)
+		if err != nil {
+			return fmt.Errorf("failed to load http authorization map: %v", err)
+		}
+		c.client.AdsController.Processor.HTTPAuth = auth.NewHTTPPolicyMap(httpAuthMap)
+		// without the maps the check still compares the cached entries
+		if m, err := utils.LoadPinnedKmeshMap(c.bpfFsPath, "kmesh_cluster", nil); err == nil {
+			c.client.AdsController.Processor.ClusterMap = m
+		} else {
+			log.Warnf("cluster map is not checked for extra entries: %v", err)
+		}
+		if m, err := utils.LoadPinnedKmeshMap(c.bpfFsPath, "map_of_router_config", nil); err == nil {
+			c.client.AdsController.Processor.RouteConfigMap = m
+		} else {
+			log.Warnf("route config map is not checked for extra entries: %v", err)
+		}
+
 		dnsResolver, err := dns.NewDNSResolver(c.client.AdsController.Processor.Cache)
 		if err != nil {
 			return fmt.Errorf("dns resolver create failed: %v", err)
@@ -116,6 +228,15 @@ func (c *Controller) Start(stopCh <-chan struct{}) error {
 		c.client.AdsController.Processor.DnsResolverChan = dnsResolver.DnsResolverChan
 	}
 
+	if c.consistencyConfig.CheckInterval > 0 {
+		go consistency.Run(stopCh, c.client.ConsistencyChecker(), c.consistencyConfig.CheckInterval)
+		log.Infof("start cache versus bpf map consistency check every %s", c.consistencyConfig.CheckInterval)
+	}
+
+	if c.metricConfig.BpfMapInterval > 0 {
+		go telemetry.RunBpfMapMetrics(stopCh, c.bpfFsPath, c.metricConfig.BpfMapInterval)
+	}
+
 	return c.client.Run(stopCh)
 }
 
@@ -132,3 +253,13 @@ func (c *Controller) Stop() {
 func (c *Controller) GetXdsClient() *XdsClient {
 	return c.client
 }
+
+// GetSecretManager returns the secret manager, nil if it is not enabled
+func (c *Controller) GetSecretManager() *security.SecretManager {
+	return c.secretManager
+}
+
+// GetKmeshManageController returns the kmesh manage controller, nil before Start
+func (c *Controller) GetKmeshManageController() *manage.KmeshManageController {
+	return c.manageController
+}
@@ -19,6 +19,7 @@ package kmeshmanage
 import (
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/cilium/ebpf/link"
 	netns "github.com/containernetworking/plugins/pkg/ns"
@@ -36,6 +37,7 @@ import (
 	"kmesh.net/kmesh/pkg/constants"
 	ns "kmesh.net/kmesh/pkg/controller/netns"
 	kmeshsecurity "kmesh.net/kmesh/pkg/controller/security"
+	"kmesh.net/kmesh/pkg/events"
 	"kmesh.net/kmesh/pkg/kube"
 	"kmesh.net/kmesh/pkg/logger"
 	"kmesh.net/kmesh/pkg/utils"
@@ -47,8 +49,49 @@ const (
 	MaxRetries             = 5
 	ActionAddAnnotation    = "add"
 	ActionDeleteAnnotation = "delete"
+
+	// podUIDIndex indexes the pods by uid, which the processes of a pod are found by
+	podUIDIndex = "uid"
 )
 
+// podLocks serializes the enrollment changes of a pod made by the informer handlers,
+// the workqueue and the reconciler, which run on their own goroutines
+type podLocks struct {
+	mutex sync.Mutex
+	locks map[string]*podLock
+}
+
+type podLock struct {
+	sync.Mutex
+	refs int
+}
+
+var enrollmentLocks = &podLocks{locks: make(map[string]*podLock)}
+
+// lock locks the pod and returns the unlock, the lock is freed with its last user
+func (l *podLocks) lock(namespace, name string) func() {
+	key := namespace + "/" + name
+	l.mutex.Lock()
+	pl, ok := l.locks[key]
+	if !ok {
+		pl = &podLock{}
+		l.locks[key] = pl
+	}
+	pl.refs++
+	l.mutex.Unlock()
+
+	pl.Lock()
+	return func() {
+		pl.Unlock()
+		l.mutex.Lock()
+		pl.refs--
+		if pl.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mutex.Unlock()
+	}
+}
+
 type QueueItem struct {
 	podName string
 	podNs   string
@@ -65,6 +108,8 @@ type KmeshManageController struct {
 	namespaceLister   v1.NamespaceLister
 	queue             workqueue.RateLimitingInterface
 	client            kubernetes.Interface
+	xdpProgFd         int
+	mode              string
 }
 
 func isPodReady(pod *corev1.Pod) bool {
@@ -80,6 +125,17 @@ func NewKmeshManageController(client kubernetes.Interface, security *kmeshsecuri
 	informerFactory := kube.NewInformerFactory(client)
 	podInformer := informerFactory.Core().V1().Pods().Informer()
 	podLister := informerFactory.Core().V1().Pods().Lister()
+	if err := podInformer.AddIndexers(cache.Indexers{
+		podUIDIndex: func(obj interface{}) ([]string, error) {
+			pod, ok := obj.(*corev1.Pod)
+			if !ok {
+				return nil, nil
+			}
+			return []string{string(pod.UID)}, nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to add uid indexer to podInformer: %v", err)
+	}
 
 	factory := informers.NewSharedInformerFactory(client, 0)
 	namespaceInformer := factory.Core().V1().Namespaces().Informer()
@@ -118,6 +174,8 @@ func NewKmeshManageController(client kubernetes.Interface, security *kmeshsecuri
 		namespaceLister:   namespaceLister,
 		queue:             queue,
 		client:            client,
+		xdpProgFd:         xdpProgFd,
+		mode:              mode,
 	}, nil
 }
 
@@ -216,12 +274,15 @@ func enableKmeshManage(pod *corev1.Pod, queue workqueue.RateLimitingInterface, s
 		log.Debugf("Pod %s/%s is not ready, skipping Kmesh manage enable", pod.GetNamespace(), pod.GetName())
 		return
 	}
+	defer enrollmentLocks.lock(pod.Namespace, pod.Name)()
 	log.Infof("%s/%s: enable Kmesh manage", pod.GetNamespace(), pod.GetName())
 	nspath, _ := ns.GetPodNSpath(pod)
 	if err := utils.HandleKmeshManage(nspath, true); err != nil {
 		log.Errorf("failed to enable Kmesh manage")
+		publishEnrollmentEvent(pod, "enroll", err)
 		return
 	}
+	publishEnrollmentEvent(pod, "enroll", nil)
 	queue.AddRateLimited(QueueItem{podName: pod.Name, podNs: pod.Namespace, action: ActionAddAnnotation})
 	_ = linkXdp(nspath, xdpProgFd, mode)
 }
@@ -232,16 +293,35 @@ func disableKmeshManage(pod *corev1.Pod, queue workqueue.RateLimitingInterface,
 		log.Debugf("%s/%s is not ready, skipping Kmesh manage disable", pod.GetNamespace(), pod.GetName())
 		return
 	}
+	defer enrollmentLocks.lock(pod.Namespace, pod.Name)()
 	log.Infof("%s/%s: disable Kmesh manage", pod.GetNamespace(), pod.GetName())
 	nspath, _ := ns.GetPodNSpath(pod)
 	if err := utils.HandleKmeshManage(nspath, false); err != nil {
 		log.Errorf("failed to disable Kmesh manage")
+		publishEnrollmentEvent(pod, "unenroll", err)
 		return
 	}
+	publishEnrollmentEvent(pod, "unenroll", nil)
 	queue.AddRateLimited(QueueItem{podName: pod.Name, podNs: pod.Namespace, action: ActionDeleteAnnotation})
 	_ = unlinkXdp(nspath, mode)
 }
 
+// publishEnrollmentEvent reports a pod enrolled in or removed from kmesh, the
+// action is suffixed with _failed on error
+func publishEnrollmentEvent(pod *corev1.Pod, action string, err error) {
+	e := events.Event{
+		Type:      events.Enrollment,
+		Action:    action,
+		Namespace: pod.Namespace,
+		Name:      pod.Name,
+	}
+	if err != nil {
+		e.Action += "_failed"
+		e.Message = err.Error()
+	}
+	events.Publish(e)
+}
+
 func enableKmeshForPodsInNamespace(namespace string, podLister v1.PodLister, queue workqueue.RateLimitingInterface, security *kmeshsecurity.SecretManager, xdpProgFd int, mode string) {
 	pods, err := podLister.Pods(namespace).List(labels.Everything())
 	if err != nil {
@@ -292,6 +372,7 @@ func (c *KmeshManageController) processItems() bool {
 		log.Errorf("expected QueueItem but got %T", key)
 		return true
 	}
+	defer enrollmentLocks.lock(queueItem.podNs, queueItem.podName)()
 
 	pod, err := c.podLister.Pods(queueItem.podNs).Get(queueItem.podName)
 	if err != nil {
@@ -329,15 +410,35 @@ func (c *KmeshManageController) processItems() bool {
 
 func sendCertRequest(security *kmeshsecurity.SecretManager, pod *corev1.Pod, op int) {
 	if security != nil {
-		Identity := spiffe.Identity{
-			TrustDomain:    constants.TrustDomain,
-			Namespace:      pod.Namespace,
-			ServiceAccount: pod.Spec.ServiceAccountName,
-		}.String()
-		security.SendCertRequest(Identity, op)
+		security.SendWorkloadCertRequest(podIdentity(pod), pod.Namespace+"/"+pod.Name, op)
 	}
 }
 
+// podIdentity is the identity the workload cert of the pod is requested for
+func podIdentity(pod *corev1.Pod) string {
+	return spiffe.Identity{
+		TrustDomain:    constants.TrustDomain,
+		Namespace:      pod.Namespace,
+		ServiceAccount: pod.Spec.ServiceAccountName,
+	}.String()
+}
+
+// PodIdentity returns the identity of the node pod the process pid runs in
+func (c *KmeshManageController) PodIdentity(pid int32) (string, error) {
+	uid, err := ns.GetPodUIDByPid(pid)
+	if err != nil {
+		return "", err
+	}
+	objs, err := c.podInformer.GetIndexer().ByIndex(podUIDIndex, string(uid))
+	if err != nil {
+		return "", err
+	}
+	if len(objs) == 0 {
+		return "", fmt.Errorf("pod %s not found on the node", uid)
+	}
+	return podIdentity(objs[0].(*corev1.Pod)), nil
+}
+
 func linkXdp(netNsPath string, xdpProgFd int, mode string) error {
 	// Currently only support workload mode
 	if mode != constants.WorkloadMode {
@@ -412,3 +513,58 @@ func unlinkXdp(netNsPath string, mode string) error {
 
 	return nil
 }
+
+// GetPod returns the cached pod and its namespace, the namespace is nil if it is not cached
+func (c *KmeshManageController) GetPod(namespace, name string) (*corev1.Pod, *corev1.Namespace, error) {
+	pod, err := c.podLister.Pods(namespace).Get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	ns, err := c.namespaceLister.Get(namespace)
+	if err != nil {
+		return pod, nil, nil
+	}
+	return pod, ns, nil
+}
+
+// XdpLink is the XDP attachment of a pod interface
+type XdpLink struct {
+	Interface string `json:"interface"`
+	Attached  bool   `json:"attached"`
+	ProgramId uint32 `json:"programId,omitempty"`
+}
+
+// GetXdpLinks reports the XDP attachment of every pod interface that linkXdp manages
+func GetXdpLinks(pod *corev1.Pod) ([]XdpLink, error) {
+	nspath, err := ns.GetPodNSpath(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []XdpLink
+	if err := netns.WithNetNSPath(nspath, func(_ netns.NetNS) error {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return err
+		}
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+				continue
+			}
+			ifLink, err := netlink.LinkByName(iface.Name)
+			if err != nil {
+				return err
+			}
+			xdpLink := XdpLink{Interface: iface.Name}
+			if xdp := ifLink.Attrs().Xdp; xdp != nil {
+				xdpLink.Attached = xdp.Attached
+				xdpLink.ProgramId = xdp.ProgId
+			}
+			links = append(links, xdpLink)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
@@ -36,10 +36,12 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/tools/cache"
 
 	"kmesh.net/kmesh/pkg/constants"
+	kmeshnetns "kmesh.net/kmesh/pkg/controller/netns"
 	"kmesh.net/kmesh/pkg/utils"
 )
 
@@ -687,3 +689,53 @@ func Test_unlinkXdp(t *testing.T) {
 		})
 	}
 }
+
+func TestPodLocks(t *testing.T) {
+	locks := &podLocks{locks: make(map[string]*podLock)}
+
+	unlock := locks.lock("default", "httpbin")
+	// another pod is not blocked
+	locks.lock("default", "sleep")()
+
+	var locked atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer locks.lock("default", "httpbin")()
+		locked.Store(true)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, locked.Load(), "the pod is locked twice")
+
+	unlock()
+	<-done
+	assert.True(t, locked.Load())
+	assert.Empty(t, locks.locks)
+}
+
+func TestPodIdentity(t *testing.T) {
+	controller, err := NewKmeshManageController(fake.NewSimpleClientset(), nil, 0, "")
+	require.NoError(t, err)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "sleep", UID: "8d3e5f7a-1c2b-4d6e-9f80-123456789abc"},
+		Spec:       corev1.PodSpec{ServiceAccountName: "sleep"},
+	}
+	require.NoError(t, controller.podInformer.GetIndexer().Add(pod))
+
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(kmeshnetns.GetPodUIDByPid, func(pid int32) (types.UID, error) {
+		if pid == 100 {
+			return pod.UID, nil
+		}
+		return "2b1f0c3d-0000-4000-8000-000000000000", nil
+	})
+
+	identity, err := controller.PodIdentity(100)
+	assert.NoError(t, err)
+	assert.Equal(t, "spiffe://cluster.local/ns/default/sa/sleep", identity)
+
+	// a process of a pod of another node
+	_, err = controller.PodIdentity(200)
+	assert.Error(t, err)
+}
@@ -0,0 +1,319 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kmeshmanage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cilium/ebpf"
+	netns "github.com/containernetworking/plugins/pkg/ns"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	v1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"kmesh.net/kmesh/pkg/constants"
+	ns "kmesh.net/kmesh/pkg/controller/netns"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+	"kmesh.net/kmesh/pkg/nets"
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// The drift types found by the reconciler, in the order they are repaired
+const (
+	// DriftManageMissing is an enrolled pod whose netns is not in the manage map
+	DriftManageMissing = "manage_map_missing"
+	// DriftManageStale is a pod no longer enrolled whose netns is still in the manage map
+	DriftManageStale = "manage_map_stale"
+	// DriftXdpDetached is an enrolled pod with an interface the XDP program is not attached to
+	DriftXdpDetached = "xdp_detached"
+	// DriftAnnotationMissing is an enrolled pod without the redirection annotation
+	DriftAnnotationMissing = "annotation_missing"
+	// DriftAnnotationStale is a pod no longer enrolled still carrying the redirection annotation
+	DriftAnnotationStale = "annotation_stale"
+)
+
+const manageMapName = "kmesh_manage"
+
+// enrollmentState is the actual enrollment of a pod. The manage map and XDP states
+// are only compared when they could be observed.
+type enrollmentState struct {
+	annotated    bool
+	managed      bool
+	managedKnown bool
+	xdpAttached  bool
+	xdpKnown     bool
+}
+
+// enrollmentDrifts compares the desired enrollment of a pod with its actual state
+func enrollmentDrifts(desired bool, state enrollmentState) []string {
+	var drifts []string
+	if desired {
+		if state.managedKnown && !state.managed {
+			drifts = append(drifts, DriftManageMissing)
+		}
+		if state.xdpKnown && !state.xdpAttached {
+			drifts = append(drifts, DriftXdpDetached)
+		}
+		if !state.annotated {
+			drifts = append(drifts, DriftAnnotationMissing)
+		}
+		return drifts
+	}
+
+	if state.managedKnown && state.managed {
+		drifts = append(drifts, DriftManageStale)
+	}
+	if state.annotated {
+		drifts = append(drifts, DriftAnnotationStale)
+	}
+	return drifts
+}
+
+// reconciler repairs the pods half enrolled by a lost informer event, a failed control
+// command, a lost annotation patch or an XDP program detached behind our back
+type reconciler struct {
+	podLister       v1.PodLister
+	namespaceLister v1.NamespaceLister
+	client          kubernetes.Interface
+	xdpProgFd       int
+	mode            string
+	manageMap       *ebpf.Map
+
+	// the pods whose last repair failed are retried with an exponential backoff
+	backoff    workqueue.RateLimiter
+	retryAfter map[string]time.Time
+}
+
+func newReconciler(podLister v1.PodLister, namespaceLister v1.NamespaceLister, client kubernetes.Interface,
+	xdpProgFd int, mode string, manageMap *ebpf.Map, interval, maxBackoff time.Duration) *reconciler {
+	return &reconciler{
+		podLister:       podLister,
+		namespaceLister: namespaceLister,
+		client:          client,
+		xdpProgFd:       xdpProgFd,
+		mode:            mode,
+		manageMap:       manageMap,
+		backoff:         workqueue.NewItemExponentialFailureRateLimiter(interval, maxBackoff),
+		retryAfter:      make(map[string]time.Time),
+	}
+}
+
+// RunReconciler compares the desired enrollment of the node pods with their actual state
+// every interval and repairs the differences, until stopChan is closed
+func (c *KmeshManageController) RunReconciler(stopChan <-chan struct{}, bpfFsPath string, interval, maxBackoff time.Duration) {
+	if !cache.WaitForCacheSync(stopChan, c.podInformer.HasSynced, c.namespaceInformer.HasSynced) {
+		log.Error("Timed out waiting for caches to sync")
+		return
+	}
+
+	manageMap, err := utils.LoadPinnedKmeshMap(bpfFsPath, manageMapName, &ebpf.LoadPinOptions{ReadOnly: true})
+	if err != nil {
+		log.Warnf("the manage map is not checked by the enrollment reconciler: %v", err)
+	} else {
+		defer manageMap.Close()
+	}
+	r := newReconciler(c.podLister, c.namespaceLister, c.client, c.xdpProgFd, c.mode, manageMap, interval, maxBackoff)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+			r.reconcile(time.Now())
+		}
+	}
+}
+
+func (r *reconciler) reconcile(now time.Time) {
+	pods, err := r.podLister.List(labels.Everything())
+	if err != nil {
+		log.Errorf("failed to list pods: %v", err)
+		return
+	}
+
+	telemetry.EnrollmentDrift.Reset()
+	for _, pod := range pods {
+		r.reconcilePod(pod.Namespace, pod.Name, now)
+	}
+
+	// forget the pods gone since their last failed repair
+	for key := range r.retryAfter {
+		namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+		if _, err := r.podLister.Pods(namespace).Get(name); err != nil {
+			r.backoff.Forget(key)
+			delete(r.retryAfter, key)
+		}
+	}
+}
+
+// reconcilePod observes and repairs a pod under its enrollment lock, so that it does
+// not race with the informer handlers and the workqueue. The pod is read again once
+// locked, a handler may have just changed its enrollment.
+func (r *reconciler) reconcilePod(namespace, name string, now time.Time) {
+	defer enrollmentLocks.lock(namespace, name)()
+
+	key := namespace + "/" + name
+	pod, err := r.podLister.Pods(namespace).Get(name)
+	if err != nil {
+		return
+	}
+	// the same pods the informer handlers skip
+	if pod.Spec.HostNetwork || pod.DeletionTimestamp != nil || !isPodReady(pod) {
+		return
+	}
+	podNamespace, err := r.namespaceLister.Get(namespace)
+	if err != nil {
+		log.Debugf("failed to get pod namespace %s: %v", namespace, err)
+		return
+	}
+
+	desired := utils.ShouldEnroll(pod, podNamespace)
+	// the annotation is only removed once the netns left the manage map, so a pod
+	// neither desired nor annotated is not probed, which costs a /proc scan and a
+	// netns switch. The XDP attachment only matters to the desired pods.
+	if !desired && pod.Annotations[constants.KmeshRedirectionAnnotation] != "enabled" {
+		r.backoff.Forget(key)
+		delete(r.retryAfter, key)
+		return
+	}
+	state, err := observeEnrollment(pod, r.manageMap, desired && r.checkXdp())
+	if err != nil {
+		log.Debugf("%s: failed to observe the enrollment: %v", key, err)
+		return
+	}
+	drifts := enrollmentDrifts(desired, state)
+	for _, d := range drifts {
+		telemetry.EnrollmentDrift.WithLabelValues(d).Inc()
+	}
+	if len(drifts) == 0 {
+		r.backoff.Forget(key)
+		delete(r.retryAfter, key)
+		return
+	}
+	if now.Before(r.retryAfter[key]) {
+		return
+	}
+
+	if err := r.repair(pod, drifts); err != nil {
+		delay := r.backoff.When(key)
+		r.retryAfter[key] = now.Add(delay)
+		log.Errorf("%s: failed to repair the enrollment, will retry in %s: %v", key, delay, err)
+		return
+	}
+	r.backoff.Forget(key)
+	delete(r.retryAfter, key)
+	log.Infof("%s: repaired the enrollment drift %v", key, drifts)
+}
+
+// repair fixes the drifts in order and stops at the first failure, as the annotation
+// must not claim an enrollment the data path does not have
+func (r *reconciler) repair(pod *corev1.Pod, drifts []string) error {
+	nspath, err := ns.GetPodNSpath(pod)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range drifts {
+		switch d {
+		case DriftManageMissing:
+			err = utils.HandleKmeshManage(nspath, true)
+		case DriftManageStale:
+			err = utils.HandleKmeshManage(nspath, false)
+		case DriftXdpDetached:
+			err = linkXdp(nspath, r.xdpProgFd, r.mode)
+		case DriftAnnotationMissing:
+			err = utils.PatchKmeshRedirectAnnotation(r.client, pod)
+		case DriftAnnotationStale:
+			err = utils.DelKmeshRedirectAnnotation(r.client, pod)
+		}
+		if err != nil {
+			telemetry.EnrollmentRepairs.WithLabelValues(d, "failed").Inc()
+			return fmt.Errorf("%s: %v", d, err)
+		}
+		telemetry.EnrollmentRepairs.WithLabelValues(d, "success").Inc()
+	}
+	return nil
+}
+
+// checkXdp tells whether the XDP program is linked to the enrolled pods, only in workload mode
+func (r *reconciler) checkXdp() bool {
+	return r.mode == constants.WorkloadMode && r.xdpProgFd >= 0
+}
+
+// observeEnrollment reads the annotation of a pod, the entry of its netns in the manage
+// map and, if checkXdp is set, the XDP attachment of its interfaces
+func observeEnrollment(pod *corev1.Pod, manageMap *ebpf.Map, checkXdp bool) (enrollmentState, error) {
+	state := enrollmentState{
+		annotated: pod.Annotations[constants.KmeshRedirectionAnnotation] == "enabled",
+	}
+
+	if manageMap != nil {
+		nspath, err := ns.GetPodNSpath(pod)
+		if err != nil {
+			return state, err
+		}
+		var cookie uint64
+		if err := netns.WithNetNSPath(nspath, func(netns.NetNS) error {
+			cookie, err = nets.GetNetNsCookie()
+			return err
+		}); err != nil && !errors.Is(err, unix.ENOPROTOOPT) {
+			return state, err
+		}
+		// without netns cookies on old kernels, the manage map is keyed by the pod ip
+		if cookie != 0 {
+			state.managed, err = isNetNsManaged(manageMap, cookie)
+			if err != nil {
+				return state, err
+			}
+			state.managedKnown = true
+		}
+	}
+
+	if checkXdp {
+		links, err := GetXdpLinks(pod)
+		if err != nil {
+			return state, err
+		}
+		state.xdpAttached, state.xdpKnown = true, true
+		for _, l := range links {
+			state.xdpAttached = state.xdpAttached && l.Attached
+		}
+	}
+	return state, nil
+}
+
+// isNetNsManaged looks up the netns cookie in the manage map, whose key is a union of
+// the cookie and an ip address
+func isNetNsManaged(manageMap *ebpf.Map, cookie uint64) (bool, error) {
+	key := make([]byte, manageMap.KeySize())
+	binary.NativeEndian.PutUint64(key, cookie)
+	value := make([]byte, manageMap.ValueSize())
+	err := manageMap.Lookup(key, value)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
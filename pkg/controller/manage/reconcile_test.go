@@ -0,0 +1,216 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kmeshmanage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	v1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"kmesh.net/kmesh/pkg/constants"
+	ns "kmesh.net/kmesh/pkg/controller/netns"
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+func TestEnrollmentDrifts(t *testing.T) {
+	tests := []struct {
+		name    string
+		desired bool
+		state   enrollmentState
+		want    []string
+	}{
+		{
+			name:    "enrolled",
+			desired: true,
+			state:   enrollmentState{annotated: true, managed: true, managedKnown: true, xdpAttached: true, xdpKnown: true},
+		},
+		{
+			name:    "not enrolled",
+			desired: false,
+			state:   enrollmentState{managedKnown: true, xdpKnown: true},
+		},
+		{
+			name:    "half enrolled",
+			desired: true,
+			state:   enrollmentState{managedKnown: true, xdpKnown: true},
+			want:    []string{DriftManageMissing, DriftXdpDetached, DriftAnnotationMissing},
+		},
+		{
+			name:    "manage map and xdp not observed",
+			desired: true,
+			state:   enrollmentState{annotated: true},
+		},
+		{
+			name:    "half removed",
+			desired: false,
+			state:   enrollmentState{annotated: true, managed: true, managedKnown: true},
+			want:    []string{DriftManageStale, DriftAnnotationStale},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, enrollmentDrifts(tt.desired, tt.state))
+		})
+	}
+}
+
+func TestIsNetNsManaged(t *testing.T) {
+	manageMap, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       manageMapName,
+		Type:       ebpf.Hash,
+		KeySize:    16,
+		ValueSize:  4,
+		MaxEntries: 16,
+	})
+	if err != nil {
+		t.Skipf("creating a bpf map is not permitted: %v", err)
+	}
+	defer manageMap.Close()
+
+	key := make([]byte, 16)
+	key[0] = 42
+	assert.NoError(t, manageMap.Put(key, uint32(0)))
+
+	managed, err := isNetNsManaged(manageMap, 42)
+	assert.NoError(t, err)
+	assert.True(t, managed)
+	managed, err = isNetNsManaged(manageMap, 43)
+	assert.NoError(t, err)
+	assert.False(t, managed)
+}
+
+func TestReconciler_reconcile(t *testing.T) {
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "default",
+			Labels: map[string]string{constants.DataPlaneModeLabel: constants.DataPlaneModeKmesh},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ut-pod"},
+		Status: corev1.PodStatus{
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+	client := fake.NewSimpleClientset(pod)
+	podIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	assert.NoError(t, podIndexer.Add(pod))
+	nsIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	assert.NoError(t, nsIndexer.Add(namespace))
+
+	r := newReconciler(v1.NewPodLister(podIndexer), v1.NewNamespaceLister(nsIndexer), client,
+		-1, constants.WorkloadMode, nil, time.Minute, 10*time.Minute)
+
+	state := enrollmentState{managedKnown: true}
+	var enrolled int
+	manageErr := errors.New("control command failed")
+
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(observeEnrollment, func(*corev1.Pod, *ebpf.Map, bool) (enrollmentState, error) {
+		return state, nil
+	})
+	patches.ApplyFunc(ns.GetPodNSpath, func(*corev1.Pod) (string, error) {
+		return "/host/proc/1/ns/net", nil
+	})
+	patches.ApplyFunc(utils.HandleKmeshManage, func(string, bool) error {
+		enrolled++
+		return manageErr
+	})
+
+	// the control command fails, the annotation is not patched and the pod backs off
+	now := time.Now()
+	r.reconcile(now)
+	assert.Equal(t, 1, enrolled)
+	assert.Equal(t, now.Add(time.Minute), r.retryAfter["default/ut-pod"])
+	got, err := client.CoreV1().Pods("default").Get(context.TODO(), "ut-pod", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, got.Annotations)
+
+	r.reconcile(now.Add(30 * time.Second))
+	assert.Equal(t, 1, enrolled)
+
+	// retried once the backoff passed
+	manageErr = nil
+	r.reconcile(now.Add(2 * time.Minute))
+	assert.Equal(t, 2, enrolled)
+	assert.Empty(t, r.retryAfter)
+	got, err = client.CoreV1().Pods("default").Get(context.TODO(), "ut-pod", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "enabled", got.Annotations[constants.KmeshRedirectionAnnotation])
+
+	// nothing to repair once the actual state matches
+	state = enrollmentState{annotated: true, managed: true, managedKnown: true}
+	r.reconcile(now.Add(3 * time.Minute))
+	assert.Equal(t, 2, enrolled)
+}
+
+func TestReconciler_skipUnenrolled(t *testing.T) {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	ready := corev1.PodStatus{
+		Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ut-pod"},
+		Status:     ready,
+	}
+	annotatedPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "ut-annotated-pod",
+			Annotations: map[string]string{constants.KmeshRedirectionAnnotation: "enabled"},
+		},
+		Status: ready,
+	}
+	client := fake.NewSimpleClientset(pod, annotatedPod)
+	podIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	assert.NoError(t, podIndexer.Add(pod))
+	assert.NoError(t, podIndexer.Add(annotatedPod))
+	nsIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	assert.NoError(t, nsIndexer.Add(namespace))
+
+	r := newReconciler(v1.NewPodLister(podIndexer), v1.NewNamespaceLister(nsIndexer), client,
+		1, constants.WorkloadMode, nil, time.Minute, 10*time.Minute)
+
+	observed := map[string]bool{}
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(observeEnrollment, func(pod *corev1.Pod, _ *ebpf.Map, checkXdp bool) (enrollmentState, error) {
+		observed[pod.Name] = checkXdp
+		return enrollmentState{annotated: true}, nil
+	})
+	patches.ApplyFunc(ns.GetPodNSpath, func(*corev1.Pod) (string, error) {
+		return "/host/proc/1/ns/net", nil
+	})
+
+	// only the pod left annotated is probed, and not for XDP
+	r.reconcile(time.Now())
+	assert.Equal(t, map[string]bool{"ut-annotated-pod": false}, observed)
+	got, err := client.CoreV1().Pods("default").Get(context.TODO(), "ut-annotated-pod", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, got.Annotations[constants.KmeshRedirectionAnnotation])
+}
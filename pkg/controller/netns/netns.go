@@ -24,6 +24,7 @@ import (
 	"io/fs"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 
 	nd "istio.io/istio/cni/pkg/nodeagent"
@@ -76,6 +77,16 @@ func FindNetnsForPod(pod *corev1.Pod) (string, error) {
 	return "", fmt.Errorf("No matching network namespace found")
 }
 
+// GetPodUIDByPid returns the uid of the pod the process pid runs in, from its cgroup
+func GetPodUIDByPid(pid int32) (types.UID, error) {
+	data, err := fs.ReadFile(builtinOrDir("/host/proc"), path.Join(strconv.Itoa(int(pid)), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	uid, _, err := nd.GetPodUIDAndContainerID(*bytes.NewBuffer(data))
+	return uid, err
+}
+
 func isNotNumber(r rune) bool {
 	return r < '0' || r > '9'
 }
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
@@ -31,14 +32,42 @@ import (
 	nodeagentutil "istio.io/istio/security/pkg/nodeagent/util"
 	pkiutil "istio.io/istio/security/pkg/pki/util"
 
+	"kmesh.net/kmesh/pkg/constants"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
 	"kmesh.net/kmesh/pkg/nets"
 )
 
 type caClient struct {
 	tlsOpts *tlsOptions
-	client  pb.IstioCertificateServiceClient
-	conn    *grpc.ClientConn
 	opts    *security.Options
+
+	mu        sync.Mutex
+	endpoints []*caEndpoint
+	// current is the endpoint tried first, it moves on failover
+	current int
+}
+
+// caEndpoint is one of the CA addresses, an endpoint failing a request is skipped
+// until its cool down passes, the longer the more it fails in a row
+type caEndpoint struct {
+	address        string
+	conn           *grpc.ClientConn
+	client         pb.IstioCertificateServiceClient
+	failures       int
+	unhealthyUntil time.Time
+}
+
+// CaConfig selects the CA signing the workload certs, the zero value is istiod
+type CaConfig struct {
+	Provider string
+	// ClusterID is sent to istiod along the CSRs
+	ClusterID string
+	// CertDir holds the CA bundle of the file provider
+	CertDir string
+	// SpireSocket is the Workload API address of the SPIRE agent
+	SpireSocket string
+	// TrustDomain of the self-signed CA
+	TrustDomain string
 }
 
 type tlsOptions struct {
@@ -47,31 +76,115 @@ type tlsOptions struct {
 	Cert     string
 }
 
+// createCaClient creates the client of the CA selected by caConfig
+func createCaClient(caConfig CaConfig, opts *security.Options, tlsOpts *tlsOptions) (CaClient, error) {
+	switch caConfig.Provider {
+	case "", constants.CaProviderIstiod:
+		return newCaClient(opts, tlsOpts)
+	case constants.CaProviderFile:
+		return newFileCaClient(opts, caConfig.CertDir)
+	case constants.CaProviderSpire:
+		return newSpireCaClient(caConfig.SpireSocket)
+	case constants.CaProviderSelfSigned:
+		return newSelfSignedCaClient(opts, caConfig.TrustDomain)
+	default:
+		return nil, fmt.Errorf("unknown CA provider %q", caConfig.Provider)
+	}
+}
+
 // NewCaClient create a CA client for CSR sign.
 // The following function is adapted from istio NewCitadelClient
 // (https://github.com/istio/istio/blob/master/security/pkg/nodeagent/caclient/providers/citadel/client.go)
 func newCaClient(opts *security.Options, tlsOpts *tlsOptions) (CaClient, error) {
-	var err error
-
 	c := &caClient{
 		tlsOpts: tlsOpts,
 		opts:    opts,
 	}
 
-	conn, err := nets.GrpcConnect(caAddress)
+	for _, address := range parseCaAddresses(caAddress) {
+		conn, err := nets.GrpcConnect(address)
+		if err != nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("failed to create grpcconnect to %s: %v", address, err)
+		}
+		c.endpoints = append(c.endpoints, &caEndpoint{
+			address: address,
+			conn:    conn,
+			client:  pb.NewIstioCertificateServiceClient(conn),
+		})
+	}
+	if len(c.endpoints) == 0 {
+		return nil, errors.New("no CA address configured")
+	}
+	return c, nil
+}
+
+// parseCaAddresses splits the comma separated CA addresses, in the order of preference
+func parseCaAddresses(addresses string) []string {
+	var ret []string
+	for _, address := range strings.Split(addresses, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			ret = append(ret, address)
+		}
+	}
+	return ret
+}
+
+// candidates returns the endpoints to try in order, the healthy ones from the current one.
+// If none is healthy, all of them are tried, so that a recovered CA is found without waiting.
+func (c *caClient) candidates(now time.Time) []*caEndpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ordered := make([]*caEndpoint, 0, len(c.endpoints))
+	for i := range c.endpoints {
+		ordered = append(ordered, c.endpoints[(c.current+i)%len(c.endpoints)])
+	}
+	healthy := make([]*caEndpoint, 0, len(ordered))
+	for _, ep := range ordered {
+		if !now.Before(ep.unhealthyUntil) {
+			healthy = append(healthy, ep)
+		}
+	}
+	if len(healthy) == 0 {
+		return ordered
+	}
+	return healthy
+}
+
+func (c *caClient) markResult(ep *caEndpoint, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if err != nil {
-		return nil, fmt.Errorf("failed to create grpcconnect : %v", err)
+		ep.failures++
+		cooldown := min(caEndpointCooldown<<(ep.failures-1), caEndpointMaxCooldown)
+		ep.unhealthyUntil = time.Now().Add(cooldown)
+		telemetry.CaRequests.WithLabelValues(ep.address, "error").Inc()
+		log.Warnf("CA %s failed %d times in a row, skip it for %v: %v", ep.address, ep.failures, cooldown, err)
+		return
 	}
 
-	c.conn = conn
-	c.client = pb.NewIstioCertificateServiceClient(conn)
-	return c, nil
+	ep.failures = 0
+	ep.unhealthyUntil = time.Time{}
+	telemetry.CaRequests.WithLabelValues(ep.address, "success").Inc()
+	if c.endpoints[c.current] == ep {
+		return
+	}
+	for i := range c.endpoints {
+		if c.endpoints[i] == ep {
+			log.Infof("fail over from CA %s to %s", c.endpoints[c.current].address, ep.address)
+			telemetry.CaFailovers.Inc()
+			c.current = i
+			return
+		}
+	}
 }
 
 // CsrSend send a grpc request to istio and sign a CSR.
 // The following function is adapted from istio CSRSign
 // (https://github.com/istio/istio/blob/master/security/pkg/nodeagent/caclient/providers/citadel/client.go)
-func (c caClient) CsrSend(csrPEM []byte, certValidsec int64, identity string) ([]string, error) {
+func (c *caClient) CsrSend(csrPEM []byte, certValidsec int64, identity string) ([]string, error) {
 	crMeta := &structpb.Struct{
 		Fields: map[string]*structpb.Value{
 			security.ImpersonatedIdentity: {
@@ -85,11 +198,28 @@ func (c caClient) CsrSend(csrPEM []byte, certValidsec int64, identity string) ([
 		Metadata:         crMeta,
 	}
 
-	// TODO: support customize clusterID, which is needed for multicluster mesh
-	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("ClusterID", "Kubernetes"))
-	// To handle potential grpc connection disconnection and retry once
-	// when certificate acquisition fails. If it still fails, return an error.
-	resp, err := c.client.CreateCertificate(ctx, req)
+	// Try the CAs in turn, the first one signing the CSR becomes the preferred one.
+	var errs []error
+	for _, ep := range c.candidates(time.Now()) {
+		certChain, err := c.createCertificate(ep, req)
+		c.markResult(ep, err)
+		if err == nil {
+			return certChain, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %v", ep.address, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (c *caClient) createCertificate(ep *caEndpoint, req *pb.IstioCertificateRequest) ([]string, error) {
+	clusterID := defaultCaClusterID
+	if c.opts != nil && c.opts.ClusterID != "" {
+		clusterID = c.opts.ClusterID
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), caRequestTimeout)
+	defer cancel()
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs("ClusterID", clusterID))
+	resp, err := ep.client.CreateCertificate(ctx, req)
 	if err != nil {
 		return nil, fmt.Errorf("create certificate failed: %v", err)
 	}
@@ -113,17 +243,22 @@ func standardCerts(certsPEM []string) []byte {
 	return []byte(certChain.String())
 }
 
+func (c *caClient) FetchCert(identity string) (*security.SecretItem, error) {
+	return generateSecret(c, c.opts, identity)
+}
+
+// generateSecret generates a key for the identity, and gets it signed by the CA.
 // The following function is adapted from istio generateNewSecret
 // (https://github.com/istio/istio/blob/master/security/pkg/nodeagent/cache/secretcache.go)
-func (c *caClient) FetchCert(identity string) (*security.SecretItem, error) {
+func generateSecret(c CaClient, opts *security.Options, identity string) (*security.SecretItem, error) {
 	var rootCertPEM []byte
 
 	options := pkiutil.CertOptions{
 		Host:       identity,
-		RSAKeySize: c.opts.WorkloadRSAKeySize,
-		PKCS8Key:   c.opts.Pkcs8Keys,
-		ECSigAlg:   pkiutil.SupportedECSignatureAlgorithms(c.opts.ECCSigAlg),
-		ECCCurve:   pkiutil.SupportedEllipticCurves(c.opts.ECCCurve),
+		RSAKeySize: opts.WorkloadRSAKeySize,
+		PKCS8Key:   opts.Pkcs8Keys,
+		ECSigAlg:   pkiutil.SupportedECSignatureAlgorithms(opts.ECCSigAlg),
+		ECCCurve:   pkiutil.SupportedEllipticCurves(opts.ECCCurve),
 	}
 
 	// Generate the cert/key, send CSR to CA.
@@ -132,7 +267,7 @@ func (c *caClient) FetchCert(identity string) (*security.SecretItem, error) {
 		log.Errorf("%s failed to generate key and certificate for CSR: %v", identity, err)
 		return nil, err
 	}
-	certChainPEM, err := c.CsrSend(csrPEM, int64(c.opts.SecretTTL.Seconds()), identity)
+	certChainPEM, err := c.CsrSend(csrPEM, int64(opts.SecretTTL.Seconds()), identity)
 	if err != nil {
 		return nil, err
 	}
@@ -159,5 +294,11 @@ func (c *caClient) FetchCert(identity string) (*security.SecretItem, error) {
 }
 
 func (c *caClient) Close() error {
-	return c.conn.Close()
+	var errs []error
+	for _, ep := range c.endpoints {
+		if err := ep.conn.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
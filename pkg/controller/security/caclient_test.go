@@ -19,6 +19,7 @@ package security
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"path"
@@ -26,11 +27,16 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/agiledragon/gomonkey/v2"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	pb "istio.io/api/security/v1alpha1"
 	istiogrpc "istio.io/istio/pilot/pkg/grpc"
 	testutil "istio.io/istio/pilot/test/util"
@@ -39,6 +45,7 @@ import (
 	"istio.io/istio/pkg/spiffe"
 	"istio.io/istio/security/pkg/credentialfetcher/plugin"
 
+	"kmesh.net/kmesh/pkg/controller/telemetry"
 	"kmesh.net/kmesh/pkg/nets"
 )
 
@@ -55,9 +62,15 @@ type mockIstioServer struct {
 	Certs         []string
 	Authenticator *security.FakeAuthenticator
 	Err           error
+	// ClusterIDs receives the ClusterID of the requests if set
+	ClusterIDs chan string
 }
 
 func (ca *mockIstioServer) CreateCertificate(ctx context.Context, in *pb.IstioCertificateRequest) (*pb.IstioCertificateResponse, error) {
+	if ca.ClusterIDs != nil {
+		md, _ := metadata.FromIncomingContext(ctx)
+		ca.ClusterIDs <- strings.Join(md.Get("ClusterID"), ",")
+	}
 	if ca.Err == nil {
 		return &pb.IstioCertificateResponse{CertChain: ca.Certs}, nil
 	}
@@ -243,3 +256,101 @@ func TestCaClient(t *testing.T) {
 		})
 	}
 }
+
+func TestCaFailover(t *testing.T) {
+	servers := map[string]mockIstioServer{
+		"ca-down":  {Err: errors.New("unavailable")},
+		"ca-up":    {Certs: fakeCert},
+		"ca-empty": {Certs: []string{}},
+	}
+	addresses := make(map[string]string)
+	for name, server := range servers {
+		addresses[name] = serve(t, server)
+	}
+	patches := gomonkey.NewPatches()
+	patches.ApplyFunc(nets.GrpcConnect, func(addr string) (*grpc.ClientConn, error) {
+		return GrpcConnect(addresses[addr], "")
+	})
+	defer patches.Reset()
+
+	newClient := func(t *testing.T, addresses string) *caClient {
+		patches.ApplyGlobalVar(&caAddress, addresses)
+		cli, err := newCaClient(nil, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = cli.Close()
+		})
+		return cli.(*caClient)
+	}
+	identity := "spiffe:///ns/default/sa/default"
+
+	t.Run("fail over to the next CA", func(t *testing.T) {
+		failovers := promtestutil.ToFloat64(telemetry.CaFailovers)
+		errs := promtestutil.ToFloat64(telemetry.CaRequests.WithLabelValues("ca-down", "error"))
+		cli := newClient(t, "ca-down, ca-up")
+
+		resp, err := cli.CsrSend([]byte{0o1}, 1, identity)
+		require.NoError(t, err)
+		assert.Equal(t, fakeCert, resp)
+		assert.Equal(t, 1, cli.current)
+		assert.Equal(t, float64(1), promtestutil.ToFloat64(telemetry.CaFailovers)-failovers)
+		assert.Equal(t, float64(1), promtestutil.ToFloat64(telemetry.CaRequests.WithLabelValues("ca-down", "error"))-errs)
+
+		// the failed CA is skipped while cooling down
+		_, err = cli.CsrSend([]byte{0o1}, 1, identity)
+		require.NoError(t, err)
+		assert.Equal(t, float64(1), promtestutil.ToFloat64(telemetry.CaRequests.WithLabelValues("ca-down", "error"))-errs)
+		assert.Equal(t, 1, cli.endpoints[0].failures)
+	})
+
+	t.Run("all CAs fail", func(t *testing.T) {
+		cli := newClient(t, "ca-down,ca-empty")
+
+		_, err := cli.CsrSend([]byte{0o1}, 1, identity)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "ca-down")
+		assert.Contains(t, err.Error(), "invalid empty CertChain")
+		assert.Equal(t, 0, cli.current)
+
+		// unhealthy CAs are still tried when none is healthy, with longer cool downs
+		_, err = cli.CsrSend([]byte{0o1}, 1, identity)
+		require.Error(t, err)
+		for _, ep := range cli.endpoints {
+			assert.Equal(t, 2, ep.failures)
+			assert.True(t, ep.unhealthyUntil.After(time.Now().Add(caEndpointCooldown)))
+		}
+	})
+
+	t.Run("no CA address", func(t *testing.T) {
+		patches.ApplyGlobalVar(&caAddress, " , ")
+		_, err := newCaClient(nil, nil)
+		assert.Error(t, err)
+	})
+}
+
+func TestCaClusterID(t *testing.T) {
+	server := mockIstioServer{Certs: fakeCert, ClusterIDs: make(chan string, 1)}
+	address := serve(t, server)
+	patches := gomonkey.NewPatches()
+	patches.ApplyFunc(nets.GrpcConnect, func(addr string) (*grpc.ClientConn, error) {
+		return GrpcConnect(address, "")
+	})
+	defer patches.Reset()
+
+	for _, tc := range []struct {
+		clusterID string
+		expected  string
+	}{
+		{clusterID: "", expected: defaultCaClusterID},
+		{clusterID: "cluster-east", expected: "cluster-east"},
+	} {
+		opts := NewSecurityOptions()
+		opts.ClusterID = tc.clusterID
+		cli, err := createCaClient(CaConfig{ClusterID: tc.clusterID}, opts, nil)
+		require.NoError(t, err)
+		_, err = cli.CsrSend([]byte{0o1}, 1, "spiffe:///ns/default/sa/default")
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, <-server.ClusterIDs)
+		_ = cli.Close()
+	}
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	istiosecurity "istio.io/istio/pkg/security"
+)
+
+const (
+	certStoreKeySize    = 32 // AES-256
+	certStoreFileSuffix = ".cert"
+	// certStoreVersion leads every entry, so that the format can change later
+	certStoreVersion byte = 1
+)
+
+// CertStore persists the workload certificates and keys on disk, so that a
+// restarted daemon does not have to sign them all again. Every entry is sealed
+// with AES-GCM and bound to its file name, which is derived from the identity,
+// so that a corrupted, tampered or swapped entry fails to open.
+type CertStore struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+type storedCert struct {
+	Identity         string    `json:"identity"`
+	CertificateChain []byte    `json:"certificateChain"`
+	PrivateKey       []byte    `json:"privateKey"`
+	RootCert         []byte    `json:"rootCert"`
+	CreatedTime      time.Time `json:"createdTime"`
+	ExpireTime       time.Time `json:"expireTime"`
+}
+
+func NewCertStore(dir, keyFile string) (*CertStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create cert store dir failed: %v", err)
+	}
+	// MkdirAll keeps the mode of an existing directory
+	if err := os.Chmod(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("restrict cert store dir failed: %v", err)
+	}
+
+	key, err := loadOrCreateStoreKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &CertStore{dir: dir, aead: aead}, nil
+}
+
+func loadOrCreateStoreKey(keyFile string) ([]byte, error) {
+	info, err := os.Stat(keyFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		key := make([]byte, certStoreKeySize)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err = os.MkdirAll(filepath.Dir(keyFile), 0o700); err != nil {
+			return nil, fmt.Errorf("create cert store key dir failed: %v", err)
+		}
+		if err = writeFileAtomic(keyFile, key); err != nil {
+			return nil, fmt.Errorf("write cert store key failed: %v", err)
+		}
+		log.Infof("created cert store key %s", keyFile)
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("stat cert store key failed: %v", err)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("cert store key %s must not be accessible by group or others, mode %v", keyFile, info.Mode().Perm())
+	}
+
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read cert store key failed: %v", err)
+	}
+	if len(key) != certStoreKeySize {
+		return nil, fmt.Errorf("cert store key %s must be %d bytes, got %d", keyFile, certStoreKeySize, len(key))
+	}
+	return key, nil
+}
+
+func (s *CertStore) fileName(identity string) string {
+	sum := sha256.Sum256([]byte(identity))
+	return hex.EncodeToString(sum[:]) + certStoreFileSuffix
+}
+
+// save writes the cert of the identity, replacing the previous one
+func (s *CertStore) save(identity string, cert *istiosecurity.SecretItem) error {
+	if s == nil {
+		return nil
+	}
+
+	plaintext, err := json.Marshal(storedCert{
+		Identity:         identity,
+		CertificateChain: cert.CertificateChain,
+		PrivateKey:       cert.PrivateKey,
+		RootCert:         cert.RootCert,
+		CreatedTime:      cert.CreatedTime,
+		ExpireTime:       cert.ExpireTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	name := s.fileName(identity)
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	data := append([]byte{certStoreVersion}, nonce...)
+	data = s.aead.Seal(data, nonce, plaintext, []byte(name))
+	return writeFileAtomic(filepath.Join(s.dir, name), data)
+}
+
+func (s *CertStore) remove(identity string) error {
+	if s == nil {
+		return nil
+	}
+	err := os.Remove(filepath.Join(s.dir, s.fileName(identity)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// loadAll returns the stored certs still valid at now by identity. Expired,
+// corrupted and tampered entries are deleted.
+func (s *CertStore) loadAll(now time.Time) map[string]*istiosecurity.SecretItem {
+	certs := make(map[string]*istiosecurity.SecretItem)
+	if s == nil {
+		return certs
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Errorf("read cert store dir failed: %v", err)
+		return certs
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, certStoreFileSuffix) {
+			continue
+		}
+
+		path := filepath.Join(s.dir, name)
+		cert, err := s.load(path, name, now)
+		if err != nil {
+			log.Warnf("drop stored cert %s: %v", name, err)
+			if err = os.Remove(path); err != nil {
+				log.Errorf("remove stored cert %s failed: %v", name, err)
+			}
+			continue
+		}
+		certs[cert.ResourceName] = cert
+	}
+	return certs
+}
+
+func (s *CertStore) load(path, name string, now time.Time) (*istiosecurity.SecretItem, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("unexpected file mode %v", info.Mode())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := s.aead.NonceSize()
+	if len(data) < 1+nonceSize || data[0] != certStoreVersion {
+		return nil, fmt.Errorf("corrupted entry")
+	}
+	plaintext, err := s.aead.Open(nil, data[1:1+nonceSize], data[1+nonceSize:], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("corrupted or tampered entry: %v", err)
+	}
+
+	var stored storedCert
+	if err = json.Unmarshal(plaintext, &stored); err != nil {
+		return nil, fmt.Errorf("decode entry failed: %v", err)
+	}
+	if s.fileName(stored.Identity) != name {
+		return nil, fmt.Errorf("entry of identity %s is misplaced", stored.Identity)
+	}
+	if !stored.ExpireTime.After(now) {
+		return nil, fmt.Errorf("cert of %s expired at %v", stored.Identity, stored.ExpireTime)
+	}
+
+	// the key must match the leaf, whose expiry is the one rotation relies on
+	pair, err := tls.X509KeyPair(stored.CertificateChain, stored.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cert of %s: %v", stored.Identity, err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid cert of %s: %v", stored.Identity, err)
+	}
+	if !leaf.NotAfter.Equal(stored.ExpireTime) {
+		return nil, fmt.Errorf("cert of %s expires at %v, not %v", stored.Identity, leaf.NotAfter, stored.ExpireTime)
+	}
+
+	return &istiosecurity.SecretItem{
+		CertificateChain: stored.CertificateChain,
+		PrivateKey:       stored.PrivateKey,
+		RootCert:         stored.RootCert,
+		ResourceName:     stored.Identity,
+		CreatedTime:      stored.CreatedTime,
+		ExpireTime:       stored.ExpireTime,
+	}, nil
+}
+
+// writeFileAtomic replaces path with a file readable by the owner only, a crash
+// leaves either the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = tmp.Chmod(0o600); err == nil {
+		if _, err = tmp.Write(data); err == nil {
+			err = tmp.Sync()
+		}
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package security
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"istio.io/istio/pkg/security"
+
+	camock "kmesh.net/kmesh/pkg/controller/security/mock"
+)
+
+func newTestCertStore(t *testing.T, dir, keyFile string) *CertStore {
+	store, err := NewCertStore(dir, keyFile)
+	require.NoError(t, err)
+	return store
+}
+
+func newTestCert(t *testing.T, identity string, lifetime time.Duration) *security.SecretItem {
+	caClient, err := camock.NewMockCaClient(NewSecurityOptions(), lifetime)
+	require.NoError(t, err)
+	cert, err := caClient.FetchCert(identity)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestCertStore(t *testing.T) {
+	tmp := t.TempDir()
+	dir, keyFile := filepath.Join(tmp, "store"), filepath.Join(tmp, "key")
+	identity := "spiffe://cluster.local/ns/default/sa/default"
+	cert := newTestCert(t, identity, 2*time.Hour)
+
+	t.Run("restricted permissions", func(t *testing.T) {
+		newTestCertStore(t, dir, keyFile)
+		info, err := os.Stat(dir)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o700), info.Mode().Perm())
+		info, err = os.Stat(keyFile)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+		require.NoError(t, os.Chmod(keyFile, 0o644))
+		_, err = NewCertStore(dir, keyFile)
+		assert.Error(t, err)
+		require.NoError(t, os.Chmod(keyFile, 0o600))
+	})
+
+	t.Run("save and load", func(t *testing.T) {
+		store := newTestCertStore(t, dir, keyFile)
+		require.NoError(t, store.save(identity, cert))
+
+		// a restarted daemon reads it with the same key
+		certs := newTestCertStore(t, dir, keyFile).loadAll(time.Now())
+		require.Contains(t, certs, identity)
+		loaded := certs[identity]
+		assert.Equal(t, cert.CertificateChain, loaded.CertificateChain)
+		assert.Equal(t, cert.PrivateKey, loaded.PrivateKey)
+		assert.Equal(t, cert.RootCert, loaded.RootCert)
+		assert.Equal(t, identity, loaded.ResourceName)
+		assert.True(t, cert.ExpireTime.Equal(loaded.ExpireTime))
+
+		require.NoError(t, store.remove(identity))
+		assert.Empty(t, store.loadAll(time.Now()))
+		assert.NoError(t, store.remove(identity))
+	})
+
+	t.Run("drop invalid entries", func(t *testing.T) {
+		store := newTestCertStore(t, dir, keyFile)
+		path := filepath.Join(dir, store.fileName(identity))
+
+		tests := []struct {
+			name   string
+			modify func(t *testing.T)
+			now    time.Time
+		}{
+			{
+				name: "tampered",
+				modify: func(t *testing.T) {
+					data, err := os.ReadFile(path)
+					require.NoError(t, err)
+					data[len(data)-1] ^= 0xff
+					require.NoError(t, os.WriteFile(path, data, 0o600))
+				},
+			},
+			{
+				name: "truncated",
+				modify: func(t *testing.T) {
+					require.NoError(t, os.WriteFile(path, []byte{certStoreVersion}, 0o600))
+				},
+			},
+			{
+				name: "swapped to another identity",
+				modify: func(t *testing.T) {
+					require.NoError(t, os.Rename(path, filepath.Join(dir, store.fileName("other"))))
+				},
+			},
+			{
+				name: "loose permissions",
+				modify: func(t *testing.T) {
+					require.NoError(t, os.Chmod(path, 0o644))
+				},
+			},
+			{
+				name: "encrypted with another key",
+				modify: func(t *testing.T) {
+					other := newTestCertStore(t, dir, filepath.Join(tmp, "other-key"))
+					require.NoError(t, other.save(identity, cert))
+				},
+			},
+			{
+				name:   "expired",
+				modify: func(t *testing.T) {},
+				now:    cert.ExpireTime.Add(time.Second),
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				require.NoError(t, store.save(identity, cert))
+				tt.modify(t)
+				now := tt.now
+				if now.IsZero() {
+					now = time.Now()
+				}
+				assert.Empty(t, store.loadAll(now))
+				entries, err := os.ReadDir(dir)
+				require.NoError(t, err)
+				assert.Empty(t, entries)
+			})
+		}
+	})
+}
+
+func TestSecretManagerCertStore(t *testing.T) {
+	caClient, err := camock.NewMockCaClient(NewSecurityOptions(), 2*time.Hour)
+	require.NoError(t, err)
+	patches := gomonkey.NewPatches()
+	patches.ApplyFunc(newCaClient, func(opts *security.Options, tlsOpts *tlsOptions) (CaClient, error) {
+		return caClient, nil
+	})
+	defer patches.Reset()
+
+	tmp := t.TempDir()
+	dir, keyFile := filepath.Join(tmp, "store"), filepath.Join(tmp, "key")
+	identity1 := "identity1"
+	identity2 := "identity2"
+
+	// the first daemon signs and persists the certs
+	stopCh := make(chan struct{})
+	secretManager, err := NewSecretManager(CaConfig{})
+	require.NoError(t, err)
+	secretManager.SetCertStore(newTestCertStore(t, dir, keyFile))
+	go secretManager.Run(stopCh)
+	secretManager.SendCertRequest(identity1, ADD)
+	secretManager.SendCertRequest(identity2, ADD)
+	var signed *security.SecretItem
+	assert.Eventually(t, func() bool {
+		secretManager.certsCache.mu.RLock()
+		defer secretManager.certsCache.mu.RUnlock()
+		signed = secretManager.certsCache.certs[identity1].cert
+		return signed != nil && secretManager.certsCache.certs[identity2].cert != nil
+	}, 5*time.Second, 50*time.Millisecond)
+	close(stopCh)
+
+	// the restarted daemon reuses the cert of identity1 without signing
+	fetched := false
+	patches.ApplyMethodFunc(caClient, "FetchCert", func(identity string) (*security.SecretItem, error) {
+		fetched = true
+		return nil, assert.AnError
+	})
+	stopCh = make(chan struct{})
+	defer close(stopCh)
+	secretManager, err = NewSecretManager(CaConfig{})
+	require.NoError(t, err)
+	secretManager.storeGracePeriod = 500 * time.Millisecond
+	store := newTestCertStore(t, dir, keyFile)
+	secretManager.SetCertStore(store)
+	go secretManager.Run(stopCh)
+	secretManager.SendCertRequest(identity1, ADD)
+	assert.Eventually(t, func() bool {
+		secretManager.certsCache.mu.RLock()
+		defer secretManager.certsCache.mu.RUnlock()
+		item := secretManager.certsCache.certs[identity1]
+		return item != nil && item.cert != nil
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, signed.CertificateChain, secretManager.GetCert(identity1).cert.CertificateChain)
+	assert.False(t, fetched)
+
+	// identity2 is not claimed within the grace period
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, store.fileName(identity2)))
+		return os.IsNotExist(err)
+	}, 5*time.Second, 50*time.Millisecond)
+	_, err = os.Stat(filepath.Join(dir, store.fileName(identity1)))
+	assert.NoError(t, err)
+
+	// the cert is removed along with its last workload
+	secretManager.SendCertRequest(identity1, DELETE)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, store.fileName(identity1)))
+		return os.IsNotExist(err)
+	}, 5*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package security
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+)
+
+// CertInfo describes the cert held for an identity
+type CertInfo struct {
+	Identity string `json:"identity"`
+	RefCnt   int32  `json:"refCnt"`
+	// Workloads are the namespace/name of the pods holding the identity
+	Workloads []string `json:"workloads,omitempty"`
+	// Pending is set before the cert is signed, the fields below are empty then
+	Pending      bool      `json:"pending,omitempty"`
+	SerialNumber string    `json:"serialNumber,omitempty"`
+	NotBefore    time.Time `json:"notBefore"`
+	NotAfter     time.Time `json:"notAfter"`
+	NextRotation time.Time `json:"nextRotation"`
+	// Retries counts the failed fetches in a row
+	Retries        int  `json:"retries,omitempty"`
+	RetryExhausted bool `json:"retryExhausted,omitempty"`
+}
+
+// Certs returns the certs held by the secret manager, sorted by identity
+func (s *SecretManager) Certs() []CertInfo {
+	s.certsCache.mu.RLock()
+	defer s.certsCache.mu.RUnlock()
+
+	certs := make([]CertInfo, 0, len(s.certsCache.certs))
+	for identity, item := range s.certsCache.certs {
+		info := CertInfo{
+			Identity:       identity,
+			RefCnt:         item.refCnt,
+			Pending:        item.cert == nil,
+			Retries:        item.retries,
+			RetryExhausted: item.retryExhausted,
+		}
+		for workload := range item.workloads {
+			info.Workloads = append(info.Workloads, workload)
+		}
+		sort.Strings(info.Workloads)
+
+		if item.cert != nil {
+			info.NotAfter = item.cert.ExpireTime
+			info.NextRotation = rotationTime(item.cert)
+			if leaf := parseLeafCert(item.cert.CertificateChain); leaf != nil {
+				info.SerialNumber = formatSerialNumber(leaf)
+				info.NotBefore = leaf.NotBefore
+			}
+		}
+		certs = append(certs, info)
+	}
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].Identity < certs[j].Identity
+	})
+	return certs
+}
+
+// HealthCheck fails when a cert could not be fetched within the retry budget
+// or has expired without being rotated.
+func (s *SecretManager) HealthCheck() error {
+	s.certsCache.mu.RLock()
+	defer s.certsCache.mu.RUnlock()
+
+	var exhausted, expired []string
+	now := time.Now()
+	for identity, item := range s.certsCache.certs {
+		if item.retryExhausted {
+			exhausted = append(exhausted, identity)
+		} else if item.cert != nil && now.After(item.cert.ExpireTime) {
+			expired = append(expired, identity)
+		}
+	}
+	sort.Strings(exhausted)
+	sort.Strings(expired)
+
+	var problems []string
+	if len(exhausted) > 0 {
+		problems = append(problems, fmt.Sprintf("cert fetch gave up for %s", strings.Join(exhausted, ", ")))
+	}
+	if len(expired) > 0 {
+		problems = append(problems, fmt.Sprintf("cert expired for %s", strings.Join(expired, ", ")))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func parseLeafCert(certChain []byte) *x509.Certificate {
+	block, _ := pem.Decode(certChain)
+	if block == nil {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
+
+// formatSerialNumber formats the serial number as openssl does, e.g. 0a:1b:2c
+func formatSerialNumber(cert *x509.Certificate) string {
+	serial := cert.SerialNumber.Bytes()
+	parts := make([]string, 0, len(serial))
+	for _, b := range serial {
+		parts = append(parts, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(parts, ":")
+}
+
+// reportCertExpiry keeps the time to expiry of the certs up to date
+func (s *SecretManager) reportCertExpiry(stop <-chan struct{}) {
+	ticker := time.NewTicker(certMetricsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.certsCache.mu.RLock()
+		for identity, item := range s.certsCache.certs {
+			if item.cert != nil {
+				telemetry.CertExpirySeconds.WithLabelValues(identity).Set(time.Until(item.cert.ExpireTime).Seconds())
+			}
+		}
+		s.certsCache.mu.RUnlock()
+	}
+}
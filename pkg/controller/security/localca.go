@@ -0,0 +1,118 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package security
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"istio.io/istio/pkg/security"
+	pkiutil "istio.io/istio/security/pkg/pki/util"
+)
+
+const (
+	// the file names of the CA bundle, same as the istio plugged-in CA certs
+	caCertFile    = "ca-cert.pem"
+	caKeyFile     = "ca-key.pem"
+	certChainFile = "cert-chain.pem"
+	rootCertFile  = "root-cert.pem"
+
+	selfSignedCaTTL     = 10 * 365 * 24 * time.Hour
+	selfSignedCaKeySize = 2048
+)
+
+// localCaClient signs the CSRs in process by a CA key it holds, so that no
+// istiod is needed, e.g. in air-gapped clusters, development and CI.
+type localCaClient struct {
+	opts   *security.Options
+	bundle *pkiutil.KeyCertBundle
+}
+
+// newFileCaClient signs by the CA bundle mounted in dir
+func newFileCaClient(opts *security.Options, dir string) (CaClient, error) {
+	var certChainFiles []string
+	chain := filepath.Join(dir, certChainFile)
+	if _, err := os.Stat(chain); err == nil {
+		certChainFiles = []string{chain}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("stat %s failed: %v", chain, err)
+	}
+
+	bundle, err := pkiutil.NewVerifiedKeyCertBundleFromFile(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile),
+		certChainFiles, filepath.Join(dir, rootCertFile))
+	if err != nil {
+		return nil, fmt.Errorf("load CA bundle from %s failed: %v", dir, err)
+	}
+	return &localCaClient{opts: opts, bundle: bundle}, nil
+}
+
+// newSelfSignedCaClient signs by a root CA generated in memory, the certs are
+// trusted by nothing else, so it only suits tests and development.
+func newSelfSignedCaClient(opts *security.Options, trustDomain string) (CaClient, error) {
+	certPEM, keyPEM, err := pkiutil.GenCertKeyFromOptions(pkiutil.CertOptions{
+		TTL:          selfSignedCaTTL,
+		Org:          trustDomain,
+		IsCA:         true,
+		IsSelfSigned: true,
+		RSAKeySize:   selfSignedCaKeySize,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("generate self-signed CA failed: %v", err)
+	}
+
+	bundle, err := pkiutil.NewVerifiedKeyCertBundleFromPem(certPEM, keyPEM, nil, certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("load self-signed CA failed: %v", err)
+	}
+	log.Warnf("signing workload certs by a self-signed CA of trust domain %s", trustDomain)
+	return &localCaClient{opts: opts, bundle: bundle}, nil
+}
+
+// CsrSend signs the CSR for identity, returning the cert chain ending with the root cert
+func (c *localCaClient) CsrSend(csrPEM []byte, certValidsec int64, identity string) ([]string, error) {
+	signingCert, signingKey, certChain, rootCert := c.bundle.GetAll()
+	csr, err := pkiutil.ParsePemEncodedCSR(csrPEM)
+	if err != nil {
+		return nil, fmt.Errorf("csr sign error: %v", err)
+	}
+
+	// a cert never outlives its CA
+	ttl := min(time.Duration(certValidsec)*time.Second, time.Until(signingCert.NotAfter))
+	certBytes, err := pkiutil.GenCertFromCSR(csr, signingCert, csr.PublicKey, *signingKey, []string{identity}, ttl, false)
+	if err != nil {
+		return nil, fmt.Errorf("csr sign error: %v", err)
+	}
+
+	ret := []string{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}))}
+	if len(certChain) > 0 {
+		ret = append(ret, string(certChain))
+	}
+	return append(ret, string(rootCert)), nil
+}
+
+func (c *localCaClient) FetchCert(identity string) (*security.SecretItem, error) {
+	return generateSecret(c, c.opts, identity)
+}
+
+func (c *localCaClient) Close() error {
+	return nil
+}
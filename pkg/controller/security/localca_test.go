@@ -0,0 +1,124 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"istio.io/istio/pkg/security"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+// verifySecret checks the cert of identity is signed by the root and matches the key
+func verifySecret(t *testing.T, cert *security.SecretItem, identity string) {
+	t.Helper()
+	pair, err := tls.X509KeyPair(cert.CertificateChain, cert.PrivateKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	require.NoError(t, err)
+	require.Len(t, leaf.URIs, 1)
+	assert.Equal(t, identity, leaf.URIs[0].String())
+	assert.True(t, leaf.NotAfter.Equal(cert.ExpireTime))
+
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(cert.RootCert))
+	intermediates := x509.NewCertPool()
+	for _, der := range pair.Certificate[1:] {
+		c, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		intermediates.AddCert(c)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	assert.NoError(t, err)
+}
+
+func TestLocalCaClient(t *testing.T) {
+	identity := "spiffe://cluster.local/ns/default/sa/default"
+	opts := NewSecurityOptions()
+	opts.SecretTTL = time.Hour
+
+	t.Run("self-signed", func(t *testing.T) {
+		cli, err := createCaClient(CaConfig{Provider: constants.CaProviderSelfSigned, TrustDomain: "cluster.local"}, opts, nil)
+		require.NoError(t, err)
+		cert, err := cli.FetchCert(identity)
+		require.NoError(t, err)
+		verifySecret(t, cert, identity)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), cert.ExpireTime, time.Minute)
+
+		// another client has another root
+		other, err := newSelfSignedCaClient(opts, "cluster.local")
+		require.NoError(t, err)
+		otherCert, err := other.FetchCert(identity)
+		require.NoError(t, err)
+		assert.NotEqual(t, cert.RootCert, otherCert.RootCert)
+	})
+
+	t.Run("file", func(t *testing.T) {
+		cli, err := createCaClient(CaConfig{Provider: constants.CaProviderFile, CertDir: "./testdata"}, opts, nil)
+		require.NoError(t, err)
+		cert, err := cli.FetchCert(identity)
+		require.NoError(t, err)
+		verifySecret(t, cert, identity)
+
+		root, _ := pem.Decode(cert.RootCert)
+		require.NotNil(t, root)
+		_, _, _, rootCert := cli.(*localCaClient).bundle.GetAllPem()
+		expected, _ := pem.Decode(rootCert)
+		assert.Equal(t, expected.Bytes, root.Bytes)
+	})
+
+	t.Run("file without CA bundle", func(t *testing.T) {
+		_, err := createCaClient(CaConfig{Provider: constants.CaProviderFile, CertDir: t.TempDir()}, opts, nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("unknown provider", func(t *testing.T) {
+		_, err := createCaClient(CaConfig{Provider: "vault"}, opts, nil)
+		assert.Error(t, err)
+	})
+}
+
+// Test the secret manager signs certs without any CA server
+func TestSecretManagerSelfSigned(t *testing.T) {
+	secretManager, err := NewSecretManager(CaConfig{Provider: constants.CaProviderSelfSigned, TrustDomain: "cluster.local"})
+	require.NoError(t, err)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go secretManager.Run(stopCh)
+
+	identity := "spiffe://cluster.local/ns/default/sa/default"
+	secretManager.SendCertRequest(identity, ADD)
+	var cert *security.SecretItem
+	assert.Eventually(t, func() bool {
+		secretManager.certsCache.mu.RLock()
+		defer secretManager.certsCache.mu.RUnlock()
+		cert = secretManager.certsCache.certs[identity].cert
+		return cert != nil
+	}, 10*time.Second, 50*time.Millisecond)
+	verifySecret(t, cert, identity)
+}
@@ -17,13 +17,17 @@
 package security
 
 import (
+	"math/rand"
 	"sync"
 	"time"
 
 	istiosecurity "istio.io/istio/pkg/security"
+	"istio.io/istio/pkg/spiffe"
 	"k8s.io/client-go/util/workqueue"
 
 	"kmesh.net/kmesh/pkg/constants"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+	"kmesh.net/kmesh/pkg/events"
 	"kmesh.net/kmesh/pkg/logger"
 )
 
@@ -32,6 +36,14 @@ var log = logger.NewLoggerField("security")
 type certItem struct {
 	cert   *istiosecurity.SecretItem
 	refCnt int32
+	// retries counts the failed fetches in a row
+	retries int
+	// retryExhausted is set when the retries run out, the fetch resumes on the next ADD
+	retryExhausted bool
+	// rotationFailed is set once the rotation of the cert has failed, it is counted once
+	rotationFailed bool
+	// workloads are the pods holding the identity
+	workloads map[string]struct{}
 }
 
 type certsCache struct {
@@ -42,6 +54,8 @@ type certsCache struct {
 type certRequest struct {
 	Identity  string
 	Operation int
+	// Workload is the namespace/name of the pod the cert is added or deleted for, if any
+	Workload string
 }
 
 type CaClient interface {
@@ -63,6 +77,59 @@ type SecretManager struct {
 	certsRotateQueue workqueue.DelayingInterface
 
 	certRequestChan chan certRequest
+
+	// failed fetches are retried up to retryBudget times with jittered exponential backoff
+	retryBudget    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	// store persists the certs across restarts, nil if disabled
+	store *CertStore
+	// storedCerts are the certs loaded from store not claimed by any workload yet,
+	// guarded by certsCache.mu
+	storedCerts map[string]*istiosecurity.SecretItem
+	// storeGracePeriod is how long the stored certs wait to be claimed after start
+	storeGracePeriod time.Duration
+
+	// certUpdateHandlers are called with the identity whenever its cert is replaced
+	certUpdateHandlers []func(identity string)
+}
+
+// AddCertUpdateHandler adds a handler called after the cert of an identity is
+// signed or rotated, it must be called before Run.
+func (s *SecretManager) AddCertUpdateHandler(handler func(identity string)) {
+	s.certUpdateHandlers = append(s.certUpdateHandlers, handler)
+}
+
+// GetSecret returns the cert of identity, nil if it is not signed yet
+func (s *SecretManager) GetSecret(identity string) *istiosecurity.SecretItem {
+	s.certsCache.mu.RLock()
+	defer s.certsCache.mu.RUnlock()
+	if item := s.certsCache.certs[identity]; item != nil {
+		return item.cert
+	}
+	return nil
+}
+
+// GetRootCert returns the root cert of the latest signed cert, nil if none is signed yet
+func (s *SecretManager) GetRootCert() []byte {
+	s.certsCache.mu.RLock()
+	defer s.certsCache.mu.RUnlock()
+	var latest *istiosecurity.SecretItem
+	for _, item := range s.certsCache.certs {
+		if item.cert != nil && (latest == nil || item.cert.CreatedTime.After(latest.CreatedTime)) {
+			latest = item.cert
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	return latest.RootCert
+}
+
+// SetCertStore enables persisting the certs in store, it must be called before Run.
+func (s *SecretManager) SetCertStore(store *CertStore) {
+	s.store = store
 }
 
 // When inline optimization is turned on, in some test cases,
@@ -74,6 +141,12 @@ func (s *SecretManager) SendCertRequest(identity string, op int) {
 	s.certRequestChan <- certRequest{Identity: identity, Operation: op}
 }
 
+// SendWorkloadCertRequest adds or deletes the cert of identity for the workload,
+// which is recorded as an owner of the cert.
+func (s *SecretManager) SendWorkloadCertRequest(identity, workload string, op int) {
+	s.certRequestChan <- certRequest{Identity: identity, Operation: op, Workload: workload}
+}
+
 func (s *SecretManager) handleCertRequests(stop <-chan struct{}) {
 	for data := range s.certRequestChan {
 		select {
@@ -85,9 +158,18 @@ func (s *SecretManager) handleCertRequests(stop <-chan struct{}) {
 		identity, op := data.Identity, data.Operation
 		switch op {
 		case ADD:
-			certificate := s.certsCache.addOrUpdate(identity)
+			certificate := s.certsCache.addOrUpdate(identity, data.Workload)
 			if certificate != nil {
 				log.Debugf("add identity: %v refCnt: %v", identity, certificate.refCnt)
+				if s.resumeFetch(identity) {
+					go s.fetchCert(identity)
+				}
+				continue
+			}
+			// reuse the cert persisted before restart, which is still valid
+			if stored := s.takeStoredCert(identity); stored != nil {
+				log.Debugf("reuse stored cert of %v, exp: %v", identity, stored.ExpireTime)
+				s.storeCert(identity, stored, false)
 				continue
 			}
 			// sign cert if only no cert exists for this identity
@@ -95,7 +177,7 @@ func (s *SecretManager) handleCertRequests(stop <-chan struct{}) {
 		case RETRY:
 			s.retryFetchCert(identity)
 		case DELETE:
-			s.deleteCert(identity)
+			s.deleteCert(identity, data.Workload)
 		case Rotate:
 			s.rotateCert(identity)
 		}
@@ -110,6 +192,20 @@ func newCertCache() *certsCache {
 }
 
 func (s *SecretManager) StoreCert(identity string, newCert *istiosecurity.SecretItem) {
+	s.storeCert(identity, newCert, true)
+}
+
+func (s *SecretManager) storeCert(identity string, newCert *istiosecurity.SecretItem, persist bool) {
+	if !s.updateCert(identity, newCert, persist) {
+		return
+	}
+	for _, handler := range s.certUpdateHandlers {
+		handler(identity)
+	}
+}
+
+// updateCert replaces the cert of identity, and reports whether it is replaced
+func (s *SecretManager) updateCert(identity string, newCert *istiosecurity.SecretItem, persist bool) bool {
 	s.certsCache.mu.Lock()
 	defer s.certsCache.mu.Unlock()
 	// Check if the key exists in the map
@@ -117,46 +213,85 @@ func (s *SecretManager) StoreCert(identity string, newCert *istiosecurity.Secret
 	if existing == nil {
 		// This can happen when delete immediately happens after add
 		log.Debugf("%v has been deleted", identity)
-		return
+		return false
 	}
 	// if the new cert expire time is before the existing one, it means the new cert is actually signed earlier,
-	// just ignore it.
-	if existing.cert != nil && newCert.ExpireTime.Before(existing.cert.ExpireTime) {
-		return
+	// just ignore it. The same expire time means the CA returned the cert in use, whose
+	// rotation is already scheduled.
+	if existing.cert != nil && !newCert.ExpireTime.After(existing.cert.ExpireTime) {
+		return false
 	}
 
+	if existing.cert != nil && persist {
+		telemetry.CertRotations.Inc()
+	}
+	switch {
+	case !persist:
+		publishCertEvent(identity, "restore", "", newCert.ExpireTime)
+	case existing.cert == nil:
+		publishCertEvent(identity, "issue", "", newCert.ExpireTime)
+	default:
+		publishCertEvent(identity, "rotate", "", newCert.ExpireTime)
+	}
 	existing.cert = newCert
-	// push to rotate queue one hour before cert expire
-	s.certsRotateQueue.AddAfter(identity, time.Until(newCert.ExpireTime.Add(-1*time.Hour)))
+	telemetry.CertExpirySeconds.WithLabelValues(identity).Set(time.Until(newCert.ExpireTime).Seconds())
+	existing.retries = 0
+	existing.retryExhausted = false
+	existing.rotationFailed = false
+	if persist {
+		if err := s.store.save(identity, newCert); err != nil {
+			log.Errorf("persist cert of %v failed: %v", identity, err)
+		}
+	}
+	s.certsRotateQueue.AddAfter(identity, time.Until(rotationTime(newCert)))
 	log.Debugf("cert %v added to rotation queue, exp: %v", identity, newCert.ExpireTime)
+	return true
+}
+
+// rotationTime is when cert is rotated, once rotateLifetimeRatio of its lifetime has passed
+func rotationTime(cert *istiosecurity.SecretItem) time.Time {
+	lifetime := cert.ExpireTime.Sub(cert.CreatedTime)
+	return cert.CreatedTime.Add(time.Duration(float64(lifetime) * rotateLifetimeRatio))
 }
 
 // addOrUpdate checks whether the certificate already exists.
 // If it exists, increment the reference count by 1,
 // Otherwise, request a new certificate.
-func (c *certsCache) addOrUpdate(identity string) *certItem {
+func (c *certsCache) addOrUpdate(identity, workload string) *certItem {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	cert := c.certs[identity]
 	if cert != nil {
 		cert.refCnt++
+		cert.addWorkload(workload)
 		return cert
 	}
 	cert = &certItem{
-		refCnt: 1,
+		refCnt:    1,
+		workloads: make(map[string]struct{}),
 	}
+	cert.addWorkload(workload)
 	c.certs[identity] = cert
 	return nil
 }
 
-// NewSecretManager creates a new secretManager
-func NewSecretManager() (*SecretManager, error) {
+func (c *certItem) addWorkload(workload string) {
+	if workload != "" {
+		c.workloads[workload] = struct{}{}
+	}
+}
+
+// NewSecretManager creates a new secretManager signing the certs by the CA of caConfig
+func NewSecretManager(caConfig CaConfig) (*SecretManager, error) {
 	tlsOpts := &tlsOptions{
 		RootCert: constants.RootCertPath,
 	}
 
 	options := NewSecurityOptions()
-	caClient, err := newCaClient(options, tlsOpts)
+	options.CAProviderName = caConfig.Provider
+	options.ClusterID = caConfig.ClusterID
+	options.TrustDomain = caConfig.TrustDomain
+	caClient, err := createCaClient(caConfig, options, tlsOpts)
 	if err != nil {
 		log.Errorf("err : %v", err)
 		return nil, err
@@ -168,18 +303,62 @@ func NewSecretManager() (*SecretManager, error) {
 		certsCache:       newCertCache(),
 		certsRotateQueue: workqueue.NewDelayingQueue(),
 		certRequestChan:  make(chan certRequest, maxConcurrentCSR),
+		retryBudget:      csrRetryBudgetEnv,
+		initialBackoff:   csrInitialBackoff,
+		maxBackoff:       csrMaxBackoff,
+		storedCerts:      make(map[string]*istiosecurity.SecretItem),
+		storeGracePeriod: defaultStoreGracePeriod,
 	}
 	return &secretManager, nil
 }
 
 func (s *SecretManager) Run(stop <-chan struct{}) {
+	if s.store != nil {
+		// load before handling any request, so that no stored identity is signed again
+		s.loadStoredCerts()
+		cleanup := time.AfterFunc(s.storeGracePeriod, s.cleanupStoredCerts)
+		defer cleanup.Stop()
+	}
 	go s.handleCertRequests(stop)
 	go s.rotateCerts()
+	go s.reportCertExpiry(stop)
 	<-stop
 	s.certsRotateQueue.ShutDown()
 	s.caClient.Close()
 }
 
+func (s *SecretManager) loadStoredCerts() {
+	certs := s.store.loadAll(time.Now())
+	s.certsCache.mu.Lock()
+	defer s.certsCache.mu.Unlock()
+	for identity, cert := range certs {
+		s.storedCerts[identity] = cert
+	}
+	log.Infof("loaded %d stored certs", len(certs))
+}
+
+func (s *SecretManager) takeStoredCert(identity string) *istiosecurity.SecretItem {
+	s.certsCache.mu.Lock()
+	defer s.certsCache.mu.Unlock()
+	cert := s.storedCerts[identity]
+	delete(s.storedCerts, identity)
+	return cert
+}
+
+// cleanupStoredCerts removes the stored certs of the identities no longer on this node
+func (s *SecretManager) cleanupStoredCerts() {
+	s.certsCache.mu.Lock()
+	defer s.certsCache.mu.Unlock()
+	for identity := range s.storedCerts {
+		if err := s.store.remove(identity); err != nil {
+			log.Errorf("remove stored cert of %v failed: %v", identity, err)
+			continue
+		}
+		delete(s.storedCerts, identity)
+		log.Debugf("stored cert of %v cleaned up", identity)
+	}
+}
+
 // Automatically check and rotate when the validity period expires
 func (s *SecretManager) rotateCerts() {
 	for {
@@ -199,10 +378,15 @@ func (s *SecretManager) fetchCert(identity string) {
 	newCert, err := s.caClient.FetchCert(identity)
 	if err != nil {
 		log.Errorf("fetchCert for [%v] error: %v", identity, err)
-		// TODO: backoff retry
-		time.AfterFunc(time.Second, func() {
-			s.SendCertRequest(identity, RETRY)
-		})
+		publishCertEvent(identity, "fetch_failed", err.Error(), time.Time{})
+		s.retryLater(identity, true)
+		return
+	}
+	if s.isCurrentCert(identity, newCert) {
+		// the CA has not renewed the cert yet, e.g. the SPIRE agent rotates the SVIDs
+		// on its own schedule, so the rotation is tried again after a backoff
+		log.Debugf("cert of [%v] is not renewed yet, exp: %v", identity, newCert.ExpireTime)
+		s.retryLater(identity, false)
 		return
 	}
 
@@ -210,20 +394,95 @@ func (s *SecretManager) fetchCert(identity string) {
 	s.StoreCert(identity, newCert)
 }
 
+func (s *SecretManager) retryLater(identity string, failed bool) {
+	delay, ok := s.nextRetry(identity, failed)
+	if !ok {
+		return
+	}
+	log.Debugf("retry fetchCert for [%v] in %v", identity, delay)
+	time.AfterFunc(delay, func() {
+		s.SendCertRequest(identity, RETRY)
+	})
+}
+
+// isCurrentCert reports whether cert expires at the same time as the cert in use for identity
+func (s *SecretManager) isCurrentCert(identity string, cert *istiosecurity.SecretItem) bool {
+	s.certsCache.mu.RLock()
+	defer s.certsCache.mu.RUnlock()
+	existing := s.certsCache.certs[identity]
+	return existing != nil && existing.cert != nil && existing.cert.ExpireTime.Equal(cert.ExpireTime)
+}
+
+// nextRetry returns the delay before fetching the cert of identity again, false if the
+// identity is deleted or its retries run out. The rotation of a cert still valid is not
+// given up, it goes on at the max backoff until the cert expires.
+func (s *SecretManager) nextRetry(identity string, failed bool) (time.Duration, bool) {
+	s.certsCache.mu.Lock()
+	defer s.certsCache.mu.Unlock()
+	certificate := s.certsCache.certs[identity]
+	if certificate == nil {
+		return 0, false
+	}
+	if failed && certificate.cert != nil && !certificate.rotationFailed {
+		telemetry.CertRotationFailures.Inc()
+		certificate.rotationFailed = true
+	}
+	rotating := certificate.cert != nil && time.Now().Before(certificate.cert.ExpireTime)
+	if certificate.retries >= s.retryBudget && !rotating {
+		log.Errorf("give up fetchCert for [%v] after %d retries", identity, certificate.retries)
+		telemetry.CaRetryBudgetExhausted.Inc()
+		certificate.retries = 0
+		certificate.retryExhausted = true
+		return 0, false
+	}
+	certificate.retries++
+	telemetry.CaFetchRetries.Inc()
+	return jitteredBackoff(s.initialBackoff, s.maxBackoff, certificate.retries), true
+}
+
+// resumeFetch reports whether the fetch of identity was given up, and clears it
+func (s *SecretManager) resumeFetch(identity string) bool {
+	s.certsCache.mu.Lock()
+	defer s.certsCache.mu.Unlock()
+	certificate := s.certsCache.certs[identity]
+	if certificate == nil || !certificate.retryExhausted {
+		return false
+	}
+	certificate.retryExhausted = false
+	return true
+}
+
+// jitteredBackoff doubles base for every retry up to limit, and picks a random
+// delay in its upper half, so that the nodes do not retry against the CA together.
+func jitteredBackoff(base, limit time.Duration, retries int) time.Duration {
+	backoff := limit
+	if shift := retries - 1; shift < 32 && base<<shift < limit {
+		backoff = base << shift
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1))
+}
+
 // Set the removed to true for the items in the certsRotateQueue priority queue.
 // Delete the certificate and status map corresponding to the identity.
-func (s *SecretManager) deleteCert(identity string) {
+func (s *SecretManager) deleteCert(identity, workload string) {
 	s.certsCache.mu.Lock()
 	defer s.certsCache.mu.Unlock()
 	certificate := s.certsCache.certs[identity]
 	if certificate == nil {
 		return
 	}
+	delete(certificate.workloads, workload)
 	certificate.refCnt--
 	log.Debugf("remove identity: %v refCnt : %v", identity, certificate.refCnt)
 	if certificate.refCnt == 0 {
 		delete(s.certsCache.certs, identity)
+		telemetry.CertExpirySeconds.DeleteLabelValues(identity)
+		if err := s.store.remove(identity); err != nil {
+			log.Errorf("remove stored cert of %v failed: %v", identity, err)
+		}
 		log.Debugf("identity: %v cert deleted", identity)
+		publishCertEvent(identity, "delete", "", time.Time{})
 	}
 }
 
@@ -237,7 +496,7 @@ func (s *SecretManager) rotateCert(identity string) {
 	}
 	s.certsCache.mu.RUnlock()
 
-	if time.Until(certificate.cert.ExpireTime) >= 1*time.Hour {
+	if time.Now().Before(rotationTime(certificate.cert)) {
 		// This can happen when delete a certificate following adding the same one later.
 		log.Debugf("cert %s expire at %T, skip rotate now", identity, certificate.cert.ExpireTime)
 	}
@@ -257,3 +516,24 @@ func (s *SecretManager) retryFetchCert(identity string) {
 
 	go s.fetchCert(identity)
 }
+
+// publishCertEvent reports a change of the cert of identity, named after its service account
+func publishCertEvent(identity, action, message string, expireTime time.Time) {
+	if !events.Enabled() {
+		return
+	}
+	e := events.Event{
+		Type:       events.Cert,
+		Action:     action,
+		Message:    message,
+		Attributes: map[string]string{"identity": identity},
+	}
+	if id, err := spiffe.ParseIdentity(identity); err == nil {
+		e.Namespace = id.Namespace
+		e.Name = id.ServiceAccount
+	}
+	if !expireTime.IsZero() {
+		e.Attributes["expireTime"] = expireTime.UTC().Format(time.RFC3339)
+	}
+	events.Publish(e)
+}
@@ -18,15 +18,19 @@ package security
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/agiledragon/gomonkey/v2"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 
 	"istio.io/istio/pkg/security"
 
 	camock "kmesh.net/kmesh/pkg/controller/security/mock"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+	"kmesh.net/kmesh/pkg/events"
 )
 
 func (s *SecretManager) GetCert(identity string) *certItem {
@@ -46,6 +50,24 @@ func TestSecurity(t *testing.T) {
 	t.Run("TestretryFetchCert", func(t *testing.T) {
 		runTestretryFetchCert(t)
 	})
+	t.Run("TestFetchCertBackoff", func(t *testing.T) {
+		runTestFetchCertBackoff(t)
+	})
+	t.Run("TestRetryBudget", func(t *testing.T) {
+		runTestRetryBudget(t)
+	})
+	t.Run("TestRotationRetry", func(t *testing.T) {
+		runTestRotationRetry(t)
+	})
+	t.Run("TestUnchangedCert", func(t *testing.T) {
+		runTestUnchangedCert(t)
+	})
+	t.Run("TestCertInventory", func(t *testing.T) {
+		runTestCertInventory(t)
+	})
+	t.Run("TestHealthCheck", func(t *testing.T) {
+		runTestHealthCheck(t)
+	})
 }
 
 // Test certificate add/delete
@@ -57,7 +79,7 @@ func runTestBaseCert(t *testing.T) {
 	defer patches.Reset()
 
 	stopCh := make(chan struct{})
-	secretManager, err := NewSecretManager()
+	secretManager, err := NewSecretManager(CaConfig{})
 	assert.ErrorIsf(t, err, nil, "NewSecretManager failed %v", err)
 	go secretManager.Run(stopCh)
 
@@ -89,13 +111,13 @@ func runTestBaseCert(t *testing.T) {
 func runTestCertRotate(t *testing.T) {
 	patches := gomonkey.NewPatches()
 	patches.ApplyFunc(newCaClient, func(opts *security.Options, tlsOpts *tlsOptions) (CaClient, error) {
-		// One-hour validity period, it will be Rotated after 2 second.
-		return camock.NewMockCaClient(opts, 1*time.Hour+2*time.Second)
+		// Four-second validity period, it will be Rotated after 2 second.
+		return camock.NewMockCaClient(opts, 4*time.Second)
 	})
 	defer patches.Reset()
 
 	stopCh := make(chan struct{})
-	secretManager, err := NewSecretManager()
+	secretManager, err := NewSecretManager(CaConfig{})
 	assert.ErrorIsf(t, err, nil, "NewSecretManager failed %v", err)
 	go secretManager.Run(stopCh)
 
@@ -150,7 +172,7 @@ func runTestretryFetchCert(t *testing.T) {
 	defer patches1.Reset()
 
 	stopCh := make(chan struct{})
-	secretManager, err := NewSecretManager()
+	secretManager, err := NewSecretManager(CaConfig{})
 	assert.ErrorIsf(t, err, nil, "NewSecretManager failed %v", err)
 
 	patches2 := gomonkey.NewPatches()
@@ -170,3 +192,303 @@ func runTestretryFetchCert(t *testing.T) {
 
 	close(stopCh)
 }
+
+func newMockSecretManager(t *testing.T, caClient *camock.CAClient) *SecretManager {
+	patches := gomonkey.NewPatches()
+	patches.ApplyFunc(newCaClient, func(opts *security.Options, tlsOpts *tlsOptions) (CaClient, error) {
+		return caClient, nil
+	})
+	defer patches.Reset()
+
+	secretManager, err := NewSecretManager(CaConfig{})
+	assert.ErrorIsf(t, err, nil, "NewSecretManager failed %v", err)
+	secretManager.initialBackoff = 20 * time.Millisecond
+	secretManager.maxBackoff = 100 * time.Millisecond
+	return secretManager
+}
+
+// Test failed fetches are retried until the CA recovers
+func runTestFetchCertBackoff(t *testing.T) {
+	caClient, err := camock.NewMockCaClient(NewSecurityOptions(), 2*time.Hour)
+	assert.NoError(t, err)
+	caClient.InjectFailures(3)
+	secretManager := newMockSecretManager(t, caClient)
+	secretManager.retryBudget = 5
+	retries := promtestutil.ToFloat64(telemetry.CaFetchRetries)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go secretManager.Run(stopCh)
+
+	identity := "identity"
+	secretManager.SendCertRequest(identity, ADD)
+	assert.Eventually(t, func() bool {
+		secretManager.certsCache.mu.RLock()
+		defer secretManager.certsCache.mu.RUnlock()
+		return secretManager.certsCache.certs[identity].cert != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 4, caClient.Requests())
+	assert.Equal(t, float64(3), promtestutil.ToFloat64(telemetry.CaFetchRetries)-retries)
+	secretManager.certsCache.mu.RLock()
+	assert.Equal(t, 0, secretManager.certsCache.certs[identity].retries)
+	secretManager.certsCache.mu.RUnlock()
+}
+
+// Test the fetch is given up when the retries run out, and resumed by the next ADD
+func runTestRetryBudget(t *testing.T) {
+	caClient, err := camock.NewMockCaClient(NewSecurityOptions(), 2*time.Hour)
+	assert.NoError(t, err)
+	caClient.InjectFailures(100)
+	secretManager := newMockSecretManager(t, caClient)
+	secretManager.retryBudget = 2
+	exhausted := promtestutil.ToFloat64(telemetry.CaRetryBudgetExhausted)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go secretManager.Run(stopCh)
+
+	identity := "identity"
+	secretManager.SendCertRequest(identity, ADD)
+	assert.Eventually(t, func() bool {
+		return promtestutil.ToFloat64(telemetry.CaRetryBudgetExhausted)-exhausted == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	// no more requests once given up
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 3, caClient.Requests())
+	assert.Nil(t, secretManager.GetCert(identity).cert)
+
+	caClient.InjectFailures(0)
+	secretManager.SendCertRequest(identity, ADD)
+	assert.Eventually(t, func() bool {
+		secretManager.certsCache.mu.RLock()
+		defer secretManager.certsCache.mu.RUnlock()
+		return secretManager.certsCache.certs[identity].cert != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), secretManager.GetCert(identity).refCnt)
+}
+
+func TestJitteredBackoff(t *testing.T) {
+	tests := []struct {
+		retries  int
+		min, max time.Duration
+	}{
+		{retries: 1, min: 500 * time.Millisecond, max: time.Second},
+		{retries: 3, min: 2 * time.Second, max: 4 * time.Second},
+		{retries: 10, min: 5 * time.Second, max: 10 * time.Second},
+		{retries: 100, min: 5 * time.Second, max: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			backoff := jitteredBackoff(time.Second, 10*time.Second, tt.retries)
+			assert.GreaterOrEqual(t, backoff, tt.min)
+			assert.LessOrEqual(t, backoff, tt.max)
+		}
+	}
+}
+
+// Test the rotation of a valid cert goes on after the retry budget and is counted once
+func runTestRotationRetry(t *testing.T) {
+	caClient, err := camock.NewMockCaClient(NewSecurityOptions(), 2*time.Hour)
+	assert.NoError(t, err)
+	secretManager := newMockSecretManager(t, caClient)
+	secretManager.retryBudget = 1
+	exhausted := promtestutil.ToFloat64(telemetry.CaRetryBudgetExhausted)
+	rotations := promtestutil.ToFloat64(telemetry.CertRotations)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go secretManager.Run(stopCh)
+
+	identity := "identity"
+	secretManager.SendCertRequest(identity, ADD)
+	assert.Eventually(t, func() bool {
+		secretManager.certsCache.mu.RLock()
+		defer secretManager.certsCache.mu.RUnlock()
+		return secretManager.certsCache.certs[identity].cert != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	rotationFailures := promtestutil.ToFloat64(telemetry.CertRotationFailures)
+	caClient.InjectFailures(4)
+	secretManager.SendCertRequest(identity, Rotate)
+	assert.Eventually(t, func() bool {
+		return promtestutil.ToFloat64(telemetry.CertRotations)-rotations == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 6, caClient.Requests())
+	assert.Equal(t, float64(1), promtestutil.ToFloat64(telemetry.CertRotationFailures)-rotationFailures)
+	assert.Equal(t, float64(0), promtestutil.ToFloat64(telemetry.CaRetryBudgetExhausted)-exhausted)
+}
+
+// fixedCaClient returns the same cert until it is replaced, as the SPIRE agent does
+// until it rotates the SVID
+type fixedCaClient struct {
+	mu       sync.Mutex
+	cert     *security.SecretItem
+	requests int
+}
+
+func (c *fixedCaClient) CsrSend([]byte, int64, string) ([]string, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (c *fixedCaClient) FetchCert(string) (*security.SecretItem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	cert := *c.cert
+	return &cert, nil
+}
+
+func (c *fixedCaClient) Close() error {
+	return nil
+}
+
+func (c *fixedCaClient) set(cert *security.SecretItem) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = cert
+}
+
+func (c *fixedCaClient) Requests() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.requests
+}
+
+// Test a cert returned again by the CA is not rotated in a loop
+func runTestUnchangedCert(t *testing.T) {
+	caClient, err := camock.NewMockCaClient(NewSecurityOptions(), 2*time.Hour)
+	assert.NoError(t, err)
+	secretManager := newMockSecretManager(t, caClient)
+	// a 1h SVID past half of its lifetime is due for rotation right away
+	now := time.Now()
+	fixed := &fixedCaClient{cert: &security.SecretItem{
+		ResourceName: "identity",
+		CreatedTime:  now.Add(-40 * time.Minute),
+		ExpireTime:   now.Add(20 * time.Minute),
+	}}
+	secretManager.caClient = fixed
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go secretManager.Run(stopCh)
+
+	identity := "identity"
+	secretManager.SendCertRequest(identity, ADD)
+	assert.Eventually(t, func() bool {
+		secretManager.certsCache.mu.RLock()
+		defer secretManager.certsCache.mu.RUnlock()
+		return secretManager.certsCache.certs[identity].cert != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the same cert is fetched again after a backoff, not in a hot loop
+	time.Sleep(300 * time.Millisecond)
+	assert.Less(t, fixed.Requests(), 10)
+
+	// the renewed cert replaces it
+	fixed.set(&security.SecretItem{
+		ResourceName: identity,
+		CreatedTime:  now,
+		ExpireTime:   now.Add(time.Hour),
+	})
+	assert.Eventually(t, func() bool {
+		secretManager.certsCache.mu.RLock()
+		defer secretManager.certsCache.mu.RUnlock()
+		return secretManager.certsCache.certs[identity].cert.ExpireTime.Equal(now.Add(time.Hour))
+	}, 5*time.Second, 10*time.Millisecond)
+	requests := fixed.Requests()
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, requests, fixed.Requests())
+}
+
+// Test the certs are listed with their workloads and reported in the metrics
+func runTestCertInventory(t *testing.T) {
+	caClient, err := camock.NewMockCaClient(NewSecurityOptions(), 2*time.Hour)
+	assert.NoError(t, err)
+	secretManager := newMockSecretManager(t, caClient)
+	rotations := promtestutil.ToFloat64(telemetry.CertRotations)
+	rotationFailures := promtestutil.ToFloat64(telemetry.CertRotationFailures)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go secretManager.Run(stopCh)
+
+	identity1 := "identity1"
+	identity2 := "identity2"
+	secretManager.SendWorkloadCertRequest(identity2, "ns2/pod-1", ADD)
+	secretManager.SendWorkloadCertRequest(identity1, "ns1/pod-2", ADD)
+	secretManager.SendWorkloadCertRequest(identity1, "ns1/pod-1", ADD)
+	assert.Eventually(t, func() bool {
+		certs := secretManager.Certs()
+		return len(certs) == 2 && !certs[0].Pending && !certs[1].Pending
+	}, 5*time.Second, 10*time.Millisecond)
+
+	certs := secretManager.Certs()
+	assert.Equal(t, identity1, certs[0].Identity)
+	assert.Equal(t, int32(2), certs[0].RefCnt)
+	assert.Equal(t, []string{"ns1/pod-1", "ns1/pod-2"}, certs[0].Workloads)
+	assert.Regexp(t, "^[0-9a-f]{2}(:[0-9a-f]{2})*$", certs[0].SerialNumber)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), certs[0].NotAfter, time.Minute)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), certs[0].NextRotation, time.Minute)
+	assert.True(t, certs[0].NotBefore.Before(certs[0].NotAfter))
+	assert.Equal(t, identity2, certs[1].Identity)
+	assert.InDelta(t, (2 * time.Hour).Seconds(), promtestutil.ToFloat64(telemetry.CertExpirySeconds.WithLabelValues(identity1)), 60)
+
+	// a failed rotation keeps the old cert, the next one replaces it
+	caClient.InjectFailures(1)
+	secretManager.SendCertRequest(identity1, Rotate)
+	assert.Eventually(t, func() bool {
+		return promtestutil.ToFloat64(telemetry.CertRotations)-rotations == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(1), promtestutil.ToFloat64(telemetry.CertRotationFailures)-rotationFailures)
+	assert.NotEqual(t, certs[0].SerialNumber, secretManager.Certs()[0].SerialNumber)
+
+	series := promtestutil.CollectAndCount(telemetry.CertExpirySeconds)
+	secretManager.SendWorkloadCertRequest(identity1, "ns1/pod-2", DELETE)
+	secretManager.SendWorkloadCertRequest(identity2, "ns2/pod-1", DELETE)
+	assert.Eventually(t, func() bool {
+		certs := secretManager.Certs()
+		return len(certs) == 1 && len(certs[0].Workloads) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"ns1/pod-1"}, secretManager.Certs()[0].Workloads)
+	// the expiry of identity2 is no longer reported
+	assert.Equal(t, series-1, promtestutil.CollectAndCount(telemetry.CertExpirySeconds))
+}
+
+func runTestHealthCheck(t *testing.T) {
+	caClient, err := camock.NewMockCaClient(NewSecurityOptions(), 2*time.Hour)
+	assert.NoError(t, err)
+	secretManager := newMockSecretManager(t, caClient)
+	assert.NoError(t, secretManager.HealthCheck())
+
+	secretManager.certsCache.mu.Lock()
+	secretManager.certsCache.certs["pending"] = &certItem{refCnt: 1}
+	secretManager.certsCache.certs["valid"] = &certItem{
+		cert:   &security.SecretItem{ExpireTime: time.Now().Add(time.Hour)},
+		refCnt: 1,
+	}
+	secretManager.certsCache.mu.Unlock()
+	assert.NoError(t, secretManager.HealthCheck())
+
+	secretManager.certsCache.mu.Lock()
+	secretManager.certsCache.certs["exhausted"] = &certItem{refCnt: 1, retryExhausted: true}
+	secretManager.certsCache.certs["expired"] = &certItem{
+		cert:   &security.SecretItem{ExpireTime: time.Now().Add(-time.Minute)},
+		refCnt: 1,
+	}
+	secretManager.certsCache.mu.Unlock()
+	assert.EqualError(t, secretManager.HealthCheck(), "cert fetch gave up for exhausted; cert expired for expired")
+}
+
+func TestPublishCertEvent(t *testing.T) {
+	sub := events.Default().Subscribe(events.Filter{Types: []events.Type{events.Cert}}, 1)
+	defer sub.Close()
+
+	expireTime := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	publishCertEvent("spiffe://cluster.local/ns/default/sa/sleep", "rotate", "", expireTime)
+
+	e := <-sub.Events()
+	assert.Equal(t, "rotate", e.Action)
+	assert.Equal(t, "default", e.Namespace)
+	assert.Equal(t, "sleep", e.Name)
+	assert.Equal(t, "2030-01-02T03:04:05Z", e.Attributes["expireTime"])
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"istio.io/istio/pkg/security"
@@ -42,6 +43,25 @@ type CAClient struct {
 	certLifetime   time.Duration
 	GeneratedCerts [][]string // Cache the generated certificates for verification purpose.
 	opts           *security.Options
+
+	mu sync.Mutex
+	// failures is the number of the following CSRs to fail
+	failures int
+	requests int
+}
+
+// InjectFailures makes the next n CSRs fail, as a CA outage does.
+func (c *CAClient) InjectFailures(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures = n
+}
+
+// Requests returns the number of CSRs received, including the failed ones.
+func (c *CAClient) Requests() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.requests
 }
 
 // NewMockCaClient create a CA client for CSR sign.
@@ -64,6 +84,15 @@ func NewMockCaClient(opts *security.Options, certLifetime time.Duration) (*CACli
 // The following function is adapted from istio CSRSign
 // (https://github.com/istio/istio/blob/1.20.0/security/pkg/nodeagent/caclient/providers/mock/mockcaclient.go)
 func (c *CAClient) CsrSend(csrPEM []byte, certValidsec int64, identity string) ([]string, error) {
+	c.mu.Lock()
+	c.requests++
+	if c.failures > 0 {
+		c.failures--
+		c.mu.Unlock()
+		return nil, fmt.Errorf("csr sign error: injected failure")
+	}
+	c.mu.Unlock()
+
 	signingCert, signingKey, certChain, rootCert := c.bundle.GetAll()
 	csr, err := util.ParsePemEncodedCSR(csrPEM)
 	if err != nil {
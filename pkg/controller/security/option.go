@@ -30,6 +30,25 @@ const (
 	Rotate
 
 	maxConcurrentCSR = 128 // max concurrent CSR
+
+	defaultCaClusterID = "Kubernetes"
+	caRequestTimeout   = 10 * time.Second
+	// a CA failing in a row is skipped for longer and longer
+	caEndpointCooldown    = 5 * time.Second
+	caEndpointMaxCooldown = 2 * time.Minute
+
+	// certs are rotated once this share of their lifetime has passed, as the SPIRE
+	// agent does, so that short lived certs are not rotated ahead of their issuance
+	rotateLifetimeRatio = 0.5
+	// certMetricsInterval is how often the time to expiry of the certs is reported
+	certMetricsInterval = 30 * time.Second
+
+	// failed cert fetches are retried with jittered exponential backoff
+	csrInitialBackoff = time.Second
+	csrMaxBackoff     = 5 * time.Minute
+
+	// defaultStoreGracePeriod is how long the stored certs wait for their workloads after restart
+	defaultStoreGracePeriod = 10 * time.Minute
 )
 
 func NewSecurityOptions() *security.Options {
@@ -43,7 +62,11 @@ func NewSecurityOptions() *security.Options {
 }
 
 var (
-	caAddress    = env.Register("CA_ADDRESS", "istiod.istio-system.svc:15012", "").Get()
+	caAddress = env.Register("CA_ADDRESS", "istiod.istio-system.svc:15012",
+		"Comma separated CA addresses in the order of preference, the next one is used when the current one fails").Get()
+	csrRetryBudgetEnv = env.Register("CSR_RETRY_BUDGET", 10,
+		"The number of retries of a failed cert fetch before giving up until the identity is requested again, "+
+			"the rotation of a cert still valid is retried until it expires").Get()
 	secretTTLEnv = env.Register("SECRET_TTL", 24*time.Hour,
 		"The cert lifetime requested by kmesh CA agent").Get()
 
@@ -0,0 +1,445 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	sdsv3 "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	resource_v3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	// SdsRootCaName is the name of the secret of the root cert, same as istio
+	SdsRootCaName = "ROOTCA"
+	// SdsPodIdentity is the identity of a rule allowing the peer the identity of
+	// the pod its process runs in, and no other
+	SdsPodIdentity = "@pod"
+)
+
+// PodIdentityFunc returns the identity of the pod the process pid runs in
+type PodIdentityFunc func(pid int32) (string, error)
+
+// SdsServer serves the workload certs held by the secret manager to the local
+// consumers over the Envoy SDS API on a unix socket. Every connection is
+// authenticated by the credentials of its peer process, and may only get the
+// identities allowed for the peer uid. The proxies of all the pods usually run
+// as the same uid, the rules of SdsPodIdentity tell their workloads apart.
+type SdsServer struct {
+	sdsv3.UnimplementedSecretDiscoveryServiceServer
+
+	secretManager *SecretManager
+	rules         []sdsRule
+	podIdentity   PodIdentityFunc
+	listener      net.Listener
+	grpcServer    *grpc.Server
+
+	// version is bumped on every cert update
+	version atomic.Uint64
+
+	mu          sync.Mutex
+	connections map[*sdsConnection]struct{}
+}
+
+// sdsRule allows the peers of uid to get the identities matching identity,
+// which is an exact identity, a prefix ending with "*", "*" for all or
+// SdsPodIdentity for the identity of the peer pod
+type sdsRule struct {
+	uid      uint32
+	identity string
+}
+
+type sdsConnection struct {
+	uid uint32
+	// push is signaled when a subscribed secret is updated
+	push chan struct{}
+
+	mu    sync.Mutex
+	names []string
+}
+
+// NewSdsServer listens on socket, allowing the peers by rules in the form of
+// uid=identity, podIdentity resolves the peer pod for the SdsPodIdentity rules.
+// It must be called before the secret manager runs.
+func NewSdsServer(socket string, rules []string, secretManager *SecretManager, podIdentity PodIdentityFunc) (*SdsServer, error) {
+	sdsRules, err := parseSdsRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	if podIdentity == nil && slices.ContainsFunc(sdsRules, func(r sdsRule) bool { return r.identity == SdsPodIdentity }) {
+		return nil, fmt.Errorf("sds rules of %s require the pod identity of the peers", SdsPodIdentity)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(socket), 0o755); err != nil {
+		return nil, fmt.Errorf("create sds socket dir failed: %v", err)
+	}
+	// remove the socket left by the previous run
+	if err = os.Remove(socket); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("remove stale sds socket failed: %v", err)
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("listen sds socket failed: %v", err)
+	}
+	// every local user may connect, the connections are authorized by peer credentials
+	if err = os.Chmod(socket, 0o666); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("chmod sds socket failed: %v", err)
+	}
+
+	s := &SdsServer{
+		secretManager: secretManager,
+		rules:         sdsRules,
+		podIdentity:   podIdentity,
+		listener:      listener,
+		grpcServer:    grpc.NewServer(grpc.Creds(peerCredentials{insecure.NewCredentials()})),
+		connections:   make(map[*sdsConnection]struct{}),
+	}
+	sdsv3.RegisterSecretDiscoveryServiceServer(s.grpcServer, s)
+	secretManager.AddCertUpdateHandler(s.onCertUpdate)
+	return s, nil
+}
+
+func parseSdsRules(rules []string) ([]sdsRule, error) {
+	sdsRules := make([]sdsRule, 0, len(rules))
+	for _, rule := range rules {
+		uid, identity, found := strings.Cut(rule, "=")
+		if !found || identity == "" {
+			return nil, fmt.Errorf("invalid sds rule %q, must be uid=identity", rule)
+		}
+		id, err := strconv.ParseUint(uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid of sds rule %q: %v", rule, err)
+		}
+		sdsRules = append(sdsRules, sdsRule{uid: uint32(id), identity: identity})
+	}
+	return sdsRules, nil
+}
+
+// allows tells whether the rule allows the peer uid the secret name, podIdentity
+// returns the identity of the peer pod, empty if it is unknown
+func (r sdsRule) allows(uid uint32, name string, podIdentity func() string) bool {
+	if r.uid != uid {
+		return false
+	}
+	// the root cert is public to any allowed peer
+	if name == SdsRootCaName || r.identity == "*" {
+		return true
+	}
+	if r.identity == SdsPodIdentity {
+		identity := podIdentity()
+		return identity != "" && name == identity
+	}
+	if prefix, found := strings.CutSuffix(r.identity, "*"); found {
+		return strings.HasPrefix(name, prefix)
+	}
+	return name == r.identity
+}
+
+func (s *SdsServer) authorize(ctx context.Context, names []string) (uint32, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return 0, status.Error(codes.Unauthenticated, "no peer")
+	}
+	info, ok := p.AuthInfo.(peerCredInfo)
+	if !ok {
+		return 0, status.Error(codes.Unauthenticated, "no peer credentials")
+	}
+	if len(names) == 0 {
+		return 0, status.Error(codes.InvalidArgument, "resource names are required")
+	}
+
+	// the peer pod is only looked up by the rules of SdsPodIdentity, once per request
+	podIdentity := sync.OnceValue(func() string {
+		identity, err := s.podIdentity(info.cred.Pid)
+		if err != nil {
+			log.Warnf("sds peer pid %d: failed to get the pod identity: %v", info.cred.Pid, err)
+		}
+		return identity
+	})
+	for _, name := range names {
+		allowed := slices.ContainsFunc(s.rules, func(r sdsRule) bool {
+			return r.allows(info.cred.Uid, name, podIdentity)
+		})
+		if !allowed {
+			log.Warnf("sds peer pid %d uid %d is denied secret %s", info.cred.Pid, info.cred.Uid, name)
+			return 0, status.Errorf(codes.PermissionDenied, "uid %d is not allowed to get secret %s", info.cred.Uid, name)
+		}
+	}
+	return info.cred.Uid, nil
+}
+
+func (s *SdsServer) Run(stop <-chan struct{}) {
+	go func() {
+		<-stop
+		s.grpcServer.Stop()
+	}()
+	log.Infof("sds server listening on %s", s.listener.Addr())
+	if err := s.grpcServer.Serve(s.listener); err != nil {
+		log.Errorf("sds server stopped: %v", err)
+	}
+}
+
+func (s *SdsServer) StreamSecrets(stream sdsv3.SecretDiscoveryService_StreamSecretsServer) error {
+	ctx := stream.Context()
+	conn := &sdsConnection{push: make(chan struct{}, 1)}
+	s.mu.Lock()
+	s.connections[conn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.connections, conn)
+		s.mu.Unlock()
+	}()
+
+	reqCh := make(chan *discoveryv3.DiscoveryRequest)
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case reqCh <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var nonce uint64
+	for {
+		select {
+		case req := <-reqCh:
+			if req.ErrorDetail != nil {
+				log.Warnf("sds peer uid %d rejected version %s: %s", conn.uid, req.VersionInfo, req.ErrorDetail.Message)
+			}
+			// an ACK or NACK of the same names needs no response
+			if req.ResponseNonce != "" && sameNames(conn.subscribed(), req.ResourceNames) {
+				continue
+			}
+			uid, err := s.authorize(ctx, req.ResourceNames)
+			if err != nil {
+				return err
+			}
+			conn.uid = uid
+			conn.subscribe(req.ResourceNames)
+		case <-conn.push:
+		case err := <-errCh:
+			if errors.Is(err, io.EOF) || status.Code(err) == codes.Canceled {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+
+		nonce++
+		resp, err := s.buildResponse(conn.subscribed(), strconv.FormatUint(nonce, 10))
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err = stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *SdsServer) FetchSecrets(ctx context.Context, req *discoveryv3.DiscoveryRequest) (*discoveryv3.DiscoveryResponse, error) {
+	if _, err := s.authorize(ctx, req.ResourceNames); err != nil {
+		return nil, err
+	}
+	resp, err := s.buildResponse(req.ResourceNames, "")
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return resp, nil
+}
+
+// onCertUpdate pushes the secrets to the connections subscribing identity or the root cert
+func (s *SdsServer) onCertUpdate(identity string) {
+	s.version.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.connections {
+		names := conn.subscribed()
+		if !slices.Contains(names, identity) && !slices.Contains(names, SdsRootCaName) {
+			continue
+		}
+		select {
+		case conn.push <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// buildResponse returns the secrets of names already signed, the others are sent once signed
+func (s *SdsServer) buildResponse(names []string, nonce string) (*discoveryv3.DiscoveryResponse, error) {
+	resp := &discoveryv3.DiscoveryResponse{
+		VersionInfo: strconv.FormatUint(s.version.Load(), 10),
+		TypeUrl:     resource_v3.SecretType,
+		Nonce:       nonce,
+	}
+	for _, name := range names {
+		secret := s.buildSecret(name)
+		if secret == nil {
+			continue
+		}
+		res, err := anypb.New(secret)
+		if err != nil {
+			return nil, err
+		}
+		resp.Resources = append(resp.Resources, res)
+	}
+	return resp, nil
+}
+
+func (s *SdsServer) buildSecret(name string) *tlsv3.Secret {
+	if name == SdsRootCaName {
+		rootCert := s.secretManager.GetRootCert()
+		if rootCert == nil {
+			return nil
+		}
+		return &tlsv3.Secret{
+			Name: name,
+			Type: &tlsv3.Secret_ValidationContext{
+				ValidationContext: &tlsv3.CertificateValidationContext{
+					TrustedCa: inlineBytes(rootCert),
+				},
+			},
+		}
+	}
+
+	cert := s.secretManager.GetSecret(name)
+	if cert == nil {
+		return nil
+	}
+	return &tlsv3.Secret{
+		Name: name,
+		Type: &tlsv3.Secret_TlsCertificate{
+			TlsCertificate: &tlsv3.TlsCertificate{
+				CertificateChain: inlineBytes(cert.CertificateChain),
+				PrivateKey:       inlineBytes(cert.PrivateKey),
+			},
+		},
+	}
+}
+
+func inlineBytes(data []byte) *v3.DataSource {
+	return &v3.DataSource{
+		Specifier: &v3.DataSource_InlineBytes{InlineBytes: data},
+	}
+}
+
+// sameNames compares the resource names as sets, their order is not meaningful
+func sameNames(a, b []string) bool {
+	set := make(map[string]struct{}, len(a))
+	for _, name := range a {
+		set[name] = struct{}{}
+	}
+	seen := make(map[string]struct{}, len(b))
+	for _, name := range b {
+		if _, ok := set[name]; !ok {
+			return false
+		}
+		seen[name] = struct{}{}
+	}
+	return len(seen) == len(set)
+}
+
+func (c *sdsConnection) subscribe(names []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names = slices.Clone(names)
+}
+
+func (c *sdsConnection) subscribed() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.names
+}
+
+// peerCredentials authenticates the unix socket connections by the credentials
+// of the peer process, the connections are not encrypted.
+type peerCredentials struct {
+	credentials.TransportCredentials
+}
+
+type peerCredInfo struct {
+	credentials.CommonAuthInfo
+	cred syscall.Ucred
+}
+
+func (peerCredInfo) AuthType() string {
+	return "peercred"
+}
+
+func (c peerCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, nil, fmt.Errorf("sds accepts unix socket connections only, got %T", conn)
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, nil, err
+	}
+	if credErr != nil {
+		return nil, nil, fmt.Errorf("get peer credentials failed: %v", credErr)
+	}
+
+	log.Debugf("sds connection from pid %d uid %d gid %d", cred.Pid, cred.Uid, cred.Gid)
+	return conn, peerCredInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity},
+		cred:           *cred,
+	}, nil
+}
+
+func (c peerCredentials) Clone() credentials.TransportCredentials {
+	return peerCredentials{c.TransportCredentials.Clone()}
+}
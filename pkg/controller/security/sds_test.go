@@ -0,0 +1,218 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package security
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	sdsv3 "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	resource_v3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+func TestSdsRules(t *testing.T) {
+	rules, err := parseSdsRules([]string{"1337=spiffe://cluster.local/ns/foo/*", "0=*", "1000=spiffe://cluster.local/ns/bar/sa/bar", "2000=@pod"})
+	require.NoError(t, err)
+	podIdentity := func() string {
+		return "spiffe://cluster.local/ns/baz/sa/baz"
+	}
+
+	tests := []struct {
+		uid     uint32
+		name    string
+		allowed bool
+	}{
+		{uid: 1337, name: "spiffe://cluster.local/ns/foo/sa/default", allowed: true},
+		{uid: 1337, name: "spiffe://cluster.local/ns/bar/sa/bar", allowed: false},
+		{uid: 1337, name: SdsRootCaName, allowed: true},
+		{uid: 0, name: "spiffe://cluster.local/ns/bar/sa/bar", allowed: true},
+		{uid: 1000, name: "spiffe://cluster.local/ns/bar/sa/bar", allowed: true},
+		{uid: 1000, name: "spiffe://cluster.local/ns/bar/sa/bar2", allowed: false},
+		{uid: 2000, name: "spiffe://cluster.local/ns/baz/sa/baz", allowed: true},
+		{uid: 2000, name: "spiffe://cluster.local/ns/bar/sa/bar", allowed: false},
+		{uid: 2000, name: SdsRootCaName, allowed: true},
+		{uid: 3000, name: SdsRootCaName, allowed: false},
+	}
+	for _, tt := range tests {
+		allowed := false
+		for _, rule := range rules {
+			allowed = allowed || rule.allows(tt.uid, tt.name, podIdentity)
+		}
+		assert.Equal(t, tt.allowed, allowed, "uid %d name %s", tt.uid, tt.name)
+	}
+
+	for _, rule := range []string{"spiffe://cluster.local/ns/foo/*", "root=*", "0="} {
+		_, err = parseSdsRules([]string{rule})
+		assert.Error(t, err, rule)
+	}
+
+	// the pod of an unknown peer gets nothing
+	assert.False(t, rules[3].allows(2000, "", func() string { return "" }))
+}
+
+func TestSdsSameNames(t *testing.T) {
+	assert.True(t, sameNames([]string{"a", SdsRootCaName}, []string{SdsRootCaName, "a"}))
+	assert.True(t, sameNames([]string{"a", "a"}, []string{"a"}))
+	assert.False(t, sameNames([]string{"a", SdsRootCaName}, []string{"a"}))
+	assert.False(t, sameNames([]string{"a"}, []string{"b"}))
+}
+
+func newTestSdsClient(t *testing.T, rules []string, podIdentity PodIdentityFunc) (sdsv3.SecretDiscoveryServiceClient, *SecretManager) {
+	secretManager, err := NewSecretManager(CaConfig{Provider: constants.CaProviderSelfSigned})
+	require.NoError(t, err)
+	socket := filepath.Join(t.TempDir(), "sds", "sds.sock")
+	sdsServer, err := NewSdsServer(socket, rules, secretManager, podIdentity)
+	require.NoError(t, err)
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	go sdsServer.Run(stopCh)
+	go secretManager.Run(stopCh)
+
+	conn, err := grpc.Dial("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return sdsv3.NewSecretDiscoveryServiceClient(conn), secretManager
+}
+
+func decodeSecrets(t *testing.T, resp *discoveryv3.DiscoveryResponse) map[string]*tlsv3.Secret {
+	t.Helper()
+	assert.Equal(t, resource_v3.SecretType, resp.TypeUrl)
+	secrets := make(map[string]*tlsv3.Secret)
+	for _, res := range resp.Resources {
+		secret := &tlsv3.Secret{}
+		require.NoError(t, res.UnmarshalTo(secret))
+		secrets[secret.Name] = secret
+	}
+	return secrets
+}
+
+func TestSdsServer(t *testing.T) {
+	identity := "spiffe://cluster.local/ns/default/sa/default"
+	uid := os.Getuid()
+
+	t.Run("stream secrets", func(t *testing.T) {
+		client, secretManager := newTestSdsClient(t, []string{fmt.Sprintf("%d=spiffe://cluster.local/ns/default/*", uid)}, nil)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		stream, err := client.StreamSecrets(ctx)
+		require.NoError(t, err)
+
+		names := []string{identity, SdsRootCaName}
+		require.NoError(t, stream.Send(&discoveryv3.DiscoveryRequest{ResourceNames: names, TypeUrl: resource_v3.SecretType}))
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Empty(t, resp.Resources)
+		// the ACK may list the names in another order, which needs no response either
+		require.NoError(t, stream.Send(&discoveryv3.DiscoveryRequest{ResourceNames: []string{SdsRootCaName, identity},
+			TypeUrl: resource_v3.SecretType, VersionInfo: resp.VersionInfo, ResponseNonce: resp.Nonce}))
+
+		// pushed once signed
+		secretManager.SendCertRequest(identity, ADD)
+		resp, err = stream.Recv()
+		require.NoError(t, err)
+		secrets := decodeSecrets(t, resp)
+		require.Len(t, secrets, 2)
+		cert := secretManager.GetSecret(identity)
+		assert.Equal(t, cert.CertificateChain, secrets[identity].GetTlsCertificate().CertificateChain.GetInlineBytes())
+		assert.Equal(t, cert.PrivateKey, secrets[identity].GetTlsCertificate().PrivateKey.GetInlineBytes())
+		assert.Equal(t, cert.RootCert, secrets[SdsRootCaName].GetValidationContext().TrustedCa.GetInlineBytes())
+		version := resp.VersionInfo
+		require.NoError(t, stream.Send(&discoveryv3.DiscoveryRequest{ResourceNames: names, TypeUrl: resource_v3.SecretType,
+			VersionInfo: resp.VersionInfo, ResponseNonce: resp.Nonce}))
+
+		// pushed again once rotated
+		secretManager.SendCertRequest(identity, Rotate)
+		resp, err = stream.Recv()
+		require.NoError(t, err)
+		assert.NotEqual(t, version, resp.VersionInfo)
+		secrets = decodeSecrets(t, resp)
+		assert.NotEqual(t, cert.CertificateChain, secrets[identity].GetTlsCertificate().CertificateChain.GetInlineBytes())
+		assert.Equal(t, secretManager.GetSecret(identity).CertificateChain, secrets[identity].GetTlsCertificate().CertificateChain.GetInlineBytes())
+
+		// subscribing another identity not allowed closes the stream
+		require.NoError(t, stream.Send(&discoveryv3.DiscoveryRequest{ResourceNames: []string{"spiffe://cluster.local/ns/other/sa/default"},
+			TypeUrl: resource_v3.SecretType, VersionInfo: resp.VersionInfo, ResponseNonce: resp.Nonce}))
+		_, err = stream.Recv()
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("fetch secrets", func(t *testing.T) {
+		client, secretManager := newTestSdsClient(t, []string{fmt.Sprintf("%d=*", uid)}, nil)
+		secretManager.SendCertRequest(identity, ADD)
+		require.Eventually(t, func() bool {
+			return secretManager.GetSecret(identity) != nil
+		}, 10*time.Second, 50*time.Millisecond)
+
+		resp, err := client.FetchSecrets(context.Background(), &discoveryv3.DiscoveryRequest{ResourceNames: []string{identity}})
+		require.NoError(t, err)
+		secrets := decodeSecrets(t, resp)
+		assert.Contains(t, secrets, identity)
+
+		_, err = client.FetchSecrets(context.Background(), &discoveryv3.DiscoveryRequest{})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("peer uid not allowed", func(t *testing.T) {
+		client, _ := newTestSdsClient(t, []string{fmt.Sprintf("%d=*", uid+1)}, nil)
+		_, err := client.FetchSecrets(context.Background(), &discoveryv3.DiscoveryRequest{ResourceNames: []string{SdsRootCaName}})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("pod identity", func(t *testing.T) {
+		podIdentity := func(pid int32) (string, error) {
+			if pid != int32(os.Getpid()) {
+				return "", fmt.Errorf("unknown pid %d", pid)
+			}
+			return identity, nil
+		}
+		client, secretManager := newTestSdsClient(t, []string{fmt.Sprintf("%d=%s", uid, SdsPodIdentity)}, podIdentity)
+		secretManager.SendCertRequest(identity, ADD)
+		require.Eventually(t, func() bool {
+			return secretManager.GetSecret(identity) != nil
+		}, 10*time.Second, 50*time.Millisecond)
+
+		resp, err := client.FetchSecrets(context.Background(), &discoveryv3.DiscoveryRequest{ResourceNames: []string{identity, SdsRootCaName}})
+		require.NoError(t, err)
+		assert.Len(t, decodeSecrets(t, resp), 2)
+
+		// the identity of another pod of the same uid is denied
+		_, err = client.FetchSecrets(context.Background(), &discoveryv3.DiscoveryRequest{ResourceNames: []string{"spiffe://cluster.local/ns/other/sa/default"}})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("pod identity rules require a resolver", func(t *testing.T) {
+		secretManager, err := NewSecretManager(CaConfig{Provider: constants.CaProviderSelfSigned})
+		require.NoError(t, err)
+		_, err = NewSdsServer(filepath.Join(t.TempDir(), "sds.sock"), []string{fmt.Sprintf("%d=%s", uid, SdsPodIdentity)}, secretManager, nil)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"istio.io/istio/pkg/security"
+)
+
+// spireCaClient gets the certs from the SPIRE agent through the SPIFFE Workload API.
+// The agent generates the keys and signs the SVIDs itself, so it only serves the
+// identities registered to the agent for kmesh.
+type spireCaClient struct {
+	client *workloadapi.Client
+}
+
+func newSpireCaClient(address string) (CaClient, error) {
+	client, err := workloadapi.New(context.Background(), workloadapi.WithAddr(address))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect SPIRE agent %s: %v", address, err)
+	}
+	return &spireCaClient{client: client}, nil
+}
+
+func (c *spireCaClient) CsrSend(csrPEM []byte, certValidsec int64, identity string) ([]string, error) {
+	return nil, errors.New("SPIRE agent does not sign CSRs, fetch the SVID instead")
+}
+
+func (c *spireCaClient) FetchCert(identity string) (*security.SecretItem, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), caRequestTimeout)
+	defer cancel()
+
+	x509Context, err := c.client.FetchX509Context(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetch X509-SVID failed: %v", err)
+	}
+	for _, svid := range x509Context.SVIDs {
+		if svid.ID.String() == identity {
+			return spireSecretItem(svid, x509Context.Bundles)
+		}
+	}
+	return nil, fmt.Errorf("SPIRE agent has no SVID for %s, register an entry of it for kmesh", identity)
+}
+
+func (c *spireCaClient) Close() error {
+	return c.client.Close()
+}
+
+// spireSecretItem encodes the SVID and the bundle of its trust domain as PEM
+func spireSecretItem(svid *x509svid.SVID, bundles *x509bundle.Set) (*security.SecretItem, error) {
+	certChain, key, err := svid.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("invalid SVID of %s: %v", svid.ID, err)
+	}
+	bundle, err := bundles.GetX509BundleForTrustDomain(svid.ID.TrustDomain())
+	if err != nil {
+		return nil, fmt.Errorf("no bundle for %s: %v", svid.ID, err)
+	}
+	rootCert, err := bundle.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle of %s: %v", svid.ID, err)
+	}
+
+	return &security.SecretItem{
+		CertificateChain: certChain,
+		PrivateKey:       key,
+		RootCert:         rootCert,
+		ResourceName:     svid.ID.String(),
+		// the agent may return an SVID it signed a while ago, the rotation is
+		// scheduled from the issuance
+		CreatedTime: svid.Certificates[0].NotBefore,
+		ExpireTime:  svid.Certificates[0].NotAfter,
+	}, nil
+}
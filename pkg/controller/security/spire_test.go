@@ -0,0 +1,129 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package security
+
+import (
+	"encoding/pem"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+func pemToDER(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var der []byte
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return der
+		}
+		der = append(der, block.Bytes...)
+	}
+}
+
+// fakeSpireAgent serves the Workload API with the given SVIDs
+type fakeSpireAgent struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+	svids []*workload.X509SVID
+}
+
+func (a *fakeSpireAgent) FetchX509SVID(req *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	return stream.Send(&workload.X509SVIDResponse{Svids: a.svids})
+}
+
+// serveFakeSpireAgent serves the agent on a unix socket and returns its address
+func serveFakeSpireAgent(t *testing.T, svids []*workload.X509SVID) string {
+	s := grpc.NewServer()
+	workload.RegisterSpiffeWorkloadAPIServer(s, &fakeSpireAgent{svids: svids})
+	t.Cleanup(s.Stop)
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listen, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	go func() {
+		_ = s.Serve(listen)
+	}()
+	return "unix://" + socket
+}
+
+func signedSVID(t *testing.T, signer CaClient, identity string) *workload.X509SVID {
+	t.Helper()
+	signed, err := signer.FetchCert(identity)
+	require.NoError(t, err)
+	return &workload.X509SVID{
+		SpiffeId:    identity,
+		X509Svid:    pemToDER(t, signed.CertificateChain),
+		X509SvidKey: pemToDER(t, signed.PrivateKey),
+		Bundle:      pemToDER(t, signed.RootCert),
+	}
+}
+
+func TestSpireCaClient(t *testing.T) {
+	identity := "spiffe://cluster.local/ns/default/sa/default"
+	opts := NewSecurityOptions()
+	opts.Pkcs8Keys = true
+	signer, err := newSelfSignedCaClient(opts, "cluster.local")
+	require.NoError(t, err)
+	svid := signedSVID(t, signer, identity)
+
+	address := serveFakeSpireAgent(t, []*workload.X509SVID{
+		signedSVID(t, signer, "spiffe://cluster.local/ns/default/sa/other"),
+		svid,
+	})
+	cli, err := createCaClient(CaConfig{Provider: constants.CaProviderSpire, SpireSocket: address}, opts, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = cli.Close()
+	})
+
+	cert, err := cli.FetchCert(identity)
+	require.NoError(t, err)
+	verifySecret(t, cert, identity)
+	assert.Equal(t, svid.X509Svid, pemToDER(t, cert.CertificateChain))
+	assert.Equal(t, svid.X509SvidKey, pemToDER(t, cert.PrivateKey))
+	assert.Equal(t, svid.Bundle, pemToDER(t, cert.RootCert))
+	// the rotation is scheduled from the issuance of the SVID
+	assert.Equal(t, parseLeafCert(cert.CertificateChain).NotBefore, cert.CreatedTime)
+
+	_, err = cli.FetchCert("spiffe://cluster.local/ns/default/sa/unknown")
+	assert.ErrorContains(t, err, "no SVID")
+	_, err = cli.CsrSend(nil, 0, identity)
+	assert.Error(t, err)
+}
+
+func TestSpireCaClientInvalidSVID(t *testing.T) {
+	identity := "spiffe://cluster.local/ns/default/sa/default"
+	address := serveFakeSpireAgent(t, []*workload.X509SVID{{
+		SpiffeId: identity,
+		X509Svid: []byte("not a cert"),
+	}})
+	cli, err := newSpireCaClient(address)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = cli.Close()
+	})
+
+	_, err = cli.FetchCert(identity)
+	assert.ErrorContains(t, err, "fetch X509-SVID failed")
+}
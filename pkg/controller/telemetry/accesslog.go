@@ -17,9 +17,26 @@
 package telemetry
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"kmesh.net/kmesh/daemon/options"
+)
+
+var (
+	accesslogRecordsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kmesh_accesslog_records_dropped_total",
+		Help: "The number of accesslog records dropped because the queue was full.",
+	})
 )
 
 type logInfo struct {
@@ -32,6 +49,10 @@ type logInfo struct {
 	destinationService   string
 	destinationWorkload  string
 	destinationNamespace string
+
+	responseFlags            string
+	connectionSecurityPolicy string
+	viaWaypoint              bool
 }
 
 func OutputAccesslog(data requestMetric, accesslog logInfo) {
@@ -52,6 +73,395 @@ func buildAccesslog(data requestMetric, accesslog logInfo) string {
 	return logResult
 }
 
+// Accesslogger writes the access log of closed connections in the configured
+// format to the configured sink, the config file is reloaded on change
+type Accesslogger struct {
+	config *options.AccesslogConfig
+	// queue is bounded, records are dropped rather than blocking the ringbuf reader
+	// on a slow sink
+	queue chan accesslogRecord
+
+	// mutex guards the settings read by the ringbuf reader. The sink is only written,
+	// replaced and closed by Run, so it is written without holding mutex.
+	mutex     sync.Mutex
+	formatter *accesslogFormatter
+	filter    *accesslogFilter
+	sink      accesslogSink
+	// failing is only used by Run
+	failing bool
+}
+
+type accesslogRecord struct {
+	data      requestMetric
+	accesslog logInfo
+}
+
+func NewAccesslogger(config *options.AccesslogConfig) (*Accesslogger, error) {
+	l := &Accesslogger{config: config}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	l.queue = make(chan accesslogRecord, config.QueueSize)
+	return l, nil
+}
+
+// reload rebuilds everything from the flags and the config file, the current
+// settings are kept if the new ones are invalid
+func (l *Accesslogger) reload() error {
+	config, err := l.config.Load()
+	if err != nil {
+		return err
+	}
+	if err = config.Validate(); err != nil {
+		return err
+	}
+	formatter, err := newAccesslogFormatter(config.Format, config.Encoding)
+	if err != nil {
+		return err
+	}
+	sink, err := newAccesslogSink(config)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	oldSink := l.sink
+	l.formatter = formatter
+	l.filter = newAccesslogFilter(&config.Filter)
+	l.sink = sink
+	l.mutex.Unlock()
+	l.failing = false
+
+	if oldSink != nil {
+		if err := oldSink.close(); err != nil {
+			log.Errorf("close accesslog sink failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// Run writes the queued records and watches the config file until ctx is done.
+// The parent directory is watched rather than the file, so that files replaced
+// by rename, e.g. a mounted ConfigMap, are picked up as well.
+func (l *Accesslogger) Run(ctx context.Context) {
+	if l == nil {
+		return
+	}
+	defer l.close()
+
+	// without a config file the watcher channels stay nil and never fire
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	configFile := filepath.Clean(l.config.ConfigFile)
+	if l.config.ConfigFile != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			log.Errorf("create accesslog config watcher failed: %v", err)
+		} else {
+			defer watcher.Close()
+			if err = watcher.Add(filepath.Dir(configFile)); err != nil {
+				log.Errorf("watch accesslog config file %s failed: %v", configFile, err)
+			} else {
+				events, errs = watcher.Events, watcher.Errors
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case record := <-l.queue:
+					l.write(&record)
+				default:
+					return
+				}
+			}
+		case record := <-l.queue:
+			l.write(&record)
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			// ConfigMap volumes swap the "..data" symlink on update
+			if filepath.Clean(event.Name) != configFile && filepath.Base(event.Name) != "..data" {
+				continue
+			}
+			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+				continue
+			}
+			if err := l.reload(); err != nil {
+				log.Errorf("reload accesslog config failed, keep the current one: %v", err)
+				continue
+			}
+			log.Infof("accesslog config %s reloaded", configFile)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			log.Errorf("accesslog config watcher error: %v", err)
+		}
+	}
+}
+
+func (l *Accesslogger) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.sink != nil {
+		if err := l.sink.close(); err != nil {
+			log.Errorf("close accesslog sink failed: %v", err)
+		}
+		l.sink = nil
+	}
+}
+
+// output falls back to the plain stdout accesslog if no Accesslogger is configured.
+// It is called from the ringbuf reader, so the record is only filtered here and
+// written by Run.
+func (l *Accesslogger) output(data requestMetric, accesslog logInfo) {
+	if l == nil {
+		OutputAccesslog(data, accesslog)
+		return
+	}
+
+	l.mutex.Lock()
+	matched := l.sink != nil && l.filter.match(&data, &accesslog)
+	l.mutex.Unlock()
+	if !matched {
+		return
+	}
+
+	select {
+	case l.queue <- accesslogRecord{data: data, accesslog: accesslog}:
+	default:
+		accesslogRecordsDropped.Inc()
+	}
+}
+
+func (l *Accesslogger) write(record *accesslogRecord) {
+	l.mutex.Lock()
+	sink, formatter := l.sink, l.formatter
+	l.mutex.Unlock()
+	if sink == nil {
+		return
+	}
+
+	line, err := formatter.format(&record.data, &record.accesslog)
+	if err != nil {
+		log.Errorf("format accesslog failed: %v", err)
+		return
+	}
+	// only report the first failure of a broken sink instead of every record
+	if err = sink.write(line); err != nil {
+		if !l.failing {
+			log.Errorf("write accesslog failed: %v", err)
+		}
+		l.failing = true
+		return
+	}
+	l.failing = false
+}
+
+// accesslogOperators are the supported envoy style command operators, in the
+// order they are written by the json encoding without a format
+var accesslogOperators = []struct {
+	name  string
+	value func(data *requestMetric, accesslog *logInfo) interface{}
+}{
+	{"START_TIME", func(data *requestMetric, _ *logInfo) interface{} {
+		start := data.closeTime
+		if start >= data.duration {
+			start -= data.duration
+		}
+		return calculateUptime(osStartTime, start).Format(time.RFC3339Nano)
+	}},
+	{"DURATION", func(data *requestMetric, _ *logInfo) interface{} { return data.duration / uint64(time.Millisecond) }},
+	{"BYTES_SENT", func(data *requestMetric, _ *logInfo) interface{} { return data.sentBytes }},
+	{"BYTES_RECEIVED", func(data *requestMetric, _ *logInfo) interface{} { return data.receivedBytes }},
+	{"DOWNSTREAM_REMOTE_ADDRESS", func(_ *requestMetric, l *logInfo) interface{} { return l.sourceAddress }},
+	{"UPSTREAM_HOST", func(_ *requestMetric, l *logInfo) interface{} { return l.destinationAddress }},
+	{"RESPONSE_FLAGS", func(_ *requestMetric, l *logInfo) interface{} { return l.responseFlags }},
+	{"CONNECTION_DIRECTION", func(_ *requestMetric, l *logInfo) interface{} { return l.direction }},
+	{"CONNECTION_SECURITY_POLICY", func(_ *requestMetric, l *logInfo) interface{} { return l.connectionSecurityPolicy }},
+	{"VIA_WAYPOINT", func(_ *requestMetric, l *logInfo) interface{} { return l.viaWaypoint }},
+	{"SOURCE_WORKLOAD", func(_ *requestMetric, l *logInfo) interface{} { return l.sourceWorkload }},
+	{"SOURCE_NAMESPACE", func(_ *requestMetric, l *logInfo) interface{} { return l.sourceNamespace }},
+	{"DESTINATION_SERVICE", func(_ *requestMetric, l *logInfo) interface{} { return l.destinationService }},
+	{"DESTINATION_WORKLOAD", func(_ *requestMetric, l *logInfo) interface{} { return l.destinationWorkload }},
+	{"DESTINATION_NAMESPACE", func(_ *requestMetric, l *logInfo) interface{} { return l.destinationNamespace }},
+}
+
+type accesslogSegment struct {
+	literal  string
+	operator int // index into accesslogOperators, -1 for a literal
+}
+
+type accesslogFormatter struct {
+	encoding string
+	// nil means the default kmesh format
+	segments []accesslogSegment
+}
+
+func newAccesslogFormatter(format, encoding string) (*accesslogFormatter, error) {
+	f := &accesslogFormatter{encoding: encoding}
+	if format == "" {
+		return f, nil
+	}
+
+	var literal strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			literal.WriteByte(format[i])
+			continue
+		}
+		if i+1 < len(format) && format[i+1] == '%' {
+			literal.WriteByte('%')
+			i++
+			continue
+		}
+
+		end := strings.IndexByte(format[i+1:], '%')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated operator at offset %d of accesslog format", i)
+		}
+		name := format[i+1 : i+1+end]
+		index := accesslogOperatorIndex(name)
+		if index < 0 {
+			return nil, fmt.Errorf("unknown accesslog operator %%%s%%", name)
+		}
+		if literal.Len() > 0 {
+			f.segments = append(f.segments, accesslogSegment{literal: literal.String(), operator: -1})
+			literal.Reset()
+		}
+		f.segments = append(f.segments, accesslogSegment{operator: index})
+		i += end + 1
+	}
+	if literal.Len() > 0 {
+		f.segments = append(f.segments, accesslogSegment{literal: literal.String(), operator: -1})
+	}
+	return f, nil
+}
+
+func accesslogOperatorIndex(name string) int {
+	for i, op := range accesslogOperators {
+		if op.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// format renders a text line, or a json object holding the operators of the format
+// keyed by their lower case name
+func (f *accesslogFormatter) format(data *requestMetric, accesslog *logInfo) ([]byte, error) {
+	if f.encoding == options.AccesslogEncodingJson {
+		fields := make(map[string]interface{}, len(accesslogOperators))
+		for i, op := range accesslogOperators {
+			if f.segments == nil || f.hasOperator(i) {
+				fields[strings.ToLower(op.name)] = accesslogValue(op.value(data, accesslog))
+			}
+		}
+		return json.Marshal(fields)
+	}
+
+	if f.segments == nil {
+		return []byte(buildAccesslog(*data, *accesslog)), nil
+	}
+	var line strings.Builder
+	for _, segment := range f.segments {
+		if segment.operator < 0 {
+			line.WriteString(segment.literal)
+			continue
+		}
+		fmt.Fprint(&line, accesslogValue(accesslogOperators[segment.operator].value(data, accesslog)))
+	}
+	return []byte(line.String()), nil
+}
+
+func (f *accesslogFormatter) hasOperator(index int) bool {
+	for _, segment := range f.segments {
+		if segment.operator == index {
+			return true
+		}
+	}
+	return false
+}
+
+// accesslogValue follows envoy and writes "-" for unknown values
+func accesslogValue(v interface{}) interface{} {
+	if s, ok := v.(string); ok && s == "" {
+		return "-"
+	}
+	return v
+}
+
+type accesslogFilter struct {
+	namespaces    map[string]struct{}
+	workloads     map[string]struct{}
+	responseFlags map[string]struct{}
+	minDuration   time.Duration
+}
+
+func newAccesslogFilter(config *options.AccesslogFilter) *accesslogFilter {
+	return &accesslogFilter{
+		namespaces:    stringSet(config.Namespaces),
+		workloads:     stringSet(config.Workloads),
+		responseFlags: stringSet(config.ResponseFlags),
+		minDuration:   config.MinDuration.Duration,
+	}
+}
+
+func (f *accesslogFilter) match(data *requestMetric, accesslog *logInfo) bool {
+	if !matchEither(f.namespaces, accesslog.sourceNamespace, accesslog.destinationNamespace) {
+		return false
+	}
+	if !matchEither(f.workloads, accesslog.sourceWorkload, accesslog.destinationWorkload) {
+		return false
+	}
+	if !matchAnyFlag(f.responseFlags, accesslog.responseFlags) {
+		return false
+	}
+	return time.Duration(data.duration) >= f.minDuration
+}
+
+// matchEither matches everything if set is empty
+func matchEither(set map[string]struct{}, a, b string) bool {
+	if len(set) == 0 {
+		return true
+	}
+	_, okA := set[a]
+	_, okB := set[b]
+	return okA || okB
+}
+
+// matchAnyFlag matches the comma separated response flags if one of them is in
+// set, and everything if set is empty
+func matchAnyFlag(set map[string]struct{}, flags string) bool {
+	if len(set) == 0 {
+		return true
+	}
+	for _, flag := range strings.Split(flags, ",") {
+		if _, ok := set[flag]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func stringSet(values []string) map[string]struct{} {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
 func getOSBootTime() (time.Time, error) {
 	now := time.Now()
 	now = now.Round(time.Duration(now.Second()))
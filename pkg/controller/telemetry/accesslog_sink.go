@@ -0,0 +1,159 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"kmesh.net/kmesh/daemon/options"
+)
+
+type accesslogSink interface {
+	write(line []byte) error
+	close() error
+}
+
+func newAccesslogSink(config *options.AccesslogConfig) (accesslogSink, error) {
+	switch config.Sink {
+	case options.AccesslogSinkStdout:
+		// keep the prefix of the plain accesslog so that text lines can be told apart
+		// from the daemon logs, json lines are self-describing
+		prefix := "accesslog: "
+		if config.Encoding == options.AccesslogEncodingJson {
+			prefix = ""
+		}
+		return &writerSink{w: os.Stdout, prefix: prefix}, nil
+	case options.AccesslogSinkFile:
+		if err := os.MkdirAll(filepath.Dir(config.FilePath), 0o700); err != nil {
+			return nil, fmt.Errorf("create accesslog directory failed: %v", err)
+		}
+		file := &lumberjack.Logger{
+			Filename:   config.FilePath,
+			MaxSize:    config.FileMaxSize, // megabytes
+			MaxBackups: config.FileMaxBackups,
+			MaxAge:     config.FileMaxAge, // days
+		}
+		return &writerSink{w: file, closer: file}, nil
+	case options.AccesslogSinkSyslog:
+		s := &syslogSink{network: config.SyslogNetwork, address: config.SyslogAddress, tag: config.SyslogTag}
+		if err := s.dial(); err != nil {
+			log.Warnf("%v, retry on the next accesslog record", err)
+		}
+		return s, nil
+	case options.AccesslogSinkUnix:
+		return &unixgramSink{path: config.SocketPath}, nil
+	default:
+		return nil, fmt.Errorf("unsupported accesslog sink %q", config.Sink)
+	}
+}
+
+// writerSink writes one record per line
+type writerSink struct {
+	w      io.Writer
+	closer io.Closer
+	prefix string
+}
+
+func (s *writerSink) write(line []byte) error {
+	buf := make([]byte, 0, len(s.prefix)+len(line)+1)
+	buf = append(buf, s.prefix...)
+	buf = append(buf, line...)
+	buf = append(buf, '\n')
+	_, err := s.w.Write(buf)
+	return err
+}
+
+func (s *writerSink) close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// syslogSink is dialed again by the next record if syslog is not reachable, so that
+// it does not keep the daemon from starting. Once connected, the writer reconnects by itself.
+type syslogSink struct {
+	network string
+	address string
+	tag     string
+	w       *syslog.Writer
+}
+
+func (s *syslogSink) dial() error {
+	w, err := syslog.Dial(s.network, s.address, syslog.LOG_INFO|syslog.LOG_LOCAL0, s.tag)
+	if err != nil {
+		return fmt.Errorf("connect to syslog failed: %v", err)
+	}
+	s.w = w
+	return nil
+}
+
+func (s *syslogSink) write(line []byte) error {
+	if s.w == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+	return s.w.Info(string(line))
+}
+
+func (s *syslogSink) close() error {
+	if s.w == nil {
+		return nil
+	}
+	return s.w.Close()
+}
+
+// unixgramSink sends one datagram per record. The socket is dialed lazily and
+// redialed after a failure, so the reader may come and go.
+type unixgramSink struct {
+	path string
+	conn net.Conn
+}
+
+func (s *unixgramSink) write(line []byte) error {
+	if s.conn == nil {
+		conn, err := net.Dial("unixgram", s.path)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	if _, err := s.conn.Write(line); err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *unixgramSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -17,10 +17,21 @@
 package telemetry
 
 import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"kmesh.net/kmesh/daemon/options"
 )
 
 func Test_buildAccesslog(t *testing.T) {
@@ -79,3 +90,332 @@ func Test_calculateUptime(t *testing.T) {
 	uptime := calculateUptime(startTime, elapsedTimeNs)
 	assert.Equal(t, want, uptime)
 }
+
+func testAccesslogRecord() (requestMetric, logInfo) {
+	return requestMetric{
+		sentBytes:     uint32(60),
+		receivedBytes: uint32(172),
+		duration:      uint64(2236000),
+		closeTime:     uint64(3506247005837715),
+	}, logInfo{
+		direction:            "INBOUND",
+		sourceAddress:        "10.244.0.10:47667",
+		sourceWorkload:       "sleep-7656cf8794-9v2gv",
+		sourceNamespace:      "kmesh-system",
+		destinationAddress:   "10.244.0.7:8080",
+		destinationWorkload:  "httpbin-86b8ffc5ff-bhvxx",
+		destinationNamespace: "ambient-demo",
+		responseFlags:        "-",
+	}
+}
+
+func TestAccesslogFormatter(t *testing.T) {
+	osStartTime = time.Date(2024, 7, 4, 20, 14, 0, 0, time.UTC)
+	data, info := testAccesslogRecord()
+
+	tests := []struct {
+		name     string
+		format   string
+		encoding string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "default text format",
+			encoding: options.AccesslogEncodingText,
+			want:     buildAccesslog(data, info),
+		},
+		{
+			name:     "envoy style format",
+			format:   "[%START_TIME%] %DOWNSTREAM_REMOTE_ADDRESS% -> %UPSTREAM_HOST% %DESTINATION_SERVICE% %BYTES_SENT% %BYTES_RECEIVED% %DURATION%ms 100%%",
+			encoding: options.AccesslogEncodingText,
+			want:     "[2024-08-14T10:11:27.003601715Z] 10.244.0.10:47667 -> 10.244.0.7:8080 - 60 172 2ms 100%",
+		},
+		{
+			name:     "json with selected operators",
+			format:   "%SOURCE_WORKLOAD% %BYTES_SENT% %DESTINATION_SERVICE%",
+			encoding: options.AccesslogEncodingJson,
+			want:     `{"bytes_sent":60,"destination_service":"-","source_workload":"sleep-7656cf8794-9v2gv"}`,
+		},
+		{
+			name:     "unknown operator",
+			format:   "%NOT_EXIST%",
+			encoding: options.AccesslogEncodingText,
+			wantErr:  true,
+		},
+		{
+			name:     "unterminated operator",
+			format:   "%BYTES_SENT",
+			encoding: options.AccesslogEncodingText,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newAccesslogFormatter(tt.format, tt.encoding)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			line, err := f.format(&data, &info)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(line))
+		})
+	}
+
+	t.Run("json with all operators", func(t *testing.T) {
+		f, err := newAccesslogFormatter("", options.AccesslogEncodingJson)
+		require.NoError(t, err)
+		line, err := f.format(&data, &info)
+		require.NoError(t, err)
+		fields := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(line, &fields))
+		assert.Len(t, fields, len(accesslogOperators))
+		assert.Equal(t, "INBOUND", fields["connection_direction"])
+		assert.Equal(t, float64(172), fields["bytes_received"])
+	})
+}
+
+func TestAccesslogFilter(t *testing.T) {
+	data, info := testAccesslogRecord()
+	tests := []struct {
+		name   string
+		filter options.AccesslogFilter
+		want   bool
+	}{
+		{
+			name: "empty filter",
+			want: true,
+		},
+		{
+			name:   "destination namespace",
+			filter: options.AccesslogFilter{Namespaces: []string{"default", "ambient-demo"}},
+			want:   true,
+		},
+		{
+			name:   "namespace not matched",
+			filter: options.AccesslogFilter{Namespaces: []string{"default"}},
+			want:   false,
+		},
+		{
+			name:   "source workload",
+			filter: options.AccesslogFilter{Workloads: []string{"sleep-7656cf8794-9v2gv"}},
+			want:   true,
+		},
+		{
+			name:   "response flags not matched",
+			filter: options.AccesslogFilter{ResponseFlags: []string{"UF"}},
+			want:   false,
+		},
+		{
+			name:   "shorter than min duration",
+			filter: options.AccesslogFilter{Namespaces: []string{"ambient-demo"}, MinDuration: metav1.Duration{Duration: 3 * time.Millisecond}},
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, newAccesslogFilter(&tt.filter).match(&data, &info))
+		})
+	}
+
+	// a connection may have several response flags, any of them matches
+	info.responseFlags = "UF,UAEX"
+	assert.True(t, newAccesslogFilter(&options.AccesslogFilter{ResponseFlags: []string{"UAEX"}}).match(&data, &info))
+	assert.True(t, newAccesslogFilter(&options.AccesslogFilter{ResponseFlags: []string{"UF"}}).match(&data, &info))
+	assert.False(t, newAccesslogFilter(&options.AccesslogFilter{ResponseFlags: []string{"UF,UAEX", "DC"}}).match(&data, &info))
+}
+
+func TestAccesslogUnixgramSink(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "accesslog.sock")
+	config := &options.AccesslogConfig{
+		Format:    "%SOURCE_NAMESPACE%/%DESTINATION_NAMESPACE%",
+		Encoding:  options.AccesslogEncodingText,
+		Sink:      options.AccesslogSinkUnix,
+		Filter:    options.AccesslogFilter{Namespaces: []string{"ambient-demo"}},
+		QueueSize: 16,
+	}
+	config.SocketPath = path
+	l, err := NewAccesslogger(config)
+	require.NoError(t, err)
+	data, info := testAccesslogRecord()
+
+	// no reader yet, the record is lost but later ones get through
+	l.write(&accesslogRecord{data: data, accesslog: info})
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.Run(ctx)
+		close(done)
+	}()
+
+	filtered := info
+	filtered.destinationNamespace = "default"
+	l.output(data, filtered)
+	l.output(data, info)
+
+	buf := make([]byte, 1024)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "kmesh-system/ambient-demo", string(buf[:n]))
+	cancel()
+	<-done
+}
+
+func TestAccesslogSyslogSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "syslog.sock")
+	config := &options.AccesslogConfig{
+		Format:        "%SOURCE_NAMESPACE%",
+		Encoding:      options.AccesslogEncodingText,
+		Sink:          options.AccesslogSinkSyslog,
+		SyslogNetwork: "unixgram",
+		SyslogAddress: path,
+		SyslogTag:     "kmesh-accesslog",
+		QueueSize:     16,
+	}
+	// syslog is not up yet, which does not fail the start
+	l, err := NewAccesslogger(config)
+	require.NoError(t, err)
+	data, info := testAccesslogRecord()
+	l.write(&accesslogRecord{data: data, accesslog: info})
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	l.write(&accesslogRecord{data: data, accesslog: info})
+	buf := make([]byte, 1024)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Contains(t, string(buf[:n]), "kmesh-accesslog")
+	assert.True(t, strings.HasSuffix(strings.TrimSpace(string(buf[:n])), "kmesh-system"))
+	l.close()
+}
+
+// blockingSink blocks every write until it is released
+type blockingSink struct {
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSink) write([]byte) error {
+	s.writing <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func (s *blockingSink) close() error {
+	return nil
+}
+
+func TestAccesslogSlowSink(t *testing.T) {
+	config := &options.AccesslogConfig{
+		Encoding:  options.AccesslogEncodingText,
+		Sink:      options.AccesslogSinkStdout,
+		QueueSize: 16,
+	}
+	l, err := NewAccesslogger(config)
+	require.NoError(t, err)
+	sink := &blockingSink{writing: make(chan struct{}), release: make(chan struct{})}
+	l.sink = sink
+	data, info := testAccesslogRecord()
+
+	done := make(chan struct{})
+	go func() {
+		l.write(&accesslogRecord{data: data, accesslog: info})
+		close(done)
+	}()
+	<-sink.writing
+
+	// the ringbuf reader goes on queueing while the sink is stuck in a write
+	queued := make(chan struct{})
+	go func() {
+		l.output(data, info)
+		close(queued)
+	}()
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("output is blocked by the write of the sink")
+	}
+	assert.Len(t, l.queue, 1)
+	close(sink.release)
+	<-done
+}
+
+func TestAccesslogQueueFull(t *testing.T) {
+	config := &options.AccesslogConfig{
+		Encoding:  options.AccesslogEncodingText,
+		Sink:      options.AccesslogSinkStdout,
+		QueueSize: 1,
+	}
+	l, err := NewAccesslogger(config)
+	require.NoError(t, err)
+	data, info := testAccesslogRecord()
+	before := testutil.ToFloat64(accesslogRecordsDropped)
+
+	// nothing drains the queue, the ringbuf reader must not block
+	l.output(data, info)
+	l.output(data, info)
+	assert.Len(t, l.queue, 1)
+	assert.Equal(t, before+1, testutil.ToFloat64(accesslogRecordsDropped))
+}
+
+func TestAccesslogReload(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "log", "accesslog.log")
+	configFile := filepath.Join(dir, "accesslog.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte("format: \"v1 %BYTES_SENT%\"\n"), 0o600))
+
+	config := &options.AccesslogConfig{
+		ConfigFile:  configFile,
+		Encoding:    options.AccesslogEncodingText,
+		Sink:        options.AccesslogSinkFile,
+		FilePath:    logFile,
+		FileMaxSize: 1,
+		QueueSize:   16,
+	}
+	l, err := NewAccesslogger(config)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.Run(ctx)
+		close(done)
+	}()
+
+	data, info := testAccesslogRecord()
+	l.output(data, info)
+
+	// an invalid config is ignored
+	require.NoError(t, os.WriteFile(configFile, []byte("sink: tcp\n"), 0o600))
+	time.Sleep(100 * time.Millisecond)
+	l.output(data, info)
+	assert.Eventually(t, func() bool {
+		content, _ := os.ReadFile(logFile)
+		return string(content) == "v1 60\nv1 60\n"
+	}, 5*time.Second, 20*time.Millisecond)
+
+	require.NoError(t, os.WriteFile(configFile, []byte("format: \"v2 %BYTES_RECEIVED%\"\nfilter:\n  minDuration: 1ms\n"), 0o600))
+	assert.Eventually(t, func() bool {
+		l.output(data, info)
+		content, _ := os.ReadFile(logFile)
+		return strings.Contains(string(content), "v2 172\n")
+	}, 5*time.Second, 20*time.Millisecond)
+	cancel()
+	<-done
+
+	content, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(content), "v1 60\nv1 60\n"))
+}
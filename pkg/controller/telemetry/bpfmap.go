@@ -0,0 +1,87 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// bpfMapFullRatio is the occupancy a map is warned about at
+const bpfMapFullRatio = 0.9
+
+var (
+	bpfMapEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kmesh_bpf_map_entries",
+		Help: "The number of entries in each pinned kmesh bpf map.",
+	}, []string{"map"})
+
+	bpfMapMaxEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kmesh_bpf_map_max_entries",
+		Help: "The capacity of each pinned kmesh bpf map, updates fail once the entries reach it.",
+	}, []string{"map"})
+)
+
+// RunBpfMapMetrics exports the occupancy of the pinned kmesh maps every interval until
+// stopCh is closed, so that maps can be alerted on before they fill up
+func RunBpfMapMetrics(stopCh <-chan struct{}, bpfFsPath string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		stats, err := utils.PinnedMapStats(bpfFsPath)
+		if err != nil {
+			log.Errorf("failed to read bpf map stats: %v", err)
+		} else {
+			reportBpfMapStats(stats)
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func reportBpfMapStats(stats []utils.MapStats) {
+	// maps disappear when the daemon switches mode, their series must not linger
+	bpfMapEntries.Reset()
+	bpfMapMaxEntries.Reset()
+	for _, s := range stats {
+		if s.Error != "" {
+			log.Warnf("failed to read bpf map %s: %s", s.Pin, s.Error)
+			continue
+		}
+		bpfMapMaxEntries.WithLabelValues(s.Name).Set(float64(s.MaxEntries))
+		if s.Entries < 0 {
+			continue
+		}
+		bpfMapEntries.WithLabelValues(s.Name).Set(float64(s.Entries))
+		// arrays are always full
+		if strings.Contains(s.Type, "Array") {
+			continue
+		}
+		if s.MaxEntries > 0 && float64(s.Entries) >= bpfMapFullRatio*float64(s.MaxEntries) {
+			log.Warnf("bpf map %s holds %d of its %d entries", s.Name, s.Entries, s.MaxEntries)
+		}
+	}
+}
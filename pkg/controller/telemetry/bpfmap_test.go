@@ -0,0 +1,44 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+func TestReportBpfMapStats(t *testing.T) {
+	reportBpfMapStats([]utils.MapStats{
+		{Name: "kmesh_backend", Type: "Hash", MaxEntries: 1000, Entries: 950},
+		{Name: "kmesh_events", Type: "RingBuf", MaxEntries: 4096, Entries: -1},
+		{Name: "kmesh_version", Type: "Array", MaxEntries: 1, Entries: 1},
+		{Name: "kmesh_broken", Entries: -1, Error: "not a bpf object"},
+	})
+	assert.Equal(t, float64(950), testutil.ToFloat64(bpfMapEntries.WithLabelValues("kmesh_backend")))
+	assert.Equal(t, float64(1000), testutil.ToFloat64(bpfMapMaxEntries.WithLabelValues("kmesh_backend")))
+	assert.Equal(t, 2, testutil.CollectAndCount(bpfMapEntries))
+	assert.Equal(t, 3, testutil.CollectAndCount(bpfMapMaxEntries))
+
+	// maps that are gone are no longer reported
+	reportBpfMapStats([]utils.MapStats{{Name: "kmesh_backend", Type: "Hash", MaxEntries: 1000, Entries: 10}})
+	assert.Equal(t, 1, testutil.CollectAndCount(bpfMapEntries))
+	assert.Equal(t, float64(10), testutil.ToFloat64(bpfMapEntries.WithLabelValues("kmesh_backend")))
+}
@@ -0,0 +1,29 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// The cni metrics are reported by the cni config watcher.
+	CniConfigRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kmesh_cni_config_repairs_total",
+		Help: "The number of times the kmesh plugin was put back in the chain of the primary cni config, by reason.",
+	}, []string{"reason"})
+)
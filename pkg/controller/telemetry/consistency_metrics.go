@@ -0,0 +1,39 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// The consistency metrics are reported by the cache versus bpf map checker.
+	ConsistencyDriftEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kmesh_consistency_drift_entries",
+		Help: "The number of bpf map entries found out of sync with the userspace cache in the last check, by map and kind.",
+	}, []string{"map", "kind"})
+
+	ConsistencyChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kmesh_consistency_checks_total",
+		Help: "The number of cache versus bpf map consistency checks, by result.",
+	}, []string{"result"})
+
+	ConsistencyRepairs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kmesh_consistency_repairs_total",
+		Help: "The number of bpf map entries rewritten from the userspace cache to repair drift.",
+	})
+)
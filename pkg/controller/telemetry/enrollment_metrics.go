@@ -0,0 +1,34 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// The enrollment metrics are reported by the pod enrollment reconciler.
+	EnrollmentDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kmesh_enrollment_drift_pods",
+		Help: "The number of pods whose enrollment differed from the desired one in the last reconcile, by type.",
+	}, []string{"type"})
+
+	EnrollmentRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kmesh_enrollment_repairs_total",
+		Help: "The number of pod enrollment repairs, by type and result.",
+	}, []string{"type", "result"})
+)
@@ -0,0 +1,428 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"kmesh.net/kmesh/daemon/options"
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+const (
+	flowDialTimeout  = 5 * time.Second
+	flowWriteTimeout = 5 * time.Second
+)
+
+var (
+	flowRecordsExported = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kmesh_flow_records_exported_total",
+		Help: "The number of IPFIX flow records sent to the collector.",
+	})
+
+	flowRecordsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kmesh_flow_records_dropped_total",
+		Help: "The number of sampled flow records dropped because the queue was full or the collector unreachable.",
+	})
+)
+
+// FlowExporter sends the closed connections as IPFIX flow records to a collector.
+// Flows are sampled by a hash of the 5-tuple, so both ends of a connection
+// managed by kmesh make the same decision. The connections closed within an
+// export interval are aggregated into one record per flow.
+type FlowExporter struct {
+	config    *options.FlowConfig
+	encoder   *ipfixEncoder
+	transport ipfixTransport
+
+	// queue is bounded, records are dropped rather than blocking the ringbuf reader
+	queue chan *flowRecord
+	// templateSent is when the templates were last sent over the current connection
+	templateSent time.Time
+	// exported are the connections of the previous export, the report of their
+	// other end is dropped if it comes late
+	exported map[connKey]struct{}
+}
+
+// flowKey identifies the connections aggregated into a flow. The source port is
+// left out, every connection of a client takes a new one.
+type flowKey struct {
+	src       netip.Addr
+	dst       netip.Addr
+	dstPort   uint16
+	direction uint8
+
+	sourceWorkload           string
+	sourceNamespace          string
+	destinationWorkload      string
+	destinationNamespace     string
+	destinationService       string
+	responseFlags            string
+	connectionSecurityPolicy string
+}
+
+// connKey is the 5-tuple of a connection, the same from both of its ends
+type connKey struct {
+	src     netip.Addr
+	dst     netip.Addr
+	srcPort uint16
+	dstPort uint16
+}
+
+// ipfixTransport sends whole messages, reporting whether the templates must be
+// sent again because the session to the collector is new
+type ipfixTransport interface {
+	send(msg []byte) error
+	newSession() bool
+	close() error
+}
+
+func NewFlowExporter(config *options.FlowConfig) (*FlowExporter, error) {
+	var transport ipfixTransport
+	switch config.Transport {
+	case options.FlowTransportUdp:
+		conn, err := net.Dial("udp", config.CollectorAddress)
+		if err != nil {
+			return nil, fmt.Errorf("dial ipfix collector %s failed: %v", config.CollectorAddress, err)
+		}
+		transport = &udpTransport{conn: conn}
+	case options.FlowTransportTcp:
+		transport = &tcpTransport{address: config.CollectorAddress}
+	default:
+		return nil, fmt.Errorf("unsupported flow transport %q", config.Transport)
+	}
+
+	return &FlowExporter{
+		config:    config,
+		encoder:   newIpfixEncoder(config.ObservationDomainID, config.EnterpriseNumber, config.MaxMessageSize),
+		transport: transport,
+		queue:     make(chan *flowRecord, config.QueueSize),
+	}, nil
+}
+
+// enqueueFlow adds a closed connection to the next export if it is sampled
+func (e *FlowExporter) enqueueFlow(data requestMetric, accesslog logInfo) {
+	if e == nil || data.state != TCP_CLOSTED || !sampleFlow(&data, e.config.SamplingRate) {
+		return
+	}
+
+	select {
+	case e.queue <- buildFlowRecord(data, accesslog):
+	default:
+		flowRecordsDropped.Inc()
+	}
+}
+
+func (e *FlowExporter) Run(ctx context.Context) {
+	if e == nil {
+		return
+	}
+
+	ticker := time.NewTicker(e.config.ExportInterval)
+	defer ticker.Stop()
+
+	var batch []*flowRecord
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case record := <-e.queue:
+					batch = append(batch, record)
+				default:
+					e.export(batch)
+					if err := e.transport.close(); err != nil {
+						log.Warnf("close ipfix transport failed: %v", err)
+					}
+					return
+				}
+			}
+		case record := <-e.queue:
+			batch = append(batch, record)
+		case <-ticker.C:
+			e.export(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// export sends the templates when they are due, followed by the records. The
+// export stops at the first failed message and the records left are dropped, the
+// collector is not expected to buffer either. A tcp session redialed by a later
+// send would otherwise receive the records before the templates.
+func (e *FlowExporter) export(batch []*flowRecord) {
+	templateDue := e.templateDue()
+	if len(batch) == 0 && !templateDue {
+		e.exported = nil
+		return
+	}
+
+	if templateDue {
+		if err := e.transport.send(e.encoder.templateMessage()); err != nil {
+			log.Warnf("send ipfix templates failed: %v", err)
+			flowRecordsDropped.Add(float64(len(batch)))
+			return
+		}
+		e.templateSent = e.encoder.now()
+	}
+
+	messages := e.encoder.dataMessages(e.aggregate(batch))
+	for i, msg := range messages {
+		if err := e.transport.send(msg.data); err != nil {
+			log.Warnf("send ipfix flow records failed: %v", err)
+			dropped := 0
+			for _, left := range messages[i:] {
+				dropped += left.records
+			}
+			flowRecordsDropped.Add(float64(dropped))
+			return
+		}
+		flowRecordsExported.Add(float64(msg.records))
+	}
+}
+
+// aggregate merges the connections of an export interval into one record per
+// flowKey, with the source port cleared. A connection between two pods of the
+// node is reported by both ends, the outbound report is kept, or the first one
+// if the reports fall into two exports.
+func (e *FlowExporter) aggregate(batch []*flowRecord) []*flowRecord {
+	conns := make(map[connKey]*flowRecord, len(batch))
+	order := make([]connKey, 0, len(batch))
+	for _, record := range batch {
+		key := record.connKey()
+		if _, ok := e.exported[key]; ok {
+			continue
+		}
+		if prev, ok := conns[key]; ok {
+			if prev.direction != flowDirectionEgress && record.direction == flowDirectionEgress {
+				conns[key] = record
+			}
+			continue
+		}
+		conns[key] = record
+		order = append(order, key)
+	}
+
+	e.exported = make(map[connKey]struct{}, len(order))
+	flows := map[flowKey]*flowRecord{}
+	var records []*flowRecord
+	for _, key := range order {
+		e.exported[key] = struct{}{}
+		record := conns[key]
+		if flow, ok := flows[record.flowKey()]; ok {
+			flow.merge(record)
+			continue
+		}
+		flow := *record
+		flow.srcPort = 0
+		flows[record.flowKey()] = &flow
+		records = append(records, &flow)
+	}
+	return records
+}
+
+// templateDue is true for a new session, and periodically over udp as the
+// collector may have missed the templates or restarted since
+func (e *FlowExporter) templateDue() bool {
+	if e.templateSent.IsZero() || e.transport.newSession() {
+		return true
+	}
+	_, isUdp := e.transport.(*udpTransport)
+	return isUdp && e.encoder.now().Sub(e.templateSent) >= e.config.TemplateRefreshInterval
+}
+
+// sampleFlow keeps one of every rate connections
+func sampleFlow(data *requestMetric, rate uint32) bool {
+	if rate <= 1 {
+		return true
+	}
+
+	h := fnv.New64a()
+	var buf [36]byte
+	for i := range data.src {
+		binary.LittleEndian.PutUint32(buf[i*4:], data.src[i])
+		binary.LittleEndian.PutUint32(buf[16+i*4:], data.dst[i])
+	}
+	binary.LittleEndian.PutUint16(buf[32:], data.srcPort)
+	binary.LittleEndian.PutUint16(buf[34:], data.dstPort)
+	_, _ = h.Write(buf[:])
+	// the low bits of fnv are poorly mixed
+	return (h.Sum64()>>32)%uint64(rate) == 0
+}
+
+func buildFlowRecord(data requestMetric, accesslog logInfo) *flowRecord {
+	var srcAddr, dstAddr []byte
+	for i := range data.dst {
+		srcAddr = binary.LittleEndian.AppendUint32(srcAddr, data.src[i])
+		dstAddr = binary.LittleEndian.AppendUint32(dstAddr, data.dst[i])
+	}
+	src, _ := netip.AddrFromSlice(restoreIPv4(srcAddr))
+	dst, _ := netip.AddrFromSlice(restoreIPv4(dstAddr))
+
+	record := &flowRecord{
+		src:       src,
+		dst:       dst,
+		srcPort:   data.srcPort,
+		dstPort:   data.dstPort,
+		start:     calculateUptime(osStartTime, data.closeTime-data.duration),
+		end:       calculateUptime(osStartTime, data.closeTime),
+		endReason: flowEndReasonEndOfFlow,
+		flows:     1,
+
+		sourceWorkload:           accesslog.sourceWorkload,
+		sourceNamespace:          accesslog.sourceNamespace,
+		destinationWorkload:      accesslog.destinationWorkload,
+		destinationNamespace:     accesslog.destinationNamespace,
+		destinationService:       accesslog.destinationService,
+		responseFlags:            accesslog.responseFlags,
+		connectionSecurityPolicy: accesslog.connectionSecurityPolicy,
+	}
+
+	// the counters are kept by the reporting end, which is the initiator of an
+	// outbound connection and the responder of an inbound one
+	local, remote := uint64(data.sentBytes), uint64(data.receivedBytes)
+	localSegs, remoteSegs := uint64(data.segsOut), uint64(data.segsIn)
+	if data.direction == constants.INBOUND {
+		record.direction = flowDirectionIngress
+		record.initiatorOctets, record.responderOctets = remote, local
+		record.initiatorPackets, record.responderPackets = remoteSegs, localSegs
+	} else {
+		record.direction = flowDirectionEgress
+		record.initiatorOctets, record.responderOctets = local, remote
+		record.initiatorPackets, record.responderPackets = localSegs, remoteSegs
+	}
+	return record
+}
+
+func (r *flowRecord) connKey() connKey {
+	return connKey{src: r.src, dst: r.dst, srcPort: r.srcPort, dstPort: r.dstPort}
+}
+
+func (r *flowRecord) flowKey() flowKey {
+	return flowKey{
+		src:                      r.src,
+		dst:                      r.dst,
+		dstPort:                  r.dstPort,
+		direction:                r.direction,
+		sourceWorkload:           r.sourceWorkload,
+		sourceNamespace:          r.sourceNamespace,
+		destinationWorkload:      r.destinationWorkload,
+		destinationNamespace:     r.destinationNamespace,
+		destinationService:       r.destinationService,
+		responseFlags:            r.responseFlags,
+		connectionSecurityPolicy: r.connectionSecurityPolicy,
+	}
+}
+
+// merge adds the connections of other to the flow, which spans both
+func (r *flowRecord) merge(other *flowRecord) {
+	if other.start.Before(r.start) {
+		r.start = other.start
+	}
+	if other.end.After(r.end) {
+		r.end = other.end
+	}
+	r.initiatorOctets += other.initiatorOctets
+	r.responderOctets += other.responderOctets
+	r.initiatorPackets += other.initiatorPackets
+	r.responderPackets += other.responderPackets
+	r.flows += other.flows
+}
+
+type udpTransport struct {
+	conn net.Conn
+}
+
+func (t *udpTransport) send(msg []byte) error {
+	_, err := t.conn.Write(msg)
+	return err
+}
+
+// newSession is always false, udp templates are refreshed on a timer instead
+func (t *udpTransport) newSession() bool {
+	return false
+}
+
+func (t *udpTransport) close() error {
+	return t.conn.Close()
+}
+
+// tcpTransport dials lazily and redials after a failure. The templates must be
+// sent first on every new connection.
+type tcpTransport struct {
+	address string
+	conn    net.Conn
+	fresh   bool
+}
+
+func (t *tcpTransport) connect() error {
+	if t.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", t.address, flowDialTimeout)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	t.fresh = true
+	return nil
+}
+
+func (t *tcpTransport) send(msg []byte) error {
+	if err := t.connect(); err != nil {
+		return err
+	}
+	// a stalled collector must not block the export loop
+	if err := t.conn.SetWriteDeadline(time.Now().Add(flowWriteTimeout)); err != nil {
+		_ = t.conn.Close()
+		t.conn = nil
+		return err
+	}
+	if _, err := t.conn.Write(msg); err != nil {
+		_ = t.conn.Close()
+		t.conn = nil
+		return err
+	}
+	t.fresh = false
+	return nil
+}
+
+// newSession connects if needed, so that the templates lead the new stream
+func (t *tcpTransport) newSession() bool {
+	if err := t.connect(); err != nil {
+		// the send that follows fails and reports the error
+		return true
+	}
+	return t.fresh
+}
+
+func (t *tcpTransport) close() error {
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
@@ -0,0 +1,535 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"kmesh.net/kmesh/daemon/options"
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+const testEnterpriseNumber = 32473
+
+type ieKey struct {
+	enterprise uint32
+	id         uint16
+}
+
+type decodedField struct {
+	key    ieKey
+	length uint16
+}
+
+type decodedMessage struct {
+	sequence  uint32
+	domainID  uint32
+	templates []uint16
+	records   []map[ieKey][]byte
+}
+
+// fakeIpfixCollector decodes the data sets with the templates it received, as a
+// real collector would, so a mismatch between the templates and the records fails
+type fakeIpfixCollector struct {
+	mutex     sync.Mutex
+	templates map[uint16][]decodedField
+	messages  []decodedMessage
+	sessions  int
+	conns     []net.Conn
+
+	udp net.PacketConn
+	tcp net.Listener
+}
+
+func newFakeIpfixCollector(t *testing.T, transport string) *fakeIpfixCollector {
+	c := &fakeIpfixCollector{templates: map[uint16][]decodedField{}}
+	var err error
+	if transport == options.FlowTransportUdp {
+		c.udp, err = net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go c.serveUdp(t)
+	} else {
+		c.tcp, err = net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go c.serveTcp(t)
+	}
+	t.Cleanup(c.close)
+	return c
+}
+
+func (c *fakeIpfixCollector) address() string {
+	if c.udp != nil {
+		return c.udp.LocalAddr().String()
+	}
+	return c.tcp.Addr().String()
+}
+
+func (c *fakeIpfixCollector) serveUdp(t *testing.T) {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := c.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// the decoded records keep slices of the message
+		c.decode(t, append([]byte(nil), buf[:n]...))
+	}
+}
+
+func (c *fakeIpfixCollector) serveTcp(t *testing.T) {
+	for {
+		conn, err := c.tcp.Accept()
+		if err != nil {
+			return
+		}
+		c.mutex.Lock()
+		c.sessions++
+		// templates are scoped to the transport session
+		c.templates = map[uint16][]decodedField{}
+		c.conns = append(c.conns, conn)
+		c.mutex.Unlock()
+
+		go func() {
+			header := make([]byte, 4)
+			for {
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				msg := make([]byte, binary.BigEndian.Uint16(header[2:]))
+				copy(msg, header)
+				if _, err := io.ReadFull(conn, msg[4:]); err != nil {
+					return
+				}
+				c.decode(t, msg)
+			}
+		}()
+	}
+}
+
+// dropSessions closes the accepted connections, like a restarting collector
+func (c *fakeIpfixCollector) dropSessions() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, conn := range c.conns {
+		_ = conn.Close()
+	}
+	c.conns = nil
+}
+
+func (c *fakeIpfixCollector) close() {
+	if c.udp != nil {
+		_ = c.udp.Close()
+	}
+	if c.tcp != nil {
+		_ = c.tcp.Close()
+	}
+	c.dropSessions()
+}
+
+func (c *fakeIpfixCollector) decode(t *testing.T, msg []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	assert.Equal(t, uint16(ipfixVersion), binary.BigEndian.Uint16(msg))
+	assert.Equal(t, len(msg), int(binary.BigEndian.Uint16(msg[2:])))
+	decoded := decodedMessage{
+		sequence: binary.BigEndian.Uint32(msg[8:]),
+		domainID: binary.BigEndian.Uint32(msg[12:]),
+	}
+
+	for offset := ipfixMessageHeaderLen; offset < len(msg); {
+		setID := binary.BigEndian.Uint16(msg[offset:])
+		setEnd := offset + int(binary.BigEndian.Uint16(msg[offset+2:]))
+		body := msg[offset+ipfixSetHeaderLen : setEnd]
+		offset = setEnd
+
+		if setID == ipfixTemplateSetID {
+			for len(body) > 0 {
+				id, count := binary.BigEndian.Uint16(body), int(binary.BigEndian.Uint16(body[2:]))
+				body = body[4:]
+				var fields []decodedField
+				for i := 0; i < count; i++ {
+					field := decodedField{
+						key:    ieKey{id: binary.BigEndian.Uint16(body) &^ ipfixEnterpriseBit},
+						length: binary.BigEndian.Uint16(body[2:]),
+					}
+					if binary.BigEndian.Uint16(body)&ipfixEnterpriseBit != 0 {
+						field.key.enterprise = binary.BigEndian.Uint32(body[4:])
+						body = body[4:]
+					}
+					body = body[4:]
+					fields = append(fields, field)
+				}
+				c.templates[id] = fields
+				decoded.templates = append(decoded.templates, id)
+			}
+			continue
+		}
+
+		fields, ok := c.templates[setID]
+		if !assert.True(t, ok, "data set %d before its template", setID) {
+			continue
+		}
+		for len(body) > 0 {
+			record := map[ieKey][]byte{}
+			for _, field := range fields {
+				length := int(field.length)
+				if field.length == ipfixVariableLength {
+					length = int(body[0])
+					body = body[1:]
+					if length == 255 {
+						length = int(binary.BigEndian.Uint16(body))
+						body = body[2:]
+					}
+				}
+				record[field.key] = body[:length]
+				body = body[length:]
+			}
+			decoded.records = append(decoded.records, record)
+		}
+	}
+	c.messages = append(c.messages, decoded)
+}
+
+func (c *fakeIpfixCollector) received() []decodedMessage {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]decodedMessage(nil), c.messages...)
+}
+
+func (c *fakeIpfixCollector) waitMessages(t *testing.T, n int) []decodedMessage {
+	require.Eventually(t, func() bool { return len(c.received()) >= n }, 5*time.Second, 10*time.Millisecond)
+	return c.received()
+}
+
+func testFlowConfig(transport, address string) *options.FlowConfig {
+	return &options.FlowConfig{
+		CollectorAddress:        address,
+		Transport:               transport,
+		SamplingRate:            1,
+		ExportInterval:          time.Hour,
+		TemplateRefreshInterval: 10 * time.Minute,
+		ObservationDomainID:     42,
+		EnterpriseNumber:        testEnterpriseNumber,
+		MaxMessageSize:          1400,
+		QueueSize:               16,
+	}
+}
+
+func testFlowRecords() []*flowRecord {
+	return testFlowRecordsFrom(50000)
+}
+
+// testFlowRecordsFrom returns the records of connections from srcPort, another
+// connection than those of a previous export
+func testFlowRecordsFrom(srcPort uint16) []*flowRecord {
+	v4 := requestMetric{
+		src:           [4]uint32{0x0af4f40a, 0, 0, 0}, // 10.244.244.10
+		dst:           [4]uint32{0x0af4f40b, 0, 0, 0}, // 11.244.244.10
+		srcPort:       srcPort,
+		dstPort:       80,
+		direction:     constants.OUTBOUND,
+		state:         TCP_CLOSTED,
+		sentBytes:     100,
+		receivedBytes: 2000,
+		segsOut:       3,
+		segsIn:        5,
+		duration:      uint64(2 * time.Second),
+		closeTime:     uint64(10 * time.Second),
+	}
+	info := logInfo{
+		sourceWorkload:           "sleep",
+		sourceNamespace:          "default",
+		destinationWorkload:      "httpbin",
+		destinationNamespace:     "default",
+		destinationService:       "httpbin.default.svc.cluster.local",
+		responseFlags:            "-",
+		connectionSecurityPolicy: "mutual_tls",
+	}
+
+	v6 := v4
+	v6.src = [4]uint32{0x000080fe, 0, 0, 0x01000000} // fe80::1
+	v6.dst = [4]uint32{0x000080fe, 0, 0, 0x02000000} // fe80::2
+	v6.direction = constants.INBOUND
+
+	return []*flowRecord{buildFlowRecord(v4, info), buildFlowRecord(v6, info)}
+}
+
+func TestBuildFlowRecord(t *testing.T) {
+	osStartTime = time.Date(2024, 7, 4, 20, 14, 0, 0, time.UTC)
+	records := testFlowRecords()
+
+	outbound := records[0]
+	assert.Equal(t, "10.244.244.10", outbound.src.String())
+	assert.Equal(t, "11.244.244.10", outbound.dst.String())
+	assert.Equal(t, uint8(flowDirectionEgress), outbound.direction)
+	assert.Equal(t, osStartTime.Add(8*time.Second), outbound.start)
+	assert.Equal(t, osStartTime.Add(10*time.Second), outbound.end)
+	assert.Equal(t, []uint64{100, 2000, 3, 5},
+		[]uint64{outbound.initiatorOctets, outbound.responderOctets, outbound.initiatorPackets, outbound.responderPackets})
+
+	// the destination reports an inbound connection, its sent bytes are the response
+	inbound := records[1]
+	assert.Equal(t, "fe80::1", inbound.src.String())
+	assert.Equal(t, "fe80::2", inbound.dst.String())
+	assert.Equal(t, uint8(flowDirectionIngress), inbound.direction)
+	assert.Equal(t, []uint64{2000, 100, 5, 3},
+		[]uint64{inbound.initiatorOctets, inbound.responderOctets, inbound.initiatorPackets, inbound.responderPackets})
+}
+
+func TestFlowExporter(t *testing.T) {
+	osStartTime = time.Date(2024, 7, 4, 20, 14, 0, 0, time.UTC)
+
+	for _, transport := range []string{options.FlowTransportUdp, options.FlowTransportTcp} {
+		t.Run(transport, func(t *testing.T) {
+			collector := newFakeIpfixCollector(t, transport)
+			exporter, err := NewFlowExporter(testFlowConfig(transport, collector.address()))
+			require.NoError(t, err)
+			defer exporter.transport.close()
+
+			exporter.export(testFlowRecords())
+			messages := collector.waitMessages(t, 3)
+			require.Len(t, messages, 3)
+
+			assert.ElementsMatch(t, []uint16{ipfixTemplateIDv4, ipfixTemplateIDv6}, messages[0].templates)
+			assert.Empty(t, messages[0].records)
+			assert.Equal(t, uint32(42), messages[0].domainID)
+			// sequence numbers count the data records sent before the message
+			assert.Equal(t, []uint32{0, 0, 1}, []uint32{messages[0].sequence, messages[1].sequence, messages[2].sequence})
+
+			v4, v6 := messages[1].records[0], messages[2].records[0]
+			assert.Equal(t, []byte{10, 244, 244, 10}, v4[ieKey{id: ieSourceIPv4Address}])
+			assert.Equal(t, []byte{0, 80}, v4[ieKey{id: ieDestinationTransportPort}])
+			assert.Equal(t, []byte{protocolTcp}, v4[ieKey{id: ieProtocolIdentifier}])
+			assert.Equal(t, uint64(osStartTime.Add(8*time.Second).UnixMilli()),
+				binary.BigEndian.Uint64(v4[ieKey{id: ieFlowStartMilliseconds}]))
+			assert.Equal(t, uint64(2000), binary.BigEndian.Uint64(v4[ieKey{id: ieResponderOctets}]))
+			assert.Equal(t, "httpbin.default.svc.cluster.local",
+				string(v4[ieKey{enterprise: testEnterpriseNumber, id: ieKmeshDestinationService}]))
+			assert.Equal(t, "mutual_tls", string(v4[ieKey{enterprise: testEnterpriseNumber, id: ieKmeshConnectionSecurityPolicy}]))
+
+			assert.Len(t, v6[ieKey{id: ieSourceIPv6Address}], 16)
+			assert.Equal(t, []byte{flowDirectionIngress}, v6[ieKey{id: ieFlowDirection}])
+			assert.Equal(t, "sleep", string(v6[ieKey{enterprise: testEnterpriseNumber, id: ieKmeshSourceWorkload}]))
+
+			assert.Equal(t, []byte{0, 0}, v4[ieKey{id: ieSourceTransportPort}], "the source port is aggregated")
+			assert.Equal(t, uint64(1), binary.BigEndian.Uint64(v4[ieKey{id: ieDeltaFlowCount}]))
+
+			// templates are only resent when due
+			exporter.export(testFlowRecordsFrom(50001)[:1])
+			messages = collector.waitMessages(t, 4)
+			assert.Empty(t, messages[3].templates)
+			assert.Equal(t, uint32(2), messages[3].sequence)
+		})
+	}
+}
+
+func TestFlowExporterTemplateRefresh(t *testing.T) {
+	collector := newFakeIpfixCollector(t, options.FlowTransportUdp)
+	exporter, err := NewFlowExporter(testFlowConfig(options.FlowTransportUdp, collector.address()))
+	require.NoError(t, err)
+	defer exporter.transport.close()
+	clock := &fakeClock{now: time.Date(2024, 8, 14, 10, 0, 0, 0, time.UTC)}
+	exporter.encoder.now = clock.Now
+
+	exporter.export(nil)
+	collector.waitMessages(t, 1)
+
+	// nothing is due, nothing is sent
+	clock.now = clock.now.Add(5 * time.Minute)
+	exporter.export(nil)
+	clock.now = clock.now.Add(5 * time.Minute)
+	exporter.export(nil)
+	messages := collector.waitMessages(t, 2)
+	require.Len(t, messages, 2)
+	assert.Len(t, messages[1].templates, 2)
+}
+
+func TestFlowExporterTcpReconnect(t *testing.T) {
+	collector := newFakeIpfixCollector(t, options.FlowTransportTcp)
+	exporter, err := NewFlowExporter(testFlowConfig(options.FlowTransportTcp, collector.address()))
+	require.NoError(t, err)
+	defer exporter.transport.close()
+
+	exporter.export(testFlowRecords()[:1])
+	collector.waitMessages(t, 2)
+
+	collector.dropSessions()
+	// the first write after the peer closed may still succeed, keep exporting
+	// until the exporter notices and reconnects
+	port := uint16(50000)
+	require.Eventually(t, func() bool {
+		port++
+		exporter.export(testFlowRecordsFrom(port)[:1])
+		collector.mutex.Lock()
+		defer collector.mutex.Unlock()
+		return collector.sessions == 2 && len(collector.messages) > 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	messages := collector.waitMessages(t, 4)
+	// the new session starts with the templates, or its records could not be decoded
+	assert.Len(t, messages[2].templates, 2)
+	assert.Len(t, messages[3].records, 1)
+}
+
+// failingTransport fails the sends after the first ok ones
+type failingTransport struct {
+	ok    int
+	sends int
+}
+
+func (t *failingTransport) send([]byte) error {
+	t.sends++
+	if t.sends > t.ok {
+		return fmt.Errorf("connection reset")
+	}
+	return nil
+}
+
+func (t *failingTransport) newSession() bool {
+	return false
+}
+
+func (t *failingTransport) close() error {
+	return nil
+}
+
+func TestFlowExporterSendFailure(t *testing.T) {
+	osStartTime = time.Date(2024, 7, 4, 20, 14, 0, 0, time.UTC)
+	exporter, err := NewFlowExporter(testFlowConfig(options.FlowTransportUdp, "127.0.0.1:4739"))
+	require.NoError(t, err)
+	exporter.transport.close()
+	// the templates go out, the first data message fails
+	transport := &failingTransport{ok: 1}
+	exporter.transport = transport
+
+	before := testutil.ToFloat64(flowRecordsDropped)
+	exporter.export(testFlowRecords())
+	assert.Equal(t, 2, transport.sends, "the export stops at the failed message")
+	assert.Equal(t, before+2, testutil.ToFloat64(flowRecordsDropped))
+}
+
+func TestFlowExporterAggregate(t *testing.T) {
+	osStartTime = time.Date(2024, 7, 4, 20, 14, 0, 0, time.UTC)
+	exporter := &FlowExporter{}
+
+	first := testFlowRecordsFrom(50000)[0]
+	second := testFlowRecordsFrom(50001)[0]
+	second.start = second.start.Add(-time.Second)
+	second.end = second.end.Add(time.Second)
+	// the server of a pod pair on the node reports the same connection inbound
+	inbound := *first
+	inbound.direction = flowDirectionIngress
+	// another destination port is another flow
+	other := testFlowRecordsFrom(50002)[0]
+	other.dstPort = 8080
+
+	records := exporter.aggregate([]*flowRecord{&inbound, first, second, other})
+	require.Len(t, records, 2)
+	flow := records[0]
+	assert.Equal(t, uint8(flowDirectionEgress), flow.direction)
+	assert.Equal(t, uint16(0), flow.srcPort)
+	assert.Equal(t, uint64(2), flow.flows)
+	assert.Equal(t, []uint64{200, 4000, 6, 10},
+		[]uint64{flow.initiatorOctets, flow.responderOctets, flow.initiatorPackets, flow.responderPackets})
+	assert.Equal(t, second.start, flow.start)
+	assert.Equal(t, second.end, flow.end)
+	assert.Equal(t, uint16(8080), records[1].dstPort)
+	assert.Equal(t, uint64(1), records[1].flows)
+	// the input records are left untouched
+	assert.Equal(t, uint16(50000), first.srcPort)
+	assert.Equal(t, uint64(1), first.flows)
+
+	// the other end of a connection exported in the previous interval is dropped
+	late := *second
+	late.direction = flowDirectionIngress
+	records = exporter.aggregate([]*flowRecord{&late, testFlowRecordsFrom(50003)[0]})
+	require.Len(t, records, 1)
+	assert.Equal(t, uint8(flowDirectionEgress), records[0].direction)
+	assert.Equal(t, uint64(1), records[0].flows)
+}
+
+func TestFlowExporterEnqueue(t *testing.T) {
+	exporter := &FlowExporter{
+		config: &options.FlowConfig{SamplingRate: 1},
+		queue:  make(chan *flowRecord, 1),
+	}
+
+	data := requestMetric{state: TCP_ESTABLISHED}
+	exporter.enqueueFlow(data, logInfo{})
+	assert.Len(t, exporter.queue, 0, "only closed connections are exported")
+
+	data.state = TCP_CLOSTED
+	exporter.enqueueFlow(data, logInfo{})
+	exporter.enqueueFlow(data, logInfo{})
+	assert.Len(t, exporter.queue, 1, "the queue is bounded")
+
+	var nilExporter *FlowExporter
+	nilExporter.enqueueFlow(data, logInfo{})
+}
+
+func TestSampleFlow(t *testing.T) {
+	sampled := 0
+	for i := 0; i < 4000; i++ {
+		data := requestMetric{src: [4]uint32{uint32(i)}, dst: [4]uint32{1}, srcPort: uint16(i), dstPort: 80}
+		assert.True(t, sampleFlow(&data, 1))
+		if sampleFlow(&data, 4) {
+			sampled++
+			// the decision only depends on the 5-tuple
+			assert.True(t, sampleFlow(&data, 4))
+		}
+	}
+	assert.InDelta(t, 1000, sampled, 150)
+}
+
+func TestIpfixMessageSize(t *testing.T) {
+	encoder := newIpfixEncoder(1, testEnterpriseNumber, 512)
+	var records []*flowRecord
+	for i := 0; i < 40; i++ {
+		record := *testFlowRecords()[i%2]
+		record.destinationService = fmt.Sprintf("svc-%d.default.svc.cluster.local", i)
+		records = append(records, &record)
+	}
+	// a record larger than a message is skipped
+	huge := *testFlowRecords()[0]
+	huge.destinationService = string(make([]byte, 600))
+	records = append(records, &huge)
+
+	total := 0
+	var sequence uint32
+	for _, msg := range encoder.dataMessages(records) {
+		assert.LessOrEqual(t, len(msg.data), 512)
+		assert.Equal(t, sequence, binary.BigEndian.Uint32(msg.data[8:]))
+		sequence += uint32(msg.records)
+		total += msg.records
+	}
+	assert.Equal(t, 40, total)
+	assert.Equal(t, uint32(40), encoder.sequence)
+
+	long := appendVariableLength(nil, string(make([]byte, 300)))
+	assert.Equal(t, []byte{255, 1, 44}, long[:3])
+}
@@ -0,0 +1,312 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+// IPFIX message layout, see RFC 7011
+const (
+	ipfixVersion          = 10
+	ipfixMessageHeaderLen = 16
+	ipfixSetHeaderLen     = 4
+	ipfixTemplateSetID    = 2
+
+	ipfixTemplateIDv4 = 256
+	ipfixTemplateIDv6 = 257
+
+	// ipfixVariableLength marks a variable length field in a template
+	ipfixVariableLength = 0xffff
+	ipfixEnterpriseBit  = 0x8000
+)
+
+// information elements assigned by IANA
+const (
+	ieDeltaFlowCount           = 3
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowDirection            = 61
+	ieFlowEndReason            = 136
+	ieFlowStartMilliseconds    = 152
+	ieFlowEndMilliseconds      = 153
+	ieInitiatorOctets          = 231
+	ieResponderOctets          = 232
+	ieInitiatorPackets         = 298
+	ieResponderPackets         = 299
+)
+
+// kmesh information elements, scoped by the configured enterprise number
+const (
+	ieKmeshSourceWorkload = iota + 1
+	ieKmeshSourceNamespace
+	ieKmeshDestinationWorkload
+	ieKmeshDestinationNamespace
+	ieKmeshDestinationService
+	ieKmeshResponseFlags
+	ieKmeshConnectionSecurityPolicy
+)
+
+const (
+	flowDirectionIngress = 0
+	flowDirectionEgress  = 1
+
+	flowEndReasonEndOfFlow = 3
+
+	protocolTcp = 6
+)
+
+type ipfixField struct {
+	id         uint16
+	length     uint16
+	enterprise bool
+}
+
+var ipfixCommonFields = []ipfixField{
+	{id: ieSourceTransportPort, length: 2},
+	{id: ieDestinationTransportPort, length: 2},
+	{id: ieProtocolIdentifier, length: 1},
+	{id: ieFlowDirection, length: 1},
+	{id: ieFlowStartMilliseconds, length: 8},
+	{id: ieFlowEndMilliseconds, length: 8},
+	{id: ieFlowEndReason, length: 1},
+	{id: ieInitiatorOctets, length: 8},
+	{id: ieResponderOctets, length: 8},
+	{id: ieInitiatorPackets, length: 8},
+	{id: ieResponderPackets, length: 8},
+	{id: ieDeltaFlowCount, length: 8},
+	{id: ieKmeshSourceWorkload, length: ipfixVariableLength, enterprise: true},
+	{id: ieKmeshSourceNamespace, length: ipfixVariableLength, enterprise: true},
+	{id: ieKmeshDestinationWorkload, length: ipfixVariableLength, enterprise: true},
+	{id: ieKmeshDestinationNamespace, length: ipfixVariableLength, enterprise: true},
+	{id: ieKmeshDestinationService, length: ipfixVariableLength, enterprise: true},
+	{id: ieKmeshResponseFlags, length: ipfixVariableLength, enterprise: true},
+	{id: ieKmeshConnectionSecurityPolicy, length: ipfixVariableLength, enterprise: true},
+}
+
+var ipfixTemplates = []struct {
+	id     uint16
+	fields []ipfixField
+}{
+	{
+		id: ipfixTemplateIDv4,
+		fields: append([]ipfixField{
+			{id: ieSourceIPv4Address, length: 4},
+			{id: ieDestinationIPv4Address, length: 4},
+		}, ipfixCommonFields...),
+	},
+	{
+		id: ipfixTemplateIDv6,
+		fields: append([]ipfixField{
+			{id: ieSourceIPv6Address, length: 16},
+			{id: ieDestinationIPv6Address, length: 16},
+		}, ipfixCommonFields...),
+	},
+}
+
+// flowRecord is a finished connection with the identity of both ends, or the
+// sum of the connections of a flow once aggregated. The source is always the
+// initiator of the connections.
+type flowRecord struct {
+	src     netip.Addr
+	dst     netip.Addr
+	srcPort uint16
+	dstPort uint16
+
+	direction uint8
+	start     time.Time
+	end       time.Time
+	endReason uint8
+
+	initiatorOctets  uint64
+	responderOctets  uint64
+	initiatorPackets uint64
+	responderPackets uint64
+	// flows is the number of connections aggregated into the record
+	flows uint64
+
+	sourceWorkload           string
+	sourceNamespace          string
+	destinationWorkload      string
+	destinationNamespace     string
+	destinationService       string
+	responseFlags            string
+	connectionSecurityPolicy string
+}
+
+// ipfixMessage is an encoded data message and the number of records in it
+type ipfixMessage struct {
+	data    []byte
+	records int
+}
+
+func (r *flowRecord) templateID() uint16 {
+	if r.src.Is4() {
+		return ipfixTemplateIDv4
+	}
+	return ipfixTemplateIDv6
+}
+
+// ipfixEncoder builds the messages of one observation domain. It is not safe
+// for concurrent use.
+type ipfixEncoder struct {
+	domainID       uint32
+	enterpriseID   uint32
+	maxMessageSize int
+	// sequence is the number of data records sent before the next message
+	sequence uint32
+	now      func() time.Time
+}
+
+func newIpfixEncoder(domainID, enterpriseID uint32, maxMessageSize int) *ipfixEncoder {
+	return &ipfixEncoder{
+		domainID:       domainID,
+		enterpriseID:   enterpriseID,
+		maxMessageSize: maxMessageSize,
+		now:            time.Now,
+	}
+}
+
+// templateMessage returns a message with a template set of all the templates
+func (e *ipfixEncoder) templateMessage() []byte {
+	msg := e.appendMessageHeader(nil)
+	setStart := len(msg)
+	msg = binary.BigEndian.AppendUint16(msg, ipfixTemplateSetID)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	for _, template := range ipfixTemplates {
+		msg = binary.BigEndian.AppendUint16(msg, template.id)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(template.fields)))
+		for _, field := range template.fields {
+			if field.enterprise {
+				msg = binary.BigEndian.AppendUint16(msg, field.id|ipfixEnterpriseBit)
+				msg = binary.BigEndian.AppendUint16(msg, field.length)
+				msg = binary.BigEndian.AppendUint32(msg, e.enterpriseID)
+			} else {
+				msg = binary.BigEndian.AppendUint16(msg, field.id)
+				msg = binary.BigEndian.AppendUint16(msg, field.length)
+			}
+		}
+	}
+	binary.BigEndian.PutUint16(msg[setStart+2:], uint16(len(msg)-setStart))
+	return finishMessage(msg)
+}
+
+// dataMessages packs the records into as few messages as the size limit allows,
+// each message holds a single data set. A record too large for an empty message
+// is skipped.
+func (e *ipfixEncoder) dataMessages(records []*flowRecord) []ipfixMessage {
+	var messages []ipfixMessage
+	for _, template := range ipfixTemplates {
+		var msg []byte
+		count := 0
+		flush := func() {
+			if count == 0 {
+				return
+			}
+			binary.BigEndian.PutUint16(msg[ipfixMessageHeaderLen+2:], uint16(len(msg)-ipfixMessageHeaderLen))
+			messages = append(messages, ipfixMessage{data: finishMessage(msg), records: count})
+			e.sequence += uint32(count)
+			msg, count = nil, 0
+		}
+
+		for _, record := range records {
+			if record.templateID() != template.id {
+				continue
+			}
+			encoded := appendFlowRecord(nil, record)
+			if ipfixMessageHeaderLen+ipfixSetHeaderLen+len(encoded) > e.maxMessageSize {
+				log.Warnf("flow record of %s:%d -> %s:%d exceeds the max ipfix message size",
+					record.src, record.srcPort, record.dst, record.dstPort)
+				continue
+			}
+			if count > 0 && len(msg)+len(encoded) > e.maxMessageSize {
+				flush()
+			}
+			if count == 0 {
+				msg = e.appendMessageHeader(make([]byte, 0, e.maxMessageSize))
+				msg = binary.BigEndian.AppendUint16(msg, template.id)
+				msg = binary.BigEndian.AppendUint16(msg, 0)
+			}
+			msg = append(msg, encoded...)
+			count++
+		}
+		flush()
+	}
+	return messages
+}
+
+// appendMessageHeader appends a header with the length left to finishMessage
+func (e *ipfixEncoder) appendMessageHeader(msg []byte) []byte {
+	msg = binary.BigEndian.AppendUint16(msg, ipfixVersion)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(e.now().Unix()))
+	msg = binary.BigEndian.AppendUint32(msg, e.sequence)
+	msg = binary.BigEndian.AppendUint32(msg, e.domainID)
+	return msg
+}
+
+func finishMessage(msg []byte) []byte {
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	return msg
+}
+
+// appendFlowRecord appends the fields of the record in template order
+func appendFlowRecord(buf []byte, r *flowRecord) []byte {
+	src, dst := r.src.AsSlice(), r.dst.AsSlice()
+	buf = append(buf, src...)
+	buf = append(buf, dst...)
+	buf = binary.BigEndian.AppendUint16(buf, r.srcPort)
+	buf = binary.BigEndian.AppendUint16(buf, r.dstPort)
+	buf = append(buf, protocolTcp, r.direction)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(r.start.UnixMilli()))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(r.end.UnixMilli()))
+	buf = append(buf, r.endReason)
+	buf = binary.BigEndian.AppendUint64(buf, r.initiatorOctets)
+	buf = binary.BigEndian.AppendUint64(buf, r.responderOctets)
+	buf = binary.BigEndian.AppendUint64(buf, r.initiatorPackets)
+	buf = binary.BigEndian.AppendUint64(buf, r.responderPackets)
+	buf = binary.BigEndian.AppendUint64(buf, r.flows)
+	for _, s := range []string{
+		r.sourceWorkload, r.sourceNamespace, r.destinationWorkload, r.destinationNamespace,
+		r.destinationService, r.responseFlags, r.connectionSecurityPolicy,
+	} {
+		buf = appendVariableLength(buf, s)
+	}
+	return buf
+}
+
+// appendVariableLength uses the one byte length prefix for short values and the
+// three byte form otherwise, see RFC 7011 section 7
+func appendVariableLength(buf []byte, s string) []byte {
+	if len(s) > 0xffff {
+		s = s[:0xffff]
+	}
+	if len(s) < 255 {
+		buf = append(buf, byte(len(s)))
+	} else {
+		buf = append(buf, 255)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	}
+	return append(buf, s...)
+}
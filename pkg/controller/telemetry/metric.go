@@ -24,6 +24,7 @@ import (
 	"net/netip"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -31,8 +32,10 @@ import (
 	"github.com/cilium/ebpf/ringbuf"
 
 	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/daemon/options"
 	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/controller/workload/cache"
+	"kmesh.net/kmesh/pkg/health"
 )
 
 const (
@@ -41,6 +44,12 @@ const (
 
 	connection_success = uint32(1)
 
+	// conn_flags reported by bpf, keep in sync with tcp_probe.h
+	connFlagWaypoint   = uint32(1 << 0)
+	connFlagReset      = uint32(1 << 1)
+	connFlagAuthDenied = uint32(1 << 2)
+	connFlagMtls       = uint32(1 << 3)
+
 	MSG_LEN = 112
 )
 
@@ -48,6 +57,13 @@ var osStartTime time.Time
 
 type MetricController struct {
 	workloadCache cache.WorkloadCache
+	connections   *connectionTracker
+	exporter      *OtlpExporter
+	accesslogger  *Accesslogger
+	series        *SeriesTracker
+	flows         *FlowExporter
+	probeConfig   *options.ProbeConfig
+	top           *TopTracker
 }
 
 type connectionDataV4 struct {
@@ -63,6 +79,15 @@ type connectionDataV4 struct {
 	Duration       uint64
 	CloseTime      uint64
 	State          uint32
+	Protocol       uint32
+	SrttUs         uint32
+	RttMin         uint32
+	MssCache       uint32
+	TotalRetrans   uint32
+	SegsIn         uint32
+	SegsOut        uint32
+	LostOut        uint32
+	ConnFlags      uint32
 }
 
 type connectionDataV6 struct {
@@ -77,6 +102,15 @@ type connectionDataV6 struct {
 	Duration       uint64
 	CloseTime      uint64
 	State          uint32
+	Protocol       uint32
+	SrttUs         uint32
+	RttMin         uint32
+	MssCache       uint32
+	TotalRetrans   uint32
+	SegsIn         uint32
+	SegsOut        uint32
+	LostOut        uint32
+	ConnFlags      uint32
 }
 
 type requestMetric struct {
@@ -91,6 +125,12 @@ type requestMetric struct {
 	success       uint32
 	duration      uint64
 	closeTime     uint64
+	// srttUs is the smoothed rtt in usecs shifted left by 3, as the kernel keeps it
+	srttUs       uint32
+	totalRetrans uint32
+	segsOut      uint32
+	segsIn       uint32
+	connFlags    uint32
 }
 
 type workloadMetricLabels struct {
@@ -154,14 +194,156 @@ type serviceMetricLabels struct {
 func NewMetric(workloadCache cache.WorkloadCache) *MetricController {
 	return &MetricController{
 		workloadCache: workloadCache,
+		connections:   newConnectionTracker(),
+		top:           NewTopTracker(),
+	}
+}
+
+// Top returns the live view of the connections, nil for a nil controller
+func (m *MetricController) Top() *TopTracker {
+	if m == nil {
+		return nil
+	}
+	return m.top
+}
+
+// SetOtlpExporter makes the controller push access logs to the exporter as well,
+// it must be called before Run
+func (m *MetricController) SetOtlpExporter(exporter *OtlpExporter) {
+	m.exporter = exporter
+}
+
+// SetAccesslogger replaces the plain stdout accesslog, it must be called before Run
+func (m *MetricController) SetAccesslogger(accesslogger *Accesslogger) {
+	m.accesslogger = accesslogger
+}
+
+// SetSeriesTracker bounds the metric series, it must be called before Run
+func (m *MetricController) SetSeriesTracker(series *SeriesTracker) {
+	m.series = series
+}
+
+// SetProbeConfig configures the sampling and filtering of the bpf tcp probe, it
+// must be called before RunProbe
+func (m *MetricController) SetProbeConfig(config *options.ProbeConfig) {
+	m.probeConfig = config
+}
+
+// SetFlowExporter exports the closed connections as IPFIX flows, it must be called before Run
+func (m *MetricController) SetFlowExporter(flows *FlowExporter) {
+	m.flows = flows
+}
+
+type connectionKey struct {
+	src       [4]uint32
+	dst       [4]uint32
+	srcPort   uint16
+	dstPort   uint16
+	direction uint32
+}
+
+const (
+	// bpf reports a connection when it is established and when it is closed, the
+	// close of a long connection may come much later or be lost with the ringbuf
+	connectionTrackerTTL  = time.Hour
+	maxTrackedConnections = 1 << 16
+)
+
+// connectionTracker remembers the totals last reported for every open connection,
+// so that counters are increased by the delta and stay monotonic. The entries are
+// evicted after connectionTrackerTTL, or at random beyond maxTrackedConnections.
+// An evicted connection contributes its totals on close, which only counts the
+// bytes of its established report twice.
+type connectionTracker struct {
+	mutex       sync.Mutex
+	connections map[connectionKey]trackedConnection
+	lastSweep   time.Time
+	now         func() time.Time
+}
+
+type trackedConnection struct {
+	data requestMetric
+	seen time.Time
+}
+
+func newConnectionTracker() *connectionTracker {
+	return &connectionTracker{
+		connections: make(map[connectionKey]trackedConnection),
+		now:         time.Now,
+	}
+}
+
+// increment returns data with the cumulative fields replaced by the increase
+// since the last report of the same connection
+func (t *connectionTracker) increment(data requestMetric) requestMetric {
+	key := connectionKey{
+		src:       data.src,
+		dst:       data.dst,
+		srcPort:   data.srcPort,
+		dstPort:   data.dstPort,
+		direction: data.direction,
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.now()
+	t.evict(now)
+	tracked, ok := t.connections[key]
+	if data.state == TCP_CLOSTED {
+		delete(t.connections, key)
+	} else {
+		if !ok && len(t.connections) >= maxTrackedConnections {
+			for evicted := range t.connections {
+				delete(t.connections, evicted)
+				break
+			}
+		}
+		t.connections[key] = trackedConnection{data: data, seen: now}
+	}
+	if !ok {
+		return data
+	}
+
+	last := tracked.data
+	delta := data
+	delta.sentBytes = subOrZero(data.sentBytes, last.sentBytes)
+	delta.receivedBytes = subOrZero(data.receivedBytes, last.receivedBytes)
+	delta.totalRetrans = subOrZero(data.totalRetrans, last.totalRetrans)
+	delta.segsOut = subOrZero(data.segsOut, last.segsOut)
+	delta.segsIn = subOrZero(data.segsIn, last.segsIn)
+	return delta
+}
+
+// evict drops the connections not reported for connectionTrackerTTL, the map is
+// walked at most once per connectionTrackerTTL
+func (t *connectionTracker) evict(now time.Time) {
+	if now.Sub(t.lastSweep) < connectionTrackerTTL {
+		return
+	}
+	t.lastSweep = now
+	for key, tracked := range t.connections {
+		if now.Sub(tracked.seen) >= connectionTrackerTTL {
+			delete(t.connections, key)
+		}
 	}
 }
 
+func subOrZero(cur, last uint32) uint32 {
+	if cur < last {
+		return 0
+	}
+	return cur - last
+}
+
 func (m *MetricController) Run(ctx context.Context, mapOfTcpInfo *ebpf.Map) {
 	if m == nil {
 		return
 	}
 
+	status := health.NewStatus(nil)
+	health.Register("ringbuf/metric", health.Liveness, status.Check)
+	defer status.SetUnhealthy("metric ringbuf reader exited")
+
 	var err error
 	osStartTime, err = getOSBootTime()
 	if err != nil {
@@ -191,10 +373,12 @@ func (m *MetricController) Run(ctx context.Context, mapOfTcpInfo *ebpf.Map) {
 			rec := ringbuf.Record{}
 			if err := reader.ReadInto(&rec); err != nil {
 				log.Errorf("ringbuf reader FAILED to read, err: %v", err)
+				tcpProbeRingbufDropped.WithLabelValues("reader").Inc()
 				continue
 			}
 			if len(rec.RawSample) != MSG_LEN {
 				log.Errorf("wrong length %v of a msg, should be %v", len(rec.RawSample), MSG_LEN)
+				tcpProbeRingbufDropped.WithLabelValues("reader").Inc()
 				continue
 			}
 
@@ -211,32 +395,49 @@ func (m *MetricController) Run(ctx context.Context, mapOfTcpInfo *ebpf.Map) {
 				continue
 			}
 
-			workloadLabels := m.buildWorkloadMetric(&data)
-			serviceLabels, accesslog := m.buildServiceMetric(&data)
-
-			workloadLabels.reporter = "-"
-			serviceLabels.reporter = "-"
-			accesslog.direction = "-"
-			if data.direction == constants.INBOUND {
-				workloadLabels.reporter = "destination"
-				serviceLabels.reporter = "destination"
-				accesslog.direction = "INBOUND"
-			}
-			if data.direction == constants.OUTBOUND {
-				workloadLabels.reporter = "source"
-				serviceLabels.reporter = "source"
-				accesslog.direction = "OUTBOUND"
-			}
+			workloadLabelMap, serviceLabelMap, accesslog := m.buildMetricLabels(&data)
 
+			// bpf reports the totals of a connection, counters only take the increment
+			increment := m.connections.increment(data)
+			m.top.record(data, accesslog)
+			m.recordPodStats(&data, connectionStatsOf(increment))
 			if data.state == TCP_CLOSTED {
-				OutputAccesslog(data, accesslog)
+				m.accesslogger.output(data, accesslog)
+				m.exporter.enqueueAccesslog(data, accesslog)
+				m.flows.enqueueFlow(data, accesslog)
+				buildConnectionHistogramsToPrometheus(data, serviceLabelMap)
 			}
-			buildWorkloadMetricsToPrometheus(data, workloadLabels)
-			buildServiceMetricsToPrometheus(data, serviceLabels)
+			buildWorkloadMetricsToPrometheus(increment, workloadLabelMap)
+			buildServiceMetricsToPrometheus(increment, serviceLabelMap)
 		}
 	}
 }
 
+// buildMetricLabels returns the tracked labels of the workload and service metrics
+// of a connection, and its accesslog info
+func (m *MetricController) buildMetricLabels(data *requestMetric) (map[string]string, map[string]string, logInfo) {
+	workloadLabels := m.buildWorkloadMetric(data)
+	serviceLabels, accesslog := m.buildServiceMetric(data)
+
+	workloadLabels.reporter = "-"
+	serviceLabels.reporter = "-"
+	accesslog.direction = "-"
+	if data.direction == constants.INBOUND {
+		workloadLabels.reporter = "destination"
+		serviceLabels.reporter = "destination"
+		accesslog.direction = "INBOUND"
+	}
+	if data.direction == constants.OUTBOUND {
+		workloadLabels.reporter = "source"
+		serviceLabels.reporter = "source"
+		accesslog.direction = "OUTBOUND"
+	}
+
+	workloadLabelMap := m.series.track(workloadSeries, struct2map(workloadLabels))
+	serviceLabelMap := m.series.track(serviceSeries, struct2map(serviceLabels))
+	return workloadLabelMap, serviceLabelMap, accesslog
+}
+
 func buildV4Metric(buf *bytes.Buffer) (requestMetric, error) {
 	data := requestMetric{}
 	connectData := connectionDataV4{}
@@ -256,6 +457,11 @@ func buildV4Metric(buf *bytes.Buffer) (requestMetric, error) {
 	data.success = connectData.ConnectSuccess
 	data.duration = connectData.Duration
 	data.closeTime = connectData.CloseTime
+	data.srttUs = connectData.SrttUs
+	data.totalRetrans = connectData.TotalRetrans
+	data.segsOut = connectData.SegsOut
+	data.segsIn = connectData.SegsIn
+	data.connFlags = connectData.ConnFlags
 
 	return data, nil
 }
@@ -278,6 +484,11 @@ func buildV6Metric(buf *bytes.Buffer) (requestMetric, error) {
 	data.success = connectData.ConnectSuccess
 	data.duration = connectData.Duration
 	data.closeTime = connectData.CloseTime
+	data.srttUs = connectData.SrttUs
+	data.totalRetrans = connectData.TotalRetrans
+	data.segsOut = connectData.SegsOut
+	data.segsIn = connectData.SegsIn
+	data.connFlags = connectData.ConnFlags
 
 	return data, nil
 }
@@ -295,8 +506,8 @@ func (m *MetricController) buildWorkloadMetric(data *requestMetric) workloadMetr
 	trafficLabels := buildWorkloadMetric(dstWorkload, srcWorkload)
 	trafficLabels.destinationPodAddress = dstIP
 	trafficLabels.requestProtocol = "tcp"
-	trafficLabels.responseFlags = "-"
-	trafficLabels.connectionSecurityPolicy = "mutual_tls"
+	trafficLabels.responseFlags = buildResponseFlags(data)
+	trafficLabels.connectionSecurityPolicy = buildConnectionSecurityPolicy(data)
 
 	return trafficLabels
 }
@@ -313,14 +524,50 @@ func (m *MetricController) buildServiceMetric(data *requestMetric) (serviceMetri
 
 	trafficLabels, accesslog := buildServiceMetric(dstWorkload, srcWorkload, data.dstPort)
 	trafficLabels.requestProtocol = "tcp"
-	trafficLabels.responseFlags = "-"
-	trafficLabels.connectionSecurityPolicy = "mutual_tls"
+	trafficLabels.responseFlags = buildResponseFlags(data)
+	trafficLabels.connectionSecurityPolicy = buildConnectionSecurityPolicy(data)
 	accesslog.destinationAddress = dstIp + ":" + fmt.Sprintf("%d", data.dstPort)
 	accesslog.sourceAddress = srcIp + ":" + fmt.Sprintf("%d", data.srcPort)
+	accesslog.responseFlags = trafficLabels.responseFlags
+	accesslog.connectionSecurityPolicy = trafficLabels.connectionSecurityPolicy
+	accesslog.viaWaypoint = data.connFlags&connFlagWaypoint != 0
 
 	return trafficLabels, accesslog
 }
 
+// recordPodStats adds the connection to the stats of the pod on this node
+func (m *MetricController) recordPodStats(data *requestMetric, delta ConnectionStats) {
+	addr := data.src
+	if data.direction == constants.INBOUND {
+		addr = data.dst
+	}
+	var raw []byte
+	for i := range addr {
+		raw = binary.LittleEndian.AppendUint32(raw, addr[i])
+	}
+	if workload, _ := m.getWorkloadByAddress(restoreIPv4(raw)); workload != nil {
+		podConnections.add(workload.Namespace, workload.Name, data.direction, delta)
+	}
+}
+
+// connectionStatsOf counts a report of the ringbuf the way the workload metrics do
+func connectionStatsOf(data requestMetric) ConnectionStats {
+	stats := ConnectionStats{
+		SentBytes:     float64(data.sentBytes),
+		ReceivedBytes: float64(data.receivedBytes),
+	}
+	if connectionOpened(data) {
+		stats.Opened = 1
+	}
+	if data.state == TCP_CLOSTED {
+		stats.Closed = 1
+	}
+	if data.success != connection_success {
+		stats.Failed = 1
+	}
+	return stats
+}
+
 func (m *MetricController) getWorkloadByAddress(address []byte) (*workloadapi.Workload, string) {
 	networkAddr := cache.NetworkAddress{}
 	networkAddr.Address, _ = netip.AddrFromSlice(address)
@@ -422,6 +669,36 @@ func buildServiceMetric(dstWorkload, srcWorkload *workloadapi.Workload, dstPort
 	return trafficLabels, accesslog
 }
 
+// buildConnectionSecurityPolicy reports mutual_tls for HBONE: the connections on
+// port 15008, and those redirected to a waypoint, which land on the HBONE mTLS
+// port the control plane advertises for it
+func buildConnectionSecurityPolicy(data *requestMetric) string {
+	if data.connFlags&(connFlagMtls|connFlagWaypoint) != 0 {
+		return "mutual_tls"
+	}
+	return "none"
+}
+
+// buildResponseFlags reports the envoy TCP response flags of a connection:
+// UF for a failed connect, UC for a reset and UAEX for a connection shut down
+// by kmesh authorization, which is enforced outside of the workload like an
+// external authorization service
+func buildResponseFlags(data *requestMetric) string {
+	flags := []string{}
+	if data.success != connection_success {
+		flags = append(flags, "UF")
+	} else if data.connFlags&(connFlagReset|connFlagAuthDenied) == connFlagReset {
+		flags = append(flags, "UC")
+	}
+	if data.connFlags&connFlagAuthDenied != 0 {
+		flags = append(flags, "UAEX")
+	}
+	if len(flags) == 0 {
+		return "-"
+	}
+	return strings.Join(flags, ",")
+}
+
 func buildPrincipal(workload *workloadapi.Workload) string {
 	if workload.TrustDomain != "" && workload.ServiceAccount != "" && workload.Namespace != "" {
 		return fmt.Sprintf("spiffe://%s/ns/%s/sa/%s", workload.TrustDomain, workload.Namespace, workload.ServiceAccount)
@@ -429,10 +706,16 @@ func buildPrincipal(workload *workloadapi.Workload) string {
 	return "-"
 }
 
-func buildWorkloadMetricsToPrometheus(data requestMetric, labels workloadMetricLabels) {
-	commonLabels := struct2map(labels)
+// connectionOpened is true for the established report of a connection, and for the
+// close of one never established, so that the closed connections do not outnumber
+// the opened ones
+func connectionOpened(data requestMetric) bool {
+	return data.state == TCP_ESTABLISHED || (data.state == TCP_CLOSTED && data.success != connection_success)
+}
+
+func buildWorkloadMetricsToPrometheus(data requestMetric, commonLabels map[string]string) {
 
-	if data.state == TCP_ESTABLISHED {
+	if connectionOpened(data) {
 		tcpConnectionOpenedInWorkload.With(commonLabels).Add(float64(1))
 	}
 	if data.state == TCP_CLOSTED {
@@ -445,20 +728,65 @@ func buildWorkloadMetricsToPrometheus(data requestMetric, labels workloadMetricL
 	tcpSentBytesInWorkload.With(commonLabels).Add(float64(data.sentBytes))
 }
 
-func buildServiceMetricsToPrometheus(data requestMetric, labels serviceMetricLabels) {
-	commonLabels := struct2map(labels)
+func buildServiceMetricsToPrometheus(data requestMetric, commonLabels map[string]string) {
 
-	if data.state == TCP_ESTABLISHED {
+	if connectionOpened(data) {
 		tcpConnectionOpenedInService.With(commonLabels).Add(float64(1))
+		deprecatedTcpConnectionOpenedInService.With(commonLabels).Add(float64(1))
 	}
 	if data.state == TCP_CLOSTED {
 		tcpConnectionClosedInService.With(commonLabels).Add(float64(1))
+		deprecatedTcpConnectionClosedInService.With(commonLabels).Add(float64(1))
 	}
 	if data.success != uint32(1) {
 		tcpConnectionFailedInService.With(commonLabels).Add(float64(1))
+		deprecatedTcpConnectionFailedInService.With(commonLabels).Add(float64(1))
 	}
 	tcpReceivedBytesInService.With(commonLabels).Add(float64(data.receivedBytes))
 	tcpSentBytesInService.With(commonLabels).Add(float64(data.sentBytes))
+	deprecatedTcpReceivedBytesInService.With(commonLabels).Add(float64(data.receivedBytes))
+	deprecatedTcpSentBytesInService.With(commonLabels).Add(float64(data.sentBytes))
+	tcpRetransmittedSegmentsInService.With(commonLabels).Add(float64(data.totalRetrans))
+	tcpSentSegmentsInService.With(commonLabels).Add(float64(data.segsOut))
+}
+
+// buildAggregatedMetricsToPrometheus adds the connections counted by pair in bpf. They
+// are not observed by the histograms, which need every connection on its own.
+func buildAggregatedMetricsToPrometheus(delta tcpProbePairStats, success bool, workloadLabels, serviceLabels map[string]string) {
+	failed := uint64(0)
+	if !success {
+		failed = delta.Closed
+	}
+
+	tcpConnectionOpenedInWorkload.With(workloadLabels).Add(float64(delta.Opened))
+	tcpConnectionClosedInWorkload.With(workloadLabels).Add(float64(delta.Closed))
+	tcpConnectionFailedInWorkload.With(workloadLabels).Add(float64(failed))
+	tcpReceivedBytesInWorkload.With(workloadLabels).Add(float64(delta.ReceivedBytes))
+	tcpSentBytesInWorkload.With(workloadLabels).Add(float64(delta.SentBytes))
+
+	tcpConnectionOpenedInService.With(serviceLabels).Add(float64(delta.Opened))
+	tcpConnectionClosedInService.With(serviceLabels).Add(float64(delta.Closed))
+	tcpConnectionFailedInService.With(serviceLabels).Add(float64(failed))
+	tcpReceivedBytesInService.With(serviceLabels).Add(float64(delta.ReceivedBytes))
+	tcpSentBytesInService.With(serviceLabels).Add(float64(delta.SentBytes))
+	deprecatedTcpConnectionOpenedInService.With(serviceLabels).Add(float64(delta.Opened))
+	deprecatedTcpConnectionClosedInService.With(serviceLabels).Add(float64(delta.Closed))
+	deprecatedTcpReceivedBytesInService.With(serviceLabels).Add(float64(delta.ReceivedBytes))
+	deprecatedTcpSentBytesInService.With(serviceLabels).Add(float64(delta.SentBytes))
+	deprecatedTcpConnectionFailedInService.With(serviceLabels).Add(float64(failed))
+	tcpRetransmittedSegmentsInService.With(serviceLabels).Add(float64(delta.TotalRetrans))
+	tcpSentSegmentsInService.With(serviceLabels).Add(float64(delta.SegsOut))
+}
+
+// buildConnectionHistogramsToPrometheus observes the distributions of a closed connection
+func buildConnectionHistogramsToPrometheus(data requestMetric, commonLabels map[string]string) {
+
+	tcpConnectionDurationInService.With(commonLabels).Observe(float64(data.duration) / float64(time.Second))
+	tcpConnectionSentBytesInService.With(commonLabels).Observe(float64(data.sentBytes))
+	tcpConnectionReceivedBytesInService.With(commonLabels).Observe(float64(data.receivedBytes))
+	if data.srttUs != 0 {
+		tcpSmoothedRttInService.With(commonLabels).Observe(float64(data.srttUs>>3) / float64(time.Second/time.Microsecond))
+	}
 }
 
 func struct2map(labels interface{}) map[string]string {
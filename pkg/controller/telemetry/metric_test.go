@@ -17,15 +17,19 @@
 package telemetry
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 
 	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/controller/workload/cache"
 )
 
@@ -172,7 +176,7 @@ func TestCommonTrafficLabels2map(t *testing.T) {
 }
 
 func TestBuildMetricsToPrometheus(t *testing.T) {
-	metrics := []*prometheus.GaugeVec{
+	metrics := []*prometheus.CounterVec{
 		tcpConnectionClosedInWorkload,
 		tcpConnectionOpenedInWorkload,
 		tcpReceivedBytesInWorkload,
@@ -236,15 +240,15 @@ func TestBuildMetricsToPrometheus(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			ctx, cancel := context.WithCancel(context.Background())
 			go RunPrometheusClient(ctx)
-			buildWorkloadMetricsToPrometheus(tt.args.data, tt.args.labels)
+			buildWorkloadMetricsToPrometheus(tt.args.data, struct2map(tt.args.labels))
 			commonLabels := struct2map(tt.args.labels)
 			for index, metric := range metrics {
-				if gauge, err := metric.GetMetricWith(commonLabels); err != nil {
+				if counter, err := metric.GetMetricWith(commonLabels); err != nil {
 					t.Errorf("use labels to get %v failed", metric)
 				} else {
 					var m dto.Metric
-					gauge.Write(&m)
-					value := m.Gauge.Value
+					counter.Write(&m)
+					value := m.Counter.Value
 					assert.Equal(t, tt.want[index], *value)
 				}
 			}
@@ -253,6 +257,13 @@ func TestBuildMetricsToPrometheus(t *testing.T) {
 	}
 }
 
+func TestConnectionOpened(t *testing.T) {
+	assert.True(t, connectionOpened(requestMetric{state: TCP_ESTABLISHED, success: connection_success}))
+	assert.False(t, connectionOpened(requestMetric{state: TCP_CLOSTED, success: connection_success}))
+	// a failed connect is only reported on close, it is counted as opened too
+	assert.True(t, connectionOpened(requestMetric{state: TCP_CLOSTED}))
+}
+
 func TestBuildWorkloadMetric(t *testing.T) {
 	type args struct {
 		dstWorkload *workloadapi.Workload
@@ -407,6 +418,8 @@ func TestBuildworkloadMetric(t *testing.T) {
 					dst:           [4]uint32{383822016, 0, 0, 0},
 					sentBytes:     uint32(156),
 					receivedBytes: uint32(1024),
+					success:       connection_success,
+					connFlags:     connFlagMtls,
 				},
 			},
 			want: workloadMetricLabels{
@@ -542,6 +555,8 @@ func TestBuildServiceMetric(t *testing.T) {
 					direction:     uint32(2),
 					sentBytes:     uint32(156),
 					receivedBytes: uint32(1024),
+					success:       connection_success,
+					connFlags:     connFlagMtls,
 				},
 			},
 			want: serviceMetricLabels{
@@ -706,3 +721,184 @@ func Test_buildServiceMetric(t *testing.T) {
 		})
 	}
 }
+
+func TestConnectionTrackerIncrement(t *testing.T) {
+	tracker := newConnectionTracker()
+	established := requestMetric{
+		src:          [4]uint32{183763210, 0, 0, 0},
+		dst:          [4]uint32{183762951, 0, 0, 0},
+		srcPort:      50000,
+		dstPort:      8080,
+		direction:    constants.OUTBOUND,
+		state:        TCP_ESTABLISHED,
+		sentBytes:    10,
+		totalRetrans: 1,
+	}
+	closed := established
+	closed.state = TCP_CLOSTED
+	closed.sentBytes = 110
+	closed.receivedBytes = 30
+	closed.totalRetrans = 3
+	closed.segsOut = 7
+
+	got := tracker.increment(established)
+	assert.Equal(t, uint32(10), got.sentBytes)
+	assert.Equal(t, uint32(1), got.totalRetrans)
+
+	got = tracker.increment(closed)
+	assert.Equal(t, uint32(100), got.sentBytes)
+	assert.Equal(t, uint32(30), got.receivedBytes)
+	assert.Equal(t, uint32(2), got.totalRetrans)
+	assert.Equal(t, uint32(7), got.segsOut)
+	assert.Empty(t, tracker.connections)
+
+	// a connection closed without an established report, e.g. after a restart,
+	// contributes its totals
+	got = tracker.increment(closed)
+	assert.Equal(t, uint32(110), got.sentBytes)
+}
+
+func TestConnectionTrackerEvict(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 8, 14, 10, 0, 0, 0, time.UTC)}
+	tracker := newConnectionTracker()
+	tracker.now = clock.Now
+
+	established := requestMetric{srcPort: 50000, dstPort: 8080, state: TCP_ESTABLISHED, sentBytes: 10}
+	tracker.increment(established)
+	other := established
+	other.srcPort = 50001
+	clock.now = clock.now.Add(connectionTrackerTTL / 2)
+	tracker.increment(other)
+
+	// the connection whose close was lost is evicted after the ttl
+	clock.now = clock.now.Add(connectionTrackerTTL / 2)
+	third := established
+	third.srcPort = 50002
+	tracker.increment(third)
+	assert.Len(t, tracker.connections, 2)
+
+	// a connection evicted while open contributes its totals on close
+	closed := established
+	closed.state = TCP_CLOSTED
+	closed.sentBytes = 110
+	got := tracker.increment(closed)
+	assert.Equal(t, uint32(110), got.sentBytes)
+
+	// the tracker is bounded
+	for i := 0; i < maxTrackedConnections+10; i++ {
+		data := established
+		data.src = [4]uint32{uint32(i)}
+		tracker.increment(data)
+	}
+	assert.Len(t, tracker.connections, maxTrackedConnections)
+}
+
+func TestBuildConnectionHistogramsToPrometheus(t *testing.T) {
+	labels := serviceMetricLabels{
+		reporter:           "source",
+		destinationService: "histogram-test",
+	}
+	data := requestMetric{
+		state:         TCP_CLOSTED,
+		duration:      uint64(2 * time.Second),
+		sentBytes:     1000,
+		receivedBytes: 2000,
+		srttUs:        800 << 3,
+	}
+	buildConnectionHistogramsToPrometheus(data, struct2map(labels))
+
+	commonLabels := struct2map(labels)
+	want := map[*prometheus.HistogramVec]float64{
+		tcpConnectionDurationInService:      2,
+		tcpConnectionSentBytesInService:     1000,
+		tcpConnectionReceivedBytesInService: 2000,
+		tcpSmoothedRttInService:             0.0008,
+	}
+	for histogram, sum := range want {
+		observer, err := histogram.GetMetricWith(commonLabels)
+		assert.NoError(t, err)
+		var m dto.Metric
+		assert.NoError(t, observer.(prometheus.Histogram).Write(&m))
+		assert.Equal(t, uint64(1), m.Histogram.GetSampleCount())
+		assert.InDelta(t, sum, m.Histogram.GetSampleSum(), 1e-9)
+	}
+}
+
+func TestBuildV4MetricTcpInfo(t *testing.T) {
+	connectData := connectionDataV4{
+		SrcAddr:      183763210,
+		DstAddr:      183762951,
+		SrcPort:      50000,
+		DstPort:      8080,
+		SentBytes:    100,
+		State:        TCP_CLOSTED,
+		SrttUs:       1600,
+		TotalRetrans: 4,
+		SegsOut:      20,
+		ConnFlags:    connFlagWaypoint | connFlagReset,
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, binary.Write(&buf, binary.LittleEndian, &connectData))
+	// struct tcp_probe_info without its type
+	assert.Equal(t, MSG_LEN-4, buf.Len())
+
+	data, err := buildV4Metric(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1600), data.srttUs)
+	assert.Equal(t, uint32(4), data.totalRetrans)
+	assert.Equal(t, uint32(20), data.segsOut)
+	assert.Equal(t, uint32(100), data.sentBytes)
+	assert.Equal(t, connFlagWaypoint|connFlagReset, data.connFlags)
+}
+
+func TestBuildResponseFlags(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       requestMetric
+		wantFlags  string
+		wantPolicy string
+	}{
+		{
+			name:       "graceful close",
+			data:       requestMetric{success: connection_success},
+			wantFlags:  "-",
+			wantPolicy: "none",
+		},
+		{
+			name:       "hbone",
+			data:       requestMetric{success: connection_success, connFlags: connFlagMtls | connFlagWaypoint},
+			wantFlags:  "-",
+			wantPolicy: "mutual_tls",
+		},
+		{
+			name:       "redirected to a waypoint",
+			data:       requestMetric{success: connection_success, connFlags: connFlagWaypoint},
+			wantFlags:  "-",
+			wantPolicy: "mutual_tls",
+		},
+		{
+			name:       "connect failed",
+			data:       requestMetric{connFlags: connFlagReset},
+			wantFlags:  "UF",
+			wantPolicy: "none",
+		},
+		{
+			name:       "reset",
+			data:       requestMetric{success: connection_success, connFlags: connFlagReset},
+			wantFlags:  "UC",
+			wantPolicy: "none",
+		},
+		{
+			name:       "denied by authorization",
+			data:       requestMetric{success: connection_success, connFlags: connFlagReset | connFlagAuthDenied},
+			wantFlags:  "UAEX",
+			wantPolicy: "none",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantFlags, buildResponseFlags(&tt.data))
+			assert.Equal(t, tt.wantPolicy, buildConnectionSecurityPolicy(&tt.data))
+		})
+	}
+}
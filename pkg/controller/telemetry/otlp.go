@@ -0,0 +1,604 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"kmesh.net/kmesh/daemon/options"
+)
+
+const (
+	otlpScopeName      = "kmesh.net/kmesh/telemetry"
+	otlpServiceName    = "kmesh-daemon"
+	otlpMetricsPath    = "/v1/metrics"
+	otlpLogsPath       = "/v1/logs"
+	otlpInitialBackoff = 500 * time.Millisecond
+	otlpMaxBackoff     = 30 * time.Second
+	// otlpPendingExports bounds the exports waiting behind one that is being retried
+	otlpPendingExports = 4
+)
+
+// OtlpExporter periodically pushes the prometheus metrics and the access logs
+// of closed connections to an OpenTelemetry collector.
+type OtlpExporter struct {
+	config    *options.OtlpConfig
+	client    otlpClient
+	gatherer  prometheus.Gatherer
+	resource  *resourcepb.Resource
+	startTime time.Time
+
+	// logQueue is bounded, records are dropped rather than blocking the ringbuf reader
+	logQueue chan *logspb.LogRecord
+	// exports are sent and retried by their own goroutine so that a slow collector
+	// neither stalls the batching nor the ticker
+	exports        chan otlpExport
+	droppedLogs    atomic.Uint64
+	reportedDrops  uint64
+	initialBackoff time.Duration
+}
+
+// otlpExport is either a batch of access logs or a snapshot of the metrics
+type otlpExport struct {
+	logs    []*logspb.LogRecord
+	metrics bool
+}
+
+type otlpClient interface {
+	exportMetrics(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error
+	exportLogs(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error
+	close() error
+}
+
+// retryableError marks a failure the collector asks us to retry, e.g. it is overloaded
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+func NewOtlpExporter(config *options.OtlpConfig) (*OtlpExporter, error) {
+	var (
+		client otlpClient
+		err    error
+	)
+
+	switch config.Protocol {
+	case options.OtlpProtocolGrpc:
+		client, err = newGrpcOtlpClient(config)
+	case options.OtlpProtocolHttp:
+		client, err = newHttpOtlpClient(config)
+	default:
+		err = fmt.Errorf("unsupported otlp protocol %q", config.Protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	registry := prometheus.NewRegistry()
+	registerMetrics(registry)
+
+	return &OtlpExporter{
+		config:         config,
+		client:         client,
+		gatherer:       registry,
+		resource:       buildOtlpResource(config.ResourceAttributes),
+		startTime:      time.Now(),
+		logQueue:       make(chan *logspb.LogRecord, config.QueueSize),
+		exports:        make(chan otlpExport, otlpPendingExports),
+		initialBackoff: otlpInitialBackoff,
+	}, nil
+}
+
+// buildOtlpResource describes this daemon, user supplied attributes take precedence
+func buildOtlpResource(extra map[string]string) *resourcepb.Resource {
+	attrs := map[string]string{
+		"service.name": otlpServiceName,
+	}
+	if nodeName := os.Getenv("NODE_NAME"); nodeName != "" {
+		attrs["k8s.node.name"] = nodeName
+	}
+	for k, v := range extra {
+		attrs[k] = v
+	}
+	return &resourcepb.Resource{Attributes: stringAttributes(attrs)}
+}
+
+func (e *OtlpExporter) Run(ctx context.Context) {
+	if e == nil {
+		return
+	}
+
+	ticker := time.NewTicker(e.config.ExportInterval)
+	defer ticker.Stop()
+
+	sent := make(chan struct{})
+	go func() {
+		e.send(ctx)
+		close(sent)
+	}()
+
+	batch := make([]*logspb.LogRecord, 0, e.config.BatchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			<-sent
+			e.shutdown(batch)
+			return
+		case record := <-e.logQueue:
+			batch = append(batch, record)
+			if len(batch) >= e.config.BatchSize {
+				e.submit(otlpExport{logs: batch})
+				batch = make([]*logspb.LogRecord, 0, e.config.BatchSize)
+			}
+		case <-ticker.C:
+			if e.config.ExportMetrics {
+				e.submit(otlpExport{metrics: true})
+			}
+			if len(batch) > 0 {
+				e.submit(otlpExport{logs: batch})
+				batch = make([]*logspb.LogRecord, 0, e.config.BatchSize)
+			}
+		}
+	}
+}
+
+// submit never blocks, while the collector is retried the pending exports are bounded:
+// log batches beyond the bound are dropped and a metrics snapshot is skipped, the next
+// one carries the same cumulative values
+func (e *OtlpExporter) submit(export otlpExport) {
+	select {
+	case e.exports <- export:
+	default:
+		if export.metrics {
+			log.Debugf("otlp collector is falling behind, skip a metrics export")
+			return
+		}
+		e.droppedLogs.Add(uint64(len(export.logs)))
+	}
+}
+
+// send pushes the submitted exports one at a time until ctx is done
+func (e *OtlpExporter) send(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case export := <-e.exports:
+			e.export(ctx, export)
+		}
+	}
+}
+
+func (e *OtlpExporter) export(ctx context.Context, export otlpExport) {
+	if export.metrics {
+		if err := e.exportMetrics(ctx); err != nil {
+			log.Errorf("export metrics to otlp collector failed: %v", err)
+		}
+		return
+	}
+	e.flushLogs(ctx, export.logs)
+}
+
+// shutdown drains the queues and pushes what is left once more before closing the connection,
+// it runs after send returned
+func (e *OtlpExporter) shutdown(batch []*logspb.LogRecord) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.config.Timeout)
+	defer cancel()
+
+	var pending []*logspb.LogRecord
+drain:
+	for {
+		select {
+		case export := <-e.exports:
+			pending = append(pending, export.logs...)
+		case record := <-e.logQueue:
+			batch = append(batch, record)
+		default:
+			break drain
+		}
+	}
+	// the submitted batches are older than the one being filled
+	batch = append(pending, batch...)
+	for len(batch) > 0 {
+		n := min(len(batch), e.config.BatchSize)
+		e.flushLogs(ctx, batch[:n])
+		batch = batch[n:]
+	}
+	if e.config.ExportMetrics {
+		if err := e.exportMetrics(ctx); err != nil {
+			log.Errorf("export metrics to otlp collector failed: %v", err)
+		}
+	}
+	if err := e.client.close(); err != nil {
+		log.Errorf("close otlp client failed: %v", err)
+	}
+}
+
+func (e *OtlpExporter) flushLogs(ctx context.Context, batch []*logspb.LogRecord) {
+	if err := e.exportLogs(ctx, batch); err != nil {
+		log.Errorf("export %d access logs to otlp collector failed: %v", len(batch), err)
+	}
+	if dropped := e.droppedLogs.Load(); dropped != e.reportedDrops {
+		log.Warnf("otlp access log queue is full or the collector is falling behind, %d records dropped so far", dropped)
+		e.reportedDrops = dropped
+	}
+}
+
+// enqueueAccesslog never blocks, the record is dropped if the queue is full
+func (e *OtlpExporter) enqueueAccesslog(data requestMetric, accesslog logInfo) {
+	if e == nil || !e.config.ExportAccesslog {
+		return
+	}
+
+	select {
+	case e.logQueue <- buildOtlpLogRecord(data, accesslog):
+	default:
+		e.droppedLogs.Add(1)
+	}
+}
+
+func buildOtlpLogRecord(data requestMetric, accesslog logInfo) *logspb.LogRecord {
+	return &logspb.LogRecord{
+		TimeUnixNano:         uint64(calculateUptime(osStartTime, data.closeTime).UnixNano()),
+		ObservedTimeUnixNano: uint64(time.Now().UnixNano()),
+		SeverityNumber:       logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+		SeverityText:         "INFO",
+		Body: &commonpb.AnyValue{
+			Value: &commonpb.AnyValue_StringValue{StringValue: buildAccesslog(data, accesslog)},
+		},
+		Attributes: []*commonpb.KeyValue{
+			stringAttribute("source.address", accesslog.sourceAddress),
+			stringAttribute("source.workload", accesslog.sourceWorkload),
+			stringAttribute("source.namespace", accesslog.sourceNamespace),
+			stringAttribute("destination.address", accesslog.destinationAddress),
+			stringAttribute("destination.service", accesslog.destinationService),
+			stringAttribute("destination.workload", accesslog.destinationWorkload),
+			stringAttribute("destination.namespace", accesslog.destinationNamespace),
+			stringAttribute("direction", accesslog.direction),
+			stringAttribute("response_flags", accesslog.responseFlags),
+			stringAttribute("connection_security_policy", accesslog.connectionSecurityPolicy),
+			intAttribute("sent_bytes", int64(data.sentBytes)),
+			intAttribute("received_bytes", int64(data.receivedBytes)),
+			intAttribute("duration_ns", int64(data.duration)),
+		},
+	}
+}
+
+func (e *OtlpExporter) exportLogs(ctx context.Context, batch []*logspb.LogRecord) error {
+	req := &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: e.resource,
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope:      &commonpb.InstrumentationScope{Name: otlpScopeName},
+				LogRecords: batch,
+			}},
+		}},
+	}
+	return e.withRetry(ctx, func(ctx context.Context) error {
+		return e.client.exportLogs(ctx, req)
+	})
+}
+
+func (e *OtlpExporter) exportMetrics(ctx context.Context) error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gather metrics failed: %v", err)
+	}
+
+	start := uint64(e.startTime.UnixNano())
+	now := uint64(time.Now().UnixNano())
+	metrics := make([]*metricspb.Metric, 0, len(families))
+	for _, family := range families {
+		if metric := convertMetricFamily(family, start, now); metric != nil {
+			metrics = append(metrics, metric)
+		}
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	req := &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: e.resource,
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: otlpScopeName},
+				Metrics: metrics,
+			}},
+		}},
+	}
+	return e.withRetry(ctx, func(ctx context.Context) error {
+		return e.client.exportMetrics(ctx, req)
+	})
+}
+
+// withRetry retries retryable failures with exponential backoff, every attempt has its own timeout
+func (e *OtlpExporter) withRetry(ctx context.Context, export func(ctx context.Context) error) error {
+	backoff := e.initialBackoff
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, e.config.Timeout)
+		err := export(attemptCtx)
+		cancel()
+
+		var retryable *retryableError
+		if err == nil || !errors.As(err, &retryable) || attempt >= e.config.MaxRetries {
+			return err
+		}
+
+		log.Debugf("otlp export failed, retry in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, otlpMaxBackoff)
+	}
+}
+
+// convertMetricFamily maps prometheus counters to cumulative monotonic sums,
+// gauges to gauges and histograms to explicit bucket histograms
+func convertMetricFamily(family *dto.MetricFamily, start, now uint64) *metricspb.Metric {
+	metric := &metricspb.Metric{
+		Name:        family.GetName(),
+		Description: family.GetHelp(),
+	}
+
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		points := make([]*metricspb.NumberDataPoint, 0, len(family.GetMetric()))
+		for _, m := range family.GetMetric() {
+			points = append(points, &metricspb.NumberDataPoint{
+				Attributes:        labelAttributes(m.GetLabel()),
+				StartTimeUnixNano: start,
+				TimeUnixNano:      now,
+				Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: m.GetCounter().GetValue()},
+			})
+		}
+		metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			DataPoints:             points,
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			IsMonotonic:            true,
+		}}
+	case dto.MetricType_GAUGE:
+		points := make([]*metricspb.NumberDataPoint, 0, len(family.GetMetric()))
+		for _, m := range family.GetMetric() {
+			points = append(points, &metricspb.NumberDataPoint{
+				Attributes:   labelAttributes(m.GetLabel()),
+				TimeUnixNano: now,
+				Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: m.GetGauge().GetValue()},
+			})
+		}
+		metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: points}}
+	case dto.MetricType_HISTOGRAM:
+		points := make([]*metricspb.HistogramDataPoint, 0, len(family.GetMetric()))
+		for _, m := range family.GetMetric() {
+			points = append(points, convertHistogram(m, start, now))
+		}
+		metric.Data = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+			DataPoints:             points,
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		}}
+	default:
+		return nil
+	}
+	return metric
+}
+
+// convertHistogram turns the cumulative prometheus buckets into per bucket counts,
+// the last OTLP bucket is the implicit +Inf one
+func convertHistogram(m *dto.Metric, start, now uint64) *metricspb.HistogramDataPoint {
+	h := m.GetHistogram()
+	bounds := make([]float64, 0, len(h.GetBucket()))
+	counts := make([]uint64, 0, len(h.GetBucket())+1)
+	var last uint64
+	for _, bucket := range h.GetBucket() {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			break
+		}
+		bounds = append(bounds, bucket.GetUpperBound())
+		counts = append(counts, bucket.GetCumulativeCount()-last)
+		last = bucket.GetCumulativeCount()
+	}
+	counts = append(counts, h.GetSampleCount()-last)
+
+	sum := h.GetSampleSum()
+	return &metricspb.HistogramDataPoint{
+		Attributes:        labelAttributes(m.GetLabel()),
+		StartTimeUnixNano: start,
+		TimeUnixNano:      now,
+		Count:             h.GetSampleCount(),
+		Sum:               &sum,
+		BucketCounts:      counts,
+		ExplicitBounds:    bounds,
+	}
+}
+
+func labelAttributes(labels []*dto.LabelPair) []*commonpb.KeyValue {
+	attrs := make([]*commonpb.KeyValue, 0, len(labels))
+	for _, label := range labels {
+		attrs = append(attrs, stringAttribute(label.GetName(), label.GetValue()))
+	}
+	return attrs
+}
+
+func stringAttributes(attrs map[string]string) []*commonpb.KeyValue {
+	kvs := make([]*commonpb.KeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		kvs = append(kvs, stringAttribute(k, v))
+	}
+	return kvs
+}
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+func intAttribute(key string, value int64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: value}},
+	}
+}
+
+type grpcOtlpClient struct {
+	conn    *grpc.ClientConn
+	metrics colmetricspb.MetricsServiceClient
+	logs    collogspb.LogsServiceClient
+}
+
+func newGrpcOtlpClient(config *options.OtlpConfig) (*grpcOtlpClient, error) {
+	creds := insecure.NewCredentials()
+	if !config.Insecure {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+
+	conn, err := grpc.NewClient(config.Endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("create otlp grpc client failed: %v", err)
+	}
+	return &grpcOtlpClient{
+		conn:    conn,
+		metrics: colmetricspb.NewMetricsServiceClient(conn),
+		logs:    collogspb.NewLogsServiceClient(conn),
+	}, nil
+}
+
+func (c *grpcOtlpClient) exportMetrics(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	_, err := c.metrics.Export(ctx, req)
+	return grpcOtlpError(err)
+}
+
+func (c *grpcOtlpClient) exportLogs(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error {
+	_, err := c.logs.Export(ctx, req)
+	return grpcOtlpError(err)
+}
+
+func (c *grpcOtlpClient) close() error {
+	return c.conn.Close()
+}
+
+// grpcOtlpError marks the codes the OTLP specification considers retryable
+func grpcOtlpError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch status.Code(err) {
+	case codes.Canceled, codes.DeadlineExceeded, codes.Aborted, codes.OutOfRange,
+		codes.Unavailable, codes.DataLoss, codes.ResourceExhausted:
+		return &retryableError{err: err}
+	default:
+		return err
+	}
+}
+
+type httpOtlpClient struct {
+	client   *http.Client
+	endpoint string
+}
+
+func newHttpOtlpClient(config *options.OtlpConfig) (*httpOtlpClient, error) {
+	endpoint := strings.TrimSuffix(config.Endpoint, "/")
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		if config.Insecure {
+			endpoint = "http://" + endpoint
+		} else {
+			endpoint = "https://" + endpoint
+		}
+	}
+	return &httpOtlpClient{
+		client:   &http.Client{},
+		endpoint: endpoint,
+	}, nil
+}
+
+func (c *httpOtlpClient) exportMetrics(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	return c.post(ctx, otlpMetricsPath, req)
+}
+
+func (c *httpOtlpClient) exportLogs(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error {
+	return c.post(ctx, otlpLogsPath, req)
+}
+
+func (c *httpOtlpClient) post(ctx context.Context, path string, msg proto.Message) error {
+	body, err := proto.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal otlp request failed: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return &retryableError{err: err}
+	}
+	defer rsp.Body.Close()
+	_, _ = io.Copy(io.Discard, rsp.Body)
+
+	switch {
+	case rsp.StatusCode >= 200 && rsp.StatusCode < 300:
+		return nil
+	case rsp.StatusCode == http.StatusTooManyRequests, rsp.StatusCode == http.StatusBadGateway,
+		rsp.StatusCode == http.StatusServiceUnavailable, rsp.StatusCode == http.StatusGatewayTimeout:
+		return &retryableError{err: fmt.Errorf("otlp collector returned %s", rsp.Status)}
+	default:
+		return fmt.Errorf("otlp collector returned %s", rsp.Status)
+	}
+}
+
+func (c *httpOtlpClient) close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,343 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"kmesh.net/kmesh/daemon/options"
+)
+
+// fakeCollector is an in-process stand-in of an OTLP collector, it fails the
+// first `failures` requests with a retryable error
+type fakeCollector struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+
+	mutex    sync.Mutex
+	failures int
+	calls    int
+	metrics  []*colmetricspb.ExportMetricsServiceRequest
+	logs     []*collogspb.ExportLogsServiceRequest
+}
+
+func (c *fakeCollector) fail() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.calls++
+	if c.failures > 0 {
+		c.failures--
+		return true
+	}
+	return false
+}
+
+func (c *fakeCollector) Export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	if c.fail() {
+		return nil, status.Error(codes.Unavailable, "collector busy")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.metrics = append(c.metrics, req)
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+type fakeLogsService struct {
+	collogspb.UnimplementedLogsServiceServer
+	collector *fakeCollector
+}
+
+func (s *fakeLogsService) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	if s.collector.fail() {
+		return nil, status.Error(codes.Unavailable, "collector busy")
+	}
+	s.collector.mutex.Lock()
+	defer s.collector.mutex.Unlock()
+	s.collector.logs = append(s.collector.logs, req)
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+func (c *fakeCollector) logRecords() []*logspb.LogRecord {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	records := []*logspb.LogRecord{}
+	for _, req := range c.logs {
+		for _, rl := range req.GetResourceLogs() {
+			for _, sl := range rl.GetScopeLogs() {
+				records = append(records, sl.GetLogRecords()...)
+			}
+		}
+	}
+	return records
+}
+
+func (c *fakeCollector) serveGrpc(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(server, c)
+	collogspb.RegisterLogsServiceServer(server, &fakeLogsService{collector: c})
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+	return lis.Addr().String()
+}
+
+func (c *fakeCollector) serveHttp(t *testing.T) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		if c.fail() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		switch r.URL.Path {
+		case otlpMetricsPath:
+			req := &colmetricspb.ExportMetricsServiceRequest{}
+			require.NoError(t, proto.Unmarshal(body, req))
+			c.metrics = append(c.metrics, req)
+		case otlpLogsPath:
+			req := &collogspb.ExportLogsServiceRequest{}
+			require.NoError(t, proto.Unmarshal(body, req))
+			c.logs = append(c.logs, req)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func newTestOtlpConfig(endpoint, protocol string) *options.OtlpConfig {
+	return &options.OtlpConfig{
+		Endpoint:           endpoint,
+		Protocol:           protocol,
+		Insecure:           true,
+		ExportMetrics:      true,
+		ExportAccesslog:    true,
+		ExportInterval:     20 * time.Millisecond,
+		Timeout:            time.Second,
+		QueueSize:          16,
+		BatchSize:          2,
+		MaxRetries:         3,
+		ResourceAttributes: map[string]string{"k8s.cluster.name": "test", "service.name": "kmesh-test"},
+	}
+}
+
+func newTestOtlpExporter(t *testing.T, config *options.OtlpConfig) (*OtlpExporter, *prometheus.CounterVec, *prometheus.HistogramVec) {
+	exporter, err := NewOtlpExporter(config)
+	require.NoError(t, err)
+	exporter.initialBackoff = time.Millisecond
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_opened_total", Help: "opened"}, []string{"app"})
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_duration_seconds", Help: "duration", Buckets: []float64{1, 2}}, []string{"app"})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(counter, histogram)
+	exporter.gatherer = registry
+	return exporter, counter, histogram
+}
+
+func attributeMap(kvs []*commonpb.KeyValue) map[string]interface{} {
+	attrs := map[string]interface{}{}
+	for _, kv := range kvs {
+		switch v := kv.GetValue().GetValue().(type) {
+		case *commonpb.AnyValue_StringValue:
+			attrs[kv.GetKey()] = v.StringValue
+		case *commonpb.AnyValue_IntValue:
+			attrs[kv.GetKey()] = v.IntValue
+		}
+	}
+	return attrs
+}
+
+func TestOtlpExporterMetrics(t *testing.T) {
+	for _, protocol := range []string{options.OtlpProtocolGrpc, options.OtlpProtocolHttp} {
+		t.Run(protocol, func(t *testing.T) {
+			collector := &fakeCollector{failures: 2}
+			var endpoint string
+			if protocol == options.OtlpProtocolGrpc {
+				endpoint = collector.serveGrpc(t)
+			} else {
+				endpoint = collector.serveHttp(t)
+			}
+			exporter, counter, histogram := newTestOtlpExporter(t, newTestOtlpConfig(endpoint, protocol))
+
+			counter.With(prometheus.Labels{"app": "sleep"}).Add(3)
+			histogram.With(prometheus.Labels{"app": "sleep"}).Observe(0.5)
+			histogram.With(prometheus.Labels{"app": "sleep"}).Observe(1.5)
+			histogram.With(prometheus.Labels{"app": "sleep"}).Observe(10)
+
+			require.NoError(t, exporter.exportMetrics(context.Background()))
+			assert.Equal(t, 3, collector.calls)
+			require.Len(t, collector.metrics, 1)
+
+			rm := collector.metrics[0].GetResourceMetrics()[0]
+			resource := attributeMap(rm.GetResource().GetAttributes())
+			assert.Equal(t, "kmesh-test", resource["service.name"])
+			assert.Equal(t, "test", resource["k8s.cluster.name"])
+
+			metrics := map[string]*metricspb.Metric{}
+			for _, m := range rm.GetScopeMetrics()[0].GetMetrics() {
+				metrics[m.GetName()] = m
+			}
+
+			sum := metrics["test_opened_total"].GetSum()
+			require.NotNil(t, sum)
+			assert.True(t, sum.GetIsMonotonic())
+			assert.Equal(t, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, sum.GetAggregationTemporality())
+			assert.Equal(t, 3.0, sum.GetDataPoints()[0].GetAsDouble())
+			assert.Equal(t, "sleep", attributeMap(sum.GetDataPoints()[0].GetAttributes())["app"])
+
+			point := metrics["test_duration_seconds"].GetHistogram().GetDataPoints()[0]
+			assert.Equal(t, uint64(3), point.GetCount())
+			assert.Equal(t, 12.0, point.GetSum())
+			assert.Equal(t, []float64{1, 2}, point.GetExplicitBounds())
+			assert.Equal(t, []uint64{1, 1, 1}, point.GetBucketCounts())
+		})
+	}
+}
+
+func TestOtlpExporterRetryLimit(t *testing.T) {
+	collector := &fakeCollector{failures: 10}
+	config := newTestOtlpConfig(collector.serveHttp(t), options.OtlpProtocolHttp)
+	exporter, counter, _ := newTestOtlpExporter(t, config)
+	counter.With(prometheus.Labels{"app": "sleep"}).Inc()
+
+	assert.Error(t, exporter.exportMetrics(context.Background()))
+	assert.Equal(t, config.MaxRetries+1, collector.calls)
+	assert.Empty(t, collector.metrics)
+}
+
+func TestOtlpExporterAccesslog(t *testing.T) {
+	collector := &fakeCollector{failures: 1}
+	config := newTestOtlpConfig(collector.serveGrpc(t), options.OtlpProtocolGrpc)
+	config.ExportMetrics = false
+	exporter, _, _ := newTestOtlpExporter(t, config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		exporter.Run(ctx)
+		close(done)
+	}()
+
+	info := logInfo{
+		direction:            "OUTBOUND",
+		sourceAddress:        "10.244.0.10:47667",
+		sourceWorkload:       "sleep",
+		sourceNamespace:      "default",
+		destinationAddress:   "10.244.0.7:8080",
+		destinationService:   "httpbin.default.svc.cluster.local",
+		destinationWorkload:  "httpbin",
+		destinationNamespace: "default",
+	}
+	for i := 0; i < 3; i++ {
+		exporter.enqueueAccesslog(requestMetric{sentBytes: uint32(i), receivedBytes: 10, duration: 2000000}, info)
+	}
+
+	// the first batch is full and sent at once, the rest is flushed by the ticker
+	assert.Eventually(t, func() bool {
+		return len(collector.logRecords()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	record := collector.logRecords()[2]
+	assert.Equal(t, logspb.SeverityNumber_SEVERITY_NUMBER_INFO, record.GetSeverityNumber())
+	assert.Contains(t, record.GetBody().GetStringValue(), "src.workload=sleep")
+	attrs := attributeMap(record.GetAttributes())
+	assert.Equal(t, "OUTBOUND", attrs["direction"])
+	assert.Equal(t, "httpbin.default.svc.cluster.local", attrs["destination.service"])
+	assert.Equal(t, int64(2), attrs["sent_bytes"])
+	assert.Equal(t, int64(2000000), attrs["duration_ns"])
+}
+
+func TestOtlpExporterSlowCollector(t *testing.T) {
+	collector := &fakeCollector{failures: 1 << 30}
+	config := newTestOtlpConfig(collector.serveGrpc(t), options.OtlpProtocolGrpc)
+	config.ExportMetrics = false
+	config.Timeout = 100 * time.Millisecond
+	exporter, _, _ := newTestOtlpExporter(t, config)
+	// the first export stays in its backoff until the exporter stops
+	exporter.initialBackoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		exporter.Run(ctx)
+		close(done)
+	}()
+
+	// one batch is retried, otlpPendingExports wait behind it and the rest is dropped
+	for i := 0; i < config.QueueSize; i++ {
+		exporter.enqueueAccesslog(requestMetric{}, logInfo{})
+	}
+	assert.Eventually(t, func() bool {
+		return len(exporter.logQueue) == 0 && exporter.droppedLogs.Load() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("exporter did not stop while the collector was retried")
+	}
+	assert.Empty(t, collector.logRecords())
+}
+
+func TestOtlpExporterQueueFull(t *testing.T) {
+	config := newTestOtlpConfig("127.0.0.1:0", options.OtlpProtocolGrpc)
+	config.QueueSize = 2
+	exporter, _, _ := newTestOtlpExporter(t, config)
+
+	for i := 0; i < 5; i++ {
+		exporter.enqueueAccesslog(requestMetric{}, logInfo{})
+	}
+	assert.Len(t, exporter.logQueue, 2)
+	assert.Equal(t, uint64(3), exporter.droppedLogs.Load())
+
+	config.ExportAccesslog = false
+	exporter.enqueueAccesslog(requestMetric{}, logInfo{})
+	assert.Equal(t, uint64(3), exporter.droppedLogs.Load())
+
+	var nilExporter *OtlpExporter
+	nilExporter.enqueueAccesslog(requestMetric{}, logInfo{})
+}
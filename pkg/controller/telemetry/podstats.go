@@ -0,0 +1,159 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"sync"
+	"time"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+const (
+	// PodStatsWindow is the period covered by PodConnectionStats
+	PodStatsWindow = 5 * time.Minute
+	// podStatsBucket is the resolution of the window, it slides by a bucket at a time
+	podStatsBucket  = 30 * time.Second
+	podStatsBuckets = int64(PodStatsWindow / podStatsBucket)
+)
+
+// ConnectionStats sums the connections of a pod over PodStatsWindow
+type ConnectionStats struct {
+	Opened        float64 `json:"opened"`
+	Closed        float64 `json:"closed"`
+	Failed        float64 `json:"failed"`
+	SentBytes     float64 `json:"sentBytes"`
+	ReceivedBytes float64 `json:"receivedBytes"`
+}
+
+func (s *ConnectionStats) add(delta *ConnectionStats) {
+	s.Opened += delta.Opened
+	s.Closed += delta.Closed
+	s.Failed += delta.Failed
+	s.SentBytes += delta.SentBytes
+	s.ReceivedBytes += delta.ReceivedBytes
+}
+
+type podStatsKey struct {
+	namespace string
+	name      string
+}
+
+type podStatsSlot struct {
+	// index of the bucket the slot holds, the unix time divided by podStatsBucket
+	index    int64
+	inbound  ConnectionStats
+	outbound ConnectionStats
+}
+
+// podStats is a ring of the buckets of a pod, a slot is reused once its bucket
+// leaves the window
+type podStats struct {
+	slots  [podStatsBuckets]podStatsSlot
+	latest int64
+}
+
+// podStatsTracker sums the connections of the local pods per bucket. The pod is
+// the destination of the inbound connections and the source of the outbound ones,
+// so the replicas of a workload are told apart, and the sums do not depend on the
+// labels kept by the metric series.
+type podStatsTracker struct {
+	mutex     sync.Mutex
+	pods      map[podStatsKey]*podStats
+	lastSweep int64
+	now       func() time.Time
+}
+
+var podConnections = newPodStatsTracker()
+
+func newPodStatsTracker() *podStatsTracker {
+	return &podStatsTracker{
+		pods: make(map[podStatsKey]*podStats),
+		now:  time.Now,
+	}
+}
+
+func (t *podStatsTracker) add(namespace, name string, direction uint32, delta ConnectionStats) {
+	if name == "" || (direction != constants.INBOUND && direction != constants.OUTBOUND) {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	index := t.now().UnixNano() / int64(podStatsBucket)
+	t.sweep(index)
+
+	key := podStatsKey{namespace: namespace, name: name}
+	pod, ok := t.pods[key]
+	if !ok {
+		pod = &podStats{}
+		t.pods[key] = pod
+	}
+	slot := &pod.slots[index%podStatsBuckets]
+	if slot.index != index {
+		*slot = podStatsSlot{index: index}
+	}
+	if direction == constants.INBOUND {
+		slot.inbound.add(&delta)
+	} else {
+		slot.outbound.add(&delta)
+	}
+	pod.latest = index
+}
+
+// sweep drops the pods without a connection in the window, the map is walked at
+// most once per window
+func (t *podStatsTracker) sweep(index int64) {
+	if index-t.lastSweep < podStatsBuckets {
+		return
+	}
+	t.lastSweep = index
+	for key, pod := range t.pods {
+		if index-pod.latest >= podStatsBuckets {
+			delete(t.pods, key)
+		}
+	}
+}
+
+func (t *podStatsTracker) delete(namespace, name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.pods, podStatsKey{namespace: namespace, name: name})
+}
+
+func (t *podStatsTracker) stats(namespace, name string) (inbound, outbound ConnectionStats) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	pod, ok := t.pods[podStatsKey{namespace: namespace, name: name}]
+	if !ok {
+		return inbound, outbound
+	}
+	index := t.now().UnixNano() / int64(podStatsBucket)
+	for i := range pod.slots {
+		if slot := &pod.slots[i]; index-slot.index < podStatsBuckets {
+			inbound.add(&slot.inbound)
+			outbound.add(&slot.outbound)
+		}
+	}
+	return inbound, outbound
+}
+
+// PodConnectionStats sums the connections accepted and opened by a pod of this
+// node over the last PodStatsWindow
+func PodConnectionStats(namespace, name string) (inbound, outbound ConnectionStats) {
+	return podConnections.stats(namespace, name)
+}
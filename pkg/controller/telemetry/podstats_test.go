@@ -0,0 +1,97 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/constants"
+	"kmesh.net/kmesh/pkg/controller/workload/cache"
+)
+
+func TestPodStatsTracker(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 8, 14, 10, 0, 0, 0, time.UTC)}
+	tracker := newPodStatsTracker()
+	tracker.now = clock.Now
+
+	tracker.add("default", "httpbin-1", constants.INBOUND, ConnectionStats{Opened: 1, ReceivedBytes: 100})
+	tracker.add("default", "httpbin-1", constants.OUTBOUND, ConnectionStats{Opened: 2, Failed: 1})
+	// a sibling replica is not counted
+	tracker.add("default", "httpbin-2", constants.OUTBOUND, ConnectionStats{Opened: 5})
+
+	inbound, outbound := tracker.stats("default", "httpbin-1")
+	assert.Equal(t, ConnectionStats{Opened: 1, ReceivedBytes: 100}, inbound)
+	assert.Equal(t, ConnectionStats{Opened: 2, Failed: 1}, outbound)
+
+	// the window slides by a bucket at a time
+	clock.now = clock.now.Add(PodStatsWindow - podStatsBucket)
+	tracker.add("default", "httpbin-1", constants.INBOUND, ConnectionStats{Closed: 1, SentBytes: 10})
+	inbound, _ = tracker.stats("default", "httpbin-1")
+	assert.Equal(t, ConnectionStats{Opened: 1, Closed: 1, SentBytes: 10, ReceivedBytes: 100}, inbound)
+
+	clock.now = clock.now.Add(podStatsBucket)
+	inbound, outbound = tracker.stats("default", "httpbin-1")
+	assert.Equal(t, ConnectionStats{Closed: 1, SentBytes: 10}, inbound)
+	assert.Equal(t, ConnectionStats{}, outbound)
+
+	// idle pods are swept, deleted pods are dropped at once
+	tracker.add("default", "sleep-1", constants.OUTBOUND, ConnectionStats{Opened: 1})
+	assert.NotContains(t, tracker.pods, podStatsKey{namespace: "default", name: "httpbin-2"})
+	tracker.delete("default", "sleep-1")
+	assert.NotContains(t, tracker.pods, podStatsKey{namespace: "default", name: "sleep-1"})
+	assert.Len(t, tracker.pods, 1)
+}
+
+func TestRecordPodStats(t *testing.T) {
+	m := &MetricController{workloadCache: cache.NewWorkloadCache()}
+	m.workloadCache.AddOrUpdateWorkload(&workloadapi.Workload{
+		Uid: "stats-httpbin", Name: "httpbin-abcde", Namespace: "stats-demo", WorkloadName: "httpbin",
+		Addresses: [][]byte{{10, 244, 0, 16}},
+	})
+	m.workloadCache.AddOrUpdateWorkload(&workloadapi.Workload{
+		Uid: "stats-sleep", Name: "sleep-xyz", Namespace: "stats-demo", WorkloadName: "sleep",
+		Addresses: [][]byte{{10, 244, 0, 17}},
+	})
+	httpbin := [4]uint32{binary.LittleEndian.Uint32([]byte{10, 244, 0, 16})}
+	sleep := [4]uint32{binary.LittleEndian.Uint32([]byte{10, 244, 0, 17})}
+	defer podConnections.delete("stats-demo", "httpbin-abcde")
+	defer podConnections.delete("stats-demo", "sleep-xyz")
+
+	// sleep connects to httpbin, both pods are on this node
+	established := requestMetric{src: sleep, dst: httpbin, direction: constants.INBOUND, state: TCP_ESTABLISHED, success: connection_success}
+	m.recordPodStats(&established, connectionStatsOf(established))
+	established.direction = constants.OUTBOUND
+	m.recordPodStats(&established, connectionStatsOf(established))
+	closed := requestMetric{src: sleep, dst: httpbin, direction: constants.INBOUND, state: TCP_CLOSTED, success: connection_success,
+		sentBytes: 30, receivedBytes: 100}
+	m.recordPodStats(&closed, connectionStatsOf(closed))
+	// httpbin fails to connect to sleep
+	failed := requestMetric{src: httpbin, dst: sleep, direction: constants.OUTBOUND, state: TCP_CLOSTED}
+	m.recordPodStats(&failed, connectionStatsOf(failed))
+
+	inbound, outbound := PodConnectionStats("stats-demo", "httpbin-abcde")
+	assert.Equal(t, ConnectionStats{Opened: 1, Closed: 1, SentBytes: 30, ReceivedBytes: 100}, inbound)
+	assert.Equal(t, ConnectionStats{Opened: 1, Closed: 1, Failed: 1}, outbound)
+	inbound, outbound = PodConnectionStats("stats-demo", "sleep-xyz")
+	assert.Equal(t, ConnectionStats{}, inbound)
+	assert.Equal(t, ConnectionStats{Opened: 1}, outbound)
+}
@@ -0,0 +1,333 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/daemon/options"
+)
+
+// index of map_of_tcp_probe_stats, keep in sync with tcp_probe.h
+const (
+	tcpProbeStatRingbufFull = iota
+	tcpProbeStatExcluded
+	tcpProbeStatAggregated
+	tcpProbeStatMax
+)
+
+var (
+	tcpProbeRingbufDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kmesh_tcp_probe_ringbuf_dropped_total",
+			Help: "The number of connection events lost on the ringbuf, by the kernel when it is full or by the reader.",
+		}, []string{"stage"})
+
+	tcpProbeEventsExcluded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kmesh_tcp_probe_events_excluded_total",
+		Help: "The number of connection events not observed because of the excluded ports and namespaces.",
+	})
+
+	tcpProbeEventsAggregated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kmesh_tcp_probe_events_aggregated_total",
+		Help: "The number of connection events counted by pair in bpf instead of reported one by one.",
+	})
+)
+
+// ProbeMaps are the maps the bpf tcp probe shares with the daemon
+type ProbeMaps struct {
+	Config        *ebpf.Map
+	ExcludedAddrs *ebpf.Map
+	Pairs         *ebpf.Map
+	Stats         *ebpf.Map
+}
+
+// tcpProbeConfig is struct tcp_probe_config
+type tcpProbeConfig struct {
+	SampleRate       uint32
+	ExcludePortCount uint32
+	ShortConnNs      uint64
+	ExcludePorts     [options.MaxProbeExcludePorts]uint16
+}
+
+// tcpProbePair is struct tcp_probe_pair, the addresses are laid out as in requestMetric
+type tcpProbePair struct {
+	SrcAddr     [4]uint32
+	DstAddr     [4]uint32
+	DstPort     uint16
+	Direction   uint8
+	ConnSuccess uint8
+	ConnFlags   uint32
+}
+
+// tcpProbePairStats is struct tcp_probe_pair_stats
+type tcpProbePairStats struct {
+	Opened        uint64
+	Closed        uint64
+	SentBytes     uint64
+	ReceivedBytes uint64
+	Duration      uint64
+	TotalRetrans  uint64
+	SegsOut       uint64
+	SegsIn        uint64
+}
+
+func buildTcpProbeConfig(config *options.ProbeConfig) tcpProbeConfig {
+	value := tcpProbeConfig{
+		SampleRate:       config.SampleRate,
+		ExcludePortCount: uint32(len(config.ExcludePorts)),
+		ShortConnNs:      uint64(config.ShortConnThreshold),
+	}
+	for i, port := range config.ExcludePorts {
+		value.ExcludePorts[i] = uint16(port)
+	}
+	return value
+}
+
+// requestMetric returns the part of a connection the labels are built from
+func (p *tcpProbePair) requestMetric() requestMetric {
+	return requestMetric{
+		src:       p.SrcAddr,
+		dst:       p.DstAddr,
+		dstPort:   p.DstPort,
+		direction: uint32(p.Direction),
+		success:   uint32(p.ConnSuccess),
+		connFlags: p.ConnFlags,
+	}
+}
+
+// sub returns the increase since last. An evicted pair starts over from zero, so
+// a decrease means all of the current value is new.
+func (s tcpProbePairStats) sub(last tcpProbePairStats) tcpProbePairStats {
+	if s.Opened < last.Opened || s.Closed < last.Closed {
+		return s
+	}
+	return tcpProbePairStats{
+		Opened:        s.Opened - last.Opened,
+		Closed:        s.Closed - last.Closed,
+		SentBytes:     s.SentBytes - last.SentBytes,
+		ReceivedBytes: s.ReceivedBytes - last.ReceivedBytes,
+		Duration:      s.Duration - last.Duration,
+		TotalRetrans:  s.TotalRetrans - last.TotalRetrans,
+		SegsOut:       s.SegsOut - last.SegsOut,
+		SegsIn:        s.SegsIn - last.SegsIn,
+	}
+}
+
+// tcpProbe keeps the config and the exclusion list of the bpf probe up to date,
+// and reads its counters
+type tcpProbe struct {
+	config *options.ProbeConfig
+	maps   ProbeMaps
+
+	excluded map[[4]uint32]struct{}
+	// pairs are the counters read last time
+	pairs map[tcpProbePair]tcpProbePairStats
+	stats [tcpProbeStatMax]uint64
+}
+
+func newTcpProbe(config *options.ProbeConfig, maps ProbeMaps) *tcpProbe {
+	return &tcpProbe{
+		config:   config,
+		maps:     maps,
+		excluded: make(map[[4]uint32]struct{}),
+		pairs:    make(map[tcpProbePair]tcpProbePairStats),
+	}
+}
+
+func (p *tcpProbe) writeConfig() error {
+	return p.maps.Config.Put(uint32(0), buildTcpProbeConfig(p.config))
+}
+
+// syncExcludedAddrs makes the excluded addresses those of the workloads in the
+// excluded namespaces
+func (p *tcpProbe) syncExcludedAddrs(workloads []*workloadapi.Workload) {
+	want := excludedAddrs(workloads, p.config.ExcludeNamespaces)
+	for addr := range p.excluded {
+		if _, ok := want[addr]; ok {
+			continue
+		}
+		if err := p.maps.ExcludedAddrs.Delete(addr); err != nil && !isNotExist(err) {
+			log.Warnf("delete probe excluded address failed: %v", err)
+			continue
+		}
+		delete(p.excluded, addr)
+	}
+	for addr := range want {
+		if _, ok := p.excluded[addr]; ok {
+			continue
+		}
+		if err := p.maps.ExcludedAddrs.Put(addr, uint32(0)); err != nil {
+			log.Warnf("add probe excluded address failed: %v", err)
+			continue
+		}
+		p.excluded[addr] = struct{}{}
+	}
+}
+
+func excludedAddrs(workloads []*workloadapi.Workload, namespaces []string) map[[4]uint32]struct{} {
+	addrs := make(map[[4]uint32]struct{})
+	if len(namespaces) == 0 {
+		return addrs
+	}
+	for _, workload := range workloads {
+		if !containsString(namespaces, workload.GetNamespace()) {
+			continue
+		}
+		for _, raw := range workload.GetAddresses() {
+			if len(raw) != 4 && len(raw) != 16 {
+				continue
+			}
+			var addr [4]uint32
+			for i := 0; i < len(raw)/4; i++ {
+				addr[i] = binary.LittleEndian.Uint32(raw[i*4:])
+			}
+			addrs[addr] = struct{}{}
+		}
+	}
+	return addrs
+}
+
+// flushPairs reports the increase of every pair counter. Pairs unchanged since
+// the last flush are deleted, an increase racing with the delete is lost.
+func (p *tcpProbe) flushPairs(report func(pair *tcpProbePair, delta tcpProbePairStats)) {
+	var (
+		pair  tcpProbePair
+		stats tcpProbePairStats
+		idle  []tcpProbePair
+	)
+
+	seen := make(map[tcpProbePair]struct{}, len(p.pairs))
+	iter := p.maps.Pairs.Iterate()
+	for iter.Next(&pair, &stats) {
+		seen[pair] = struct{}{}
+		last, ok := p.pairs[pair]
+		if ok && last == stats {
+			idle = append(idle, pair)
+			continue
+		}
+		p.pairs[pair] = stats
+		report(&pair, stats.sub(last))
+	}
+	if err := iter.Err(); err != nil {
+		log.Warnf("iterate probe pairs failed: %v", err)
+		return
+	}
+
+	for _, pair := range idle {
+		if err := p.maps.Pairs.Delete(pair); err != nil && !isNotExist(err) {
+			log.Warnf("delete idle probe pair failed: %v", err)
+			continue
+		}
+		delete(p.pairs, pair)
+	}
+	// evicted by the lru
+	for pair := range p.pairs {
+		if _, ok := seen[pair]; !ok {
+			delete(p.pairs, pair)
+		}
+	}
+}
+
+// flushStats adds the increase of the per cpu probe stats to the metrics
+func (p *tcpProbe) flushStats() {
+	for index := uint32(0); index < tcpProbeStatMax; index++ {
+		var perCPU []uint64
+		if err := p.maps.Stats.Lookup(index, &perCPU); err != nil {
+			log.Warnf("lookup probe stat %d failed: %v", index, err)
+			continue
+		}
+		var total uint64
+		for _, v := range perCPU {
+			total += v
+		}
+		delta := total - p.stats[index]
+		p.stats[index] = total
+
+		switch index {
+		case tcpProbeStatRingbufFull:
+			tcpProbeRingbufDropped.WithLabelValues("kernel").Add(float64(delta))
+		case tcpProbeStatExcluded:
+			tcpProbeEventsExcluded.Add(float64(delta))
+		case tcpProbeStatAggregated:
+			tcpProbeEventsAggregated.Add(float64(delta))
+		}
+	}
+}
+
+func isNotExist(err error) bool {
+	return errors.Is(err, ebpf.ErrKeyNotExist)
+}
+
+// RunProbe configures the bpf tcp probe and periodically reads its counters
+func (m *MetricController) RunProbe(ctx context.Context, maps ProbeMaps) {
+	if m == nil {
+		return
+	}
+
+	config := m.probeConfig
+	if config == nil {
+		config = &options.ProbeConfig{SampleRate: 1, FlushInterval: 5 * time.Second}
+	}
+	probe := newTcpProbe(config, maps)
+	if err := probe.writeConfig(); err != nil {
+		log.Errorf("write tcp probe config failed: %v", err)
+	}
+
+	ticker := time.NewTicker(config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var aggregated []topAggregate
+			probe.syncExcludedAddrs(m.workloadCache.List())
+			probe.flushPairs(func(pair *tcpProbePair, delta tcpProbePairStats) {
+				aggregated = append(aggregated, m.reportProbePair(pair, delta))
+			})
+			m.top.recordAggregated(aggregated)
+			probe.flushStats()
+		}
+	}
+}
+
+// reportProbePair adds the connections counted in a pair by the bpf probe to the
+// metrics, and returns them for the top view
+func (m *MetricController) reportProbePair(pair *tcpProbePair, delta tcpProbePairStats) topAggregate {
+	data := pair.requestMetric()
+	workloadLabels, serviceLabels, accesslog := m.buildMetricLabels(&data)
+	buildAggregatedMetricsToPrometheus(delta, data.success == connection_success, workloadLabels, serviceLabels)
+	stats := ConnectionStats{
+		Opened:        float64(delta.Opened),
+		Closed:        float64(delta.Closed),
+		SentBytes:     float64(delta.SentBytes),
+		ReceivedBytes: float64(delta.ReceivedBytes),
+	}
+	if data.success != connection_success {
+		stats.Failed = float64(delta.Closed)
+	}
+	m.recordPodStats(&data, stats)
+	return topAggregate{data: data, accesslog: accesslog, delta: delta}
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/daemon/options"
+	"kmesh.net/kmesh/pkg/constants"
+	"kmesh.net/kmesh/pkg/controller/workload/cache"
+)
+
+func newTestProbeMap(t *testing.T, spec *ebpf.MapSpec) *ebpf.Map {
+	m, err := ebpf.NewMap(spec)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = m.Close() })
+	return m
+}
+
+func TestTcpProbeLayout(t *testing.T) {
+	// sizes of the structs in tcp_probe.h
+	assert.Equal(t, 48, binary.Size(tcpProbeConfig{}))
+	assert.Equal(t, 40, binary.Size(tcpProbePair{}))
+	assert.Equal(t, 64, binary.Size(tcpProbePairStats{}))
+
+	config := buildTcpProbeConfig(&options.ProbeConfig{
+		SampleRate:         10,
+		ExcludePorts:       []uint{15021, 8080},
+		ShortConnThreshold: 100 * time.Millisecond,
+	})
+	assert.Equal(t, uint32(10), config.SampleRate)
+	assert.Equal(t, uint32(2), config.ExcludePortCount)
+	assert.Equal(t, uint64(100*time.Millisecond), config.ShortConnNs)
+	assert.Equal(t, []uint16{15021, 8080, 0}, config.ExcludePorts[:3])
+}
+
+func TestTcpProbeSyncExcludedAddrs(t *testing.T) {
+	excl := newTestProbeMap(t, &ebpf.MapSpec{
+		Name:       "map_of_tcp_probe_excl",
+		Type:       ebpf.Hash,
+		KeySize:    16,
+		ValueSize:  4,
+		MaxEntries: 64,
+	})
+	config := &options.ProbeConfig{ExcludeNamespaces: []string{"monitoring"}}
+	probe := newTcpProbe(config, ProbeMaps{ExcludedAddrs: excl})
+
+	workloads := []*workloadapi.Workload{
+		{Name: "prometheus", Namespace: "monitoring", Addresses: [][]byte{{10, 244, 0, 5}}},
+		{Name: "grafana", Namespace: "monitoring", Addresses: [][]byte{
+			{0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+		}},
+		{Name: "httpbin", Namespace: "default", Addresses: [][]byte{{10, 244, 0, 6}}},
+	}
+	probe.syncExcludedAddrs(workloads)
+
+	var value uint32
+	// laid out as the ip4 member of struct ip_addr
+	assert.NoError(t, excl.Lookup([4]uint32{binary.LittleEndian.Uint32([]byte{10, 244, 0, 5})}, &value))
+	assert.Len(t, probe.excluded, 2)
+	assert.ErrorIs(t, excl.Lookup([4]uint32{binary.LittleEndian.Uint32([]byte{10, 244, 0, 6})}, &value), ebpf.ErrKeyNotExist)
+
+	// the workload is gone
+	probe.syncExcludedAddrs(workloads[1:])
+	assert.ErrorIs(t, excl.Lookup([4]uint32{binary.LittleEndian.Uint32([]byte{10, 244, 0, 5})}, &value), ebpf.ErrKeyNotExist)
+	assert.Len(t, probe.excluded, 1)
+
+	config.ExcludeNamespaces = nil
+	probe.syncExcludedAddrs(workloads)
+	assert.Empty(t, probe.excluded)
+}
+
+func TestTcpProbeFlushPairs(t *testing.T) {
+	pairs := newTestProbeMap(t, &ebpf.MapSpec{
+		Name:       "map_of_tcp_probe_pair",
+		Type:       ebpf.LRUHash,
+		KeySize:    40,
+		ValueSize:  64,
+		MaxEntries: 64,
+	})
+	probe := newTcpProbe(&options.ProbeConfig{}, ProbeMaps{Pairs: pairs})
+
+	pair := tcpProbePair{DstPort: 80, Direction: uint8(constants.OUTBOUND), ConnSuccess: 1}
+	reported := map[tcpProbePair]tcpProbePairStats{}
+	report := func(pair *tcpProbePair, delta tcpProbePairStats) {
+		reported[*pair] = delta
+	}
+
+	require.NoError(t, pairs.Put(pair, tcpProbePairStats{Opened: 3, Closed: 2, SentBytes: 100}))
+	probe.flushPairs(report)
+	assert.Equal(t, tcpProbePairStats{Opened: 3, Closed: 2, SentBytes: 100}, reported[pair])
+
+	require.NoError(t, pairs.Put(pair, tcpProbePairStats{Opened: 4, Closed: 4, SentBytes: 150}))
+	probe.flushPairs(report)
+	assert.Equal(t, tcpProbePairStats{Opened: 1, Closed: 2, SentBytes: 50}, reported[pair])
+
+	// unchanged pairs are deleted, and start over from zero
+	clear(reported)
+	probe.flushPairs(report)
+	assert.Empty(t, reported)
+	var stats tcpProbePairStats
+	assert.ErrorIs(t, pairs.Lookup(pair, &stats), ebpf.ErrKeyNotExist)
+	assert.Empty(t, probe.pairs)
+
+	require.NoError(t, pairs.Put(pair, tcpProbePairStats{Opened: 1}))
+	probe.flushPairs(report)
+	assert.Equal(t, tcpProbePairStats{Opened: 1}, reported[pair])
+}
+
+func TestTcpProbePairStatsSub(t *testing.T) {
+	last := tcpProbePairStats{Opened: 5, Closed: 5, SentBytes: 500}
+	// evicted by the lru and counted again from zero
+	evicted := tcpProbePairStats{Opened: 1, Closed: 1, SentBytes: 10}
+	assert.Equal(t, evicted, evicted.sub(last))
+}
+
+func TestTcpProbeFlushStats(t *testing.T) {
+	stats := newTestProbeMap(t, &ebpf.MapSpec{
+		Name:       "map_of_tcp_probe_stats",
+		Type:       ebpf.PerCPUArray,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: tcpProbeStatMax,
+	})
+	probe := newTcpProbe(&options.ProbeConfig{}, ProbeMaps{Stats: stats})
+	cpus, err := ebpf.PossibleCPU()
+	require.NoError(t, err)
+
+	kernelDropped := tcpProbeRingbufDropped.WithLabelValues("kernel")
+	before := testutil.ToFloat64(kernelDropped)
+	excludedBefore := testutil.ToFloat64(tcpProbeEventsExcluded)
+
+	perCPU := make([]uint64, cpus)
+	perCPU[0] = 2
+	require.NoError(t, stats.Put(uint32(tcpProbeStatRingbufFull), perCPU))
+	perCPU[cpus-1] += 3
+	require.NoError(t, stats.Put(uint32(tcpProbeStatExcluded), perCPU))
+	probe.flushStats()
+	assert.Equal(t, before+2, testutil.ToFloat64(kernelDropped))
+	assert.Equal(t, excludedBefore+5, testutil.ToFloat64(tcpProbeEventsExcluded))
+
+	// only the increase is added
+	perCPU[0] = 4
+	require.NoError(t, stats.Put(uint32(tcpProbeStatRingbufFull), perCPU))
+	probe.flushStats()
+	assert.Equal(t, before+4, testutil.ToFloat64(kernelDropped))
+	assert.Equal(t, excludedBefore+5, testutil.ToFloat64(tcpProbeEventsExcluded))
+}
+
+func TestReportProbePair(t *testing.T) {
+	resetMetricVecs()
+	defer resetMetricVecs()
+
+	m := &MetricController{workloadCache: cache.NewWorkloadCache()}
+	m.workloadCache.AddOrUpdateWorkload(&workloadapi.Workload{
+		Uid: "httpbin", Name: "httpbin-1", Namespace: "default", WorkloadName: "httpbin",
+		Addresses: [][]byte{{10, 244, 0, 6}},
+	})
+	pair := &tcpProbePair{
+		DstAddr:     [4]uint32{binary.LittleEndian.Uint32([]byte{10, 244, 0, 6})},
+		DstPort:     80,
+		Direction:   uint8(constants.INBOUND),
+		ConnSuccess: 0,
+	}
+	m.reportProbePair(pair, tcpProbePairStats{Closed: 3, SentBytes: 30, SegsOut: 6})
+
+	assert.Equal(t, 1, countSeries(tcpConnectionFailedInService))
+	workloadLabels, serviceLabels, _ := m.buildMetricLabels(&requestMetric{
+		dst: pair.DstAddr, dstPort: 80, direction: constants.INBOUND,
+	})
+	assert.Equal(t, "httpbin-1", workloadLabels["destination_pod_name"])
+	assert.Equal(t, "UF", serviceLabels["response_flags"])
+	assert.Equal(t, float64(3), testutil.ToFloat64(tcpConnectionFailedInService.With(serviceLabels)))
+	assert.Equal(t, float64(3), testutil.ToFloat64(deprecatedTcpConnectionFailedInService.With(serviceLabels)), "the deprecated name is exported too")
+	assert.Equal(t, float64(3), testutil.ToFloat64(tcpConnectionClosedInWorkload.With(workloadLabels)))
+	assert.Equal(t, float64(6), testutil.ToFloat64(tcpSentSegmentsInService.With(serviceLabels)))
+	assert.Equal(t, 0, countSeries(tcpConnectionDurationInService), "aggregated connections are not observed one by one")
+}
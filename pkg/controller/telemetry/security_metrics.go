@@ -0,0 +1,59 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// The CA and cert metrics are reported by the secret manager.
+	CaRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kmesh_ca_requests_total",
+		Help: "The number of CSR requests sent to each CA, by result.",
+	}, []string{"ca", "result"})
+
+	CaFailovers = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kmesh_ca_failovers_total",
+		Help: "The number of times the preferred CA moved to another address after failures.",
+	})
+
+	CaFetchRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kmesh_ca_fetch_retries_total",
+		Help: "The number of failed cert fetches scheduled for a retry with backoff.",
+	})
+
+	CaRetryBudgetExhausted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kmesh_ca_retry_budget_exhausted_total",
+		Help: "The number of identities given up after using all their cert fetch retries.",
+	})
+
+	CertExpirySeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kmesh_cert_expiry_seconds",
+		Help: "The time in seconds until the workload cert of the identity expires.",
+	}, []string{"identity"})
+
+	CertRotations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kmesh_cert_rotations_total",
+		Help: "The number of workload certs replaced by a newly signed one.",
+	})
+
+	CertRotationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kmesh_cert_rotation_failures_total",
+		Help: "The number of rotations of a cert whose first attempt to sign the new cert failed, counted once however often it is retried.",
+	})
+)
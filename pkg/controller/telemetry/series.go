@@ -0,0 +1,224 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"kmesh.net/kmesh/daemon/options"
+)
+
+type seriesKind int
+
+const (
+	workloadSeries seriesKind = iota
+	serviceSeries
+)
+
+// overflowLabelValue replaces every label but the reporter of the series over the limit
+const overflowLabelValue = "overflow"
+
+var (
+	metricSeriesTracked = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kmesh_metric_series",
+		Help: "The number of workload and service metric series tracked on this node.",
+	})
+
+	metricSeriesOverflow = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kmesh_metric_series_overflow_total",
+		Help: "The number of samples aggregated into the overflow series because of the series limit.",
+	})
+
+	metricSeriesExpired = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kmesh_metric_series_expired_total",
+		Help: "The number of metric series deleted after being idle.",
+	})
+)
+
+type seriesKey struct {
+	kind   seriesKind
+	labels string
+}
+
+type trackedSeries struct {
+	labels   prometheus.Labels
+	lastSeen time.Time
+}
+
+// SeriesTracker bounds the cardinality of the workload and service metrics.
+// Every label set is tracked, so that it can be deleted from all the metrics of
+// its kind once idle, and new label sets beyond the limit are aggregated into an
+// overflow series.
+type SeriesTracker struct {
+	idleTTL    time.Duration
+	maxSeries  int
+	dropLabels []string
+
+	mutex  sync.Mutex
+	series map[seriesKey]*trackedSeries
+	now    func() time.Time
+}
+
+func NewSeriesTracker(config *options.MetricConfig) (*SeriesTracker, error) {
+	for _, name := range config.DropLabels {
+		if !containsString(workloadLabels, name) && !containsString(serviceLabels, name) {
+			return nil, fmt.Errorf("unknown metric label %q to drop", name)
+		}
+		if name == "reporter" {
+			return nil, fmt.Errorf("metric label reporter can not be dropped")
+		}
+	}
+
+	return &SeriesTracker{
+		idleTTL:    config.SeriesIdleTTL,
+		maxSeries:  config.MaxSeries,
+		dropLabels: config.DropLabels,
+		series:     make(map[seriesKey]*trackedSeries),
+		now:        time.Now,
+	}, nil
+}
+
+// track returns the labels to report a sample under, a nil tracker keeps them as is
+func (t *SeriesTracker) track(kind seriesKind, labels map[string]string) map[string]string {
+	if t == nil {
+		return labels
+	}
+
+	for _, name := range t.dropLabels {
+		if _, ok := labels[name]; ok {
+			labels[name] = "-"
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	key := seriesKey{kind: kind, labels: joinLabels(kind, labels)}
+	if s, ok := t.series[key]; ok {
+		s.lastSeen = now
+		return labels
+	}
+
+	// overflow series are tracked and expire like the others, they are the only ones
+	// added past the limit and there is at most one per kind and reporter
+	if t.maxSeries > 0 && len(t.series) >= t.maxSeries {
+		metricSeriesOverflow.Inc()
+		labels = overflowLabels(labels)
+		key = seriesKey{kind: kind, labels: joinLabels(kind, labels)}
+		if s, ok := t.series[key]; ok {
+			s.lastSeen = now
+			return labels
+		}
+	}
+
+	t.series[key] = &trackedSeries{labels: labels, lastSeen: now}
+	metricSeriesTracked.Set(float64(len(t.series)))
+	return labels
+}
+
+// expire deletes the series idle for longer than the ttl from the metrics
+func (t *SeriesTracker) expire() int {
+	if t == nil || t.idleTTL <= 0 {
+		return 0
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	deadline := t.now().Add(-t.idleTTL)
+	expired := 0
+	for key, s := range t.series {
+		if !s.lastSeen.Before(deadline) {
+			continue
+		}
+		vecs := workloadMetrics
+		if key.kind == serviceSeries {
+			vecs = serviceMetrics
+		}
+		for _, vec := range vecs {
+			vec.Delete(s.labels)
+		}
+		delete(t.series, key)
+		expired++
+	}
+
+	if expired > 0 {
+		metricSeriesExpired.Add(float64(expired))
+		metricSeriesTracked.Set(float64(len(t.series)))
+		log.Debugf("expired %d idle metric series", expired)
+	}
+	return expired
+}
+
+func (t *SeriesTracker) Run(ctx context.Context) {
+	if t == nil || t.idleTTL <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(max(t.idleTTL/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.expire()
+		}
+	}
+}
+
+func overflowLabels(labels map[string]string) map[string]string {
+	overflow := make(map[string]string, len(labels))
+	for name, value := range labels {
+		if name == "reporter" {
+			overflow[name] = value
+		} else {
+			overflow[name] = overflowLabelValue
+		}
+	}
+	return overflow
+}
+
+func joinLabels(kind seriesKind, labels map[string]string) string {
+	names := workloadLabels
+	if kind == serviceSeries {
+		names = serviceLabels
+	}
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(labels[name])
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"kmesh.net/kmesh/daemon/options"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestSeriesTracker(t *testing.T, config *options.MetricConfig) (*SeriesTracker, *fakeClock) {
+	tracker, err := NewSeriesTracker(config)
+	require.NoError(t, err)
+	clock := &fakeClock{now: time.Date(2024, 8, 14, 10, 0, 0, 0, time.UTC)}
+	tracker.now = clock.Now
+	return tracker, clock
+}
+
+func resetMetricVecs() {
+	for _, vec := range workloadMetrics {
+		vec.Reset()
+	}
+	for _, vec := range serviceMetrics {
+		vec.Reset()
+	}
+}
+
+func countSeries(collectors ...prometheus.Collector) int {
+	ch := make(chan prometheus.Metric, 1024)
+	go func() {
+		for _, c := range collectors {
+			c.Collect(ch)
+		}
+		close(ch)
+	}()
+
+	n := 0
+	for range ch {
+		n++
+	}
+	return n
+}
+
+func testServiceLabels(reporter, pod string) map[string]string {
+	return struct2map(serviceMetricLabels{
+		reporter:                    reporter,
+		sourceWorkload:              "sleep",
+		sourceWorkloadNamespace:     "default",
+		destinationService:          "httpbin.default.svc.cluster.local",
+		destinationServiceNamespace: "default",
+		destinationWorkload:         pod,
+		requestProtocol:             "tcp",
+	})
+}
+
+func testWorkloadLabels(pod string) map[string]string {
+	return struct2map(workloadMetricLabels{
+		reporter:                "destination",
+		sourceWorkload:          "sleep",
+		destinationPodName:      pod,
+		destinationPodAddress:   "10.244.0.7",
+		destinationWorkload:     "httpbin",
+		destinationPodNamespace: "default",
+		requestProtocol:         "tcp",
+	})
+}
+
+func TestNewSeriesTracker(t *testing.T) {
+	_, err := NewSeriesTracker(&options.MetricConfig{DropLabels: []string{"destination_pod_name"}})
+	assert.NoError(t, err)
+	_, err = NewSeriesTracker(&options.MetricConfig{DropLabels: []string{"not_a_label"}})
+	assert.Error(t, err)
+	_, err = NewSeriesTracker(&options.MetricConfig{DropLabels: []string{"reporter"}})
+	assert.Error(t, err)
+}
+
+func TestSeriesTrackerDropLabels(t *testing.T) {
+	tracker, _ := newTestSeriesTracker(t, &options.MetricConfig{
+		DropLabels: []string{"destination_pod_name", "destination_pod_address"},
+	})
+
+	first := tracker.track(workloadSeries, testWorkloadLabels("httpbin-1"))
+	second := tracker.track(workloadSeries, testWorkloadLabels("httpbin-2"))
+	assert.Equal(t, first, second)
+	assert.Equal(t, "-", first["destination_pod_name"])
+	assert.Equal(t, "-", first["destination_pod_address"])
+	assert.Equal(t, "httpbin", first["destination_workload"])
+	assert.Len(t, tracker.series, 1)
+
+	var nilTracker *SeriesTracker
+	labels := testWorkloadLabels("httpbin-1")
+	assert.Equal(t, labels, nilTracker.track(workloadSeries, labels))
+}
+
+func TestSeriesTrackerLimit(t *testing.T) {
+	tracker, _ := newTestSeriesTracker(t, &options.MetricConfig{MaxSeries: 2})
+
+	assert.Equal(t, "httpbin-1", tracker.track(serviceSeries, testServiceLabels("source", "httpbin-1"))["destination_workload"])
+	assert.Equal(t, "httpbin-2", tracker.track(serviceSeries, testServiceLabels("source", "httpbin-2"))["destination_workload"])
+	// known series are still reported under their own labels
+	assert.Equal(t, "httpbin-1", tracker.track(serviceSeries, testServiceLabels("source", "httpbin-1"))["destination_workload"])
+
+	overflow := tracker.track(serviceSeries, testServiceLabels("source", "httpbin-3"))
+	assert.Equal(t, "source", overflow["reporter"])
+	assert.Equal(t, overflowLabelValue, overflow["destination_workload"])
+	assert.Equal(t, overflowLabelValue, overflow["source_workload"])
+	assert.Equal(t, overflow, tracker.track(serviceSeries, testServiceLabels("source", "httpbin-4")))
+
+	// one overflow series per reporter
+	tracker.track(serviceSeries, testServiceLabels("destination", "httpbin-5"))
+	assert.Len(t, tracker.series, 4)
+}
+
+func TestSeriesTrackerExpire(t *testing.T) {
+	resetMetricVecs()
+	defer resetMetricVecs()
+
+	tracker, clock := newTestSeriesTracker(t, &options.MetricConfig{SeriesIdleTTL: time.Minute})
+	data := requestMetric{state: TCP_ESTABLISHED, success: connection_success, sentBytes: 10}
+
+	buildServiceMetricsToPrometheus(data, tracker.track(serviceSeries, testServiceLabels("source", "httpbin-1")))
+	buildWorkloadMetricsToPrometheus(data, tracker.track(workloadSeries, testWorkloadLabels("httpbin-1")))
+	clock.now = clock.now.Add(40 * time.Second)
+	buildServiceMetricsToPrometheus(data, tracker.track(serviceSeries, testServiceLabels("source", "httpbin-2")))
+	assert.Equal(t, 2, countSeries(tcpConnectionOpenedInService))
+	assert.Equal(t, 2, countSeries(deprecatedTcpConnectionOpenedInService), "the deprecated names are exported too")
+	assert.Equal(t, 1, countSeries(tcpConnectionOpenedInWorkload))
+
+	clock.now = clock.now.Add(40 * time.Second)
+	assert.Equal(t, 2, tracker.expire())
+	assert.Equal(t, 1, countSeries(tcpConnectionOpenedInService))
+	assert.Equal(t, 0, countSeries(tcpConnectionOpenedInWorkload))
+	assert.Equal(t, 0, countSeries(tcpSentBytesInWorkload))
+
+	clock.now = clock.now.Add(time.Minute)
+	assert.Equal(t, 1, tracker.expire())
+	assert.Empty(t, tracker.series)
+	assert.Equal(t, 0, countSeries(serviceMetricCollectors()...))
+}
+
+func serviceMetricCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		tcpConnectionOpenedInService, tcpConnectionClosedInService, tcpReceivedBytesInService, tcpSentBytesInService,
+		tcpConnectionFailedInService, tcpRetransmittedSegmentsInService, tcpSentSegmentsInService,
+		tcpConnectionDurationInService, tcpConnectionSentBytesInService, tcpConnectionReceivedBytesInService,
+		tcpSmoothedRttInService, deprecatedTcpConnectionOpenedInService, deprecatedTcpConnectionClosedInService,
+		deprecatedTcpReceivedBytesInService, deprecatedTcpSentBytesInService, deprecatedTcpConnectionFailedInService,
+	}
+}
+
+// TestSeriesTrackerChurn replaces every pod each round, like a busy CI cluster,
+// and checks neither the series nor the heap grow with the number of pods seen
+func TestSeriesTrackerChurn(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip long running churn test in short mode")
+	}
+	resetMetricVecs()
+	defer resetMetricVecs()
+
+	const (
+		rounds       = 500
+		podsPerRound = 20
+		maxSeries    = 200
+	)
+	tracker, clock := newTestSeriesTracker(t, &options.MetricConfig{SeriesIdleTTL: time.Minute, MaxSeries: maxSeries})
+
+	var before runtime.MemStats
+	round := func(i int) {
+		for p := 0; p < podsPerRound; p++ {
+			pod := fmt.Sprintf("httpbin-%d-%d", i, p)
+			opened := requestMetric{state: TCP_ESTABLISHED, success: connection_success}
+			closed := requestMetric{state: TCP_CLOSTED, success: connection_success, sentBytes: 100, duration: uint64(time.Second)}
+			serviceLabels := tracker.track(serviceSeries, testServiceLabels("source", pod))
+			buildServiceMetricsToPrometheus(opened, serviceLabels)
+			buildServiceMetricsToPrometheus(closed, serviceLabels)
+			buildConnectionHistogramsToPrometheus(closed, serviceLabels)
+			buildWorkloadMetricsToPrometheus(closed, tracker.track(workloadSeries, testWorkloadLabels(pod)))
+		}
+		clock.now = clock.now.Add(10 * time.Second)
+		tracker.expire()
+	}
+
+	// warm up, so that the maps reach their steady size
+	for i := 0; i < rounds/10; i++ {
+		round(i)
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	for i := rounds / 10; i < rounds; i++ {
+		round(i)
+		// 6 rounds within the ttl, plus the overflow series of both kinds
+		require.LessOrEqual(t, len(tracker.series), min(maxSeries, 6*2*podsPerRound)+2)
+	}
+	assert.LessOrEqual(t, countSeries(tcpConnectionOpenedInService), maxSeries+1)
+	assert.LessOrEqual(t, countSeries(tcpConnectionClosedInWorkload), maxSeries+1)
+
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	// several thousand pods came and went, a leak of one series each would show
+	assert.Less(t, int64(after.HeapAlloc)-int64(before.HeapAlloc), int64(8<<20))
+}
@@ -0,0 +1,508 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+const (
+	// topMaxOpen bounds the open connections tracked, the oldest is dropped beyond it
+	topMaxOpen = 8192
+	// topMaxPairs bounds the workload pairs, new pairs are not tracked beyond it
+	topMaxPairs = 4096
+	// topMaxRecent is the number of closed and denied connections kept
+	topMaxRecent = 256
+	// topPairIdle is how long a pair without open connections is kept
+	topPairIdle = 10 * time.Minute
+)
+
+// topKey identifies a connection regardless of the side reporting it, so that a
+// connection between two pods of this node is only counted once
+type topKey struct {
+	src     [4]uint32
+	dst     [4]uint32
+	srcPort uint16
+	dstPort uint16
+}
+
+type topPairKey struct {
+	source      string
+	destination string
+}
+
+// TopConnection is a connection seen in the metric ringbuf. The bytes are only
+// known once it is closed, bpf does not report open connections periodically.
+type TopConnection struct {
+	Source              string `json:"source"`
+	Destination         string `json:"destination"`
+	SourceWorkload      string `json:"sourceWorkload,omitempty"`
+	DestinationWorkload string `json:"destinationWorkload,omitempty"`
+	DestinationService  string `json:"destinationService,omitempty"`
+	// Direction is the side that reported the connection first
+	Direction string    `json:"direction"`
+	Opened    time.Time `json:"opened"`
+	// Closed is nil while the connection is open
+	Closed *time.Time `json:"closed,omitempty"`
+	// SentBytes are sent by the source, ReceivedBytes by the destination
+	SentBytes      uint64  `json:"sentBytes"`
+	ReceivedBytes  uint64  `json:"receivedBytes"`
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+	ResponseFlags  string  `json:"responseFlags,omitempty"`
+
+	key topKey
+}
+
+// TopPair sums the connections from a source workload to a destination workload.
+// The counters are cumulative, BytesPerSecond is the increase since the previous
+// snapshot of the stream.
+type TopPair struct {
+	SourceWorkload      string  `json:"sourceWorkload"`
+	DestinationWorkload string  `json:"destinationWorkload"`
+	Active              int     `json:"active"`
+	Opened              uint64  `json:"opened"`
+	Closed              uint64  `json:"closed"`
+	Failed              uint64  `json:"failed"`
+	Denied              uint64  `json:"denied"`
+	SentBytes           uint64  `json:"sentBytes"`
+	ReceivedBytes       uint64  `json:"receivedBytes"`
+	BytesPerSecond      float64 `json:"bytesPerSecond"`
+
+	lastSeen time.Time
+}
+
+// TopSnapshot is one frame of the kmesh-daemon top stream
+type TopSnapshot struct {
+	Time time.Time `json:"time"`
+	// OpenConnections counts all the open connections. Connections lists those of the
+	// busiest pairs first, the bytes of a connection are only known once it is closed.
+	OpenConnections int              `json:"openConnections"`
+	Connections     []*TopConnection `json:"connections"`
+	// Closed are the busiest recently closed connections
+	Closed []*TopConnection `json:"closed"`
+	Pairs  []*TopPair       `json:"pairs"`
+	// Denies are the latest connections reset because of an authorization policy
+	Denies         []*TopConnection `json:"denies"`
+	DeniedTotal    uint64           `json:"deniedTotal"`
+	BytesPerSecond float64          `json:"bytesPerSecond"`
+}
+
+// TopTracker keeps a bounded live view of the connections reported by the metric
+// ringbuf, it backs the kmesh-daemon top stream
+type TopTracker struct {
+	mutex sync.Mutex
+	open  map[topKey]*list.Element
+	// openOrder holds the open connections from the oldest to the newest
+	openOrder   *list.List
+	closed      []*TopConnection
+	denies      []*TopConnection
+	deniedTotal uint64
+	pairs       map[topPairKey]*TopPair
+	now         func() time.Time
+}
+
+func NewTopTracker() *TopTracker {
+	return &TopTracker{
+		open:      make(map[topKey]*list.Element),
+		openOrder: list.New(),
+		pairs:     make(map[topPairKey]*TopPair),
+		now:       time.Now,
+	}
+}
+
+// record takes a record of the metric ringbuf, a nil tracker ignores it
+func (t *TopTracker) record(data requestMetric, accesslog logInfo) {
+	if t == nil {
+		return
+	}
+
+	key := topKey{src: data.src, dst: data.dst, srcPort: data.srcPort, dstPort: data.dstPort}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	if data.state != TCP_CLOSTED {
+		if _, ok := t.open[key]; ok {
+			return
+		}
+		conn := newTopConnection(key, data, accesslog, now)
+		if len(t.open) >= topMaxOpen {
+			t.dropOldestOpen()
+		}
+		t.open[key] = t.openOrder.PushBack(conn)
+		if pair := t.pair(conn, now); pair != nil {
+			pair.Active++
+			pair.Opened++
+		}
+		return
+	}
+
+	var conn *TopConnection
+	elem, ok := t.open[key]
+	if ok {
+		conn = t.openOrder.Remove(elem).(*TopConnection)
+		delete(t.open, key)
+		if pair := t.pair(conn, now); pair != nil && pair.Active > 0 {
+			pair.Active--
+		}
+	} else {
+		if t.recentlyClosed(key) {
+			// the other side of a connection between two local pods
+			return
+		}
+		conn = newTopConnection(key, data, accesslog, now)
+		conn.Opened = now.Add(-time.Duration(data.duration))
+		if pair := t.pair(conn, now); pair != nil {
+			pair.Opened++
+		}
+	}
+
+	conn.Closed = &now
+	conn.SentBytes, conn.ReceivedBytes = uint64(data.sentBytes), uint64(data.receivedBytes)
+	if data.direction == constants.INBOUND {
+		conn.SentBytes, conn.ReceivedBytes = conn.ReceivedBytes, conn.SentBytes
+	}
+	if seconds := time.Duration(data.duration).Seconds(); seconds > 0 {
+		conn.BytesPerSecond = float64(conn.SentBytes+conn.ReceivedBytes) / seconds
+	}
+	conn.ResponseFlags = accesslog.responseFlags
+	t.closed = appendRecent(t.closed, conn)
+
+	denied := data.connFlags&connFlagAuthDenied != 0
+	if denied {
+		t.deniedTotal++
+		t.denies = appendRecent(t.denies, conn)
+	}
+	if pair := t.pair(conn, now); pair != nil {
+		pair.Closed++
+		pair.SentBytes += conn.SentBytes
+		pair.ReceivedBytes += conn.ReceivedBytes
+		if data.success != connection_success {
+			pair.Failed++
+		}
+		if denied {
+			pair.Denied++
+		}
+	}
+}
+
+// topAggregate is the increase of a pair counted by the bpf probe instead of
+// reported through the ringbuf
+type topAggregate struct {
+	data      requestMetric
+	accesslog logInfo
+	delta     tcpProbePairStats
+}
+
+// recordAggregated adds the connections counted by pair in bpf to the pairs, they
+// are too short lived to be listed on their own. A pair of two local pods is
+// counted by both sides, only the client side is taken.
+func (t *TopTracker) recordAggregated(batch []topAggregate) {
+	if t == nil || len(batch) == 0 {
+		return
+	}
+
+	outbound := make(map[topKey]struct{}, len(batch))
+	for i := range batch {
+		if batch[i].data.direction == constants.OUTBOUND {
+			outbound[aggregateKeyOf(&batch[i].data)] = struct{}{}
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	for i := range batch {
+		aggregate := &batch[i]
+		if aggregate.data.direction == constants.INBOUND {
+			if _, ok := outbound[aggregateKeyOf(&aggregate.data)]; ok {
+				continue
+			}
+		}
+		conn := newTopConnection(topKey{}, aggregate.data, aggregate.accesslog, now)
+		pair := t.pair(conn, now)
+		if pair == nil {
+			continue
+		}
+		delta := aggregate.delta
+		sent, received := delta.SentBytes, delta.ReceivedBytes
+		if aggregate.data.direction == constants.INBOUND {
+			sent, received = received, sent
+		}
+		pair.Opened += delta.Opened
+		pair.Closed += delta.Closed
+		pair.SentBytes += sent
+		pair.ReceivedBytes += received
+		if aggregate.data.success != connection_success {
+			pair.Failed += delta.Closed
+		}
+		if aggregate.data.connFlags&connFlagAuthDenied != 0 {
+			pair.Denied += delta.Closed
+			t.deniedTotal += delta.Closed
+		}
+	}
+}
+
+// aggregateKeyOf identifies the pairs of both sides, which leave out the client port
+func aggregateKeyOf(data *requestMetric) topKey {
+	return topKey{src: data.src, dst: data.dst, dstPort: data.dstPort}
+}
+
+func newTopConnection(key topKey, data requestMetric, accesslog logInfo, now time.Time) *TopConnection {
+	conn := &TopConnection{
+		Source:             accesslog.sourceAddress,
+		Destination:        accesslog.destinationAddress,
+		SourceWorkload:     namespacedName(accesslog.sourceNamespace, accesslog.sourceWorkload),
+		DestinationService: accesslog.destinationService,
+		Direction:          accesslog.direction,
+		Opened:             now,
+		key:                key,
+	}
+	if accesslog.destinationWorkload != "" {
+		conn.DestinationWorkload = namespacedName(accesslog.destinationNamespace, accesslog.destinationWorkload)
+	}
+	return conn
+}
+
+func namespacedName(namespace, name string) string {
+	if name == "" {
+		return ""
+	}
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// pair returns the pair of the connection, nil if there are too many pairs
+func (t *TopTracker) pair(conn *TopConnection, now time.Time) *TopPair {
+	key := pairKeyOf(conn)
+	pair, ok := t.pairs[key]
+	if !ok {
+		if len(t.pairs) >= topMaxPairs {
+			t.dropIdlePairs(now)
+			if len(t.pairs) >= topMaxPairs {
+				return nil
+			}
+		}
+		pair = &TopPair{SourceWorkload: key.source, DestinationWorkload: key.destination}
+		t.pairs[key] = pair
+	}
+	pair.lastSeen = now
+	return pair
+}
+
+func (t *TopTracker) dropIdlePairs(now time.Time) {
+	for key, pair := range t.pairs {
+		if pair.Active == 0 && now.Sub(pair.lastSeen) > topPairIdle {
+			delete(t.pairs, key)
+		}
+	}
+}
+
+// dropOldestOpen forgets the oldest open connection, its close report is then
+// counted as a connection opened before the daemon started
+func (t *TopTracker) dropOldestOpen() {
+	elem := t.openOrder.Front()
+	if elem == nil {
+		return
+	}
+	oldest := t.openOrder.Remove(elem).(*TopConnection)
+	delete(t.open, oldest.key)
+	if pair, ok := t.pairs[pairKeyOf(oldest)]; ok && pair.Active > 0 {
+		pair.Active--
+	}
+}
+
+// pairKeyOf groups the connections of workloads not in the cache under unknown
+func pairKeyOf(conn *TopConnection) topPairKey {
+	key := topPairKey{source: conn.SourceWorkload, destination: conn.DestinationWorkload}
+	if key.source == "" {
+		key.source = "unknown"
+	}
+	if key.destination == "" {
+		key.destination = "unknown"
+	}
+	return key
+}
+
+func (t *TopTracker) recentlyClosed(key topKey) bool {
+	for i := len(t.closed) - 1; i >= 0; i-- {
+		if t.closed[i].key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func appendRecent(recent []*TopConnection, conn *TopConnection) []*TopConnection {
+	if len(recent) >= topMaxRecent {
+		recent = append(recent[:0], recent[1:]...)
+	}
+	return append(recent, conn)
+}
+
+// Snapshot returns a copy of the view with at most limit entries per list, 0 means
+// no limit. The rates of the pairs are left to Stream.
+func (t *TopTracker) Snapshot(limit int) *TopSnapshot {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	snapshot := &TopSnapshot{
+		Time:            t.now(),
+		OpenConnections: len(t.open),
+		Connections:     make([]*TopConnection, 0, len(t.open)),
+		Closed:          make([]*TopConnection, 0, len(t.closed)),
+		Pairs:           make([]*TopPair, 0, len(t.pairs)),
+		Denies:          make([]*TopConnection, 0, len(t.denies)),
+		DeniedTotal:     t.deniedTotal,
+	}
+	for elem := t.openOrder.Front(); elem != nil; elem = elem.Next() {
+		c := *elem.Value.(*TopConnection)
+		snapshot.Connections = append(snapshot.Connections, &c)
+	}
+	for _, conn := range t.closed {
+		c := *conn
+		snapshot.Closed = append(snapshot.Closed, &c)
+	}
+	sort.SliceStable(snapshot.Closed, func(i, j int) bool {
+		return snapshot.Closed[i].SentBytes+snapshot.Closed[i].ReceivedBytes > snapshot.Closed[j].SentBytes+snapshot.Closed[j].ReceivedBytes
+	})
+	for i := len(t.denies) - 1; i >= 0; i-- {
+		c := *t.denies[i]
+		snapshot.Denies = append(snapshot.Denies, &c)
+	}
+	for _, pair := range t.pairs {
+		p := *pair
+		snapshot.Pairs = append(snapshot.Pairs, &p)
+	}
+	sortPairs(snapshot.Pairs)
+	sortConnections(snapshot)
+	snapshot.truncate(limit)
+	return snapshot
+}
+
+// truncate keeps at most limit entries per list, 0 means no limit
+func (s *TopSnapshot) truncate(limit int) {
+	s.Connections = truncate(s.Connections, limit)
+	s.Closed = truncate(s.Closed, limit)
+	s.Pairs = truncate(s.Pairs, limit)
+	s.Denies = truncate(s.Denies, limit)
+}
+
+func sortPairs(pairs []*TopPair) {
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].BytesPerSecond != pairs[j].BytesPerSecond {
+			return pairs[i].BytesPerSecond > pairs[j].BytesPerSecond
+		}
+		if pairs[i].SentBytes+pairs[i].ReceivedBytes != pairs[j].SentBytes+pairs[j].ReceivedBytes {
+			return pairs[i].SentBytes+pairs[i].ReceivedBytes > pairs[j].SentBytes+pairs[j].ReceivedBytes
+		}
+		if pairs[i].SourceWorkload != pairs[j].SourceWorkload {
+			return pairs[i].SourceWorkload < pairs[j].SourceWorkload
+		}
+		return pairs[i].DestinationWorkload < pairs[j].DestinationWorkload
+	})
+}
+
+// sortConnections ranks the open connections by the traffic of their pair, the
+// oldest first within a pair. The connections are in open order already.
+func sortConnections(s *TopSnapshot) {
+	rank := make(map[topPairKey]int, len(s.Pairs))
+	for i, pair := range s.Pairs {
+		rank[topPairKey{source: pair.SourceWorkload, destination: pair.DestinationWorkload}] = i
+	}
+	sort.SliceStable(s.Connections, func(i, j int) bool {
+		ri, ok := rank[pairKeyOf(s.Connections[i])]
+		if !ok {
+			ri = len(s.Pairs)
+		}
+		rj, ok := rank[pairKeyOf(s.Connections[j])]
+		if !ok {
+			rj = len(s.Pairs)
+		}
+		return ri < rj
+	})
+}
+
+func truncate[T any](s []T, limit int) []T {
+	if limit > 0 && len(s) > limit {
+		return s[:limit]
+	}
+	return s
+}
+
+// Stream emits a snapshot every interval until the context is done, emit fails or
+// count snapshots are emitted, 0 means no limit. The pair rates are the increase
+// since the previous snapshot.
+func (t *TopTracker) Stream(ctx context.Context, interval time.Duration, limit, count int, emit func(*TopSnapshot) error) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var prev *TopSnapshot
+	for n := 0; count == 0 || n < count; n++ {
+		if n > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+		}
+		snapshot := t.Snapshot(0)
+		setPairRates(snapshot, prev)
+		sortConnections(snapshot)
+		prev = snapshot
+
+		frame := *snapshot
+		frame.truncate(limit)
+		if err := emit(&frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setPairRates(snapshot, prev *TopSnapshot) {
+	if prev == nil {
+		return
+	}
+	seconds := snapshot.Time.Sub(prev.Time).Seconds()
+	if seconds <= 0 {
+		return
+	}
+	last := make(map[topPairKey]*TopPair, len(prev.Pairs))
+	for _, pair := range prev.Pairs {
+		last[topPairKey{source: pair.SourceWorkload, destination: pair.DestinationWorkload}] = pair
+	}
+	for _, pair := range snapshot.Pairs {
+		bytes := pair.SentBytes + pair.ReceivedBytes
+		if p, ok := last[topPairKey{source: pair.SourceWorkload, destination: pair.DestinationWorkload}]; ok {
+			bytes -= min(bytes, p.SentBytes+p.ReceivedBytes)
+		}
+		pair.BytesPerSecond = float64(bytes) / seconds
+		snapshot.BytesPerSecond += pair.BytesPerSecond
+	}
+	sortPairs(snapshot.Pairs)
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+func newTopRecord(srcPort uint16, direction, state uint32) (requestMetric, logInfo) {
+	data := requestMetric{
+		src:       [4]uint32{0x0100000a},
+		dst:       [4]uint32{0x0200000a},
+		srcPort:   srcPort,
+		dstPort:   8080,
+		direction: direction,
+		state:     state,
+		success:   connection_success,
+	}
+	info := logInfo{
+		direction:            "OUTBOUND",
+		sourceAddress:        "10.0.0.1:1000",
+		sourceWorkload:       "sleep-1",
+		sourceNamespace:      "default",
+		destinationAddress:   "10.0.0.2:8080",
+		destinationWorkload:  "httpbin-1",
+		destinationNamespace: "default",
+		destinationService:   "httpbin.default.svc.cluster.local",
+	}
+	if direction == constants.INBOUND {
+		info.direction = "INBOUND"
+	}
+	return data, info
+}
+
+func TestTopTracker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tracker := NewTopTracker()
+	tracker.now = func() time.Time { return now }
+
+	// a connection between two local pods is reported by both sides
+	tracker.record(newTopRecord(1000, constants.OUTBOUND, TCP_ESTABLISHED))
+	tracker.record(newTopRecord(1000, constants.INBOUND, TCP_ESTABLISHED))
+	tracker.record(newTopRecord(1001, constants.OUTBOUND, TCP_ESTABLISHED))
+
+	snapshot := tracker.Snapshot(0)
+	assert.Equal(t, 2, snapshot.OpenConnections)
+	assert.Len(t, snapshot.Pairs, 1)
+	assert.Equal(t, 2, snapshot.Pairs[0].Active)
+	assert.Equal(t, uint64(2), snapshot.Pairs[0].Opened)
+
+	now = now.Add(2 * time.Second)
+	data, info := newTopRecord(1000, constants.OUTBOUND, TCP_CLOSTED)
+	data.sentBytes, data.receivedBytes, data.duration = 100, 300, uint64(2*time.Second)
+	tracker.record(data, info)
+	// the server side counts the same bytes the other way around
+	data, info = newTopRecord(1000, constants.INBOUND, TCP_CLOSTED)
+	data.sentBytes, data.receivedBytes, data.duration = 300, 100, uint64(2*time.Second)
+	tracker.record(data, info)
+	data, info = newTopRecord(1001, constants.OUTBOUND, TCP_CLOSTED)
+	data.connFlags = connFlagReset | connFlagAuthDenied
+	info.responseFlags = "UAEX"
+	tracker.record(data, info)
+
+	snapshot = tracker.Snapshot(1)
+	assert.Equal(t, 0, snapshot.OpenConnections)
+	assert.Len(t, snapshot.Closed, 1)
+	closed := snapshot.Closed[0]
+	assert.Equal(t, "default/sleep-1", closed.SourceWorkload)
+	assert.Equal(t, "default/httpbin-1", closed.DestinationWorkload)
+	assert.Equal(t, uint64(100), closed.SentBytes)
+	assert.Equal(t, uint64(300), closed.ReceivedBytes)
+	assert.Equal(t, float64(200), closed.BytesPerSecond)
+	assert.NotNil(t, closed.Closed)
+	assert.Equal(t, uint64(1), snapshot.DeniedTotal)
+	assert.Len(t, snapshot.Denies, 1)
+	assert.Equal(t, "UAEX", snapshot.Denies[0].ResponseFlags)
+
+	pair := snapshot.Pairs[0]
+	assert.Equal(t, 0, pair.Active)
+	assert.Equal(t, uint64(2), pair.Closed)
+	assert.Equal(t, uint64(1), pair.Denied)
+	assert.Equal(t, uint64(400), pair.SentBytes+pair.ReceivedBytes)
+}
+
+func TestTopTrackerStream(t *testing.T) {
+	tracker := NewTopTracker()
+
+	var snapshots []*TopSnapshot
+	err := tracker.Stream(context.Background(), 10*time.Millisecond, 10, 2, func(s *TopSnapshot) error {
+		snapshots = append(snapshots, s)
+		if len(snapshots) == 1 {
+			data, info := newTopRecord(1000, constants.OUTBOUND, TCP_CLOSTED)
+			data.sentBytes, data.receivedBytes = 1000, 1000
+			tracker.record(data, info)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, snapshots, 2)
+	assert.Empty(t, snapshots[0].Pairs)
+	assert.Len(t, snapshots[1].Pairs, 1)
+	assert.Greater(t, snapshots[1].Pairs[0].BytesPerSecond, float64(0))
+	assert.Equal(t, snapshots[1].Pairs[0].BytesPerSecond, snapshots[1].BytesPerSecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = tracker.Stream(ctx, time.Hour, 10, 0, func(s *TopSnapshot) error { return nil })
+	assert.ErrorIs(t, err, context.Canceled)
+
+	var nilTracker *TopTracker
+	nilTracker.record(newTopRecord(1000, constants.OUTBOUND, TCP_ESTABLISHED))
+}
+
+func TestTopTrackerOpenConnections(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tracker := NewTopTracker()
+	tracker.now = func() time.Time { return now }
+
+	for port := 0; port <= topMaxOpen; port++ {
+		tracker.record(newTopRecord(uint16(port), constants.OUTBOUND, TCP_ESTABLISHED))
+		now = now.Add(time.Millisecond)
+	}
+	// the oldest connection is dropped beyond the bound
+	snapshot := tracker.Snapshot(0)
+	assert.Equal(t, topMaxOpen, snapshot.OpenConnections)
+	assert.Equal(t, uint16(1), snapshot.Connections[0].key.srcPort)
+	assert.Equal(t, topMaxOpen, snapshot.Pairs[0].Active)
+
+	// a busier pair is listed first, although its connection is the newest
+	data, info := newTopRecord(30000, constants.OUTBOUND, TCP_ESTABLISHED)
+	info.destinationWorkload = "productpage-1"
+	tracker.record(data, info)
+	data.state, data.sentBytes = TCP_CLOSTED, 1000
+	tracker.record(data, info)
+	data.srcPort, data.state, data.sentBytes = 30001, TCP_ESTABLISHED, 0
+	tracker.record(data, info)
+
+	snapshot = tracker.Snapshot(2)
+	assert.Len(t, snapshot.Connections, 2)
+	assert.Equal(t, "default/productpage-1", snapshot.Connections[0].DestinationWorkload)
+	assert.Equal(t, uint16(2), snapshot.Connections[1].key.srcPort)
+}
+
+func TestTopTrackerAggregated(t *testing.T) {
+	tracker := NewTopTracker()
+	aggregate := func(direction uint32, src uint32, delta tcpProbePairStats) topAggregate {
+		data, info := newTopRecord(0, direction, TCP_CLOSTED)
+		data.src = [4]uint32{src}
+		return topAggregate{data: data, accesslog: info, delta: delta}
+	}
+
+	tracker.recordAggregated([]topAggregate{
+		aggregate(constants.OUTBOUND, 0x0100000a, tcpProbePairStats{Opened: 3, Closed: 3, SentBytes: 30, ReceivedBytes: 90}),
+		// the server side of the same local connections
+		aggregate(constants.INBOUND, 0x0100000a, tcpProbePairStats{Opened: 3, Closed: 3, SentBytes: 90, ReceivedBytes: 30}),
+		// a client on another node
+		aggregate(constants.INBOUND, 0x0300000a, tcpProbePairStats{Opened: 1, Closed: 1, SentBytes: 10, ReceivedBytes: 5}),
+	})
+	denied := aggregate(constants.OUTBOUND, 0x0100000a, tcpProbePairStats{Opened: 2, Closed: 2})
+	denied.data.connFlags = connFlagAuthDenied
+	denied.data.success = 0
+	tracker.recordAggregated([]topAggregate{denied})
+
+	snapshot := tracker.Snapshot(0)
+	assert.Equal(t, 0, snapshot.OpenConnections)
+	assert.Len(t, snapshot.Pairs, 1)
+	pair := snapshot.Pairs[0]
+	assert.Equal(t, 0, pair.Active)
+	assert.Equal(t, uint64(6), pair.Opened)
+	assert.Equal(t, uint64(6), pair.Closed)
+	assert.Equal(t, uint64(35), pair.SentBytes)
+	assert.Equal(t, uint64(100), pair.ReceivedBytes)
+	assert.Equal(t, uint64(2), pair.Failed)
+	assert.Equal(t, uint64(2), pair.Denied)
+	assert.Equal(t, uint64(2), snapshot.DeniedTotal)
+
+	var nilTracker *TopTracker
+	nilTracker.recordAggregated([]topAggregate{denied})
+}
@@ -116,63 +116,167 @@ var (
 )
 
 var (
-	tcpConnectionOpenedInWorkload = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	tcpConnectionOpenedInWorkload = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "kmesh_tcp_workload_connections_opened_total",
 		Help: "The total number of TCP connections opened to a workload",
 	}, workloadLabels)
 
-	tcpConnectionClosedInWorkload = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
+	tcpConnectionClosedInWorkload = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
 			Name: "kmesh_tcp_workload_connections_closed_total",
 			Help: "The total number of TCP connections closed to a workload",
 		}, workloadLabels)
 
-	tcpReceivedBytesInWorkload = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
+	tcpReceivedBytesInWorkload = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
 			Name: "kmesh_tcp_workload_received_bytes_total",
 			Help: "The size of the total number of bytes received in response to a workload over a TCP connection.",
 		}, workloadLabels)
 
-	tcpSentBytesInWorkload = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
+	tcpSentBytesInWorkload = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
 			Name: "kmesh_tcp_workload_sent_bytes_total",
 			Help: "The size of the total number of bytes sent in response to a workload over a TCP connection.",
 		}, workloadLabels)
 
-	tcpConnectionFailedInWorkload = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
+	tcpConnectionFailedInWorkload = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
 			Name: "kmesh_tcp_workload_conntections_failed_total",
 			Help: "The total number of TCP connections failed to a workload.",
 		}, workloadLabels)
 
-	tcpConnectionOpenedInService = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "kmesh_tcp_connections_opened_total",
+	// The service metrics use the same names as the istio standard metrics,
+	// so that the dashboards built for sidecars work unchanged.
+	tcpConnectionOpenedInService = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "istio_tcp_connections_opened_total",
 		Help: "The total number of TCP connections opened to a service",
 	}, serviceLabels)
 
-	tcpConnectionClosedInService = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "kmesh_tcp_connections_closed_total",
+	tcpConnectionClosedInService = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "istio_tcp_connections_closed_total",
 			Help: "The total number of TCP connections closed to a service",
 		}, serviceLabels)
 
-	tcpReceivedBytesInService = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "kmesh_tcp_received_bytes_total",
+	tcpReceivedBytesInService = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "istio_tcp_received_bytes_total",
 			Help: "The size of the total number of bytes reveiced in response to a service over a TCP connection.",
 		}, serviceLabels)
 
-	tcpSentBytesInService = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "kmesh_tcp_sent_bytes_total",
+	tcpSentBytesInService = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "istio_tcp_sent_bytes_total",
 			Help: "The size of the total number of bytes sent in response to a service over a TCP connection.",
 		}, serviceLabels)
 
-	tcpConnectionFailedInService = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "kmesh_tcp_conntections_failed_total",
+	tcpConnectionFailedInService = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "istio_tcp_connections_failed_total",
 			Help: "The total number of TCP connections failed to a service.",
 		}, serviceLabels)
+
+	// The service counters were named kmesh_tcp_* before they took the istio names,
+	// the old names are kept for a release so that dashboards can move over.
+	// TODO: remove the deprecated service counters in the next release
+	deprecatedTcpConnectionOpenedInService = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kmesh_tcp_connections_opened_total",
+		Help: "Deprecated, use istio_tcp_connections_opened_total.",
+	}, serviceLabels)
+
+	deprecatedTcpConnectionClosedInService = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kmesh_tcp_connections_closed_total",
+			Help: "Deprecated, use istio_tcp_connections_closed_total.",
+		}, serviceLabels)
+
+	deprecatedTcpReceivedBytesInService = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kmesh_tcp_received_bytes_total",
+			Help: "Deprecated, use istio_tcp_received_bytes_total.",
+		}, serviceLabels)
+
+	deprecatedTcpSentBytesInService = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kmesh_tcp_sent_bytes_total",
+			Help: "Deprecated, use istio_tcp_sent_bytes_total.",
+		}, serviceLabels)
+
+	deprecatedTcpConnectionFailedInService = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kmesh_tcp_conntections_failed_total",
+			Help: "Deprecated, use istio_tcp_connections_failed_total.",
+		}, serviceLabels)
+
+	tcpRetransmittedSegmentsInService = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kmesh_tcp_retransmitted_segments_total",
+			Help: "The total number of TCP segments retransmitted on connections to a service.",
+		}, serviceLabels)
+
+	tcpSentSegmentsInService = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kmesh_tcp_sent_segments_total",
+			Help: "The total number of TCP segments sent on connections to a service.",
+		}, serviceLabels)
+
+	// 1ms to about 70 minutes
+	tcpConnectionDurationInService = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "kmesh_tcp_connection_duration_seconds",
+			Help:    "The duration of closed TCP connections to a service.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 12),
+		}, serviceLabels)
+
+	// 64B to 256MB
+	tcpConnectionSentBytesInService = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "kmesh_tcp_connection_sent_bytes",
+			Help:    "The number of bytes sent per closed TCP connection to a service.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 12),
+		}, serviceLabels)
+
+	tcpConnectionReceivedBytesInService = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "kmesh_tcp_connection_received_bytes",
+			Help:    "The number of bytes received per closed TCP connection to a service.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 12),
+		}, serviceLabels)
+
+	// 100us to about 3 seconds
+	tcpSmoothedRttInService = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "kmesh_tcp_smoothed_rtt_seconds",
+			Help:    "The smoothed round trip time of closed TCP connections to a service.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+		}, serviceLabels)
+
+	workloadMetrics = []*prometheus.MetricVec{
+		tcpConnectionOpenedInWorkload.MetricVec,
+		tcpConnectionClosedInWorkload.MetricVec,
+		tcpReceivedBytesInWorkload.MetricVec,
+		tcpSentBytesInWorkload.MetricVec,
+		tcpConnectionFailedInWorkload.MetricVec,
+	}
+
+	serviceMetrics = []*prometheus.MetricVec{
+		tcpConnectionOpenedInService.MetricVec,
+		tcpConnectionClosedInService.MetricVec,
+		tcpReceivedBytesInService.MetricVec,
+		tcpSentBytesInService.MetricVec,
+		tcpConnectionFailedInService.MetricVec,
+		tcpRetransmittedSegmentsInService.MetricVec,
+		tcpSentSegmentsInService.MetricVec,
+		tcpConnectionDurationInService.MetricVec,
+		tcpConnectionSentBytesInService.MetricVec,
+		tcpConnectionReceivedBytesInService.MetricVec,
+		tcpSmoothedRttInService.MetricVec,
+		deprecatedTcpConnectionOpenedInService.MetricVec,
+		deprecatedTcpConnectionClosedInService.MetricVec,
+		deprecatedTcpReceivedBytesInService.MetricVec,
+		deprecatedTcpSentBytesInService.MetricVec,
+		deprecatedTcpConnectionFailedInService.MetricVec,
+	}
 )
 
 func RunPrometheusClient(ctx context.Context) {
@@ -191,8 +295,7 @@ func runPrometheusClient(registry *prometheus.Registry) {
 	// ensure not occur matche the same requests as /status/metric panic
 	mu.Lock()
 	defer mu.Unlock()
-	registry.MustRegister(tcpConnectionOpenedInWorkload, tcpConnectionClosedInWorkload, tcpReceivedBytesInWorkload, tcpSentBytesInWorkload)
-	registry.MustRegister(tcpConnectionOpenedInService, tcpConnectionClosedInService, tcpReceivedBytesInService, tcpSentBytesInService)
+	registerMetrics(registry)
 
 	http.Handle("/status/metric", promhttp.HandlerFor(registry, promhttp.HandlerOpts{
 		Registry: registry,
@@ -202,16 +305,37 @@ func runPrometheusClient(registry *prometheus.Registry) {
 	}
 }
 
+// registerMetrics registers all kmesh metrics to the registry, it is shared by the
+// prometheus endpoint and the otlp exporter
+func registerMetrics(registry *prometheus.Registry) {
+	registry.MustRegister(tcpConnectionOpenedInWorkload, tcpConnectionClosedInWorkload, tcpReceivedBytesInWorkload, tcpSentBytesInWorkload,
+		tcpConnectionFailedInWorkload)
+	registry.MustRegister(tcpConnectionOpenedInService, tcpConnectionClosedInService, tcpReceivedBytesInService, tcpSentBytesInService,
+		tcpConnectionFailedInService, tcpRetransmittedSegmentsInService, tcpSentSegmentsInService)
+	registry.MustRegister(tcpConnectionDurationInService, tcpConnectionSentBytesInService, tcpConnectionReceivedBytesInService,
+		tcpSmoothedRttInService)
+	registry.MustRegister(deprecatedTcpConnectionOpenedInService, deprecatedTcpConnectionClosedInService,
+		deprecatedTcpReceivedBytesInService, deprecatedTcpSentBytesInService, deprecatedTcpConnectionFailedInService)
+	registry.MustRegister(metricSeriesTracked, metricSeriesOverflow, metricSeriesExpired)
+	registry.MustRegister(flowRecordsExported, flowRecordsDropped, accesslogRecordsDropped)
+	registry.MustRegister(tcpProbeRingbufDropped, tcpProbeEventsExcluded, tcpProbeEventsAggregated)
+	registry.MustRegister(CaRequests, CaFailovers, CaFetchRetries, CaRetryBudgetExhausted)
+	registry.MustRegister(CertExpirySeconds, CertRotations, CertRotationFailures)
+	registry.MustRegister(ConsistencyDriftEntries, ConsistencyChecks, ConsistencyRepairs)
+	registry.MustRegister(bpfMapEntries, bpfMapMaxEntries)
+	registry.MustRegister(EnrollmentDrift, EnrollmentRepairs)
+	registry.MustRegister(CniConfigRepairs)
+}
+
 func DeleteWorkloadMetric(workload *workloadapi.Workload) {
 	if workload == nil {
 		return
 	}
 
-	_ = tcpConnectionClosedInWorkload.DeletePartialMatch(prometheus.Labels{"destination_pod_name": workload.Name, "destination_pod_namespace": workload.Namespace})
-	_ = tcpConnectionFailedInWorkload.DeletePartialMatch(prometheus.Labels{"destination_pod_name": workload.Name, "destination_pod_namespace": workload.Namespace})
-	_ = tcpConnectionOpenedInWorkload.DeletePartialMatch(prometheus.Labels{"destination_pod_name": workload.Name, "destination_pod_namespace": workload.Namespace})
-	_ = tcpReceivedBytesInWorkload.DeletePartialMatch(prometheus.Labels{"destination_pod_name": workload.Name, "destination_pod_namespace": workload.Namespace})
-	_ = tcpSentBytesInWorkload.DeletePartialMatch(prometheus.Labels{"destination_pod_name": workload.Name, "destination_pod_namespace": workload.Namespace})
+	for _, metric := range workloadMetrics {
+		_ = metric.DeletePartialMatch(prometheus.Labels{"destination_pod_name": workload.Name, "destination_pod_namespace": workload.Namespace})
+	}
+	podConnections.delete(workload.Namespace, workload.Name)
 }
 
 func DeleteServiceMetric(serviceName string) {
@@ -228,9 +352,7 @@ func DeleteServiceMetric(serviceName string) {
 		svcHost = strings.Split(serviceName, "/")[1]
 	}
 
-	_ = tcpConnectionClosedInService.DeletePartialMatch(prometheus.Labels{"destination_service_name": svcHost, "destination_service_namespace": svcNamespace})
-	_ = tcpConnectionFailedInService.DeletePartialMatch(prometheus.Labels{"destination_service_name": svcHost, "destination_service_namespace": svcNamespace})
-	_ = tcpConnectionOpenedInService.DeletePartialMatch(prometheus.Labels{"destination_service_name": svcHost, "destination_service_namespace": svcNamespace})
-	_ = tcpReceivedBytesInService.DeletePartialMatch(prometheus.Labels{"destination_service_name": svcHost, "destination_service_namespace": svcNamespace})
-	_ = tcpSentBytesInService.DeletePartialMatch(prometheus.Labels{"destination_service_name": svcHost, "destination_service_namespace": svcNamespace})
+	for _, metric := range serviceMetrics {
+		_ = metric.DeletePartialMatch(prometheus.Labels{"destination_service_name": svcHost, "destination_service_namespace": svcNamespace})
+	}
 }
@@ -39,7 +39,7 @@ func TestRegisterMetrics(t *testing.T) {
 		}
 	}()
 
-	exportMetrics := []*prometheus.GaugeVec{
+	exportMetrics := []*prometheus.CounterVec{
 		tcpConnectionClosedInWorkload,
 		tcpConnectionOpenedInWorkload,
 		tcpReceivedBytesInWorkload,
@@ -104,17 +104,17 @@ func TestRegisterMetrics(t *testing.T) {
 		"connection_security_policy":     "mutual_tls",
 	}
 
-	tcpConnectionClosedInWorkload.With(workloadLabels).Set(2)
-	tcpConnectionOpenedInWorkload.With(workloadLabels).Set(4)
-	tcpReceivedBytesInWorkload.With(workloadLabels).Set(12.64)
-	tcpSentBytesInWorkload.With(workloadLabels).Set(11.45)
-	tcpConnectionFailedInWorkload.With(workloadLabels).Set(1.0)
+	tcpConnectionClosedInWorkload.With(workloadLabels).Add(2)
+	tcpConnectionOpenedInWorkload.With(workloadLabels).Add(4)
+	tcpReceivedBytesInWorkload.With(workloadLabels).Add(12.64)
+	tcpSentBytesInWorkload.With(workloadLabels).Add(11.45)
+	tcpConnectionFailedInWorkload.With(workloadLabels).Add(1.0)
 
-	tcpConnectionClosedInService.With(serviceLabels).Set(4)
-	tcpReceivedBytesInService.With(serviceLabels).Set(8)
-	tcpSentBytesInService.With(serviceLabels).Set(9)
-	tcpConnectionOpenedInService.With(serviceLabels).Set(16.25)
-	tcpConnectionFailedInService.With(serviceLabels).Set(6.0)
+	tcpConnectionClosedInService.With(serviceLabels).Add(4)
+	tcpReceivedBytesInService.With(serviceLabels).Add(8)
+	tcpSentBytesInService.With(serviceLabels).Add(9)
+	tcpConnectionOpenedInService.With(serviceLabels).Add(16.25)
+	tcpConnectionFailedInService.With(serviceLabels).Add(6.0)
 
 	for _, metric := range exportMetrics {
 		if err := prometheus.Register(metric); err != nil {
@@ -138,7 +138,7 @@ func TestDeleteWorkloadMetric(t *testing.T) {
 		}
 	}()
 
-	exportMetrics := []*prometheus.GaugeVec{
+	exportMetrics := []*prometheus.CounterVec{
 		tcpConnectionClosedInWorkload,
 		tcpConnectionOpenedInWorkload,
 		tcpReceivedBytesInWorkload,
@@ -190,11 +190,11 @@ func TestDeleteWorkloadMetric(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tcpConnectionClosedInWorkload.With(workloadLabels).Set(2)
-			tcpConnectionOpenedInWorkload.With(workloadLabels).Set(4)
-			tcpReceivedBytesInWorkload.With(workloadLabels).Set(12.64)
-			tcpSentBytesInWorkload.With(workloadLabels).Set(11.45)
-			tcpConnectionFailedInWorkload.With(workloadLabels).Set(1.0)
+			tcpConnectionClosedInWorkload.With(workloadLabels).Add(2)
+			tcpConnectionOpenedInWorkload.With(workloadLabels).Add(4)
+			tcpReceivedBytesInWorkload.With(workloadLabels).Add(12.64)
+			tcpSentBytesInWorkload.With(workloadLabels).Add(11.45)
+			tcpConnectionFailedInWorkload.With(workloadLabels).Add(1.0)
 
 			DeleteWorkloadMetric(tt.args.workload)
 
@@ -222,7 +222,7 @@ func TestDeleteServiceMetric(t *testing.T) {
 		}
 	}()
 
-	exportMetrics := []*prometheus.GaugeVec{
+	exportMetrics := []*prometheus.CounterVec{
 		tcpConnectionClosedInService,
 		tcpConnectionOpenedInService,
 		tcpReceivedBytesInService,
@@ -271,11 +271,11 @@ func TestDeleteServiceMetric(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tcpConnectionClosedInService.With(serviceLabels).Set(4)
-			tcpReceivedBytesInService.With(serviceLabels).Set(8)
-			tcpSentBytesInService.With(serviceLabels).Set(9)
-			tcpConnectionOpenedInService.With(serviceLabels).Set(16.25)
-			tcpConnectionFailedInService.With(serviceLabels).Set(6.0)
+			tcpConnectionClosedInService.With(serviceLabels).Add(4)
+			tcpReceivedBytesInService.With(serviceLabels).Add(8)
+			tcpSentBytesInService.With(serviceLabels).Add(9)
+			tcpConnectionOpenedInService.With(serviceLabels).Add(16.25)
+			tcpConnectionFailedInService.With(serviceLabels).Add(6.0)
 
 			DeleteServiceMetric(tt.args.serviceName)
 			for _, metric := range exportMetrics {
@@ -52,3 +52,8 @@ func (c *Cache) BackendLookup(key *BackendKey, value *BackendValue) error {
 	log.Debugf("BackendLookup [%#v]", *key)
 	return c.bpfMap.KmeshBackend.Lookup(key, value)
 }
+
+// BackendDump returns all the entries of the backend map
+func (c *Cache) BackendDump() (map[BackendKey]BackendValue, error) {
+	return dumpMap[BackendKey, BackendValue](c.bpfMap.KmeshBackend)
+}
@@ -44,6 +44,11 @@ func (c *Cache) EndpointLookup(key *EndpointKey, value *EndpointValue) error {
 	return c.bpfMap.KmeshEndpoint.Lookup(key, value)
 }
 
+// EndpointDump returns all the entries of the endpoint map
+func (c *Cache) EndpointDump() (map[EndpointKey]EndpointValue, error) {
+	return dumpMap[EndpointKey, EndpointValue](c.bpfMap.KmeshEndpoint)
+}
+
 func (c *Cache) EndpointIterFindKey(workloadUid uint32) []EndpointKey {
 	log.Debugf("EndpointIterFindKey [%#v]", workloadUid)
 	var (
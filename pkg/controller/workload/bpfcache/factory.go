@@ -17,6 +17,8 @@
 package bpfcache
 
 import (
+	"github.com/cilium/ebpf"
+
 	"kmesh.net/kmesh/bpf/kmesh/bpf2go"
 	"kmesh.net/kmesh/pkg/logger"
 )
@@ -32,3 +34,18 @@ func NewCache(workloadMap bpf2go.KmeshCgroupSockWorkloadMaps) *Cache {
 		bpfMap: workloadMap,
 	}
 }
+
+// dumpMap reads all the entries of a bpf map
+func dumpMap[K comparable, V any](m *ebpf.Map) (map[K]V, error) {
+	var (
+		key   K
+		value V
+		iter  = m.Iterate()
+	)
+
+	res := make(map[K]V)
+	for iter.Next(&key, &value) {
+		res[key] = value
+	}
+	return res, iter.Err()
+}
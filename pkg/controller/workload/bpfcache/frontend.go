@@ -46,6 +46,11 @@ func (c *Cache) FrontendLookup(key *FrontendKey, value *FrontendValue) error {
 		Lookup(key, value)
 }
 
+// FrontendDump returns all the entries of the frontend map
+func (c *Cache) FrontendDump() (map[FrontendKey]FrontendValue, error) {
+	return dumpMap[FrontendKey, FrontendValue](c.bpfMap.KmeshFrontend)
+}
+
 func (c *Cache) FrontendIterFindKey(upstreamId uint32) []FrontendKey {
 	log.Debugf("FrontendIterFindKey [%#v]", upstreamId)
 	var (
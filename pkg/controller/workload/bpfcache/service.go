@@ -54,3 +54,8 @@ func (c *Cache) ServiceLookup(key *ServiceKey, value *ServiceValue) error {
 	log.Debugf("ServiceLookup [%#v]", *key)
 	return c.bpfMap.KmeshService.Lookup(key, value)
 }
+
+// ServiceDump returns all the entries of the service map
+func (c *Cache) ServiceDump() (map[ServiceKey]ServiceValue, error) {
+	return dumpMap[ServiceKey, ServiceValue](c.bpfMap.KmeshService)
+}
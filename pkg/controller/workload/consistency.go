@@ -0,0 +1,580 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"fmt"
+	"slices"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/consistency"
+	bpf "kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+const (
+	frontendMapName = "kmesh_frontend"
+	serviceMapName  = "kmesh_service"
+	endpointMapName = "kmesh_endpoint"
+	backendMapName  = "kmesh_backend"
+	// hashNameMapName reports the persisted name to id mapping, it is not a bpf map
+	hashNameMapName = "hash_name"
+	// checkAttempts bounds the checks restarted by responses changing the maps during the walk
+	checkAttempts = 3
+)
+
+// expectedBackend is the backend map value derived from a cached workload
+type expectedBackend struct {
+	value bpf.BackendValue
+	// the processor writes the backend once per address and the last one wins,
+	// so any address of the workload is accepted
+	ips      [][16]byte
+	services map[uint32]struct{}
+}
+
+// expectedState is the content of the workload bpf maps according to the caches
+type expectedState struct {
+	// a frontend ip may be claimed by several upstreams, any of them is accepted
+	frontends map[bpf.FrontendKey][]uint32
+	services  map[bpf.ServiceKey]bpf.ServiceValue
+	// service id -> backend uids
+	endpoints map[uint32]map[uint32]struct{}
+	backends  map[bpf.BackendKey]*expectedBackend
+	// service id -> backend uid -> endpoint index recorded by the workload cache
+	relations map[uint32]map[uint32]uint32
+	// hash names not used by the caches
+	dangling map[string]uint32
+}
+
+// bpfState is a snapshot of the workload bpf maps
+type bpfState struct {
+	frontends map[bpf.FrontendKey]bpf.FrontendValue
+	services  map[bpf.ServiceKey]bpf.ServiceValue
+	endpoints map[bpf.EndpointKey]bpf.EndpointValue
+	backends  map[bpf.BackendKey]bpf.BackendValue
+}
+
+// Check compares the workload and service caches with the workload bpf maps.
+// The caches are copied under mu and the maps are walked without it, so the
+// responses are not held up by the walk. The check starts over when a response
+// has changed the maps in the meantime.
+func (p *Processor) Check() ([]consistency.Diff, error) {
+	for i := 0; i < checkAttempts; i++ {
+		p.mu.Lock()
+		generation := p.generation
+		want, diffs := p.snapshot()
+		p.mu.Unlock()
+
+		got, err := p.dumpBpf()
+		if err != nil {
+			return nil, err
+		}
+
+		p.mu.Lock()
+		changed := p.generation != generation
+		p.mu.Unlock()
+		if !changed {
+			return p.diff(want, got, diffs), nil
+		}
+	}
+	return nil, fmt.Errorf("workload bpf maps changed during each of %d checks", checkAttempts)
+}
+
+// Repair rewrites the workload bpf maps from the caches: the extra entries are
+// deleted, the endpoint slots of each service are compacted, the missing and
+// mismatched entries are rewritten and the dangling hash names are released.
+func (p *Processor) Repair() ([]consistency.Diff, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	want, diffs := p.snapshot()
+	got, err := p.dumpBpf()
+	if err != nil {
+		return nil, err
+	}
+	diffs = p.diff(want, got, diffs)
+	if len(diffs) == 0 {
+		return diffs, nil
+	}
+
+	p.generation++
+	want, _ = p.expectedState(func(name string) (uint32, bool) {
+		return p.hashName.StrToNum(name), true
+	})
+	if err = p.repair(want, got); err != nil {
+		return nil, err
+	}
+	log.Infof("repaired %d workload bpf map entries out of sync with the cache", len(diffs))
+	return diffs, nil
+}
+
+// snapshot copies from the caches what the check compares with the maps,
+// the caller holds mu
+func (p *Processor) snapshot() (*expectedState, []consistency.Diff) {
+	want, diffs := p.expectedState(p.hashName.lookup)
+	for serviceId, endpoints := range want.endpoints {
+		relations := make(map[uint32]uint32, len(endpoints))
+		for uid := range endpoints {
+			if relationId, ok := p.WorkloadCache.GetRelationShip(uid, serviceId); ok {
+				relations[uid] = relationId
+			}
+		}
+		want.relations[serviceId] = relations
+	}
+	want.dangling = p.danglingNames()
+	return want, diffs
+}
+
+func (p *Processor) diff(want *expectedState, got *bpfState, diffs []consistency.Diff) []consistency.Diff {
+	diffs = append(diffs, p.compare(want, got)...)
+	for name, num := range want.dangling {
+		diffs = append(diffs, consistency.Diff{
+			Map:    hashNameMapName,
+			Key:    name,
+			Kind:   consistency.Extra,
+			Detail: fmt.Sprintf("id %d is not used by any cached workload or service", num),
+		})
+	}
+	return diffs
+}
+
+// expectedState derives the bpf maps from the caches the same way the processor
+// writes them, the names id cannot resolve are reported missing from the hash name
+func (p *Processor) expectedState(id func(string) (uint32, bool)) (*expectedState, []consistency.Diff) {
+	var diffs []consistency.Diff
+	want := &expectedState{
+		frontends: make(map[bpf.FrontendKey][]uint32),
+		services:  make(map[bpf.ServiceKey]bpf.ServiceValue),
+		endpoints: make(map[uint32]map[uint32]struct{}),
+		backends:  make(map[bpf.BackendKey]*expectedBackend),
+		relations: make(map[uint32]map[uint32]uint32),
+	}
+	unresolved := make(map[string]struct{})
+	resolve := func(name string) (uint32, bool) {
+		num, ok := id(name)
+		if !ok {
+			if _, reported := unresolved[name]; !reported {
+				unresolved[name] = struct{}{}
+				diffs = append(diffs, consistency.Diff{
+					Map:    hashNameMapName,
+					Key:    name,
+					Kind:   consistency.Missing,
+					Detail: "no id allocated for a cached name",
+				})
+			}
+		}
+		return num, ok
+	}
+	addFrontend := func(ip []byte, upstream uint32) {
+		key := bpf.FrontendKey{}
+		nets.CopyIpByteFromSlice(&key.Ip, ip)
+		want.frontends[key] = append(want.frontends[key], upstream)
+	}
+
+	for _, service := range p.ServiceCache.List() {
+		serviceName := service.ResourceName()
+		serviceId, ok := resolve(serviceName)
+		if !ok {
+			continue
+		}
+		want.services[bpf.ServiceKey{ServiceId: serviceId}] = newServiceValue(serviceName, service.GetWaypoint(), service.GetPorts())
+		want.endpoints[serviceId] = make(map[uint32]struct{})
+		for _, networkAddress := range service.GetAddresses() {
+			addFrontend(networkAddress.Address, serviceId)
+		}
+	}
+
+	for _, workload := range p.WorkloadCache.List() {
+		uid, ok := resolve(workload.GetUid())
+		if !ok {
+			continue
+		}
+
+		backend := &expectedBackend{services: make(map[uint32]struct{})}
+		if waypoint := workload.GetWaypoint(); waypoint != nil {
+			nets.CopyIpByteFromSlice(&backend.value.WaypointAddr, waypoint.GetAddress().Address)
+			backend.value.WaypointPort = nets.ConvertPortToBigEndian(waypoint.GetHboneMtlsPort())
+		}
+		for serviceName := range workload.GetServices() {
+			serviceId, ok := resolve(serviceName)
+			if !ok {
+				continue
+			}
+			backend.services[serviceId] = struct{}{}
+			// the endpoints of a service not received yet are only kept in memory
+			if endpoints, ok := want.endpoints[serviceId]; ok {
+				endpoints[uid] = struct{}{}
+			}
+		}
+		serviceIds := make([]uint32, 0, len(backend.services))
+		for serviceId := range backend.services {
+			serviceIds = append(serviceIds, serviceId)
+		}
+		slices.Sort(serviceIds)
+		for _, serviceId := range serviceIds {
+			if backend.value.ServiceCount >= bpf.MaxServiceNum {
+				break
+			}
+			backend.value.Services[backend.value.ServiceCount] = serviceId
+			backend.value.ServiceCount++
+		}
+
+		for _, ip := range workload.GetAddresses() {
+			var addr [16]byte
+			nets.CopyIpByteFromSlice(&addr, ip)
+			backend.ips = append(backend.ips, addr)
+			backend.value.Ip = addr
+			if workload.GetNetworkMode() != workloadapi.NetworkMode_HOST_NETWORK {
+				addFrontend(ip, uid)
+			}
+		}
+		// the backend is written once per address, none without an address
+		if len(backend.ips) > 0 {
+			want.backends[bpf.BackendKey{BackendUid: uid}] = backend
+		}
+	}
+
+	for serviceId, endpoints := range want.endpoints {
+		key := bpf.ServiceKey{ServiceId: serviceId}
+		value := want.services[key]
+		value.EndpointCount = uint32(len(endpoints))
+		want.services[key] = value
+	}
+	return want, diffs
+}
+
+func (p *Processor) dumpBpf() (*bpfState, error) {
+	var (
+		got = &bpfState{}
+		err error
+	)
+
+	if got.frontends, err = p.bpf.FrontendDump(); err != nil {
+		return nil, fmt.Errorf("dump frontend map failed: %v", err)
+	}
+	if got.services, err = p.bpf.ServiceDump(); err != nil {
+		return nil, fmt.Errorf("dump service map failed: %v", err)
+	}
+	if got.endpoints, err = p.bpf.EndpointDump(); err != nil {
+		return nil, fmt.Errorf("dump endpoint map failed: %v", err)
+	}
+	if got.backends, err = p.bpf.BackendDump(); err != nil {
+		return nil, fmt.Errorf("dump backend map failed: %v", err)
+	}
+	return got, nil
+}
+
+func (p *Processor) compare(want *expectedState, got *bpfState) []consistency.Diff {
+	var diffs []consistency.Diff
+	add := func(mapName, key string, kind consistency.Kind, format string, args ...interface{}) {
+		diffs = append(diffs, consistency.Diff{
+			Map:    mapName,
+			Key:    key,
+			Kind:   kind,
+			Detail: fmt.Sprintf(format, args...),
+		})
+	}
+
+	for key, upstreams := range want.frontends {
+		value, ok := got.frontends[key]
+		if !ok {
+			add(frontendMapName, nets.IpString(key.Ip), consistency.Missing, "upstream %s", p.idName(upstreams[0]))
+		} else if !slices.Contains(upstreams, value.UpstreamId) {
+			add(frontendMapName, nets.IpString(key.Ip), consistency.Mismatch, "upstream %s, expected %s", p.idName(value.UpstreamId), p.idName(upstreams[0]))
+		}
+	}
+	for key, value := range got.frontends {
+		if _, ok := want.frontends[key]; !ok {
+			add(frontendMapName, nets.IpString(key.Ip), consistency.Extra, "upstream %s", p.idName(value.UpstreamId))
+		}
+	}
+
+	for key, value := range want.services {
+		name := p.idName(key.ServiceId)
+		stored, ok := got.services[key]
+		switch {
+		case !ok:
+			add(serviceMapName, name, consistency.Missing, "%d endpoints", value.EndpointCount)
+		case stored.EndpointCount != value.EndpointCount:
+			add(serviceMapName, name, consistency.Mismatch, "endpoint count %d, expected %d", stored.EndpointCount, value.EndpointCount)
+		case stored != value:
+			add(serviceMapName, name, consistency.Mismatch, "ports, lb policy or waypoint differ from the cached service")
+		}
+	}
+	for key, value := range got.services {
+		if _, ok := want.services[key]; !ok {
+			add(serviceMapName, p.idName(key.ServiceId), consistency.Extra, "%d endpoints", value.EndpointCount)
+		}
+	}
+
+	slots := groupEndpoints(got.endpoints)
+	for serviceId, endpoints := range want.endpoints {
+		name := p.idName(serviceId)
+		indexes := slots[serviceId]
+		seen := make(map[uint32]struct{})
+		for _, index := range sortedKeys(indexes) {
+			uid := indexes[index]
+			slot := fmt.Sprintf("%s[%d]", name, index)
+			_, isEndpoint := endpoints[uid]
+			_, duplicated := seen[uid]
+			switch {
+			case index == 0 || index > uint32(len(endpoints)):
+				add(endpointMapName, slot, consistency.Extra, "orphaned slot of backend %s beyond the endpoint count %d", p.idName(uid), len(endpoints))
+			case !isEndpoint:
+				add(endpointMapName, slot, consistency.Mismatch, "backend %s is not an endpoint of the service", p.idName(uid))
+			case duplicated:
+				add(endpointMapName, slot, consistency.Mismatch, "backend %s is stored in another slot too", p.idName(uid))
+			default:
+				seen[uid] = struct{}{}
+				if relationId, ok := want.relations[serviceId][uid]; !ok {
+					add(endpointMapName, slot, consistency.Mismatch, "workload cache has no relationship for backend %s", p.idName(uid))
+				} else if relationId != index {
+					add(endpointMapName, slot, consistency.Mismatch, "workload cache records backend %s at index %d", p.idName(uid), relationId)
+				}
+			}
+		}
+		for index := uint32(1); index <= uint32(len(endpoints)); index++ {
+			if _, ok := indexes[index]; !ok {
+				add(endpointMapName, fmt.Sprintf("%s[%d]", name, index), consistency.Missing, "hole in the endpoint slots")
+			}
+		}
+		for uid := range endpoints {
+			if _, ok := seen[uid]; !ok {
+				add(endpointMapName, name, consistency.Missing, "backend %s has no endpoint slot", p.idName(uid))
+			}
+		}
+	}
+	for serviceId, indexes := range slots {
+		if _, ok := want.endpoints[serviceId]; ok {
+			continue
+		}
+		for index, uid := range indexes {
+			add(endpointMapName, fmt.Sprintf("%s[%d]", p.idName(serviceId), index), consistency.Extra, "orphaned slot of backend %s of an unknown service", p.idName(uid))
+		}
+	}
+
+	for key, backend := range want.backends {
+		name := p.idName(key.BackendUid)
+		stored, ok := got.backends[key]
+		if !ok {
+			add(backendMapName, name, consistency.Missing, "%d services", len(backend.services))
+		} else if detail := backend.compare(&stored); detail != "" {
+			add(backendMapName, name, consistency.Mismatch, "%s", detail)
+		}
+	}
+	for key, value := range got.backends {
+		if _, ok := want.backends[key]; !ok {
+			add(backendMapName, p.idName(key.BackendUid), consistency.Extra, "ip %s", nets.IpString(value.Ip))
+		}
+	}
+
+	return diffs
+}
+
+func (p *Processor) repair(want *expectedState, got *bpfState) error {
+	slots := groupEndpoints(got.endpoints)
+
+	// write the endpoint slots before the endpoint counts covering them
+	for serviceId, endpoints := range want.endpoints {
+		indexes := slots[serviceId]
+		ordered := orderEndpoints(indexes, endpoints)
+
+		// DeleteRelationShip drops the relationship of the workload recorded at
+		// the index, so clear them all before recording the compacted slots
+		last := got.services[bpf.ServiceKey{ServiceId: serviceId}].EndpointCount
+		for index := range indexes {
+			last = max(last, index)
+		}
+		for index := uint32(1); index <= last; index++ {
+			p.WorkloadCache.DeleteRelationShip(serviceId, index)
+		}
+
+		for i, uid := range ordered {
+			ek := bpf.EndpointKey{ServiceId: serviceId, BackendIndex: uint32(i + 1)}
+			if stored, ok := indexes[ek.BackendIndex]; !ok || stored != uid {
+				if err := p.bpf.EndpointUpdate(&ek, &bpf.EndpointValue{BackendUid: uid}); err != nil {
+					return fmt.Errorf("EndpointUpdate failed: %v", err)
+				}
+			}
+			p.WorkloadCache.UpdateRelationShip(uid, serviceId, ek.BackendIndex)
+		}
+	}
+
+	for key, value := range want.services {
+		if stored, ok := got.services[key]; !ok || stored != value {
+			if err := p.bpf.ServiceUpdate(&key, &value); err != nil {
+				return fmt.Errorf("ServiceUpdate failed: %v", err)
+			}
+		}
+	}
+	for key := range got.services {
+		if _, ok := want.services[key]; !ok {
+			if err := p.bpf.ServiceDelete(&key); err != nil {
+				return fmt.Errorf("ServiceDelete failed: %v", err)
+			}
+		}
+	}
+
+	for key := range got.endpoints {
+		endpoints, ok := want.endpoints[key.ServiceId]
+		if ok && key.BackendIndex != 0 && key.BackendIndex <= uint32(len(endpoints)) {
+			continue
+		}
+		if err := p.bpf.EndpointDelete(&key); err != nil {
+			return fmt.Errorf("EndpointDelete failed: %v", err)
+		}
+		if !ok {
+			p.WorkloadCache.DeleteRelationShip(key.ServiceId, key.BackendIndex)
+		}
+	}
+
+	for key, backend := range want.backends {
+		if stored, ok := got.backends[key]; !ok || backend.compare(&stored) != "" {
+			if err := p.bpf.BackendUpdate(&key, &backend.value); err != nil {
+				return fmt.Errorf("BackendUpdate failed: %v", err)
+			}
+		}
+	}
+	for key := range got.backends {
+		if _, ok := want.backends[key]; !ok {
+			if err := p.bpf.BackendDelete(&key); err != nil {
+				return fmt.Errorf("BackendDelete failed: %v", err)
+			}
+		}
+	}
+
+	for key, upstreams := range want.frontends {
+		if stored, ok := got.frontends[key]; !ok || !slices.Contains(upstreams, stored.UpstreamId) {
+			if err := p.bpf.FrontendUpdate(&key, &bpf.FrontendValue{UpstreamId: upstreams[0]}); err != nil {
+				return fmt.Errorf("FrontendUpdate failed: %v", err)
+			}
+		}
+	}
+	for key := range got.frontends {
+		if _, ok := want.frontends[key]; !ok {
+			if err := p.bpf.FrontendDelete(&key); err != nil {
+				return fmt.Errorf("FrontendDelete failed: %v", err)
+			}
+		}
+	}
+
+	for name := range p.danglingNames() {
+		p.hashName.Delete(name)
+	}
+	return nil
+}
+
+// danglingNames returns the hash names not used by any cached workload or
+// service, nor referenced as a service by a cached workload
+func (p *Processor) danglingNames() map[string]uint32 {
+	referenced := make(map[string]struct{})
+	for _, workload := range p.WorkloadCache.List() {
+		referenced[workload.GetUid()] = struct{}{}
+		for serviceName := range workload.GetServices() {
+			referenced[serviceName] = struct{}{}
+		}
+	}
+	for _, service := range p.ServiceCache.List() {
+		referenced[service.ResourceName()] = struct{}{}
+	}
+
+	dangling := make(map[string]uint32)
+	for name, num := range p.hashName.list() {
+		if _, ok := referenced[name]; !ok {
+			dangling[name] = num
+		}
+	}
+	return dangling
+}
+
+func (p *Processor) idName(id uint32) string {
+	if name := p.hashName.NumToStr(id); name != "" {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", id)
+}
+
+// compare returns why the stored backend differs, empty if it matches
+func (b *expectedBackend) compare(stored *bpf.BackendValue) string {
+	if !slices.Contains(b.ips, stored.Ip) {
+		return fmt.Sprintf("ip %s is not an address of the workload", nets.IpString(stored.Ip))
+	}
+	if stored.WaypointAddr != b.value.WaypointAddr || stored.WaypointPort != b.value.WaypointPort {
+		return "waypoint differs from the cached workload"
+	}
+	// the processor stores at most MaxServiceNum services in map order
+	if stored.ServiceCount != b.value.ServiceCount {
+		return fmt.Sprintf("%d services, expected %d", stored.ServiceCount, b.value.ServiceCount)
+	}
+	seen := make(map[uint32]struct{}, stored.ServiceCount)
+	for _, serviceId := range stored.Services[:min(stored.ServiceCount, bpf.MaxServiceNum)] {
+		_, ok := b.services[serviceId]
+		_, duplicated := seen[serviceId]
+		if !ok || duplicated {
+			return "services differ from the cached workload"
+		}
+		seen[serviceId] = struct{}{}
+	}
+	return ""
+}
+
+// groupEndpoints indexes the endpoint map by service id and slot index
+func groupEndpoints(endpoints map[bpf.EndpointKey]bpf.EndpointValue) map[uint32]map[uint32]uint32 {
+	slots := make(map[uint32]map[uint32]uint32)
+	for key, value := range endpoints {
+		if slots[key.ServiceId] == nil {
+			slots[key.ServiceId] = make(map[uint32]uint32)
+		}
+		slots[key.ServiceId][key.BackendIndex] = value.BackendUid
+	}
+	return slots
+}
+
+// orderEndpoints keeps the valid backends in their current slot order, then
+// appends the missing ones, to move as few slots as possible
+func orderEndpoints(indexes map[uint32]uint32, endpoints map[uint32]struct{}) []uint32 {
+	ordered := make([]uint32, 0, len(endpoints))
+	seen := make(map[uint32]struct{}, len(endpoints))
+	for _, index := range sortedKeys(indexes) {
+		uid := indexes[index]
+		_, ok := endpoints[uid]
+		_, duplicated := seen[uid]
+		if index == 0 || !ok || duplicated {
+			continue
+		}
+		ordered = append(ordered, uid)
+		seen[uid] = struct{}{}
+	}
+
+	missing := make([]uint32, 0, len(endpoints)-len(ordered))
+	for uid := range endpoints {
+		if _, ok := seen[uid]; !ok {
+			missing = append(missing, uid)
+		}
+	}
+	slices.Sort(missing)
+	return append(ordered, missing...)
+}
+
+func sortedKeys(m map[uint32]uint32) []uint32 {
+	keys := make([]uint32, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/stretchr/testify/assert"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/consistency"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+func diffKinds(diffs []consistency.Diff) map[string]consistency.Kind {
+	kinds := make(map[string]consistency.Kind, len(diffs))
+	for _, d := range diffs {
+		kinds[d.Map+" "+d.Key] = d.Kind
+	}
+	return kinds
+}
+
+func Test_processorCheckAndRepair(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	wl1 := createFakeWorkload("10.244.0.1", workloadapi.NetworkMode_STANDARD)
+	wl2 := createFakeWorkload("10.244.0.2", workloadapi.NetworkMode_STANDARD)
+	svc := createFakeService("testsvc", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.handleService(svc))
+	assert.NoError(t, p.handleWorkload(wl2))
+
+	diffs, err := p.Check()
+	assert.NoError(t, err)
+	assert.Empty(t, diffs)
+
+	// 1. drift the maps behind the back of the processor
+	svcID := p.hashName.StrToNum(svc.ResourceName())
+	wl2ID := p.hashName.StrToNum(wl2.Uid)
+	ghostID := p.hashName.StrToNum("cluster0/ghost")
+	assert.NoError(t, p.bpf.EndpointDelete(&bpfcache.EndpointKey{ServiceId: svcID, BackendIndex: 2}))
+	assert.NoError(t, p.bpf.BackendUpdate(&bpfcache.BackendKey{BackendUid: ghostID}, &bpfcache.BackendValue{}))
+	ghostFrontend := bpfcache.FrontendKey{}
+	nets.CopyIpByteFromSlice(&ghostFrontend.Ip, []byte{10, 244, 0, 99})
+	assert.NoError(t, p.bpf.FrontendUpdate(&ghostFrontend, &bpfcache.FrontendValue{UpstreamId: ghostID}))
+
+	diffs, err = p.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]consistency.Kind{
+		"kmesh_endpoint default/testsvc.default.svc.cluster.local[2]": consistency.Missing,
+		"kmesh_endpoint default/testsvc.default.svc.cluster.local":    consistency.Missing,
+		"kmesh_backend cluster0/ghost":                                consistency.Extra,
+		"kmesh_frontend 10.244.0.99":                                  consistency.Extra,
+		"hash_name cluster0/ghost":                                    consistency.Extra,
+	}, diffKinds(diffs))
+
+	// 2. repair rewrites the maps from the cache
+	repaired, err := p.Repair()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, diffs, repaired)
+
+	diffs, err = p.Check()
+	assert.NoError(t, err)
+	assert.Empty(t, diffs)
+	var ev bpfcache.EndpointValue
+	assert.NoError(t, p.bpf.EndpointLookup(&bpfcache.EndpointKey{ServiceId: svcID, BackendIndex: 2}, &ev))
+	assert.Equal(t, wl2ID, ev.BackendUid)
+	_, ok := p.hashName.lookup("cluster0/ghost")
+	assert.False(t, ok)
+}
+
+func Test_processorCheckRelationShip(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	svc := createFakeService("testsvc", "10.240.10.1", "10.240.10.200")
+	wl1 := createFakeWorkload("10.244.0.1", workloadapi.NetworkMode_STANDARD)
+	wl2 := createFakeWorkload("10.244.0.2", workloadapi.NetworkMode_STANDARD)
+	assert.NoError(t, p.handleService(svc))
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.handleWorkload(wl2))
+
+	// removing the first endpoint moves the last one into its slot
+	assert.NoError(t, p.removeWorkloadResource([]string{wl1.Uid}))
+
+	diffs, err := p.Check()
+	assert.NoError(t, err)
+	assert.Empty(t, diffs)
+
+	svcID := p.hashName.StrToNum(svc.ResourceName())
+	relationId, ok := p.WorkloadCache.GetRelationShip(p.hashName.StrToNum(wl2.Uid), svcID)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(1), relationId)
+	_, ok = p.WorkloadCache.GetRelationShip(p.hashName.StrToNum(wl1.Uid), svcID)
+	assert.False(t, ok)
+
+	// removing the last endpoint leaves nothing behind
+	assert.NoError(t, p.removeWorkloadResource([]string{wl2.Uid}))
+	diffs, err = p.Check()
+	assert.NoError(t, err)
+	assert.Empty(t, diffs)
+	_, ok = p.WorkloadCache.GetRelationShip(p.hashName.StrToNum(wl2.Uid), svcID)
+	assert.False(t, ok)
+}
+
+func Test_processorCheckConcurrentResponse(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	svc := createFakeService("testsvc", "10.240.10.1", "10.240.10.200")
+	wl := createFakeWorkload("10.244.0.1", workloadapi.NetworkMode_STANDARD)
+	assert.NoError(t, p.handleService(svc))
+	assert.NoError(t, p.handleWorkload(wl))
+
+	frontends, err := p.bpf.FrontendDump()
+	assert.NoError(t, err)
+	dumps := 0
+	// a response is handled while the first walk is in progress
+	bumps := 1
+	patches := gomonkey.ApplyMethod(reflect.TypeOf(p.bpf), "FrontendDump",
+		func(*bpfcache.Cache) (map[bpfcache.FrontendKey]bpfcache.FrontendValue, error) {
+			dumps++
+			if dumps <= bumps {
+				p.mu.Lock()
+				p.generation++
+				p.mu.Unlock()
+			}
+			return frontends, nil
+		})
+	defer patches.Reset()
+
+	diffs, err := p.Check()
+	assert.NoError(t, err)
+	assert.Empty(t, diffs)
+	assert.Equal(t, 2, dumps)
+
+	// the check gives up when the maps keep changing
+	dumps, bumps = 0, checkAttempts
+	_, err = p.Check()
+	assert.Error(t, err)
+	assert.Equal(t, checkAttempts, dumps)
+}
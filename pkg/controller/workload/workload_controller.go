@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/cilium/ebpf"
 	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 
 	"kmesh.net/kmesh/pkg/auth"
@@ -56,6 +57,20 @@ func NewController(bpfWorkload *bpf.BpfKmeshWorkload) *Controller {
 func (c *Controller) Run(ctx context.Context) {
 	go c.Rbac.Run(ctx, c.bpfWorkloadObj.SockOps.MapOfTuple, c.bpfWorkloadObj.XdpAuth.MapOfAuth)
 	go c.MetricController.Run(ctx, c.bpfWorkloadObj.SockConn.MapOfTcpInfo)
+	go c.MetricController.RunProbe(ctx, telemetry.ProbeMaps{
+		Config:        c.bpfWorkloadObj.SockConn.MapOfTcpProbeConf,
+		ExcludedAddrs: c.bpfWorkloadObj.SockConn.MapOfTcpProbeExcl,
+		Pairs:         c.bpfWorkloadObj.SockConn.MapOfTcpProbePair,
+		Stats:         c.bpfWorkloadObj.SockConn.MapOfTcpProbeStats,
+	})
+}
+
+// GetAuthMap returns the bpf map of the connections denied by authorization policies
+func (c *Controller) GetAuthMap() *ebpf.Map {
+	if c.bpfWorkloadObj == nil {
+		return nil
+	}
+	return c.bpfWorkloadObj.XdpAuth.MapOfAuth
 }
 
 func (c *Controller) WorkloadStreamCreateAndSend(client discoveryv3.AggregatedDiscoveryServiceClient, ctx context.Context) error {
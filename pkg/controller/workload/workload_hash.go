@@ -22,16 +22,21 @@ import (
 	"hash/fnv"
 	"math"
 	"os"
+	"sync"
 
 	"gopkg.in/yaml.v3"
+
+	"kmesh.net/kmesh/pkg/constants"
 )
 
 const (
-	persistPath = "/mnt/workload_hash_name.yaml"
+	persistPath = constants.HashNamePersistPath
 )
 
 // HashName converts a string to a uint32 integer as the key of bpf map
 type HashName struct {
+	// mu guards the maps, which are read by the status server while the processor updates them
+	mu       sync.RWMutex
 	numToStr map[uint32]string
 	strToNum map[string]uint32
 	hash     hash.Hash32
@@ -93,6 +98,9 @@ func (h *HashName) flushDelta(str string, num uint32) error {
 func (h *HashName) StrToNum(str string) uint32 {
 	var num uint32
 
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	if num, exists := h.strToNum[str]; exists {
 		return num
 	}
@@ -121,10 +129,34 @@ func (h *HashName) StrToNum(str string) uint32 {
 }
 
 func (h *HashName) NumToStr(num uint32) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 	return h.numToStr[num]
 }
 
+// lookup returns the id of str without allocating one when it is unknown
+func (h *HashName) lookup(str string) (uint32, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	num, exists := h.strToNum[str]
+	return num, exists
+}
+
+// list returns a copy of the name to id mapping
+func (h *HashName) list() map[string]uint32 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make(map[string]uint32, len(h.strToNum))
+	for str, num := range h.strToNum {
+		out[str] = num
+	}
+	return out
+}
+
 func (h *HashName) Delete(str string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	// only when the num exists, we do the logic
 	if num, exists := h.strToNum[str]; exists {
 		delete(h.numToStr, num)
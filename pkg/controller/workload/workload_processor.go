@@ -20,7 +20,9 @@ import (
 	"fmt"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 
 	service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"google.golang.org/protobuf/proto"
@@ -36,6 +38,7 @@ import (
 	"kmesh.net/kmesh/pkg/controller/telemetry"
 	bpf "kmesh.net/kmesh/pkg/controller/workload/bpfcache"
 	"kmesh.net/kmesh/pkg/controller/workload/cache"
+	"kmesh.net/kmesh/pkg/events"
 	"kmesh.net/kmesh/pkg/nets"
 )
 
@@ -45,8 +48,12 @@ const (
 )
 
 type Processor struct {
-	ack *service_discovery_v3.DeltaDiscoveryRequest
-	req *service_discovery_v3.DeltaDiscoveryRequest
+	// mu serializes the handling of the responses with the consistency check and repair
+	mu sync.Mutex
+	// generation counts the responses and repairs, which change the bpf maps
+	generation uint64
+	ack        *service_discovery_v3.DeltaDiscoveryRequest
+	req        *service_discovery_v3.DeltaDiscoveryRequest
 
 	hashName *HashName
 	// workloads indexer, svc key -> workload id
@@ -68,6 +75,16 @@ func newProcessor(workloadMap bpf2go.KmeshCgroupSockWorkloadMaps) *Processor {
 	}
 }
 
+// GetBpfCache returns the cache of the workload bpf maps
+func (p *Processor) GetBpfCache() *bpf.Cache {
+	return p.bpf
+}
+
+// GetHashName returns the mapping between names and the ids used as keys of the bpf maps
+func (p *Processor) GetHashName() *HashName {
+	return p.hashName
+}
+
 func newDeltaRequest(typeUrl string, names []string, initialResourceVersions map[string]string) *service_discovery_v3.DeltaDiscoveryRequest {
 	return &service_discovery_v3.DeltaDiscoveryRequest{
 		TypeUrl:                 typeUrl,
@@ -92,6 +109,10 @@ func newAckRequest(rsp *service_discovery_v3.DeltaDiscoveryResponse) *service_di
 func (p *Processor) processWorkloadResponse(rsp *service_discovery_v3.DeltaDiscoveryResponse, rbac *auth.Rbac) {
 	var err error
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.generation++
 	p.ack = newAckRequest(rsp)
 	switch rsp.GetTypeUrl() {
 	case AddressType:
@@ -104,6 +125,7 @@ func (p *Processor) processWorkloadResponse(rsp *service_discovery_v3.DeltaDisco
 	if err != nil {
 		log.Error(err)
 	}
+	publishXdsEvent(rsp, err)
 }
 
 func (p *Processor) deletePodFrontendData(uid uint32) error {
@@ -145,9 +167,12 @@ func (p *Processor) storePodFrontendData(uid uint32, ip []byte) error {
 
 func (p *Processor) removeWorkloadResource(removedResources []string) error {
 	for _, uid := range removedResources {
-		telemetry.DeleteWorkloadMetric(p.WorkloadCache.GetWorkloadByUid(uid))
+		workload := p.WorkloadCache.GetWorkloadByUid(uid)
+		telemetry.DeleteWorkloadMetric(workload)
 		p.WorkloadCache.DeleteWorkload(uid)
-		if err := p.removeWorkloadFromBpfMap(uid); err != nil {
+		err := p.removeWorkloadFromBpfMap(uid)
+		publishAddressEvent(events.Workload, "remove", workload.GetNamespace(), workload.GetName(), uid, err)
+		if err != nil {
 			return err
 		}
 	}
@@ -207,9 +232,12 @@ func (p *Processor) deleteFrontendData(id uint32) error {
 func (p *Processor) removeServiceResource(resources []string) error {
 	var err error
 	for _, name := range resources {
+		service := p.ServiceCache.GetService(name)
 		telemetry.DeleteServiceMetric(name)
 		p.ServiceCache.DeleteService(name)
-		if err = p.removeServiceResourceFromBpfMap(name); err != nil {
+		err = p.removeServiceResourceFromBpfMap(name)
+		publishAddressEvent(events.Service, "remove", service.GetNamespace(), service.GetName(), name, err)
+		if err != nil {
 			return err
 		}
 	}
@@ -450,26 +478,10 @@ func (p *Processor) storeServiceData(serviceName string, waypoint *workloadapi.G
 
 	sk.ServiceId = p.hashName.StrToNum(serviceName)
 
-	newValue := bpf.ServiceValue{}
-	newValue.LbPolicy = LbPolicyRandom
-	if waypoint != nil {
-		nets.CopyIpByteFromSlice(&newValue.WaypointAddr, waypoint.GetAddress().Address)
-		newValue.WaypointPort = nets.ConvertPortToBigEndian(waypoint.GetHboneMtlsPort())
-	}
-
-	for i, port := range ports {
-		if i >= bpf.MaxPortNum {
-			log.Warnf("exceed the max port count,current only support maximum of 10 ports")
-			break
-		}
-
-		newValue.ServicePort[i] = nets.ConvertPortToBigEndian(port.ServicePort)
-		if strings.Contains(serviceName, "waypoint") {
-			newValue.TargetPort[i] = nets.ConvertPortToBigEndian(KmeshWaypointPort)
-		} else {
-			newValue.TargetPort[i] = nets.ConvertPortToBigEndian(port.TargetPort)
-		}
+	if len(ports) > bpf.MaxPortNum {
+		log.Warnf("exceed the max port count,current only support maximum of 10 ports")
 	}
+	newValue := newServiceValue(serviceName, waypoint, ports)
 
 	// Already exists, it means this is service update.
 	if err = p.bpf.ServiceLookup(&sk, &oldValue); err == nil {
@@ -503,6 +515,30 @@ func (p *Processor) storeServiceData(serviceName string, waypoint *workloadapi.G
 	return nil
 }
 
+// newServiceValue builds the service map value, except the endpoint count
+func newServiceValue(serviceName string, waypoint *workloadapi.GatewayAddress, ports []*workloadapi.Port) bpf.ServiceValue {
+	value := bpf.ServiceValue{}
+	value.LbPolicy = LbPolicyRandom
+	if waypoint != nil {
+		nets.CopyIpByteFromSlice(&value.WaypointAddr, waypoint.GetAddress().Address)
+		value.WaypointPort = nets.ConvertPortToBigEndian(waypoint.GetHboneMtlsPort())
+	}
+
+	for i, port := range ports {
+		if i >= bpf.MaxPortNum {
+			break
+		}
+
+		value.ServicePort[i] = nets.ConvertPortToBigEndian(port.ServicePort)
+		if strings.Contains(serviceName, "waypoint") {
+			value.TargetPort[i] = nets.ConvertPortToBigEndian(KmeshWaypointPort)
+		} else {
+			value.TargetPort[i] = nets.ConvertPortToBigEndian(port.TargetPort)
+		}
+	}
+	return value
+}
+
 func (p *Processor) handleService(service *workloadapi.Service) error {
 	log.Debugf("service resource name: %s/%s", service.Namespace, service.Hostname)
 
@@ -583,10 +619,14 @@ func (p *Processor) handleAddressTypeResponse(rsp *service_discovery_v3.DeltaDis
 		switch address.GetType().(type) {
 		case *workloadapi.Address_Workload:
 			workload := address.GetWorkload()
+			action := addOrUpdate(p.WorkloadCache.GetWorkloadByUid(workload.GetUid()) == nil)
 			err = p.handleWorkload(workload)
+			publishAddressEvent(events.Workload, action, workload.GetNamespace(), workload.GetName(), workload.GetUid(), err)
 		case *workloadapi.Address_Service:
 			service := address.GetService()
+			action := addOrUpdate(p.ServiceCache.GetService(service.ResourceName()) == nil)
 			err = p.handleService(service)
+			publishAddressEvent(events.Service, action, service.GetNamespace(), service.GetName(), service.ResourceName(), err)
 		default:
 			log.Errorf("unknown type")
 		}
@@ -690,9 +730,25 @@ func (p *Processor) deleteEndpointRecords(endpoint_keys []bpf.EndpointKey) error
 			// 3. find the last indexed endpoint of the service
 			lastEndpointKey.ServiceId = skUpdate.ServiceId
 			lastEndpointKey.BackendIndex = svUpdate.EndpointCount
-			if err = p.bpf.EndpointLookup(&lastEndpointKey, &lastEndpointValue); err == nil {
+			if lastEndpointKey.BackendIndex == ek.BackendIndex {
+				// the removed endpoint is the last one, there is nothing to move
+				if err = p.deleteRelationShipWithWorkloadAndService(ek.ServiceId, ek.BackendIndex); err != nil {
+					log.Errorf("EndpointDelete failed: %s", err)
+					return err
+				}
+
+				svUpdate.EndpointCount = svUpdate.EndpointCount - 1
+				if err = p.bpf.ServiceUpdate(&skUpdate, &svUpdate); err != nil {
+					log.Errorf("ServiceUpdate failed: %s", err)
+					return err
+				}
+			} else if err = p.bpf.EndpointLookup(&lastEndpointKey, &lastEndpointValue); err == nil {
 				log.Debugf("Find EndpointValue: [%#v]", lastEndpointValue)
-				// 4. switch the index of the last with the current removed endpoint
+				// 4. switch the index of the last with the current removed endpoint,
+				// the relationships of both indexes are dropped before the last one
+				// is recorded again at the removed index
+				p.WorkloadCache.DeleteRelationShip(ek.ServiceId, ek.BackendIndex)
+				p.WorkloadCache.DeleteRelationShip(lastEndpointKey.ServiceId, lastEndpointKey.BackendIndex)
 				if err = p.updateRelationShipWithWorkloadAndService(lastEndpointValue.BackendUid, ek.ServiceId, ek.BackendIndex); err != nil {
 					log.Errorf("EndpointUpdate failed: %s", err)
 					return err
@@ -702,7 +758,6 @@ func (p *Processor) deleteEndpointRecords(endpoint_keys []bpf.EndpointKey) error
 					log.Errorf("EndpointDelete failed: %s", err)
 					return err
 				}
-				p.WorkloadCache.DeleteRelationShip(ek.ServiceId, ek.BackendIndex)
 
 				svUpdate.EndpointCount = svUpdate.EndpointCount - 1
 				if err = p.bpf.ServiceUpdate(&skUpdate, &svUpdate); err != nil {
@@ -757,3 +812,51 @@ func (p *Processor) deleteRelationShipWithWorkloadAndService(serviceId uint32, r
 	p.WorkloadCache.DeleteRelationShip(serviceId, relationId)
 	return nil
 }
+
+func addOrUpdate(add bool) string {
+	if add {
+		return "add"
+	}
+	return "update"
+}
+
+// publishAddressEvent reports a workload or service applied to the caches, a
+// failure to apply it is a bpf map write error
+func publishAddressEvent(typ events.Type, action, namespace, name, resource string, err error) {
+	if !events.Enabled() {
+		return
+	}
+	e := events.Event{
+		Type:       typ,
+		Action:     action,
+		Namespace:  namespace,
+		Name:       name,
+		Attributes: map[string]string{"resource": resource},
+	}
+	if err != nil {
+		e.Type = events.BpfError
+		e.Message = err.Error()
+		e.Attributes["kind"] = string(typ)
+	}
+	events.Publish(e)
+}
+
+func publishXdsEvent(rsp *service_discovery_v3.DeltaDiscoveryResponse, err error) {
+	if !events.Enabled() {
+		return
+	}
+	e := events.Event{
+		Type:   events.Xds,
+		Action: "apply",
+		Attributes: map[string]string{
+			"typeUrl":   rsp.GetTypeUrl(),
+			"nonce":     rsp.GetNonce(),
+			"resources": strconv.Itoa(len(rsp.GetResources())),
+			"removed":   strconv.Itoa(len(rsp.GetRemovedResources())),
+		},
+	}
+	if err != nil {
+		e.Message = err.Error()
+	}
+	events.Publish(e)
+}
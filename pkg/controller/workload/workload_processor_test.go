@@ -151,6 +151,55 @@ func Test_handleWorkload(t *testing.T) {
 	hashNameClean(p)
 }
 
+func Test_deleteEndpointRecords(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	fakeSvc := createFakeService("testsvc", "10.240.10.1", "10.240.10.2")
+	assert.NoError(t, p.handleService(fakeSvc))
+	svcID := checkFrontEndMap(t, fakeSvc.Addresses[0].Address, p)
+
+	workloadIDs := make([]uint32, 0, 3)
+	for _, ip := range []string{"1.2.3.4", "1.2.3.5", "1.2.3.6"} {
+		wl := createFakeWorkload(ip, workloadapi.NetworkMode_STANDARD)
+		assert.NoError(t, p.handleWorkload(wl))
+		workloadIDs = append(workloadIDs, checkFrontEndMap(t, wl.Addresses[0], p))
+	}
+	checkServiceMap(t, p, svcID, fakeSvc, 3)
+
+	checkEndpoint := func(index uint32, workloadID uint32) {
+		var ev bpfcache.EndpointValue
+		assert.NoError(t, p.bpf.EndpointLookup(&bpfcache.EndpointKey{ServiceId: svcID, BackendIndex: index}, &ev))
+		assert.Equal(t, workloadID, ev.BackendUid)
+		relationId, ok := p.WorkloadCache.GetRelationShip(workloadID, svcID)
+		assert.True(t, ok)
+		assert.Equal(t, index, relationId)
+	}
+	checkNoEndpoint := func(index uint32, workloadID uint32) {
+		var ev bpfcache.EndpointValue
+		assert.Error(t, p.bpf.EndpointLookup(&bpfcache.EndpointKey{ServiceId: svcID, BackendIndex: index}, &ev))
+		_, ok := p.WorkloadCache.GetRelationShip(workloadID, svcID)
+		assert.False(t, ok)
+	}
+
+	// 1. delete the middle endpoint, the last one moves into its slot and
+	// keeps its relationship at the new index
+	assert.NoError(t, p.deleteEndpointRecords([]bpfcache.EndpointKey{{ServiceId: svcID, BackendIndex: 2}}))
+	checkServiceMap(t, p, svcID, fakeSvc, 2)
+	checkEndpoint(1, workloadIDs[0])
+	checkEndpoint(2, workloadIDs[2])
+	checkNoEndpoint(3, workloadIDs[1])
+
+	// 2. delete the last endpoint, nothing moves
+	assert.NoError(t, p.deleteEndpointRecords([]bpfcache.EndpointKey{{ServiceId: svcID, BackendIndex: 2}}))
+	checkServiceMap(t, p, svcID, fakeSvc, 1)
+	checkEndpoint(1, workloadIDs[0])
+	checkNoEndpoint(2, workloadIDs[2])
+}
+
 func Test_hostnameNetworkMode(t *testing.T) {
 	workloadMap := bpfcache.NewFakeWorkloadMap(t)
 	p := newProcessor(workloadMap)
@@ -0,0 +1,196 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package events streams what the daemon does as typed events, for tooling
+// and for debugging issues that can not be reproduced.
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type is the source of an event.
+type Type string
+
+const (
+	// Xds is an xDS response applied to the caches
+	Xds Type = "xds"
+	// Workload is a workload added, updated or removed
+	Workload Type = "workload"
+	// Service is a service added, updated or removed
+	Service Type = "service"
+	// BpfError is a failed write to a bpf map
+	BpfError Type = "bpf_error"
+	// Rbac is the verdict of the authorization of a connection
+	Rbac Type = "rbac"
+	// Cert is a workload certificate issued, rotated, deleted or failed to fetch
+	Cert Type = "cert"
+	// Enrollment is a pod enrolled in or removed from kmesh
+	Enrollment Type = "enrollment"
+	// BpfLog is a line logged by the bpf programs
+	BpfLog Type = "bpf_log"
+)
+
+// Dropped is sent by the streams, not published, when events were dropped
+// because the client fell behind.
+const Dropped Type = "dropped"
+
+// Types lists every event type.
+var Types = []Type{Xds, Workload, Service, BpfError, Rbac, Cert, Enrollment, BpfLog}
+
+// Event is something that happened in the daemon.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type Type      `json:"type"`
+	// Action is what happened, e.g. add, remove, allow or deny
+	Action     string            `json:"action,omitempty"`
+	Namespace  string            `json:"namespace,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Filter selects the events of a subscription, an empty list matches any value.
+type Filter struct {
+	Types      []Type
+	Namespaces []string
+}
+
+func (f Filter) matches(e *Event) bool {
+	if len(f.Types) > 0 && !contains(f.Types, e.Type) {
+		return false
+	}
+	if len(f.Namespaces) > 0 && !contains(f.Namespaces, e.Namespace) {
+		return false
+	}
+	return true
+}
+
+func contains[T comparable](s []T, v T) bool {
+	for _, item := range s {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription receives the events matching its filter. Events are dropped
+// rather than blocking the publisher when it falls behind.
+type Subscription struct {
+	bus     *Bus
+	filter  Filter
+	ch      chan Event
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Events returns the channel of the events, it is closed by Close.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns the number of events dropped because the channel was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.unsubscribe(s)
+		close(s.ch)
+	})
+}
+
+// Bus fans the published events out to the subscriptions.
+type Bus struct {
+	mu            sync.RWMutex
+	subscriptions map[*Subscription]struct{}
+	// count lets Publish skip building events nobody listens to
+	count atomic.Int32
+	now   func() time.Time
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		subscriptions: make(map[*Subscription]struct{}),
+		now:           time.Now,
+	}
+}
+
+// Subscribe returns a subscription whose channel buffers size events.
+func (b *Bus) Subscribe(filter Filter, size int) *Subscription {
+	s := &Subscription{bus: b, filter: filter, ch: make(chan Event, size)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscriptions[s] = struct{}{}
+	b.count.Store(int32(len(b.subscriptions)))
+	return s
+}
+
+func (b *Bus) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscriptions, s)
+	b.count.Store(int32(len(b.subscriptions)))
+}
+
+// Enabled reports whether anyone is subscribed, callers can skip building
+// costly events when it is false.
+func (b *Bus) Enabled() bool {
+	return b.count.Load() > 0
+}
+
+// Publish sends the event to the matching subscriptions without blocking, the
+// time is set if it is zero.
+func (b *Bus) Publish(e Event) {
+	if !b.Enabled() {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = b.now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subscriptions {
+		if !s.filter.matches(&e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+var defaultBus = NewBus()
+
+// Default returns the bus the daemon components publish their events to.
+func Default() *Bus {
+	return defaultBus
+}
+
+func Publish(e Event) {
+	defaultBus.Publish(e)
+}
+
+func Enabled() bool {
+	return defaultBus.Enabled()
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	assert.False(t, bus.Enabled())
+	// nobody listens, the event is not even built
+	bus.Publish(Event{Type: Workload, Namespace: "default"})
+
+	all := bus.Subscribe(Filter{}, 10)
+	filtered := bus.Subscribe(Filter{Types: []Type{Workload, Service}, Namespaces: []string{"default"}}, 1)
+	assert.True(t, bus.Enabled())
+
+	bus.Publish(Event{Type: Workload, Action: "add", Namespace: "default", Name: "httpbin"})
+	bus.Publish(Event{Type: Workload, Action: "add", Namespace: "other", Name: "sleep"})
+	bus.Publish(Event{Type: Rbac, Action: "deny", Namespace: "default"})
+	// the filtered channel is full
+	bus.Publish(Event{Type: Service, Action: "remove", Namespace: "default", Name: "httpbin"})
+
+	assert.Len(t, all.Events(), 4)
+	assert.Len(t, filtered.Events(), 1)
+	assert.Equal(t, uint64(1), filtered.Dropped())
+	e := <-filtered.Events()
+	assert.Equal(t, "httpbin", e.Name)
+	assert.False(t, e.Time.IsZero())
+
+	filtered.Close()
+	filtered.Close()
+	_, ok := <-filtered.Events()
+	assert.False(t, ok)
+	all.Close()
+	assert.False(t, bus.Enabled())
+	bus.Publish(Event{Type: Workload})
+}
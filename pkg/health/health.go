@@ -0,0 +1,177 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package health
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Kind selects which probes a check contributes to.
+type Kind uint8
+
+const (
+	// Readiness checks gate traffic: the daemon is not ready until they pass.
+	Readiness Kind = 1 << iota
+	// Liveness checks detect a daemon that will not recover without a restart.
+	Liveness
+)
+
+// Check reports the health of a component, returning nil when it is healthy.
+type Check func() error
+
+// ComponentStatus is the result of running one registered check.
+type ComponentStatus struct {
+	Name      string `json:"name"`
+	Readiness bool   `json:"readiness"`
+	Liveness  bool   `json:"liveness"`
+	Healthy   bool   `json:"healthy"`
+	Message   string `json:"message,omitempty"`
+}
+
+// Report aggregates the status of the checks of one or more kinds.
+type Report struct {
+	Healthy    bool              `json:"healthy"`
+	Components []ComponentStatus `json:"components"`
+}
+
+// Failed returns the components whose check did not pass.
+func (r *Report) Failed() []ComponentStatus {
+	var failed []ComponentStatus
+	for _, c := range r.Components {
+		if !c.Healthy {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
+
+type entry struct {
+	kind  Kind
+	check Check
+}
+
+// Registry holds the checks registered by the daemon components.
+type Registry struct {
+	mu     sync.RWMutex
+	checks map[string]entry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		checks: make(map[string]entry),
+	}
+}
+
+// Register adds or replaces the check of the named component.
+func (r *Registry) Register(name string, kind Kind, check Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks[name] = entry{kind: kind, check: check}
+}
+
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.checks, name)
+}
+
+// Run runs every check that contributes to one of the given kinds, or all
+// checks when kind is 0. The report is healthy when all of them pass.
+func (r *Registry) Run(kind Kind) *Report {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.checks))
+	entries := make(map[string]entry, len(r.checks))
+	for name, e := range r.checks {
+		if kind != 0 && e.kind&kind == 0 {
+			continue
+		}
+		names = append(names, name)
+		entries[name] = e
+	}
+	r.mu.RUnlock()
+	sort.Strings(names)
+
+	// checks run outside the lock so that a slow one does not block registration
+	report := &Report{Healthy: true, Components: make([]ComponentStatus, 0, len(names))}
+	for _, name := range names {
+		e := entries[name]
+		status := ComponentStatus{
+			Name:      name,
+			Readiness: e.kind&Readiness != 0,
+			Liveness:  e.kind&Liveness != 0,
+			Healthy:   true,
+		}
+		if err := e.check(); err != nil {
+			status.Healthy = false
+			status.Message = err.Error()
+			report.Healthy = false
+		}
+		report.Components = append(report.Components, status)
+	}
+	return report
+}
+
+var defaultRegistry = NewRegistry()
+
+// Default returns the registry the daemon components register their checks in.
+func Default() *Registry {
+	return defaultRegistry
+}
+
+func Register(name string, kind Kind, check Check) {
+	defaultRegistry.Register(name, kind, check)
+}
+
+func Unregister(name string) {
+	defaultRegistry.Unregister(name)
+}
+
+// Status is a check whose result is pushed by the component itself, for
+// components such as stream clients and event loops that know their state
+// better than a probe could observe it.
+type Status struct {
+	mu  sync.RWMutex
+	err error
+}
+
+// NewStatus returns a Status reporting err until it is first set.
+func NewStatus(err error) *Status {
+	return &Status{err: err}
+}
+
+func (s *Status) Set(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *Status) SetHealthy() {
+	s.Set(nil)
+}
+
+func (s *Status) SetUnhealthy(msg string) {
+	s.Set(errors.New(msg))
+}
+
+// Check implements Check.
+func (s *Status) Check() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package health
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryRun(t *testing.T) {
+	r := NewRegistry()
+	xds := NewStatus(errors.New("not connected"))
+	r.Register("xds", Readiness, xds.Check)
+	r.Register("bpf", Readiness|Liveness, func() error { return nil })
+	r.Register("ringbuf", Liveness, func() error { return nil })
+
+	ready := r.Run(Readiness)
+	assert.False(t, ready.Healthy)
+	assert.Equal(t, []ComponentStatus{
+		{Name: "bpf", Readiness: true, Liveness: true, Healthy: true},
+		{Name: "xds", Readiness: true, Healthy: false, Message: "not connected"},
+	}, ready.Components)
+	assert.Equal(t, []ComponentStatus{
+		{Name: "xds", Readiness: true, Healthy: false, Message: "not connected"},
+	}, ready.Failed())
+
+	live := r.Run(Liveness)
+	assert.True(t, live.Healthy)
+	assert.Len(t, live.Components, 2)
+	assert.Empty(t, live.Failed())
+
+	xds.SetHealthy()
+	all := r.Run(0)
+	assert.True(t, all.Healthy)
+	assert.Len(t, all.Components, 3)
+
+	xds.SetUnhealthy("stream closed")
+	r.Unregister("ringbuf")
+	all = r.Run(0)
+	assert.False(t, all.Healthy)
+	assert.Len(t, all.Components, 2)
+	assert.Equal(t, "stream closed", all.Failed()[0].Message)
+}
+
+func TestRegistryReplace(t *testing.T) {
+	r := NewRegistry()
+	r.Register("cni", Readiness, func() error { return errors.New("not installed") })
+	r.Register("cni", Readiness, func() error { return nil })
+
+	report := r.Run(Readiness)
+	assert.True(t, report.Healthy)
+	assert.Len(t, report.Components, 1)
+}
+
+func TestEmptyRegistry(t *testing.T) {
+	report := NewRegistry().Run(Readiness | Liveness)
+	assert.True(t, report.Healthy)
+	assert.Empty(t, report.Components)
+}
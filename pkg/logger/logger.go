@@ -30,6 +30,8 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 
 	"kmesh.net/kmesh/pkg/constants"
+	"kmesh.net/kmesh/pkg/events"
+	"kmesh.net/kmesh/pkg/health"
 )
 
 const (
@@ -102,6 +104,11 @@ func GetLoggerNames() []string {
 	return names
 }
 
+// LogDir returns the directory holding the daemon log file and its rotated backups
+func LogDir() string {
+	return filepath.Dir(defaultLogFile)
+}
+
 // InitializeDefaultLogger return a initialized logger
 func InitializeDefaultLogger(onlyFile bool) *logrus.Logger {
 	logger := logrus.New()
@@ -148,9 +155,9 @@ func StartRingBufReader(ctx context.Context, mode string, bpfFsPath string) erro
 	var path string
 
 	if mode == constants.AdsMode {
-		path = bpfFsPath + "/bpf_kmesh/map"
+		path = bpfFsPath + constants.AdsMapPath
 	} else if mode == constants.WorkloadMode {
-		path = bpfFsPath + "/bpf_kmesh_workload/map"
+		path = bpfFsPath + constants.WorkloadMapPath
 	} else {
 		return fmt.Errorf("invalid start mode:%s", mode)
 	}
@@ -167,7 +174,11 @@ func StartRingBufReader(ctx context.Context, mode string, bpfFsPath string) erro
 
 func handleLogEvents(ctx context.Context, rbMap *ebpf.Map) {
 	log := NewLoggerField("ebpf")
-	events, err := ringbuf.NewReader(rbMap)
+	status := health.NewStatus(nil)
+	health.Register("ringbuf/bpf-log", health.Liveness, status.Check)
+	defer status.SetUnhealthy("bpf log ringbuf reader exited")
+
+	reader, err := ringbuf.NewReader(rbMap)
 	if err != nil {
 		log.Errorf("ringbuf new reader from rb map failed:%v", err)
 		return
@@ -178,8 +189,9 @@ func handleLogEvents(ctx context.Context, rbMap *ebpf.Map) {
 		case <-ctx.Done():
 			return
 		default:
-			record, err := events.Read()
+			record, err := reader.Read()
 			if err != nil {
+				log.Errorf("ringbuf read failed: %v", err)
 				return
 			}
 			le, err := decodeRecord(record.RawSample)
@@ -187,6 +199,7 @@ func handleLogEvents(ctx context.Context, rbMap *ebpf.Map) {
 				log.Errorf("ringbuf decode data failed:%v", err)
 			}
 			log.Infof("%v", le.Msg)
+			events.Publish(events.Event{Type: events.BpfLog, Message: le.Msg})
 		}
 	}
 }
@@ -22,6 +22,8 @@ import (
 	"net"
 	"syscall"
 
+	"golang.org/x/sys/unix"
+
 	"kmesh.net/kmesh/pkg/constants"
 )
 
@@ -60,6 +62,17 @@ func CopyIpByteFromSlice(dst *[16]byte, src []byte) {
 	copy(dst[:], src)
 }
 
+// IpString formats an address of the bpf maps, an ipv4 address is stored in
+// the first 4 bytes and the rest is zero
+func IpString(ip [16]byte) string {
+	for _, b := range ip[net.IPv4len:] {
+		if b != 0 {
+			return net.IP(ip[:]).String()
+		}
+	}
+	return net.IP(ip[:net.IPv4len]).String()
+}
+
 func checkIPVersion() (ipv4, ipv6 bool) {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
@@ -144,3 +157,15 @@ func TriggerControlCommand(oper int) error {
 	}
 	return nil
 }
+
+// GetNetNsCookie returns the cookie of the current network namespace, the value that
+// bpf_get_netns_cookie gives the programs of a socket created in it. It needs a 5.14+ kernel.
+func GetNetNsCookie() (uint64, error) {
+	sockfd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(sockfd)
+
+	return unix.GetsockoptUint64(sockfd, unix.SOL_SOCKET, unix.SO_NETNS_COOKIE)
+}
@@ -17,10 +17,12 @@
 package nets
 
 import (
+	"errors"
 	"net/netip"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 func Test_ConvertIpToUint32(t *testing.T) {
@@ -67,3 +69,25 @@ func TestCopyIpByteFromSlice(t *testing.T) {
 		})
 	}
 }
+
+func TestIpString(t *testing.T) {
+	var ip [16]byte
+	CopyIpByteFromSlice(&ip, []byte{10, 244, 0, 7})
+	assert.Equal(t, "10.244.0.7", IpString(ip))
+
+	CopyIpByteFromSlice(&ip, netip.MustParseAddr("2001::1").AsSlice())
+	assert.Equal(t, "2001::1", IpString(ip))
+}
+
+func TestGetNetNsCookie(t *testing.T) {
+	cookie, err := GetNetNsCookie()
+	if errors.Is(err, unix.ENOPROTOOPT) {
+		t.Skip("SO_NETNS_COOKIE is not supported by the kernel")
+	}
+	assert.NoError(t, err)
+	assert.NotZero(t, cookie)
+
+	again, err := GetNetNsCookie()
+	assert.NoError(t, err)
+	assert.Equal(t, cookie, again)
+}
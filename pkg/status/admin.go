@@ -0,0 +1,178 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package status
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"kmesh.net/kmesh/daemon/options"
+)
+
+type trustedConnKey struct{}
+
+// peerCredListener accepts the unix socket connections of root and of the daemon user only
+type peerCredListener struct {
+	*net.UnixListener
+}
+
+func listenAdminSocket(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	// a socket left behind by a daemon that did not exit cleanly fails the bind
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return &peerCredListener{UnixListener: l}, nil
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := peerUID(conn)
+		if err == nil && (uid == 0 || uid == uint32(os.Geteuid())) {
+			return conn, nil
+		}
+		if err != nil {
+			log.Warnf("rejected admin socket connection: %v", err)
+		} else {
+			log.Warnf("rejected admin socket connection of uid %d", uid)
+		}
+		_ = conn.Close()
+	}
+}
+
+func peerUID(conn *net.UnixConn) (uint32, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, fmt.Errorf("reading peer credentials: %v", credErr)
+	}
+	return cred.Uid, nil
+}
+
+// connContext marks the requests of unix socket connections, whose peer was checked on accept
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	if _, ok := c.(*net.UnixConn); ok {
+		return context.WithValue(ctx, trustedConnKey{}, true)
+	}
+	return ctx
+}
+
+// trusted reports whether the request may change the state of the daemon: it came over the
+// unix socket or over mutual TLS, where the client certificate was verified by the handshake
+func trusted(r *http.Request) bool {
+	if v, _ := r.Context().Value(trustedConnKey{}).(bool); v {
+		return true
+	}
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+func isProbe(path string) bool {
+	switch path {
+	case patternHelp, patternReadyProbe, patternLiveProbe, patternHealth:
+		return true
+	}
+	return false
+}
+
+// authorize separates the read only requests from the mutating ones. Untrusted connections
+// may read according to tcpAccess and never change anything.
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if trusted(r) || isProbe(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+		if !readOnly || s.tcpAccess != options.AdminTCPAccessRead {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "\t%s %s requires the admin socket %s or mutual TLS\n", r.Method, r.URL.Path, adminSocket)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func loadAdminTLSConfig(c *options.AdminConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading admin certificate: %v", err)
+	}
+	ca, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading admin client CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in admin client CA %s", c.ClientCAFile)
+	}
+	// kubelet probes come without a client certificate, trusted checks the verified
+	// chains before anything else than a probe is served
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// GetAdminClient returns the client of the kmesh-daemon subcommands. It talks to the status
+// server over the admin socket, and falls back to tcp when the socket does not exist, as with
+// a daemon that predates it, in which case only what --admin-tcp-access allows succeeds.
+func GetAdminClient() *http.Client {
+	dialer := &net.Dialer{}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if _, err := os.Stat(adminSocket); err == nil {
+					return dialer.DialContext(ctx, "unix", adminSocket)
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
@@ -17,9 +17,20 @@
 package status
 
 import (
+	"encoding/binary"
+	"fmt"
 	"net"
+	"sort"
+	"strconv"
+
+	"github.com/cilium/ebpf"
 
 	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/api/v2/workloadapi/security"
+	"kmesh.net/kmesh/pkg/auth"
+	"kmesh.net/kmesh/pkg/controller/workload"
+	bpfcache "kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+	"kmesh.net/kmesh/pkg/nets"
 )
 
 type Workload struct {
@@ -75,6 +86,93 @@ type Service struct {
 	Waypoint     *Waypoint           `json:"waypoint"`
 }
 
+type AuthorizationPolicy struct {
+	Name      string               `json:"name"`
+	Namespace string               `json:"namespace"`
+	Scope     string               `json:"scope"`
+	Action    string               `json:"action"`
+	Rules     []*AuthorizationRule `json:"rules"`
+}
+
+type AuthorizationRule struct {
+	// Clauses are AND-ed
+	Clauses []*AuthorizationClause `json:"clauses"`
+}
+
+type AuthorizationClause struct {
+	// Matches are OR-ed
+	Matches []*AuthorizationMatch `json:"matches"`
+}
+
+// AuthorizationMatch holds the string matches as "exact", "prefix*" or "*suffix"
+// and the addresses as CIDRs
+type AuthorizationMatch struct {
+	Namespaces          []string `json:"namespaces,omitempty"`
+	NotNamespaces       []string `json:"notNamespaces,omitempty"`
+	Principals          []string `json:"principals,omitempty"`
+	NotPrincipals       []string `json:"notPrincipals,omitempty"`
+	SourceIps           []string `json:"sourceIps,omitempty"`
+	NotSourceIps        []string `json:"notSourceIps,omitempty"`
+	DestinationIps      []string `json:"destinationIps,omitempty"`
+	NotDestinationIps   []string `json:"notDestinationIps,omitempty"`
+	DestinationPorts    []uint32 `json:"destinationPorts,omitempty"`
+	NotDestinationPorts []uint32 `json:"notDestinationPorts,omitempty"`
+}
+
+// WorkloadBpfMaps is the content of the workload bpf maps, with the ids
+// translated back to the names of the services and workloads
+type WorkloadBpfMaps struct {
+	Frontends []*BpfFrontend `json:"frontends"`
+	Services  []*BpfService  `json:"services"`
+	Endpoints []*BpfEndpoint `json:"endpoints"`
+	Backends  []*BpfBackend  `json:"backends"`
+	// DeniedConnections are the entries of the auth map, the connections
+	// the xdp program resets because an authorization policy denied them
+	DeniedConnections []*BpfAuthTuple `json:"deniedConnections"`
+}
+
+type BpfFrontend struct {
+	Address    string `json:"address"`
+	UpstreamId uint32 `json:"upstreamId"`
+	// Upstream is the service of a service address, or the workload uid of a pod address
+	Upstream string `json:"upstream"`
+}
+
+type BpfServicePort struct {
+	ServicePort uint32 `json:"servicePort"`
+	TargetPort  uint32 `json:"targetPort"`
+}
+
+type BpfService struct {
+	ServiceId     uint32            `json:"serviceId"`
+	Service       string            `json:"service"`
+	EndpointCount uint32            `json:"endpointCount"`
+	LbPolicy      uint32            `json:"lbPolicy"`
+	Ports         []*BpfServicePort `json:"ports,omitempty"`
+	Waypoint      string            `json:"waypoint,omitempty"`
+}
+
+type BpfEndpoint struct {
+	ServiceId    uint32 `json:"serviceId"`
+	Service      string `json:"service"`
+	BackendIndex uint32 `json:"backendIndex"`
+	BackendUid   uint32 `json:"backendUid"`
+	Backend      string `json:"backend"`
+}
+
+type BpfBackend struct {
+	BackendUid uint32   `json:"backendUid"`
+	Backend    string   `json:"backend"`
+	Address    string   `json:"address"`
+	Services   []string `json:"services,omitempty"`
+	Waypoint   string   `json:"waypoint,omitempty"`
+}
+
+type BpfAuthTuple struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
 type NetworkAddress struct {
 	// Network represents the network this address is on.
 	Network string
@@ -162,3 +260,267 @@ func ConvertService(s *workloadapi.Service) *Service {
 
 	return out
 }
+
+func ConvertAuthorizationPolicy(p *security.Authorization) *AuthorizationPolicy {
+	out := &AuthorizationPolicy{
+		Name:      p.GetName(),
+		Namespace: p.GetNamespace(),
+		Scope:     p.GetScope().String(),
+		Action:    p.GetAction().String(),
+		Rules:     make([]*AuthorizationRule, 0, len(p.GetRules())),
+	}
+	for _, rule := range p.GetRules() {
+		r := &AuthorizationRule{Clauses: make([]*AuthorizationClause, 0, len(rule.GetClauses()))}
+		for _, clause := range rule.GetClauses() {
+			c := &AuthorizationClause{Matches: make([]*AuthorizationMatch, 0, len(clause.GetMatches()))}
+			for _, match := range clause.GetMatches() {
+				c.Matches = append(c.Matches, convertAuthorizationMatch(match))
+			}
+			r.Clauses = append(r.Clauses, c)
+		}
+		out.Rules = append(out.Rules, r)
+	}
+	return out
+}
+
+func convertAuthorizationMatch(m *security.Match) *AuthorizationMatch {
+	return &AuthorizationMatch{
+		Namespaces:          convertStringMatches(m.GetNamespaces()),
+		NotNamespaces:       convertStringMatches(m.GetNotNamespaces()),
+		Principals:          convertStringMatches(m.GetPrincipals()),
+		NotPrincipals:       convertStringMatches(m.GetNotPrincipals()),
+		SourceIps:           convertAddresses(m.GetSourceIps()),
+		NotSourceIps:        convertAddresses(m.GetNotSourceIps()),
+		DestinationIps:      convertAddresses(m.GetDestinationIps()),
+		NotDestinationIps:   convertAddresses(m.GetNotDestinationIps()),
+		DestinationPorts:    m.GetDestinationPorts(),
+		NotDestinationPorts: m.GetNotDestinationPorts(),
+	}
+}
+
+func convertStringMatch(m *security.StringMatch) string {
+	switch m.GetMatchType().(type) {
+	case *security.StringMatch_Prefix:
+		return m.GetPrefix() + "*"
+	case *security.StringMatch_Suffix:
+		return "*" + m.GetSuffix()
+	default:
+		return m.GetExact()
+	}
+}
+
+func convertStringMatches(matches []*security.StringMatch) []string {
+	if len(matches) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(matches))
+	for _, m := range matches {
+		out = append(out, convertStringMatch(m))
+	}
+	return out
+}
+
+func convertAddresses(addresses []*security.Address) []string {
+	if len(addresses) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(addresses))
+	for _, addr := range addresses {
+		out = append(out, net.IP(addr.GetAddress()).String()+"/"+strconv.Itoa(int(addr.GetLength())))
+	}
+	return out
+}
+
+// bpfWaypointString formats the waypoint address and network order port of
+// the bpf maps as host:port, empty when no waypoint is set
+func bpfWaypointString(addr [16]byte, port uint32) string {
+	if addr == [16]byte{} {
+		return ""
+	}
+	return net.JoinHostPort(nets.IpString(addr), strconv.Itoa(int(nets.ConvertPortToBigEndian(port))))
+}
+
+func bpfIdName(hashName *workload.HashName, id uint32) string {
+	if name := hashName.NumToStr(id); name != "" {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", id)
+}
+
+// ConvertWorkloadBpfMaps reads the workload bpf maps through the cache
+func ConvertWorkloadBpfMaps(c *bpfcache.Cache, hashName *workload.HashName, authMap *ebpf.Map) (*WorkloadBpfMaps, error) {
+	frontends, err := convertBpfFrontends(c, hashName)
+	if err != nil {
+		return nil, err
+	}
+	services, err := convertBpfServices(c, hashName)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := convertBpfEndpoints(c, hashName)
+	if err != nil {
+		return nil, err
+	}
+	backends, err := convertBpfBackends(c, hashName)
+	if err != nil {
+		return nil, err
+	}
+	denied, err := convertBpfAuthMap(authMap)
+	if err != nil {
+		return nil, err
+	}
+	return &WorkloadBpfMaps{
+		Frontends:         frontends,
+		Services:          services,
+		Endpoints:         endpoints,
+		Backends:          backends,
+		DeniedConnections: denied,
+	}, nil
+}
+
+func convertBpfFrontends(c *bpfcache.Cache, hashName *workload.HashName) ([]*BpfFrontend, error) {
+	frontends, err := c.FrontendDump()
+	if err != nil {
+		return nil, fmt.Errorf("dump frontend map failed: %v", err)
+	}
+	out := make([]*BpfFrontend, 0, len(frontends))
+	for k, v := range frontends {
+		out = append(out, &BpfFrontend{
+			Address:    nets.IpString(k.Ip),
+			UpstreamId: v.UpstreamId,
+			Upstream:   bpfIdName(hashName, v.UpstreamId),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Address < out[j].Address
+	})
+	return out, nil
+}
+
+func convertBpfServices(c *bpfcache.Cache, hashName *workload.HashName) ([]*BpfService, error) {
+	services, err := c.ServiceDump()
+	if err != nil {
+		return nil, fmt.Errorf("dump service map failed: %v", err)
+	}
+	out := make([]*BpfService, 0, len(services))
+	for k, v := range services {
+		svc := &BpfService{
+			ServiceId:     k.ServiceId,
+			Service:       bpfIdName(hashName, k.ServiceId),
+			EndpointCount: v.EndpointCount,
+			LbPolicy:      v.LbPolicy,
+			Waypoint:      bpfWaypointString(v.WaypointAddr, v.WaypointPort),
+		}
+		for i := range v.ServicePort {
+			if v.ServicePort[i] == 0 {
+				continue
+			}
+			svc.Ports = append(svc.Ports, &BpfServicePort{
+				ServicePort: nets.ConvertPortToBigEndian(v.ServicePort[i]),
+				TargetPort:  nets.ConvertPortToBigEndian(v.TargetPort[i]),
+			})
+		}
+		out = append(out, svc)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Service < out[j].Service
+	})
+	return out, nil
+}
+
+func convertBpfEndpoints(c *bpfcache.Cache, hashName *workload.HashName) ([]*BpfEndpoint, error) {
+	endpoints, err := c.EndpointDump()
+	if err != nil {
+		return nil, fmt.Errorf("dump endpoint map failed: %v", err)
+	}
+	out := make([]*BpfEndpoint, 0, len(endpoints))
+	for k, v := range endpoints {
+		out = append(out, &BpfEndpoint{
+			ServiceId:    k.ServiceId,
+			Service:      bpfIdName(hashName, k.ServiceId),
+			BackendIndex: k.BackendIndex,
+			BackendUid:   v.BackendUid,
+			Backend:      bpfIdName(hashName, v.BackendUid),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Service != out[j].Service {
+			return out[i].Service < out[j].Service
+		}
+		return out[i].BackendIndex < out[j].BackendIndex
+	})
+	return out, nil
+}
+
+func convertBpfBackends(c *bpfcache.Cache, hashName *workload.HashName) ([]*BpfBackend, error) {
+	backends, err := c.BackendDump()
+	if err != nil {
+		return nil, fmt.Errorf("dump backend map failed: %v", err)
+	}
+	out := make([]*BpfBackend, 0, len(backends))
+	for k, v := range backends {
+		backend := &BpfBackend{
+			BackendUid: k.BackendUid,
+			Backend:    bpfIdName(hashName, k.BackendUid),
+			Address:    nets.IpString(v.Ip),
+			Waypoint:   bpfWaypointString(v.WaypointAddr, v.WaypointPort),
+		}
+		for i := uint32(0); i < v.ServiceCount && i < bpfcache.MaxServiceNum; i++ {
+			backend.Services = append(backend.Services, bpfIdName(hashName, v.Services[i]))
+		}
+		out = append(out, backend)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Backend < out[j].Backend
+	})
+	return out, nil
+}
+
+// convertBpfAuthMap lists the connections of the auth map, a nil map has none
+func convertBpfAuthMap(authMap *ebpf.Map) ([]*BpfAuthTuple, error) {
+	out := []*BpfAuthTuple{}
+	if authMap == nil {
+		return out, nil
+	}
+	var value uint32
+	key := make([]byte, authMap.KeySize())
+	iter := authMap.Iterate()
+	for iter.Next(key, &value) {
+		out = append(out, convertAuthTuple(key))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("dump auth map failed: %v", err)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Source != out[j].Source {
+			return out[i].Source < out[j].Source
+		}
+		return out[i].Destination < out[j].Destination
+	})
+	return out, nil
+}
+
+// convertAuthTuple decodes a key of the auth map, a struct bpf_sock_tuple
+// whose addresses and ports are in network order
+func convertAuthTuple(key []byte) *BpfAuthTuple {
+	ipv4 := true
+	for _, b := range key[auth.IPV4_TUPLE_LENGTH:] {
+		if b != 0 {
+			ipv4 = false
+			break
+		}
+	}
+
+	ipLen := net.IPv6len
+	if ipv4 {
+		ipLen = net.IPv4len
+	}
+	src := net.IP(key[:ipLen])
+	dst := net.IP(key[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(key[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(key[2*ipLen+2:])
+	return &BpfAuthTuple{
+		Source:      net.JoinHostPort(src.String(), strconv.Itoa(int(srcPort))),
+		Destination: net.JoinHostPort(dst.String(), strconv.Itoa(int(dstPort))),
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"kmesh.net/kmesh/pkg/constants"
+	"kmesh.net/kmesh/pkg/controller/workload"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// BpfMapDump is the decoded content of a bpf map
+type BpfMapDump struct {
+	Name    string        `json:"name"`
+	Entries []BpfMapEntry `json:"entries"`
+}
+
+// BpfMapEntry is an entry of a bpf map. Key is the readable form of the map key, with
+// the HashName ids translated to names, and is what the key filter matches against.
+type BpfMapEntry struct {
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+}
+
+// bpfMapDecoders decode the maps of the running mode, by the name of their pin
+func (s *Server) bpfMapDecoders() map[string]func() ([]BpfMapEntry, error) {
+	client := s.xdsClient
+	if client == nil {
+		return nil
+	}
+
+	if client.WorkloadController != nil {
+		processor := client.WorkloadController.Processor
+		if processor.GetBpfCache() == nil {
+			return nil
+		}
+		return workloadMapDecoders(processor.GetBpfCache(), processor.GetHashName(), client.WorkloadController.GetAuthMap())
+	}
+
+	if client.AdsController != nil {
+		cache := client.AdsController.Processor.Cache
+		return map[string]func() ([]BpfMapEntry, error){
+			"kmesh_listener": func() ([]BpfMapEntry, error) {
+				return protoMapEntries(cache.ListenerCache.DumpBpf())
+			},
+			"kmesh_cluster": func() ([]BpfMapEntry, error) {
+				return protoMapEntries(cache.ClusterCache.DumpBpf())
+			},
+			"map_of_router_config": func() ([]BpfMapEntry, error) {
+				return protoMapEntries(cache.RouteCache.DumpBpf())
+			},
+		}
+	}
+	return nil
+}
+
+// workloadMapDecoders decode the workload maps through the bpf cache, keyed by names instead of HashName ids
+func workloadMapDecoders(c *bpfcache.Cache, hashName *workload.HashName, authMap *ebpf.Map) map[string]func() ([]BpfMapEntry, error) {
+	return map[string]func() ([]BpfMapEntry, error){
+		"kmesh_frontend": func() ([]BpfMapEntry, error) {
+			frontends, err := convertBpfFrontends(c, hashName)
+			return bpfMapEntries(frontends, func(f *BpfFrontend) string { return f.Address }), err
+		},
+		"kmesh_service": func() ([]BpfMapEntry, error) {
+			services, err := convertBpfServices(c, hashName)
+			return bpfMapEntries(services, func(svc *BpfService) string { return svc.Service }), err
+		},
+		"kmesh_endpoint": func() ([]BpfMapEntry, error) {
+			endpoints, err := convertBpfEndpoints(c, hashName)
+			return bpfMapEntries(endpoints, func(e *BpfEndpoint) string {
+				return e.Service + "[" + strconv.Itoa(int(e.BackendIndex)) + "]"
+			}), err
+		},
+		"kmesh_backend": func() ([]BpfMapEntry, error) {
+			backends, err := convertBpfBackends(c, hashName)
+			return bpfMapEntries(backends, func(b *BpfBackend) string { return b.Backend }), err
+		},
+		"map_of_auth": func() ([]BpfMapEntry, error) {
+			denied, err := convertBpfAuthMap(authMap)
+			return bpfMapEntries(denied, func(t *BpfAuthTuple) string { return t.Source + "->" + t.Destination }), err
+		},
+	}
+}
+
+// filterBpfMapEntries keeps the entries whose key contains filter
+func filterBpfMapEntries(entries []BpfMapEntry, filter string) []BpfMapEntry {
+	if filter == "" {
+		return entries
+	}
+	matched := []BpfMapEntry{}
+	for _, e := range entries {
+		if strings.Contains(e.Key, filter) {
+			matched = append(matched, e)
+		}
+	}
+	return matched
+}
+
+func bpfMapEntries[T any](values []T, key func(T) string) []BpfMapEntry {
+	entries := make([]BpfMapEntry, 0, len(values))
+	for _, v := range values {
+		entries = append(entries, BpfMapEntry{Key: key(v), Value: v})
+	}
+	return entries
+}
+
+// protoMapEntries converts the ads resources read back from a map, keyed by their names
+func protoMapEntries[T interface {
+	proto.Message
+	GetName() string
+}](values []T) ([]BpfMapEntry, error) {
+	entries := make([]BpfMapEntry, 0, len(values))
+	for _, v := range values {
+		data, err := protojson.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("marshal %s failed: %v", v.GetName(), err)
+		}
+		entries = append(entries, BpfMapEntry{Key: v.GetName(), Value: json.RawMessage(data)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, nil
+}
+
+func (s *Server) bpfFsPath() string {
+	if s.config != nil && s.config.BpfConfig != nil && s.config.BpfConfig.BpfFsPath != "" {
+		return s.config.BpfConfig.BpfFsPath
+	}
+	return constants.BpfFsPath
+}
+
+func (s *Server) bpfMapsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := utils.PinnedMapStats(s.bpfFsPath())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "\t%s: %v\n", "failed to read the pinned maps", err)
+		return
+	}
+	if stats == nil {
+		stats = []utils.MapStats{}
+	}
+	data, err := json.MarshalIndent(stats, "", "    ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+func (s *Server) bpfMapHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, patternBpfMap)
+	decoders := s.bpfMapDecoders()
+	if len(decoders) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "\t%s\n", "invalid ClientMode")
+		return
+	}
+	decode, ok := decoders[name]
+	if !ok {
+		names := make([]string, 0, len(decoders))
+		for n := range decoders {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "\tunknown map %q, the maps decoded in this mode are %v\n", name, names)
+		return
+	}
+
+	entries, err := decode()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "\t%v\n", err)
+		return
+	}
+	entries = filterBpfMapEntries(entries, r.URL.Query().Get("key"))
+
+	data, err := json.MarshalIndent(&BpfMapDump{Name: name, Entries: entries}, "", "    ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,283 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"istio.io/istio/pkg/spiffe"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/constants"
+	"kmesh.net/kmesh/pkg/controller/bypass"
+	kmeshmanage "kmesh.net/kmesh/pkg/controller/manage"
+	kmeshsecurity "kmesh.net/kmesh/pkg/controller/security"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+	"kmesh.net/kmesh/pkg/utils"
+	"kmesh.net/kmesh/pkg/utils/istio"
+)
+
+// podGetter looks up a pod and its namespace in the informer caches
+type podGetter interface {
+	GetPod(namespace, name string) (*corev1.Pod, *corev1.Namespace, error)
+}
+
+// PodDescription gathers what kmesh knows about a pod on this node
+type PodDescription struct {
+	Name           string                  `json:"name"`
+	Namespace      string                  `json:"namespace"`
+	Node           string                  `json:"node,omitempty"`
+	IP             string                  `json:"ip,omitempty"`
+	ServiceAccount string                  `json:"serviceAccount,omitempty"`
+	Enrollment     *PodEnrollment          `json:"enrollment,omitempty"`
+	Bypass         *PodBypass              `json:"bypass,omitempty"`
+	Xdp            []kmeshmanage.XdpLink   `json:"xdp,omitempty"`
+	XdpError       string                  `json:"xdpError,omitempty"`
+	Workload       *Workload               `json:"workload,omitempty"`
+	Frontends      []*BpfFrontend          `json:"frontends,omitempty"`
+	Backend        *BpfBackend             `json:"backend,omitempty"`
+	Services       []*PodService           `json:"services,omitempty"`
+	Waypoint       string                  `json:"waypoint,omitempty"`
+	Policies       []*AuthorizationPolicy  `json:"policies,omitempty"`
+	Identity       string                  `json:"identity,omitempty"`
+	Certificate    *kmeshsecurity.CertInfo `json:"certificate,omitempty"`
+	// Inbound counts the connections accepted by the pod, Outbound the ones opened by it,
+	// both over the last ConnectionWindow
+	Inbound          *telemetry.ConnectionStats `json:"inbound,omitempty"`
+	Outbound         *telemetry.ConnectionStats `json:"outbound,omitempty"`
+	ConnectionWindow time.Duration              `json:"connectionWindow,omitempty"`
+}
+
+type PodEnrollment struct {
+	ShouldEnroll bool `json:"shouldEnroll"`
+	// Annotation is the redirection annotation set by the kmesh manage controller
+	Annotation     string `json:"annotation,omitempty"`
+	Enrolled       bool   `json:"enrolled"`
+	PodLabel       string `json:"podLabel,omitempty"`
+	NamespaceLabel string `json:"namespaceLabel,omitempty"`
+}
+
+type PodBypass struct {
+	ControllerEnabled bool `json:"controllerEnabled"`
+	Sidecar           bool `json:"sidecar"`
+	Label             bool `json:"label"`
+	Bypassed          bool `json:"bypassed"`
+}
+
+// PodService is a service the pod backs, with its frontends and the slot of the pod in the endpoint map
+type PodService struct {
+	Name      string         `json:"name"`
+	Service   *Service       `json:"service,omitempty"`
+	Frontends []*BpfFrontend `json:"frontends,omitempty"`
+	Endpoints []*BpfEndpoint `json:"endpoints,omitempty"`
+}
+
+func GetDescribePodURL(namespace, name string) string {
+	return "http://" + adminAddr + patternDescribePod + namespace + "/" + name
+}
+
+func (s *Server) describePodHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, patternDescribePod), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "\t%s\n", "expected "+patternDescribePod+"<namespace>/<name>")
+		return
+	}
+
+	desc, err := s.describePod(parts[0], parts[1])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "\t%s: %v\n", "describe pod failed", err)
+		return
+	}
+	if desc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "\tpod %s/%s not found on this node\n", parts[0], parts[1])
+		return
+	}
+
+	data, err := json.MarshalIndent(desc, "", "    ")
+	if err != nil {
+		log.Errorf("Failed to marshal pod description: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+// describePod returns nil if neither the pod nor its workload is known
+func (s *Server) describePod(namespace, name string) (*PodDescription, error) {
+	var (
+		pod *corev1.Pod
+		ns  *corev1.Namespace
+		err error
+	)
+	if s.pods != nil {
+		pod, ns, err = s.pods.GetPod(namespace, name)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	wl := s.findWorkload(namespace, name)
+	if pod == nil && wl == nil {
+		return nil, nil
+	}
+
+	desc := &PodDescription{Name: name, Namespace: namespace}
+	if pod != nil {
+		s.describeK8sPod(desc, pod, ns)
+	}
+	if wl != nil {
+		if err := s.describeWorkload(desc, wl); err != nil {
+			return nil, err
+		}
+	}
+
+	if desc.ServiceAccount != "" {
+		desc.Identity = spiffe.Identity{
+			TrustDomain:    constants.TrustDomain,
+			Namespace:      namespace,
+			ServiceAccount: desc.ServiceAccount,
+		}.String()
+	}
+	if s.secretManager != nil && desc.Identity != "" {
+		for _, cert := range s.secretManager.Certs() {
+			if cert.Identity == desc.Identity {
+				cert := cert
+				desc.Certificate = &cert
+				break
+			}
+		}
+	}
+	return desc, nil
+}
+
+func (s *Server) describeK8sPod(desc *PodDescription, pod *corev1.Pod, ns *corev1.Namespace) {
+	desc.Node = pod.Spec.NodeName
+	desc.IP = pod.Status.PodIP
+	desc.ServiceAccount = pod.Spec.ServiceAccountName
+
+	desc.Enrollment = &PodEnrollment{
+		ShouldEnroll: utils.ShouldEnroll(pod, ns),
+		Annotation:   pod.Annotations[constants.KmeshRedirectionAnnotation],
+		PodLabel:     pod.Labels[constants.DataPlaneModeLabel],
+	}
+	desc.Enrollment.Enrolled = desc.Enrollment.Annotation == "enabled"
+	if ns != nil {
+		desc.Enrollment.NamespaceLabel = ns.Labels[constants.DataPlaneModeLabel]
+	}
+
+	desc.Bypass = &PodBypass{
+		ControllerEnabled: s.config != nil && s.config.ByPassConfig != nil && s.config.ByPassConfig.EnableByPass,
+		Sidecar:           istio.PodHasSidecar(pod),
+		Label:             pod.Labels[bypass.ByPassLabel] == bypass.ByPassValue,
+	}
+	desc.Bypass.Bypassed = desc.Bypass.ControllerEnabled && desc.Bypass.Label
+
+	links, err := kmeshmanage.GetXdpLinks(pod)
+	if err != nil {
+		desc.XdpError = err.Error()
+	} else {
+		desc.Xdp = links
+	}
+}
+
+func (s *Server) describeWorkload(desc *PodDescription, wl *workloadapi.Workload) error {
+	workloadController := s.xdsClient.WorkloadController
+	desc.Workload = ConvertWorkload(wl)
+	sort.Strings(desc.Workload.Services)
+	desc.Waypoint = desc.Workload.Waypoint
+	if desc.Node == "" {
+		desc.Node = wl.Node
+	}
+	if desc.IP == "" && len(desc.Workload.Addresses) > 0 {
+		desc.IP = desc.Workload.Addresses[0]
+	}
+	if desc.ServiceAccount == "" {
+		desc.ServiceAccount = wl.ServiceAccount
+	}
+
+	var bpfMaps *WorkloadBpfMaps
+	if bpfCache := workloadController.Processor.GetBpfCache(); bpfCache != nil {
+		var err error
+		if bpfMaps, err = ConvertWorkloadBpfMaps(bpfCache, workloadController.Processor.GetHashName(), nil); err != nil {
+			return err
+		}
+		for _, frontend := range bpfMaps.Frontends {
+			if frontend.Upstream == wl.Uid {
+				desc.Frontends = append(desc.Frontends, frontend)
+			}
+		}
+		for _, backend := range bpfMaps.Backends {
+			if backend.Backend == wl.Uid {
+				desc.Backend = backend
+				break
+			}
+		}
+	}
+
+	for _, name := range desc.Workload.Services {
+		podService := &PodService{Name: name}
+		if svc := workloadController.Processor.ServiceCache.GetService(name); svc != nil {
+			podService.Service = ConvertService(svc)
+		}
+		if bpfMaps != nil {
+			for _, frontend := range bpfMaps.Frontends {
+				if frontend.Upstream == name {
+					podService.Frontends = append(podService.Frontends, frontend)
+				}
+			}
+			for _, endpoint := range bpfMaps.Endpoints {
+				if endpoint.Service == name && endpoint.Backend == wl.Uid {
+					podService.Endpoints = append(podService.Endpoints, endpoint)
+				}
+			}
+		}
+		desc.Services = append(desc.Services, podService)
+	}
+
+	for _, policy := range workloadController.Rbac.WorkloadPolicies(wl) {
+		desc.Policies = append(desc.Policies, ConvertAuthorizationPolicy(policy))
+	}
+
+	inbound, outbound := telemetry.PodConnectionStats(desc.Namespace, desc.Name)
+	desc.Inbound, desc.Outbound = &inbound, &outbound
+	desc.ConnectionWindow = telemetry.PodStatsWindow
+	return nil
+}
+
+// findWorkload returns the cached workload of the pod, nil if there is none
+func (s *Server) findWorkload(namespace, name string) *workloadapi.Workload {
+	if s.xdsClient == nil || s.xdsClient.WorkloadController == nil || s.xdsClient.WorkloadController.Processor == nil {
+		return nil
+	}
+	for _, wl := range s.xdsClient.WorkloadController.Processor.WorkloadCache.List() {
+		if wl.Namespace == namespace && wl.Name == name {
+			return wl
+		}
+	}
+	return nil
+}
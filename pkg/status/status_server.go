@@ -17,12 +17,17 @@
 package status
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cilium/ebpf"
@@ -30,11 +35,16 @@ import (
 	"google.golang.org/protobuf/encoding/protojson"
 
 	adminv2 "kmesh.net/kmesh/api/v2/admin"
-	"kmesh.net/kmesh/api/v2/workloadapi/security"
 	"kmesh.net/kmesh/daemon/options"
 	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/controller"
 	"kmesh.net/kmesh/pkg/controller/ads"
+	"kmesh.net/kmesh/pkg/controller/consistency"
+	kmeshmanage "kmesh.net/kmesh/pkg/controller/manage"
+	kmeshsecurity "kmesh.net/kmesh/pkg/controller/security"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+	"kmesh.net/kmesh/pkg/events"
+	"kmesh.net/kmesh/pkg/health"
 	"kmesh.net/kmesh/pkg/logger"
 )
 
@@ -42,19 +52,43 @@ var log = logger.NewLoggerField("status")
 
 const (
 	adminAddr = "localhost:15200"
+	// adminSocket serves the same endpoints as adminAddr, including the mutating ones
+	adminSocket = "/var/run/kmesh/admin.sock"
+	// probeAddr serves only the probes on every address, the kubelet cannot reach the
+	// loopback adminAddr of the pod
+	probeAddr = ":15021"
 
 	patternHelp               = "/help"
 	patternOptions            = "/options"
 	patternBpfAdsMaps         = "/debug/bpf/ads"
+	patternBpfMaps            = "/debug/bpf/maps"
+	patternBpfMap             = "/debug/bpf/map/"
 	configDumpPrefix          = "/debug/config_dump"
 	patternConfigDumpAds      = configDumpPrefix + "/ads"
 	patternConfigDumpWorkload = configDumpPrefix + "/workload"
 	patternReadyProbe         = "/debug/ready"
+	patternLiveProbe          = "/debug/live"
+	patternHealth             = "/debug/health"
 	patternLoggers            = "/debug/loggers"
+	patternCerts              = "/debug/certs"
+	patternDiff               = "/debug/diff"
+	patternDescribePod        = "/debug/describe/pod/"
+	patternTop                = "/debug/top"
+	patternEvents             = "/debug/events"
+	patternPprof              = "/debug/pprof/"
 
 	bpfLoggerName = "bpf"
 
 	httpTimeout = time.Second * 20
+
+	defaultTopInterval = 2 * time.Second
+	minTopInterval     = 100 * time.Millisecond
+	defaultTopLimit    = 20
+
+	// eventsBufferSize is the number of events buffered per stream before dropping
+	eventsBufferSize = 1024
+	// eventsDropInterval is how often a stream reports the events it dropped
+	eventsDropInterval = time.Second
 )
 
 type Server struct {
@@ -62,7 +96,15 @@ type Server struct {
 	xdsClient      *controller.XdsClient
 	mux            *http.ServeMux
 	server         *http.Server
+	probeServer    *http.Server
 	bpfLogLevelMap *ebpf.Map
+	secretManager  *kmeshsecurity.SecretManager
+	health         *health.Registry
+	checker        consistency.Checker
+	pods           podGetter
+	eventBus       *events.Bus
+	tcpAccess      string
+	adminConfig    *options.AdminConfig
 }
 
 func GetConfigDumpAddr(mode string) string {
@@ -73,32 +115,118 @@ func GetLoggerURL() string {
 	return "http://" + adminAddr + patternLoggers
 }
 
-func NewServer(c *controller.XdsClient, configs *options.BootstrapConfigs, bpfLogLevel *ebpf.Map) *Server {
+func GetCertsURL() string {
+	return "http://" + adminAddr + patternCerts
+}
+
+func GetDiffURL() string {
+	return "http://" + adminAddr + patternDiff
+}
+
+func GetEventsURL() string {
+	return "http://" + adminAddr + patternEvents
+}
+
+func GetTopURL() string {
+	return "http://" + adminAddr + patternTop
+}
+
+func GetBpfMapsURL() string {
+	return "http://" + adminAddr + patternBpfMaps
+}
+
+func GetBpfMapURL(name string) string {
+	return "http://" + adminAddr + patternBpfMap + name
+}
+
+func GetPprofURL(profile string) string {
+	return "http://" + adminAddr + patternPprof + profile
+}
+
+// DebugEndpoint is a read only endpoint of the status server and the file its output is saved to
+type DebugEndpoint struct {
+	File string
+	URL  string
+}
+
+// GetDebugEndpoints returns the endpoints describing the state of the daemon, as collected by
+// bug reports. Streaming endpoints are bounded so that every request completes.
+func GetDebugEndpoints() []DebugEndpoint {
+	base := "http://" + adminAddr
+	return []DebugEndpoint{
+		{File: "help.txt", URL: base + patternHelp},
+		{File: "options.txt", URL: base + patternOptions},
+		{File: "health.json", URL: base + patternHealth},
+		{File: "loggers.json", URL: base + patternLoggers},
+		{File: "certs.json", URL: base + patternCerts},
+		{File: "diff.json", URL: base + patternDiff},
+		{File: "config_dump_ads.json", URL: base + patternConfigDumpAds},
+		{File: "config_dump_workload.json", URL: base + patternConfigDumpWorkload},
+		{File: "bpf_ads.json", URL: base + patternBpfAdsMaps},
+		{File: "bpf_maps.json", URL: base + patternBpfMaps},
+		{File: "top.json", URL: base + patternTop + "?count=1&limit=100"},
+	}
+}
+
+func NewServer(c *controller.XdsClient, configs *options.BootstrapConfigs, bpfLogLevel *ebpf.Map, secretManager *kmeshsecurity.SecretManager, manageController *kmeshmanage.KmeshManageController) *Server {
 	s := &Server{
 		config:         configs,
 		xdsClient:      c,
 		mux:            http.NewServeMux(),
 		bpfLogLevelMap: bpfLogLevel,
+		secretManager:  secretManager,
+		health:         health.Default(),
+		eventBus:       events.Default(),
+		tcpAccess:      options.AdminTCPAccessProbes,
+	}
+	if configs != nil && configs.AdminConfig != nil {
+		s.adminConfig = configs.AdminConfig
+		s.tcpAccess = configs.AdminConfig.TCPAccess
+	}
+	if c != nil {
+		s.checker = c.ConsistencyChecker()
+	}
+	if manageController != nil {
+		s.pods = manageController
 	}
 	s.server = &http.Server{
 		Addr:         adminAddr,
-		Handler:      s.mux,
+		Handler:      s.authorize(s.mux),
 		ReadTimeout:  httpTimeout,
 		WriteTimeout: httpTimeout,
+		ConnContext:  connContext,
 	}
 
 	s.mux.HandleFunc(patternHelp, s.httpHelp)
 	s.mux.HandleFunc(patternOptions, s.httpOptions)
 	s.mux.HandleFunc(patternBpfAdsMaps, s.bpfAdsMaps)
+	s.mux.HandleFunc(patternBpfMaps, s.bpfMapsHandler)
+	s.mux.HandleFunc(patternBpfMap, s.bpfMapHandler)
 	s.mux.HandleFunc(patternConfigDumpAds, s.configDumpAds)
 	s.mux.HandleFunc(patternConfigDumpWorkload, s.configDumpWorkload)
 	s.mux.HandleFunc(patternLoggers, s.loggersHandler)
+	s.mux.HandleFunc(patternCerts, s.certsHandler)
+	s.mux.HandleFunc(patternDiff, s.diffHandler)
+	s.mux.HandleFunc(patternDescribePod, s.describePodHandler)
+	s.mux.HandleFunc(patternTop, s.topHandler)
+	s.mux.HandleFunc(patternEvents, s.eventsHandler)
 
-	// TODO: add dump certificate, authorizationPolicies and services
 	s.mux.HandleFunc(patternReadyProbe, s.readyProbe)
+	s.mux.HandleFunc(patternLiveProbe, s.liveProbe)
+	s.mux.HandleFunc(patternHealth, s.healthHandler)
+
+	probeMux := http.NewServeMux()
+	probeMux.HandleFunc(patternReadyProbe, s.readyProbe)
+	probeMux.HandleFunc(patternLiveProbe, s.liveProbe)
+	s.probeServer = &http.Server{
+		Addr:         probeAddr,
+		Handler:      probeMux,
+		ReadTimeout:  httpTimeout,
+		WriteTimeout: httpTimeout,
+	}
 
 	// support pprof
-	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	s.mux.HandleFunc(patternPprof, pprof.Index)
 	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
@@ -109,18 +237,40 @@ func NewServer(c *controller.XdsClient, configs *options.BootstrapConfigs, bpfLo
 func (s *Server) httpHelp(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 
+	fmt.Fprintf(w, "mutating requests are only accepted on the unix socket %s or over mutual TLS\n", adminSocket)
+
 	fmt.Fprintf(w, "\t%s: %s\n", patternHelp,
 		"print list of commands")
 	fmt.Fprintf(w, "\t%s: %s\n", patternOptions,
 		"print config options")
 	fmt.Fprintf(w, "\t%s: %s\n", patternBpfAdsMaps,
 		"print bpf kmesh maps in kernel")
+	fmt.Fprintf(w, "\t%s: %s\n", patternBpfMaps,
+		"list the pinned kmesh maps with their size and occupancy")
+	fmt.Fprintf(w, "\t%s: %s\n", patternBpfMap+"<name>",
+		"decode the entries of a bpf map with the ids translated to names, ?key=<substring> filters by key")
 	fmt.Fprintf(w, "\t%s: %s\n", patternConfigDumpAds,
 		"dump xDS[Listener, Route, Cluster] configurations")
 	fmt.Fprintf(w, "\t%s: %s\n", patternConfigDumpWorkload,
-		"dump workload configurations")
+		"dump workload configurations, authorization policies and the content of the workload bpf maps")
 	fmt.Fprintf(w, "\t%s: %s\n", patternLoggers,
 		"get or set logger level")
+	fmt.Fprintf(w, "\t%s: %s\n", patternCerts,
+		"list the workload certificates held by the secret manager")
+	fmt.Fprintf(w, "\t%s: %s\n", patternDiff,
+		"compare the userspace cache with the bpf maps, POST to rewrite the out of sync entries")
+	fmt.Fprintf(w, "\t%s: %s\n", patternDescribePod+"<namespace>/<name>",
+		"describe the enrollment, bpf entries, policies, certificate and connection metrics of a pod")
+	fmt.Fprintf(w, "\t%s: %s\n", patternTop,
+		"stream the busiest connections and workload pairs as json lines, ?interval=2s&limit=20&count=0")
+	fmt.Fprintf(w, "\t%s: %s\n", patternEvents,
+		"stream the daemon events as json lines or server-sent events, ?type=xds,rbac&namespace=default&format=sse")
+	fmt.Fprintf(w, "\t%s: %s\n", patternReadyProbe,
+		"readiness probe, fails while any readiness check fails, also served on "+probeAddr)
+	fmt.Fprintf(w, "\t%s: %s\n", patternLiveProbe,
+		"liveness probe, fails while any liveness check fails, also served on "+probeAddr)
+	fmt.Fprintf(w, "\t%s: %s\n", patternHealth,
+		"print the status of every component health check")
 }
 
 func (s *Server) httpOptions(w http.ResponseWriter, r *http.Request) {
@@ -278,8 +428,9 @@ func (s *Server) configDumpAds(w http.ResponseWriter, r *http.Request) {
 type WorkloadDump struct {
 	Workloads []*Workload
 	Services  []*Service
-	// TODO: add authorization
-	Policies []*security.Authorization
+	Policies  []*AuthorizationPolicy
+	// BpfMaps is what the data plane actually holds, to compare with the caches above
+	BpfMaps *WorkloadBpfMaps `json:",omitempty"`
 }
 
 func (s *Server) configDumpWorkload(w http.ResponseWriter, r *http.Request) {
@@ -302,13 +453,256 @@ func (s *Server) configDumpWorkload(w http.ResponseWriter, r *http.Request) {
 	for _, s := range services {
 		workloadDump.Services = append(workloadDump.Services, ConvertService(s))
 	}
+	for _, p := range client.WorkloadController.Rbac.ListPolicies() {
+		workloadDump.Policies = append(workloadDump.Policies, ConvertAuthorizationPolicy(p))
+	}
+	if bpfCache := client.WorkloadController.Processor.GetBpfCache(); bpfCache != nil {
+		bpfMaps, err := ConvertWorkloadBpfMaps(bpfCache, client.WorkloadController.Processor.GetHashName(), client.WorkloadController.GetAuthMap())
+		if err != nil {
+			log.Errorf("Failed to dump workload bpf maps: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		workloadDump.BpfMaps = bpfMaps
+	}
 	printWorkloadDump(w, workloadDump)
 }
 
-func (s *Server) readyProbe(w http.ResponseWriter, r *http.Request) {
-	// TODO: Add some components check
+func (s *Server) certsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.secretManager == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "\t%s\n", "secret manager is not enabled")
+		return
+	}
+
+	data, err := json.MarshalIndent(s.secretManager.Certs(), "", "    ")
+	if err != nil {
+		log.Errorf("Failed to marshal certs: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte("OK"))
+	_, _ = w.Write(data)
+}
+
+func (s *Server) diffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if s.checker == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "\t%s\n", "no bpf maps to check in this mode")
+		return
+	}
+
+	report, err := consistency.Check(s.checker, r.Method == http.MethodPost)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "\t%s: %v\n", "consistency check failed", err)
+		return
+	}
+	data, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		log.Errorf("Failed to marshal consistency report: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+// topHandler streams a snapshot of the connections per line until the client goes
+// away or count snapshots are sent
+func (s *Server) topHandler(w http.ResponseWriter, r *http.Request) {
+	client := s.xdsClient
+	if client == nil || client.WorkloadController == nil || client.WorkloadController.MetricController.Top() == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "\t%s\n", "invalid ClientMode")
+		return
+	}
+
+	query := r.URL.Query()
+	interval := defaultTopInterval
+	if v := query.Get("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < minTopInterval {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "\tinvalid interval %q, must be at least %v\n", v, minTopInterval)
+			return
+		}
+		interval = d
+	}
+	limit, err := queryInt(query.Get("limit"), defaultTopLimit)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "\t%s: %v\n", "invalid limit", err)
+		return
+	}
+	count, err := queryInt(query.Get("count"), 0)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "\t%s: %v\n", "invalid count", err)
+		return
+	}
+
+	// the stream outlives the write timeout of the server
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	err = client.WorkloadController.MetricController.Top().Stream(r.Context(), interval, limit, count, func(snapshot *telemetry.TopSnapshot) error {
+		if err := encoder.Encode(snapshot); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+	if err != nil && r.Context().Err() == nil {
+		log.Debugf("top stream ended: %v", err)
+	}
+}
+
+// eventsHandler streams the events matching the type and namespace filters until
+// the client goes away
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := events.Filter{Namespaces: splitQuery(query.Get("namespace"))}
+	for _, t := range splitQuery(query.Get("type")) {
+		if !slices.Contains(events.Types, events.Type(t)) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "\tunknown event type %q, must be one of %v\n", t, events.Types)
+			return
+		}
+		filter.Types = append(filter.Types, events.Type(t))
+	}
+	sse := query.Get("format") == "sse" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+	sub := s.eventBus.Subscribe(filter, eventsBufferSize)
+	defer sub.Close()
+
+	// the stream outlives the write timeout of the server
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	write := func(e events.Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if sse {
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", data)
+		}
+		if err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	ticker := time.NewTicker(eventsDropInterval)
+	defer ticker.Stop()
+	var reported uint64
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-sub.Events():
+			err = write(e)
+		case <-ticker.C:
+			if dropped := sub.Dropped(); dropped > reported {
+				err = write(events.Event{
+					Time:    time.Now(),
+					Type:    events.Dropped,
+					Message: fmt.Sprintf("%d events dropped", dropped-reported),
+				})
+				reported = dropped
+			}
+		}
+		if err != nil {
+			log.Debugf("events stream ended: %v", err)
+			return
+		}
+	}
+}
+
+// splitQuery splits a comma separated query value, empty items are skipped
+func splitQuery(value string) []string {
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func queryInt(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%d is negative", n)
+	}
+	return n, nil
+}
+
+func (s *Server) readyProbe(w http.ResponseWriter, r *http.Request) {
+	s.probe(w, health.Readiness)
+}
+
+func (s *Server) liveProbe(w http.ResponseWriter, r *http.Request) {
+	s.probe(w, health.Liveness)
+}
+
+// probe answers a kubelet probe: OK when every check of the kind passes,
+// otherwise 503 with one line per failing component.
+func (s *Server) probe(w http.ResponseWriter, kind health.Kind) {
+	report := s.health.Run(kind)
+	if report.Healthy {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("OK"))
+		return
+	}
+
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, c := range report.Failed() {
+		fmt.Fprintf(w, "%s: %s\n", c.Name, c.Message)
+	}
+}
+
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	report := s.health.Run(0)
+	data, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		log.Errorf("Failed to marshal health report: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if report.Healthy {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(data)
 }
 
 func (s *Server) getBpfLogLevel() (*LoggerInfo, error) {
@@ -369,16 +763,45 @@ func (s *Server) setBpfLogLevel(w http.ResponseWriter, levelStr string) {
 }
 
 func (s *Server) StartServer() {
-	go func() {
-		err := s.server.ListenAndServe()
-		if err != nil && err != http.ErrServerClosed {
+	if l, err := listenAdminSocket(adminSocket); err != nil {
+		log.Errorf("Failed to listen on admin socket %s: %v", adminSocket, err)
+	} else {
+		go s.serve(s.server, l)
+	}
+
+	if l, err := net.Listen("tcp", probeAddr); err != nil {
+		log.Errorf("Failed to listen on probe address %s: %v", probeAddr, err)
+	} else {
+		go s.serve(s.probeServer, l)
+	}
+
+	l, err := net.Listen("tcp", adminAddr)
+	if err != nil {
+		log.Errorf("Failed to start status server: %v", err)
+		return
+	}
+	if s.adminConfig != nil && s.adminConfig.TLSEnabled() {
+		tlsConfig, err := loadAdminTLSConfig(s.adminConfig)
+		if err != nil {
+			// never fall back to plain http, the operator asked for the listener to be authenticated
+			_ = l.Close()
 			log.Errorf("Failed to start status server: %v", err)
+			return
 		}
-	}()
+		l = tls.NewListener(l, tlsConfig)
+	}
+	go s.serve(s.server, l)
+}
+
+func (s *Server) serve(server *http.Server, l net.Listener) {
+	err := server.Serve(l)
+	if err != nil && err != http.ErrServerClosed {
+		log.Errorf("Failed to serve status server on %s: %v", l.Addr(), err)
+	}
 }
 
 func (s *Server) StopServer() error {
-	return s.server.Close()
+	return errors.Join(s.server.Close(), s.probeServer.Close())
 }
 
 func printWorkloadDump(w http.ResponseWriter, wd WorkloadDump) {
@@ -17,26 +17,52 @@
 package status
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
+	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"istio.io/istio/pilot/test/util"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"kmesh.net/kmesh/api/v2/workloadapi"
+	authsecurity "kmesh.net/kmesh/api/v2/workloadapi/security"
 	"kmesh.net/kmesh/daemon/options"
 	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/controller"
+	"kmesh.net/kmesh/pkg/controller/consistency"
+	"kmesh.net/kmesh/pkg/controller/security"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
 	"kmesh.net/kmesh/pkg/controller/workload"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
 	"kmesh.net/kmesh/pkg/controller/workload/cache"
+	"kmesh.net/kmesh/pkg/events"
+	"kmesh.net/kmesh/pkg/health"
 	"kmesh.net/kmesh/pkg/logger"
+	"kmesh.net/kmesh/pkg/nets"
 	"kmesh.net/kmesh/pkg/utils/test"
 )
 
@@ -295,3 +321,556 @@ func TestServer_configDumpWorkload(t *testing.T) {
 
 	util.CompareContent(t, w.Body.Bytes(), "./testdata/workload_configdump.json")
 }
+
+func TestServer_certsHandler(t *testing.T) {
+	t.Run("secret manager disabled", func(t *testing.T) {
+		server := &Server{}
+		w := httptest.NewRecorder()
+		server.certsHandler(w, httptest.NewRequest(http.MethodGet, patternCerts, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("list certs", func(t *testing.T) {
+		secretManager, err := security.NewSecretManager(security.CaConfig{Provider: constants.CaProviderSelfSigned})
+		assert.NoError(t, err)
+		stopCh := make(chan struct{})
+		defer close(stopCh)
+		go secretManager.Run(stopCh)
+
+		identity := "spiffe://cluster.local/ns/default/sa/default"
+		secretManager.SendWorkloadCertRequest(identity, "default/pod-1", security.ADD)
+		secretManager.SendWorkloadCertRequest(identity, "default/pod-2", security.ADD)
+		assert.Eventually(t, func() bool {
+			certs := secretManager.Certs()
+			return len(certs) == 1 && !certs[0].Pending
+		}, 10*time.Second, 50*time.Millisecond)
+
+		server := &Server{secretManager: secretManager}
+		w := httptest.NewRecorder()
+		server.certsHandler(w, httptest.NewRequest(http.MethodGet, patternCerts, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var certs []security.CertInfo
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &certs))
+		assert.Len(t, certs, 1)
+		assert.Equal(t, identity, certs[0].Identity)
+		assert.Equal(t, int32(2), certs[0].RefCnt)
+		assert.Equal(t, []string{"default/pod-1", "default/pod-2"}, certs[0].Workloads)
+		assert.NotEmpty(t, certs[0].SerialNumber)
+		assert.True(t, certs[0].NotBefore.Before(certs[0].NotAfter))
+	})
+}
+
+func TestServer_probes(t *testing.T) {
+	registry := health.NewRegistry()
+	xds := health.NewStatus(errors.New("xds stream is not connected"))
+	registry.Register("bpf", health.Readiness|health.Liveness, func() error { return nil })
+	registry.Register("xds", health.Readiness, xds.Check)
+	server := &Server{health: registry}
+
+	w := httptest.NewRecorder()
+	server.readyProbe(w, httptest.NewRequest(http.MethodGet, patternReadyProbe, nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "xds: xds stream is not connected\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	server.liveProbe(w, httptest.NewRequest(http.MethodGet, patternLiveProbe, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "OK", w.Body.String())
+
+	w = httptest.NewRecorder()
+	server.healthHandler(w, httptest.NewRequest(http.MethodGet, patternHealth, nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var report health.Report
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.False(t, report.Healthy)
+	assert.Equal(t, []health.ComponentStatus{
+		{Name: "bpf", Readiness: true, Liveness: true, Healthy: true},
+		{Name: "xds", Readiness: true, Message: "xds stream is not connected"},
+	}, report.Components)
+
+	xds.SetHealthy()
+	w = httptest.NewRecorder()
+	server.readyProbe(w, httptest.NewRequest(http.MethodGet, patternReadyProbe, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "OK", w.Body.String())
+}
+
+type fakeChecker struct {
+	diffs    []consistency.Diff
+	repaired bool
+}
+
+func (c *fakeChecker) Check() ([]consistency.Diff, error) {
+	return c.diffs, nil
+}
+
+func (c *fakeChecker) Repair() ([]consistency.Diff, error) {
+	c.repaired = true
+	return c.diffs, nil
+}
+
+func TestServer_diffHandler(t *testing.T) {
+	server := &Server{}
+	w := httptest.NewRecorder()
+	server.diffHandler(w, httptest.NewRequest(http.MethodGet, patternDiff, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	checker := &fakeChecker{diffs: []consistency.Diff{
+		{Map: "kmesh_service", Key: "default/foo.default.svc.cluster.local", Kind: consistency.Mismatch, Detail: "endpoint count 2, expected 1"},
+	}}
+	server.checker = checker
+
+	w = httptest.NewRecorder()
+	server.diffHandler(w, httptest.NewRequest(http.MethodGet, patternDiff, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report consistency.Report
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.False(t, report.Repaired)
+	assert.Equal(t, checker.diffs, report.Diffs)
+	assert.False(t, checker.repaired)
+
+	w = httptest.NewRecorder()
+	server.diffHandler(w, httptest.NewRequest(http.MethodPost, patternDiff, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.True(t, report.Repaired)
+	assert.True(t, checker.repaired)
+}
+
+func TestServer_authorize(t *testing.T) {
+	server := &Server{tcpAccess: options.AdminTCPAccessRead}
+	handler := server.authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(method, path string, ctx context.Context, state *tls.ConnectionState) int {
+		r := httptest.NewRequest(method, path, nil).WithContext(ctx)
+		r.TLS = state
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	trustedCtx := context.WithValue(context.Background(), trustedConnKey{}, true)
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, patternCerts, context.Background(), nil))
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodPost, patternLoggers, context.Background(), nil))
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodPost, patternDiff, context.Background(), &tls.ConnectionState{}))
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost, patternLoggers, trustedCtx, nil))
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost, patternDiff, context.Background(), verified))
+
+	server.tcpAccess = options.AdminTCPAccessProbes
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodGet, patternCerts, context.Background(), nil))
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, patternReadyProbe, context.Background(), nil))
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, patternCerts, trustedCtx, nil))
+}
+
+func TestAdminTLSWithoutClientCert(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	config := &options.AdminConfig{
+		TLSCertFile:  filepath.Join(dir, "tls.crt"),
+		TLSKeyFile:   filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	assert.NoError(t, os.WriteFile(config.TLSCertFile, certPem, 0o600))
+	assert.NoError(t, os.WriteFile(config.ClientCAFile, certPem, 0o600))
+	assert.NoError(t, os.WriteFile(config.TLSKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+
+	tlsConfig, err := loadAdminTLSConfig(config)
+	assert.NoError(t, err)
+	server := &Server{tcpAccess: options.AdminTCPAccessProbes}
+	ts := httptest.NewUnstartedServer(server.authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	// a kubelet probe completes the handshake without a client certificate
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get(ts.URL + patternReadyProbe)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = client.Post(ts.URL+patternLoggers, "application/json", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	cert, err := tls.X509KeyPair(certPem, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	assert.NoError(t, err)
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{cert},
+	}}}
+	resp, err = client.Post(ts.URL+patternLoggers, "application/json", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestListenAdminSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kmesh", "admin.sock")
+	// a stale socket is replaced
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+	assert.NoError(t, os.WriteFile(path, nil, 0o600))
+
+	l, err := listenAdminSocket(path)
+	assert.NoError(t, err)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	server := &Server{tcpAccess: options.AdminTCPAccessProbes}
+	httpServer := &http.Server{
+		Handler: server.authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})),
+		ConnContext: connContext,
+	}
+	go func() { _ = httpServer.Serve(l) }()
+	defer httpServer.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	// the test runs as root or as the owner of the socket, so its peer credentials are accepted
+	resp, err := client.Post("http://"+adminAddr+patternLoggers, "application/json", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+type fakePodGetter struct {
+	pods map[string]*corev1.Pod
+}
+
+func (f *fakePodGetter) GetPod(namespace, name string) (*corev1.Pod, *corev1.Namespace, error) {
+	if pod, ok := f.pods[namespace+"/"+name]; ok {
+		return pod, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   namespace,
+			Labels: map[string]string{constants.DataPlaneModeLabel: constants.DataPlaneModeKmesh},
+		}}, nil
+	}
+	return nil, nil, apierrors.NewNotFound(corev1.Resource("pods"), name)
+}
+
+func TestServer_describePodHandler(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "httpbin-abcde",
+			Namespace:   "ns",
+			Annotations: map[string]string{constants.KmeshRedirectionAnnotation: "enabled"},
+		},
+		Spec:   corev1.PodSpec{NodeName: "node-1", ServiceAccountName: "httpbin"},
+		Status: corev1.PodStatus{PodIP: "10.244.0.5"},
+	}
+	wl := &workloadapi.Workload{
+		Uid:            "cluster0//Pod/ns/httpbin-abcde",
+		Name:           "httpbin-abcde",
+		Namespace:      "ns",
+		WorkloadName:   "httpbin",
+		ServiceAccount: "httpbin",
+		Addresses:      [][]byte{netip.MustParseAddr("10.244.0.5").AsSlice()},
+		Services: map[string]*workloadapi.PortList{
+			"ns/httpbin.ns.svc.cluster.local": {Ports: []*workloadapi.Port{{ServicePort: 8000, TargetPort: 80}}},
+		},
+	}
+	svc := &workloadapi.Service{Name: "httpbin", Namespace: "ns", Hostname: "httpbin.ns.svc.cluster.local"}
+	workloadCache := cache.NewWorkloadCache()
+	serviceCache := cache.NewServiceCache()
+	workloadCache.AddOrUpdateWorkload(wl)
+	serviceCache.AddOrUpdateService(svc)
+
+	server := &Server{
+		pods: &fakePodGetter{pods: map[string]*corev1.Pod{"ns/httpbin-abcde": pod}},
+		xdsClient: &controller.XdsClient{
+			WorkloadController: &workload.Controller{
+				Processor: &workload.Processor{
+					WorkloadCache: workloadCache,
+					ServiceCache:  serviceCache,
+				},
+			},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	server.describePodHandler(w, httptest.NewRequest(http.MethodGet, patternDescribePod+"ns", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	server.describePodHandler(w, httptest.NewRequest(http.MethodGet, patternDescribePod+"ns/missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	server.describePodHandler(w, httptest.NewRequest(http.MethodGet, patternDescribePod+"ns/httpbin-abcde", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var desc PodDescription
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &desc))
+	assert.Equal(t, "node-1", desc.Node)
+	assert.Equal(t, "10.244.0.5", desc.IP)
+	assert.True(t, desc.Enrollment.ShouldEnroll)
+	assert.True(t, desc.Enrollment.Enrolled)
+	assert.Equal(t, constants.DataPlaneModeKmesh, desc.Enrollment.NamespaceLabel)
+	assert.False(t, desc.Bypass.Bypassed)
+	// the pod netns is not reachable in the test
+	assert.NotEmpty(t, desc.XdpError)
+	assert.Equal(t, wl.Uid, desc.Workload.Uid)
+	assert.Len(t, desc.Services, 1)
+	assert.Equal(t, "ns/httpbin.ns.svc.cluster.local", desc.Services[0].Name)
+	assert.Equal(t, "httpbin", desc.Services[0].Service.Name)
+	assert.Equal(t, "spiffe://cluster.local/ns/ns/sa/httpbin", desc.Identity)
+	assert.NotNil(t, desc.Inbound)
+	assert.Equal(t, telemetry.PodStatsWindow, desc.ConnectionWindow)
+}
+
+func TestServer_topHandler(t *testing.T) {
+	server := &Server{}
+	w := httptest.NewRecorder()
+	server.topHandler(w, httptest.NewRequest(http.MethodGet, patternTop, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	server.xdsClient = &controller.XdsClient{
+		WorkloadController: &workload.Controller{
+			MetricController: telemetry.NewMetric(cache.NewWorkloadCache()),
+		},
+	}
+	w = httptest.NewRecorder()
+	server.topHandler(w, httptest.NewRequest(http.MethodGet, patternTop+"?interval=1ms", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	server.topHandler(w, httptest.NewRequest(http.MethodGet, patternTop+"?interval=100ms&count=2", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	decoder := json.NewDecoder(w.Body)
+	for i := 0; i < 2; i++ {
+		var snapshot telemetry.TopSnapshot
+		assert.NoError(t, decoder.Decode(&snapshot))
+		assert.Equal(t, 0, snapshot.OpenConnections)
+	}
+	assert.False(t, decoder.More())
+}
+
+func TestServer_eventsHandler(t *testing.T) {
+	bus := events.NewBus()
+	server := &Server{eventBus: bus}
+
+	w := httptest.NewRecorder()
+	server.eventsHandler(w, httptest.NewRequest(http.MethodGet, patternEvents+"?type=unknown", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	ts := httptest.NewServer(http.HandlerFunc(server.eventsHandler))
+	defer ts.Close()
+
+	t.Run("json lines", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "?type=workload,rbac&namespace=default")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+		assert.Eventually(t, bus.Enabled, 5*time.Second, 10*time.Millisecond)
+
+		bus.Publish(events.Event{Type: events.Workload, Action: "add", Namespace: "other", Name: "sleep"})
+		bus.Publish(events.Event{Type: events.Service, Action: "add", Namespace: "default", Name: "httpbin"})
+		bus.Publish(events.Event{Type: events.Workload, Action: "add", Namespace: "default", Name: "httpbin"})
+
+		var e events.Event
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&e))
+		assert.Equal(t, events.Workload, e.Type)
+		assert.Equal(t, "default", e.Namespace)
+		assert.Equal(t, "httpbin", e.Name)
+	})
+
+	t.Run("server-sent events", func(t *testing.T) {
+		assert.Eventually(t, func() bool { return !bus.Enabled() }, 5*time.Second, 10*time.Millisecond)
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Accept", "text/event-stream")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		assert.Eventually(t, bus.Enabled, 5*time.Second, 10*time.Millisecond)
+
+		bus.Publish(events.Event{Type: events.Cert, Action: "rotate", Namespace: "default", Name: "sleep"})
+		reader := bufio.NewReader(resp.Body)
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "event: cert\n", line)
+		line, err = reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(line, "data: {"))
+	})
+}
+
+func TestConvertAuthorizationPolicy(t *testing.T) {
+	policy := &authsecurity.Authorization{
+		Name:      "deny-foo",
+		Namespace: "ns",
+		Scope:     authsecurity.Scope_NAMESPACE,
+		Action:    authsecurity.Action_DENY,
+		Rules: []*authsecurity.Rule{{
+			Clauses: []*authsecurity.Clause{{
+				Matches: []*authsecurity.Match{{
+					Namespaces: []*authsecurity.StringMatch{
+						{MatchType: &authsecurity.StringMatch_Exact{Exact: "foo"}},
+						{MatchType: &authsecurity.StringMatch_Prefix{Prefix: "bar-"}},
+					},
+					NotPrincipals: []*authsecurity.StringMatch{
+						{MatchType: &authsecurity.StringMatch_Suffix{Suffix: "/sa/admin"}},
+					},
+					SourceIps:        []*authsecurity.Address{{Address: []byte{10, 0, 0, 0}, Length: 8}},
+					DestinationPorts: []uint32{8080},
+				}},
+			}},
+		}},
+	}
+
+	assert.Equal(t, &AuthorizationPolicy{
+		Name:      "deny-foo",
+		Namespace: "ns",
+		Scope:     "NAMESPACE",
+		Action:    "DENY",
+		Rules: []*AuthorizationRule{{
+			Clauses: []*AuthorizationClause{{
+				Matches: []*AuthorizationMatch{{
+					Namespaces:       []string{"foo", "bar-*"},
+					NotPrincipals:    []string{"*/sa/admin"},
+					SourceIps:        []string{"10.0.0.0/8"},
+					DestinationPorts: []uint32{8080},
+				}},
+			}},
+		}},
+	}, ConvertAuthorizationPolicy(policy))
+}
+
+func TestConvertWorkloadBpfMaps(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+	bpfCache := bpfcache.NewCache(workloadMap)
+	hashName := workload.NewHashName()
+	defer hashName.Reset()
+
+	serviceId := hashName.StrToNum("ns/svc.ns.svc.cluster.local")
+	backendUid := hashName.StrToNum("cluster0//Pod/ns/pod")
+	var serviceIp, podIp [16]byte
+	nets.CopyIpByteFromSlice(&serviceIp, []byte{10, 96, 0, 1})
+	nets.CopyIpByteFromSlice(&podIp, []byte{10, 244, 0, 5})
+
+	assert.NoError(t, bpfCache.FrontendUpdate(&bpfcache.FrontendKey{Ip: serviceIp}, &bpfcache.FrontendValue{UpstreamId: serviceId}))
+	assert.NoError(t, bpfCache.FrontendUpdate(&bpfcache.FrontendKey{Ip: podIp}, &bpfcache.FrontendValue{UpstreamId: backendUid}))
+	sv := &bpfcache.ServiceValue{EndpointCount: 1}
+	sv.ServicePort[0] = nets.ConvertPortToBigEndian(80)
+	sv.TargetPort[0] = nets.ConvertPortToBigEndian(8080)
+	assert.NoError(t, bpfCache.ServiceUpdate(&bpfcache.ServiceKey{ServiceId: serviceId}, sv))
+	assert.NoError(t, bpfCache.EndpointUpdate(&bpfcache.EndpointKey{ServiceId: serviceId, BackendIndex: 1}, &bpfcache.EndpointValue{BackendUid: backendUid}))
+	bv := &bpfcache.BackendValue{Ip: podIp, ServiceCount: 1}
+	bv.Services[0] = serviceId
+	assert.NoError(t, bpfCache.BackendUpdate(&bpfcache.BackendKey{BackendUid: backendUid}, bv))
+	// an endpoint whose backend id is no longer known
+	assert.NoError(t, bpfCache.EndpointUpdate(&bpfcache.EndpointKey{ServiceId: serviceId, BackendIndex: 2}, &bpfcache.EndpointValue{BackendUid: 1}))
+
+	bpfMaps, err := ConvertWorkloadBpfMaps(bpfCache, hashName, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, &WorkloadBpfMaps{
+		Frontends: []*BpfFrontend{
+			{Address: "10.244.0.5", UpstreamId: backendUid, Upstream: "cluster0//Pod/ns/pod"},
+			{Address: "10.96.0.1", UpstreamId: serviceId, Upstream: "ns/svc.ns.svc.cluster.local"},
+		},
+		Services: []*BpfService{{
+			ServiceId:     serviceId,
+			Service:       "ns/svc.ns.svc.cluster.local",
+			EndpointCount: 1,
+			Ports:         []*BpfServicePort{{ServicePort: 80, TargetPort: 8080}},
+		}},
+		Endpoints: []*BpfEndpoint{
+			{ServiceId: serviceId, Service: "ns/svc.ns.svc.cluster.local", BackendIndex: 1, BackendUid: backendUid, Backend: "cluster0//Pod/ns/pod"},
+			{ServiceId: serviceId, Service: "ns/svc.ns.svc.cluster.local", BackendIndex: 2, BackendUid: 1, Backend: "unknown(1)"},
+		},
+		Backends: []*BpfBackend{{
+			BackendUid: backendUid,
+			Backend:    "cluster0//Pod/ns/pod",
+			Address:    "10.244.0.5",
+			Services:   []string{"ns/svc.ns.svc.cluster.local"},
+		}},
+		DeniedConnections: []*BpfAuthTuple{},
+	}, bpfMaps)
+}
+
+func TestWorkloadMapDecoders(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+	bpfCache := bpfcache.NewCache(workloadMap)
+	hashName := workload.NewHashName()
+	defer hashName.Reset()
+
+	serviceId := hashName.StrToNum("ns/svc.ns.svc.cluster.local")
+	backendUid := hashName.StrToNum("cluster0//Pod/ns/pod")
+	assert.NoError(t, bpfCache.EndpointUpdate(&bpfcache.EndpointKey{ServiceId: serviceId, BackendIndex: 1}, &bpfcache.EndpointValue{BackendUid: backendUid}))
+	assert.NoError(t, bpfCache.EndpointUpdate(&bpfcache.EndpointKey{ServiceId: serviceId, BackendIndex: 2}, &bpfcache.EndpointValue{BackendUid: 1}))
+
+	decoders := workloadMapDecoders(bpfCache, hashName, nil)
+	assert.Len(t, decoders, 5)
+
+	entries, err := decoders["kmesh_endpoint"]()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "ns/svc.ns.svc.cluster.local[1]", entries[0].Key)
+
+	filtered := filterBpfMapEntries(entries, "svc.ns.svc.cluster.local[2]")
+	assert.Len(t, filtered, 1)
+	assert.Equal(t, "unknown(1)", filtered[0].Value.(*BpfEndpoint).Backend)
+	assert.Empty(t, filterBpfMapEntries(entries, "other"))
+	assert.Len(t, filterBpfMapEntries(entries, ""), 2)
+
+	entries, err = decoders["map_of_auth"]()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestServer_bpfMapHandler(t *testing.T) {
+	server := &Server{}
+	w := httptest.NewRecorder()
+	server.bpfMapHandler(w, httptest.NewRequest(http.MethodGet, patternBpfMap+"kmesh_frontend", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	server.config = &options.BootstrapConfigs{BpfConfig: &options.BpfConfig{BpfFsPath: t.TempDir()}}
+	w = httptest.NewRecorder()
+	server.bpfMapsHandler(w, httptest.NewRequest(http.MethodGet, patternBpfMaps, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]", w.Body.String())
+}
+
+func TestConvertAuthTuple(t *testing.T) {
+	v4 := make([]byte, 36)
+	copy(v4, []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x1f, 0x90, 0x00, 0x50})
+	assert.Equal(t, &BpfAuthTuple{Source: "10.0.0.1:8080", Destination: "10.0.0.2:80"}, convertAuthTuple(v4))
+
+	v6 := make([]byte, 36)
+	src := netip.MustParseAddr("fd00::1").As16()
+	dst := netip.MustParseAddr("fd00::2").As16()
+	copy(v6, src[:])
+	copy(v6[16:], dst[:])
+	copy(v6[32:], []byte{0x1f, 0x90, 0x00, 0x50})
+	assert.Equal(t, &BpfAuthTuple{Source: "[fd00::1]:8080", Destination: "[fd00::2]:80"}, convertAuthTuple(v6))
+}
@@ -16,12 +16,98 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/cilium/ebpf"
+
+	"kmesh.net/kmesh/pkg/constants"
 )
 
+// KmeshMapDirs are the directories, relative to the bpf filesystem, the loader pins the maps under
+var KmeshMapDirs = []string{constants.AdsMapPath, constants.WorkloadMapPath}
+
+// MapStats describes a pinned kmesh map and how full it is
+type MapStats struct {
+	Name       string `json:"name"`
+	Pin        string `json:"pin"`
+	Type       string `json:"type"`
+	KeySize    uint32 `json:"keySize"`
+	ValueSize  uint32 `json:"valueSize"`
+	MaxEntries uint32 `json:"maxEntries"`
+	// Entries is -1 when the map cannot be walked, such as a ring buffer
+	Entries int `json:"entries"`
+	// Error is set when the pin cannot be loaded, only Name and Pin are valid then
+	Error string `json:"error,omitempty"`
+}
+
+// PinnedMapStats returns the stats of the maps pinned by kmesh under bpfFsPath, sorted by name.
+// The maps are named after their pin, the kernel truncates map names to 15 characters.
+// A pin that cannot be loaded is reported with its error rather than failing the others.
+func PinnedMapStats(bpfFsPath string) ([]MapStats, error) {
+	var stats []MapStats
+	for _, dir := range KmeshMapDirs {
+		entries, err := os.ReadDir(filepath.Join(bpfFsPath, dir))
+		if errors.Is(err, fs.ErrNotExist) {
+			// only the directory of the running mode exists
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			pin := filepath.Join(bpfFsPath, dir, entry.Name())
+			m, err := ebpf.LoadPinnedMap(pin, &ebpf.LoadPinOptions{ReadOnly: true})
+			if err != nil {
+				stats = append(stats, MapStats{
+					Name:    entry.Name(),
+					Pin:     pin,
+					Entries: -1,
+					Error:   err.Error(),
+				})
+				continue
+			}
+			count, err := CountMapEntries(m)
+			if err != nil {
+				count = -1
+			}
+			stats = append(stats, MapStats{
+				Name:       entry.Name(),
+				Pin:        pin,
+				Type:       m.Type().String(),
+				KeySize:    m.KeySize(),
+				ValueSize:  m.ValueSize(),
+				MaxEntries: m.MaxEntries(),
+				Entries:    count,
+			})
+			m.Close()
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats, nil
+}
+
+// LoadPinnedKmeshMap opens the map pinned as name by the running mode under bpfFsPath
+func LoadPinnedKmeshMap(bpfFsPath, name string, opts *ebpf.LoadPinOptions) (*ebpf.Map, error) {
+	var errs []error
+	for _, dir := range KmeshMapDirs {
+		m, err := ebpf.LoadPinnedMap(filepath.Join(bpfFsPath, dir, name), opts)
+		if err == nil {
+			return m, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
 func GetProgramByName(name string) (*ebpf.Program, error) {
 	var (
 		progID         ebpf.ProgramID
@@ -85,3 +171,33 @@ func GetMapByName(name string) (*ebpf.Map, error) {
 		}
 	}
 }
+
+// CountMapEntries returns the number of keys present in m. Array maps always hold
+// MaxEntries elements, so they are reported as full without walking them.
+func CountMapEntries(m *ebpf.Map) (int, error) {
+	switch m.Type() {
+	case ebpf.Array, ebpf.PerCPUArray, ebpf.ProgramArray, ebpf.ArrayOfMaps:
+		return int(m.MaxEntries()), nil
+	case ebpf.RingBuf, ebpf.PerfEventArray, ebpf.Queue, ebpf.Stack:
+		return 0, fmt.Errorf("map type %s has no keys", m.Type())
+	}
+
+	count := 0
+	// the first key is looked up with a nil interface, a typed nil slice cannot be marshaled
+	var key interface{}
+	for {
+		next, err := m.NextKeyBytes(key)
+		if err != nil {
+			return count, err
+		}
+		if next == nil {
+			return count, nil
+		}
+		count++
+		if count > int(m.MaxEntries()) {
+			// entries were deleted while walking and the walk restarted from the first key
+			return int(m.MaxEntries()), nil
+		}
+		key = next
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+func TestPinnedMapStatsSkipsBrokenPins(t *testing.T) {
+	bpfFsPath := t.TempDir()
+	dir := filepath.Join(bpfFsPath, constants.WorkloadMapPath)
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	// a regular file is not a bpf object, it must not hide the other maps
+	for _, name := range []string{"km_b", "km_a"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+
+	stats, err := PinnedMapStats(bpfFsPath)
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+	assert.Equal(t, "km_a", stats[0].Name)
+	assert.Equal(t, filepath.Join(dir, "km_a"), stats[0].Pin)
+	assert.Equal(t, -1, stats[0].Entries)
+	assert.NotEmpty(t, stats[0].Error)
+	assert.Equal(t, "km_b", stats[1].Name)
+}
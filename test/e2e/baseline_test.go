@@ -843,7 +843,7 @@ func buildL4Query(src, dst echo.Instance) prometheus.Query {
 		"source_cluster":                 "Kubernetes",
 	}
 
-	query.Metric = "kmesh_tcp_connections_opened_total"
+	query.Metric = "istio_tcp_connections_opened_total"
 	query.Labels = labels
 
 	return query
@@ -55,7 +55,7 @@ function load_kmesh_config()
     CHECK_RESULT $? 0 0 "kmesh-cmd start failed"
     sleep 2
 
-    curl http://127.0.0.1:15200/bpf/kmesh/maps --connect-timeout 5 > tmp_kmesh_conf_read.log
+    curl --unix-socket /var/run/kmesh/admin.sock http://localhost/bpf/kmesh/maps --connect-timeout 5 > tmp_kmesh_conf_read.log
     grep "stenerConfigs\|routeConfigs\|clusterConfigs" tmp_kmesh_conf_read.log
     CHECK_RESULT $? 0 0 "check kmesh conf failed"
 }